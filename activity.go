@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ActivityCounter counts one kind of viewer input and when it happened
+type ActivityCounter struct {
+	Count int64      `json:"count"`
+	First *time.Time `json:"first,omitempty"`
+	Last  *time.Time `json:"last,omitempty"`
+}
+
+func (c *ActivityCounter) add(now time.Time) {
+	c.Count++
+	if c.First == nil {
+		first := now
+		c.First = &first
+	}
+	last := now
+	c.Last = &last
+}
+
+// InputActivity is what a viewer did in a session, for audit trails; only
+// counts and times are kept, never which keys were pressed or what was pasted
+type InputActivity struct {
+	Keys      ActivityCounter `json:"keys"`
+	Pointer   ActivityCounter `json:"pointer"`
+	Clipboard ActivityCounter `json:"clipboard"`
+}
+
+// sessionActivity accumulates the InputActivity of a live session
+type sessionActivity struct {
+	mu sync.Mutex
+	InputActivity
+}
+
+// observeRFB counts the KeyEvent, PointerEvent and ClientCutText messages of a viewer frame
+func (a *sessionActivity) observeRFB(msg []byte) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(msg) > 0 {
+		size := rfbClientMessageSize(msg)
+		if size < 0 {
+			return
+		}
+		switch msg[0] {
+		case 4, 255: // KeyEvent, QEMU extended key event
+			a.Keys.add(now)
+		case 5: // PointerEvent
+			a.Pointer.add(now)
+		case 6: // ClientCutText
+			a.Clipboard.add(now)
+		}
+		msg = msg[size:]
+	}
+}
+
+// observeTerminal counts a termproxy input frame as a key event
+func (a *sessionActivity) observeTerminal(msg []byte) {
+	if termproxyData(msg) == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Keys.add(time.Now())
+}
+
+func (a *sessionActivity) snapshot() *InputActivity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := a.InputActivity
+	return &out
+}
+
+// formatActivity renders activity as " keys=... pointer=... clipboard=... last_input=..." for log lines
+func formatActivity(a *InputActivity) string {
+	var last *time.Time
+	for _, c := range []ActivityCounter{a.Keys, a.Pointer, a.Clipboard} {
+		if c.Last != nil && (last == nil || c.Last.After(*last)) {
+			last = c.Last
+		}
+	}
+	lastInput := "none"
+	if last != nil {
+		lastInput = last.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf(" keys=%d pointer=%d clipboard=%d last_input=%s",
+		a.Keys.Count, a.Pointer.Count, a.Clipboard.Count, lastInput)
+}
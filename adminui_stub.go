@@ -0,0 +1,32 @@
+//go:build noadminui
+// +build noadminui
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const featureAdminUI = false
+
+// Header carrying a WebAuthn admin session, still read by the gRPC API
+const adminSessionHeader = "X-Admin-Session"
+
+// WebAuthn is never configured in builds without the admin UI
+type WebAuthn struct{}
+
+func NewWebAuthn(rpID, origin, path string, sessionTTL time.Duration) (*WebAuthn, error) {
+	return nil, fmt.Errorf("built without WebAuthn (-tags noadminui)")
+}
+
+func (w *WebAuthn) ValidSession(token string) bool { return false }
+
+// requireAdminSession allows everything, there is no admin session to require
+func requireAdminSession(cfg *Config, c *gin.Context) bool { return true }
+
+func registerWebAuthnRoutes(api *gin.Engine, cfg *Config) {}
+
+func registerDashboardRoutes(api *gin.Engine, cfg *Config) {}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Content bytes a window needs before its entropy means anything
+const anomalyMinSample = 64
+
+// AnomalyAlert is POSTed to -anomaly_webhook when a session looks like data
+// is being pushed through the console
+type AnomalyAlert struct {
+	Event     string      `json:"event"`
+	Time      time.Time   `json:"time"`
+	Session   SessionInfo `json:"session"`
+	InputRate float64     `json:"input_bytes_per_second"`
+	Entropy   float64     `json:"entropy_bits"`
+	Windows   int         `json:"windows"`
+}
+
+// trafficAnalyzer profiles the keystrokes and clipboard text a viewer sends.
+// A window is suspicious when its input rate reaches -anomaly_input_rate and the
+// typed/pasted bytes have at least -anomaly_entropy bits of entropy (encoded or
+// compressed data rather than prose or a held key); -anomaly_windows suspicious
+// windows in a row raise one alert per session. Only the session's own goroutine
+// reading the client calls observe
+type trafficAnalyzer struct {
+	cfg  *Config
+	live *liveSession
+
+	windowStart time.Time
+	counts      [256]int
+	total       int
+	suspicious  int
+	alerted     bool
+}
+
+// newTrafficAnalyzer returns nil when -anomaly_webhook is not set
+func newTrafficAnalyzer(cfg *Config, live *liveSession) *trafficAnalyzer {
+	if cfg.AnomalyWebhook == "" {
+		return nil
+	}
+	return &trafficAnalyzer{cfg: cfg, live: live, windowStart: time.Now()}
+}
+
+// observe accounts a client frame sent after the RFB handshake
+func (a *trafficAnalyzer) observe(msg []byte) {
+	if a == nil || a.alerted {
+		return
+	}
+
+	now := time.Now()
+	if elapsed := now.Sub(a.windowStart); elapsed >= a.cfg.AnomalyWindow {
+		a.closeWindow(elapsed)
+		// A quiet gap breaks the streak
+		if elapsed >= 2*a.cfg.AnomalyWindow {
+			a.suspicious = 0
+		}
+		a.windowStart, a.counts, a.total = now, [256]int{}, 0
+	}
+
+	for _, b := range rfbInputContent(msg) {
+		a.counts[b]++
+		a.total++
+	}
+}
+
+// closeWindow scores the finished window and alerts once the streak is long enough
+func (a *trafficAnalyzer) closeWindow(elapsed time.Duration) {
+	rate := float64(a.total) / elapsed.Seconds()
+	entropy := a.entropy()
+	if a.total < anomalyMinSample || rate < float64(a.cfg.AnomalyInputRate) || entropy < a.cfg.AnomalyEntropy {
+		a.suspicious = 0
+		return
+	}
+
+	a.suspicious++
+	if a.suspicious < a.cfg.AnomalyWindows {
+		return
+	}
+
+	a.alerted = true
+	alert := AnomalyAlert{
+		Event:     "traffic_anomaly",
+		Time:      time.Now(),
+		Session:   a.live.snapshot(),
+		InputRate: math.Round(rate*10) / 10,
+		Entropy:   math.Round(entropy*100) / 100,
+		Windows:   a.suspicious,
+	}
+	fmt.Printf("[WARN] Session %s (hash %s, viewer %s) looks like data exfiltration: %.1f input bytes/s, %.2f bits entropy for %d windows\n",
+		alert.Session.ID, alert.Session.Hash, alert.Session.ViewerIP, alert.InputRate, alert.Entropy, alert.Windows)
+	go sendAnomalyAlert(a.cfg, alert)
+}
+
+// entropy is the Shannon entropy of the window's content in bits per byte
+func (a *trafficAnalyzer) entropy() float64 {
+	if a.total == 0 {
+		return 0
+	}
+	h := 0.0
+	for _, n := range a.counts {
+		if n > 0 {
+			p := float64(n) / float64(a.total)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// sendAnomalyAlert POSTs an alert to -anomaly_webhook
+func sendAnomalyAlert(cfg *Config, alert AnomalyAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.AnomalyWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to send anomaly alert: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("[ERROR] Anomaly webhook answered %s\n", resp.Status)
+	}
+}
+
+// rfbInputContent extracts what a viewer frame types or pastes: the low byte of
+// each pressed keysym and the text of ClientCutText. Frames that can't be parsed
+// count in full, like rfbClientInput
+func rfbInputContent(msg []byte) []byte {
+	var content []byte
+	for len(msg) > 0 {
+		size := 0
+		switch msg[0] {
+		case 0: // SetPixelFormat
+			size = 20
+		case 2: // SetEncodings
+			if len(msg) >= 4 {
+				size = 4 + 4*int(binary.BigEndian.Uint16(msg[2:4]))
+			}
+		case 3, 150: // FramebufferUpdateRequest, EnableContinuousUpdates
+			size = 10
+		case 248: // ClientFence
+			if len(msg) >= 9 {
+				size = 9 + int(msg[8])
+			}
+		case 4: // KeyEvent
+			size = 8
+			if len(msg) >= size && msg[1] != 0 {
+				content = append(content, msg[7])
+			}
+		case 5: // PointerEvent
+			size = 6
+		case 6: // ClientCutText, a negative length is an extended clipboard message
+			if len(msg) >= 8 {
+				n := int32(binary.BigEndian.Uint32(msg[4:8]))
+				if n < 0 {
+					n = -n
+				}
+				size = 8 + int(n)
+				if len(msg) >= size {
+					content = append(content, msg[8:size]...)
+				}
+			}
+		case 255: // QEMU extended KeyEvent
+			size = 12
+			if len(msg) >= size && msg[1] == 0 && binary.BigEndian.Uint16(msg[2:4]) != 0 {
+				content = append(content, msg[7])
+			}
+		}
+		if size == 0 || len(msg) < size {
+			return append(content, msg...)
+		}
+		msg = msg[size:]
+	}
+	return content
+}
@@ -1,28 +1,171 @@
 package main
 
 import (
-	"crypto/tls"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
-	"io"
+	"math"
 	"net/http"
 	"net/url"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 )
 
-// Global in-memory store
-var proxied = NewProxiedList(time.Minute)
+// Global store, replaced in main according to -store
+var proxied ProxiedStore = NewProxiedList(time.Minute)
+
+// Limits registrations per controller IP and overall, configured in main
+var registrationLimiter = NewRateLimiter(0, 0, 0, 0)
 
 // Struct for POST body
 type ProxyRequest struct {
-	Hash                string `json:"hash" binding:"required"`
-	Token               string `json:"proxmox_token"`
-	Cookie              string `json:"cookie"`
-	CSRFPreventionToken string `json:"csrfp_revention_token"`
-	URL                 string `json:"proxmox_ws_url" binding:"required"`
+	Hash                string            `json:"hash"`
+	Namespace           string            `json:"namespace"`
+	Token               string            `json:"proxmox_token"`
+	Cookie              string            `json:"cookie"`
+	CSRFPreventionToken string            `json:"csrfp_revention_token"`
+	URL                 string            `json:"proxmox_ws_url"`
+	SingleUse           bool              `json:"single_use"`
+	DuplicatePolicy     string            `json:"duplicate_policy"`
+	TTLSeconds          int               `json:"ttl_seconds"`
+	ExpiresAt           string            `json:"expires_at"`
+	Console             string            `json:"console"`
+	Product             string            `json:"product"`
+	Metadata            map[string]string `json:"metadata"`
+	MaxUses             int               `json:"max_uses"`
+	ViewerIP            string            `json:"viewer_ip"`
+	MaxViewers          int               `json:"max_viewers"`
+	Shadow              bool              `json:"shadow"`
+	ReadOnly            bool              `json:"read_only"`
+	BlockClipboard      bool              `json:"block_clipboard"`
+	MaxClipboardBytes   int               `json:"max_clipboard_bytes"`
+	BlockedKeys         string            `json:"blocked_keys"`
+	Record              bool              `json:"record"`
+	IdleTimeoutSeconds  int               `json:"idle_timeout_seconds"`
+	Viewer              *ViewerOptions    `json:"viewer"`
+
+	// Instead of proxmox_ws_url, in order of preference: when a backend can't
+	// be reached the next one is dialed
+	URLs []string `json:"proxmox_ws_urls"`
+
+	// With console spice, instead of proxmox_ws_url: what spiceproxy returned
+	Spice *SpiceParams `json:"spice"`
+
+	// Open the console to native VNC viewers on -native_vnc_listen, with a
+	// password generated into NativePassword; the proxy answers the backend's
+	// VNC authentication with vnc_password, or the ticket when it is unset
+	NativeVNC      bool   `json:"native_vnc"`
+	VNCPassword    string `json:"vnc_password"`
+	NativePassword string `json:"-"`
+
+	// Instead of proxmox_ws_url, built with -target_url_template; without
+	// vncticket the proxy requests the ticket itself
+	Node        string `json:"node"`
+	VMType      string `json:"vmtype"`
+	VMID        int    `json:"vmid"`
+	Port        int    `json:"port"`
+	VNCTicket   string `json:"vncticket"`
+	ProxmoxHost string `json:"proxmox_host"`
+}
+
+// Gin context key holding the principal that authenticated a control API request
+const principalContextKey = "principal"
+
+// principalOf returns the principal set by authorizeControl
+func principalOf(c *gin.Context) string {
+	return c.GetString(principalContextKey)
+}
+
+// authorizeControl checks the API key and source IP of a control API request,
+// writing the error response itself when the request is rejected
+func authorizeControl(cfg *Config, c *gin.Context) bool {
+	clientIP := c.ClientIP()
+
+	// Client certificate check
+	certLabel, hasCert := clientCertPrincipal(c)
+	if cfg.ClientCertMode == clientCertRequired && !hasCert {
+		fmt.Printf("[ERROR] Authentication failed for IP %s - no valid client certificate\n", clientIP)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"errors": []string{"Client certificate required"},
+		})
+		return false
+	}
+	if cfg.ClientCertMode == clientCertAlternative && hasCert {
+		fmt.Printf("[INFO] Client certificate accepted for %s (%s)\n", clientIP, certLabel)
+		return authorizeControlIP(cfg, c, certLabel)
+	}
+
+	// API Key check
+	apiKey := c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		apiKey = c.Query("api_key")
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] API key found in query parameter\n")
+		}
+	} else if cfg.Debug {
+		fmt.Printf("[DEBUG] API key found in header\n")
+	}
+
+	if cfg.Debug {
+		if apiKey != "" {
+			fmt.Printf("[DEBUG] API key length: %d characters\n", len(apiKey))
+		} else {
+			fmt.Printf("[DEBUG] No API key provided\n")
+		}
+	}
+
+	label, ok := cfg.APIKeys.Lookup(apiKey)
+	if !ok {
+		fmt.Printf("[ERROR] Authentication failed for IP %s - invalid API key\n", clientIP)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Received key length: %d, configured keys: %v\n",
+				len(apiKey), cfg.APIKeys.Labels())
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"errors": []string{"Invalid API Key"},
+		})
+		return false
+	}
+
+	fmt.Printf("[INFO] API key validation passed for %s (key %s)\n", clientIP, label)
+
+	return authorizeControlIP(cfg, c, label)
+}
+
+// authorizeControlIP checks the source IP and records the authenticated principal
+func authorizeControlIP(cfg *Config, c *gin.Context, label string) bool {
+	clientIP := c.ClientIP()
+
+	// Client IP check
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Checking IP authorization: client=%s, allowed=%v\n",
+			clientIP, cfg.AllowedNetworks)
+	}
+
+	if !cfg.IsControlIP(clientIP) {
+		fmt.Printf("[ERROR] IP authorization failed - forbidden access from %s (allowed %v)\n",
+			clientIP, cfg.AllowedNetworks)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Client IP details: %s\n", clientIP)
+			fmt.Printf("[DEBUG] X-Forwarded-For header: %s\n", c.GetHeader("X-Forwarded-For"))
+			fmt.Printf("[DEBUG] X-Real-IP header: %s\n", c.GetHeader("X-Real-IP"))
+		}
+		c.JSON(http.StatusForbidden, gin.H{
+			"status": "error",
+			"errors": []string{"Forbidden IP"},
+		})
+		return false
+	}
+
+	fmt.Printf("[INFO] IP authorization passed for %s\n", clientIP)
+
+	c.Set(principalContextKey, label)
+	return true
 }
 
 // POST /api/proxy
@@ -33,6 +176,24 @@ func proxyHandler(cfg *Config) gin.HandlerFunc {
 
 		fmt.Printf("[INFO] Received proxy request from %s\n", clientIP)
 
+		if rejectIfMaintenance(c) {
+			return
+		}
+
+		if ok, wait := registrationLimiter.AllowIP(clientIP); !ok {
+			fmt.Printf("[WARN] Registration rate limit exceeded by %s\n", clientIP)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"status": "error",
+				"errors": []string{"Too many registrations"},
+			})
+			return
+		}
+
+		if rejectUnsigned(cfg, c) {
+			return
+		}
+
 		if err := c.ShouldBindJSON(&req); err != nil {
 			fmt.Printf("[ERROR] Invalid JSON payload from %s: %v\n", clientIP, err)
 			if cfg.Debug {
@@ -53,66 +214,66 @@ func proxyHandler(cfg *Config) gin.HandlerFunc {
 			fmt.Printf("[DEBUG] Request Content-Type: %s\n", c.GetHeader("Content-Type"))
 		}
 
-		// API Key check
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == "" {
-			apiKey = c.Query("api_key")
-			if cfg.Debug {
-				fmt.Printf("[DEBUG] API key found in query parameter\n")
-			}
-		} else if cfg.Debug {
-			fmt.Printf("[DEBUG] API key found in header\n")
+		if !authorizeControl(cfg, c) {
+			return
 		}
 
-		if cfg.Debug {
-			if apiKey != "" {
-				fmt.Printf("[DEBUG] API key length: %d characters\n", len(apiKey))
-			} else {
-				fmt.Printf("[DEBUG] No API key provided\n")
-			}
+		if ok, wait := registrationLimiter.AllowGlobal(); !ok {
+			fmt.Printf("[WARN] Global registration rate limit exceeded, refusing %s\n", clientIP)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"status": "error",
+				"errors": []string{"Too many registrations"},
+			})
+			return
 		}
 
-		if apiKey != cfg.ApiKey {
-			fmt.Printf("[ERROR] Authentication failed for IP %s - invalid API key\n", clientIP)
-			if cfg.Debug {
-				fmt.Printf("[DEBUG] Expected key length: %d, received key length: %d\n",
-					len(cfg.ApiKey), len(apiKey))
-			}
-			c.JSON(http.StatusUnauthorized, gin.H{
+		if ok, wait := keyRegistrations.Allow(cfg, principalOf(c)); !ok {
+			fmt.Printf("[WARN] Registration quota of key %s exceeded\n", principalOf(c))
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{
 				"status": "error",
-				"errors": []string{"Invalid API Key"},
+				"errors": []string{"Registration quota of this key exceeded"},
 			})
 			return
 		}
 
-		fmt.Printf("[INFO] API key validation passed for %s\n", clientIP)
-
-		// Client IP check
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Checking IP authorization: client=%s, allowed=%s\n",
-				clientIP, cfg.PuqcloudIP)
+		err := validateProxyRequest(cfg, &req)
+		if err == nil {
+			err = assignHash(cfg, &req, principalOf(c))
+		}
+		if err == nil {
+			err = assignNativePassword(&req)
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] Registration by %s rejected: %v\n", principalOf(c), err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"errors": []string{err.Error()},
+			})
+			return
 		}
 
-		if clientIP != cfg.PuqcloudIP {
-			fmt.Printf("[ERROR] IP authorization failed - forbidden access from %s (expected %s)\n",
-				clientIP, cfg.PuqcloudIP)
-			if cfg.Debug {
-				fmt.Printf("[DEBUG] Client IP details: %s\n", clientIP)
-				fmt.Printf("[DEBUG] X-Forwarded-For header: %s\n", c.GetHeader("X-Forwarded-For"))
-				fmt.Printf("[DEBUG] X-Real-IP header: %s\n", c.GetHeader("X-Real-IP"))
-			}
+		if err := authorizeNamespace(cfg, req.Hash, principalOf(c), req.targetURLs()...); err != nil {
+			fmt.Printf("[ERROR] Registration by %s rejected: %v\n", principalOf(c), err)
 			c.JSON(http.StatusForbidden, gin.H{
 				"status": "error",
-				"errors": []string{"Forbidden IP"},
+				"errors": []string{err.Error()},
 			})
 			return
 		}
 
-		fmt.Printf("[INFO] IP authorization passed for %s\n", clientIP)
-
 		// Add to proxied list
 		fmt.Printf("[INFO] Adding proxy entry to cache for hash: %s\n", req.Hash)
-		proxied.Add(req.Hash, req.Token, req.Cookie, req.CSRFPreventionToken, req.URL)
+		shadowHash, err := registerProxy(cfg, &req, principalOf(c))
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to store proxy entry for hash %s: %v\n", req.Hash, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "error",
+				"errors": []string{"Storage unavailable"},
+			})
+			return
+		}
 
 		if cfg.Debug {
 			fmt.Printf("[DEBUG] Proxy entry added successfully:\n")
@@ -125,10 +286,24 @@ func proxyHandler(cfg *Config) gin.HandlerFunc {
 		fmt.Printf("[INFO] Proxy request processed successfully for %s\n", clientIP)
 
 		// Success response
-		c.JSON(http.StatusOK, gin.H{
+		resp := gin.H{
 			"status":  "success",
 			"message": "Proxied entry added successfully",
-		})
+			"hash":    req.Hash,
+		}
+		if u := consoleURL(cfg, req.Hash, req.Console); u != "" {
+			resp["url"] = u
+		}
+		if shadowHash != "" {
+			resp["shadow_hash"] = shadowHash
+			if u := consoleURL(cfg, shadowHash, req.Console); u != "" {
+				resp["shadow_url"] = u
+			}
+		}
+		if req.NativePassword != "" {
+			resp["native_vnc_password"] = req.NativePassword
+		}
+		c.JSON(http.StatusOK, resp)
 
 		if cfg.Debug {
 			fmt.Printf("[DEBUG] Response sent to client %s with status 200\n", clientIP)
@@ -136,250 +311,474 @@ func proxyHandler(cfg *Config) gin.HandlerFunc {
 	}
 }
 
-func handleVNCWebSocket(cfg *Config, ctx *gin.Context) {
-	data := ctx.Param("data")
-	fmt.Printf("[INFO] Starting VNC WebSocket connection for data parameter\n")
-
-	if cfg.Debug {
-		fmt.Printf("[DEBUG] Received data parameter: %s\n", data)
+// validateProxyRequest checks the optional registration settings and builds
+// the target URL of registrations by node and vmid
+func validateProxyRequest(cfg *Config, req *ProxyRequest) error {
+	if !validProduct(req.Product) {
+		return fmt.Errorf("product must be pve, pbs or pmg")
 	}
-
-	token, cookie, csrfp_revention_token, targetURL, err := proxied.Get(data)
-	if err != nil {
-		fmt.Printf("[ERROR] Failed to decode token and URL from data parameter: %v\n", err)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Data parameter that failed to decode: %s\n", data)
+	switch {
+	case req.Product == productPBS && req.Console != consoleXterm:
+		return fmt.Errorf("Proxmox Backup Server only offers shells, register them with console xterm")
+	case req.Product == productPMG && req.Console == consoleSpice:
+		return fmt.Errorf("Proxmox Mail Gateway only offers vnc and xterm shells")
+	case req.Product == productPMG && req.Token != "":
+		return fmt.Errorf("Proxmox Mail Gateway has no API tokens, register with cookie and csrfp_revention_token")
+	}
+	if err := expandSpiceTarget(req); err != nil {
+		return err
+	}
+	if err := expandTargetList(req); err != nil {
+		return err
+	}
+	if err := expandProxmoxTarget(cfg, req); err != nil {
+		return err
+	}
+	if err := checkTCPBackends(cfg, req); err != nil {
+		return err
+	}
+	switch {
+	case req.NativeVNC && cfg.NativeVNCListen == "":
+		return fmt.Errorf("native_vnc needs -native_vnc_listen on the proxy")
+	case req.NativeVNC && (req.Console == consoleXterm || req.Console == consoleSpice):
+		return fmt.Errorf("native_vnc is only available for VNC consoles")
+	case req.VNCPassword != "" && !req.NativeVNC:
+		return fmt.Errorf("vnc_password is only used with native_vnc")
+	}
+	if strings.HasPrefix(req.Hash, statelessPrefix) {
+		return fmt.Errorf("hashes starting with %q are reserved for stateless tokens", statelessPrefix)
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		return err
+	}
+	for _, n := range splitList(req.ViewerIP) {
+		if _, err := parseNetwork(n); err != nil {
+			return fmt.Errorf("viewer_ip %q must be an IP address or CIDR", n)
 		}
-		ctx.String(400, "token and url error: %v", err)
-		return
 	}
-
-	fmt.Printf("[INFO] Successfully get target URL\n")
-	if cfg.Debug {
-		fmt.Printf("[DEBUG] Get target URL: %s\n", targetURL)
-		fmt.Printf("[DEBUG] Token length: %d characters\n", len(token))
+	if req.MaxViewers < 0 {
+		return fmt.Errorf("max_viewers must not be negative")
 	}
-
-	if err := validateProxmoxURL(targetURL); err != nil {
-		fmt.Printf("[ERROR] URL validation failed: %v\n", err)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Invalid URL that failed validation: %s\n", targetURL)
+	if req.MaxUses < 0 {
+		return fmt.Errorf("max_uses must not be negative")
+	}
+	if req.MaxUses > 0 && req.SingleUse {
+		return fmt.Errorf("use either single_use or max_uses")
+	}
+	if !validConsole(req.Console) {
+		return fmt.Errorf("console must be vnc, xterm or spice")
+	}
+	if req.DuplicatePolicy != "" && !validDuplicatePolicy(req.DuplicatePolicy) {
+		return fmt.Errorf("duplicate_policy must be allow, reject, replace, share or fanout")
+	}
+	if (req.DuplicatePolicy == duplicateFanout || req.Shadow) && req.Console == consoleXterm {
+		return fmt.Errorf("fanout and shadow are only available for VNC consoles")
+	}
+	if req.MaxClipboardBytes < 0 {
+		return fmt.Errorf("max_clipboard_bytes must not be negative")
+	}
+	if (req.BlockClipboard || req.MaxClipboardBytes > 0) && req.Console == consoleXterm {
+		return fmt.Errorf("block_clipboard and max_clipboard_bytes are only available for VNC consoles")
+	}
+	if req.Record && req.Console == consoleXterm {
+		return fmt.Errorf("record is only available for VNC consoles, see -transcript_dir")
+	}
+	if req.Record && cfg.RecordingDir == "" {
+		return fmt.Errorf("record needs -recording_dir on the proxy")
+	}
+	if req.BlockedKeys != "" {
+		if req.Console == consoleXterm {
+			return fmt.Errorf("blocked_keys is only available for VNC consoles")
+		}
+		if _, err := parseKeyRules(splitList(req.BlockedKeys)); err != nil {
+			return fmt.Errorf("blocked_keys: %v", err)
 		}
-		ctx.String(400, "invalid URL: %v", err)
-		return
 	}
-
-	fmt.Printf("[INFO] URL validation passed for Proxmox endpoint\n")
-
-	upgrader := websocket.Upgrader{
-		CheckOrigin:      func(r *http.Request) bool { return true },
-		HandshakeTimeout: 30 * time.Second,
-		ReadBufferSize:   8192,
-		WriteBufferSize:  8192,
+	if req.IdleTimeoutSeconds < 0 {
+		return fmt.Errorf("idle_timeout_seconds must not be negative")
+	}
+	if req.Viewer != nil {
+		if err := req.Viewer.validate(req.Console); err != nil {
+			return err
+		}
 	}
+	if req.TTLSeconds < 0 || time.Duration(req.TTLSeconds)*time.Second > cfg.MaxTTL {
+		return fmt.Errorf("ttl_seconds must be between 0 and %d", int(cfg.MaxTTL/time.Second))
+	}
+	if req.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		switch {
+		case err != nil:
+			return fmt.Errorf("expires_at must be an RFC3339 timestamp")
+		case req.TTLSeconds != 0:
+			return fmt.Errorf("use either ttl_seconds or expires_at")
+		case expiredWithSkew(cfg, expiresAt):
+			return fmt.Errorf("expires_at is in the past")
+		case time.Until(expiresAt) > cfg.MaxTTL:
+			return fmt.Errorf("expires_at is more than %v ahead", cfg.MaxTTL)
+		}
+	}
+	return nil
+}
 
-	fmt.Printf("[INFO] Upgrading client connection to WebSocket\n")
-	clientConn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
-	if err != nil {
-		fmt.Printf("[ERROR] Client WebSocket upgrade failed: %v\n", err)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Upgrade error details: %v\n", err)
+// assignHash generates a random hash when the caller did not supply one, inside
+// the requested namespace or the only one the principal is bound to
+func assignHash(cfg *Config, req *ProxyRequest, principal string) error {
+	if req.Hash != "" {
+		if cfg.GeneratedHashesOnly {
+			return fmt.Errorf("caller-supplied hashes are disabled, omit hash to have one generated")
+		}
+		if req.Namespace != "" && splitNamespace(req.Hash) != req.Namespace {
+			return fmt.Errorf("hash is not in namespace %q", req.Namespace)
 		}
-		return
+		return nil
 	}
-	defer clientConn.Close()
 
-	fmt.Printf("[INFO] Client WebSocket connection established successfully\n")
-	if cfg.Debug {
-		fmt.Printf("[DEBUG] Client connection remote address: %s\n", clientConn.RemoteAddr())
+	ns := req.Namespace
+	if bound := cfg.boundNamespaces(principal); ns == "" && len(bound) == 1 {
+		ns = bound[0]
 	}
 
-	u, err := url.Parse(targetURL)
-	if err != nil {
-		fmt.Printf("[ERROR] Failed to parse target URL: %v\n", err)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] URL that failed to parse: %s\n", targetURL)
-		}
-		clientConn.Close()
-		return
+	hash, err := randomHash(ns)
+	req.Hash = hash
+	return err
+}
+
+// randomHash generates an unguessable hash in namespace ns
+func randomHash(ns string) (string, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generating hash: %v", err)
+	}
+	hash := base64.RawURLEncoding.EncodeToString(id)
+	if ns != "" {
+		hash = ns + ":" + hash
 	}
+	return hash, nil
+}
 
-	dialer := websocket.Dialer{
-		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
-		HandshakeTimeout: 30 * time.Second,
-		ReadBufferSize:   8192,
-		WriteBufferSize:  8192,
+// consoleURL is the viewer WebSocket URL of hash under -external_url, "" when unset
+func consoleURL(cfg *Config, hash, console string) string {
+	if cfg.ExternalURL == "" {
+		return ""
 	}
+	if console == consoleSpice {
+		return cfg.ExternalURL + "/spice/" + url.PathEscape(hash)
+	}
+	return cfg.ExternalURL + "/vncproxy/" + url.PathEscape(hash)
+}
 
-	headers := http.Header{}
+// newProxiedItem builds the entry stored for a validated registration made by principal
+func newProxiedItem(cfg *Config, req *ProxyRequest, principal string) *ProxiedItem {
+	item := &ProxiedItem{
+		Token:               req.Token,
+		Cookie:              req.Cookie,
+		CSRFPreventionToken: req.CSRFPreventionToken,
+		URL:                 req.URL,
+		Principal:           principal,
+		SingleUse:           req.SingleUse,
+		DuplicatePolicy:     req.DuplicatePolicy,
+		TTL:                 time.Duration(req.TTLSeconds) * time.Second,
+		Console:             req.Console,
+		Product:             req.Product,
+		Metadata:            req.Metadata,
+		MaxUses:             req.MaxUses,
+		ViewerNetworks:      splitList(req.ViewerIP),
+		MaxViewers:          req.MaxViewers,
+		ReadOnly:            req.ReadOnly,
+		BlockClipboard:      req.BlockClipboard,
+		MaxClipboardBytes:   req.MaxClipboardBytes,
+		BlockedKeys:         splitList(req.BlockedKeys),
+		Record:              req.Record,
+		IdleTimeout:         time.Duration(req.IdleTimeoutSeconds) * time.Second,
+		Viewer:              req.Viewer,
+		TicketAPI:           ticketAPI(req),
+		FallbackURLs:        fallbackURLs(req),
+		Spice:               req.Spice,
+		NativePassword:      req.NativePassword,
+		VNCPassword:         req.VNCPassword,
+	}
+	if req.ExpiresAt != "" {
+		// Validated by validateProxyRequest; kept until the skew allowance has passed too
+		item.ExpiresAt, _ = time.Parse(time.RFC3339, req.ExpiresAt)
+		item.TTL = time.Until(item.ExpiresAt.Add(cfg.ClockSkew))
+	}
+	return item
+}
 
-	if token != "" {
-		headers.Set("Authorization", "PVEAPIToken="+token)
-	} else {
-		if cookie != "" {
-			headers.Set("Cookie", "PVEAuthCookie="+cookie)
+// registerProxy stores a registration made by principal, returning the
+// generated observer hash when a shadow URL was requested
+func registerProxy(cfg *Config, req *ProxyRequest, principal string) (string, error) {
+	item := newProxiedItem(cfg, req, principal)
+	if req.Shadow {
+		shadowHash, err := randomHash(splitNamespace(req.Hash))
+		if err != nil {
+			return "", err
+		}
+		// The observer entry carries no credentials, it only finds the session to watch
+		shadow := &ProxiedItem{
+			URL:               req.URL,
+			Principal:         principal,
+			TTL:               item.TTL,
+			ExpiresAt:         item.ExpiresAt,
+			Console:           item.Console,
+			Metadata:          item.Metadata,
+			MaxViewers:        item.MaxViewers,
+			ShadowOf:          req.Hash,
+			BlockClipboard:    item.BlockClipboard,
+			MaxClipboardBytes: item.MaxClipboardBytes,
+			Viewer:            item.Viewer,
 		}
-		if csrfp_revention_token != "" {
-			headers.Set("CSRFPreventionToken", csrfp_revention_token)
+		if err := proxied.Add(shadowHash, shadow); err != nil {
+			return "", err
 		}
+		item.ShadowHash = shadowHash
+	}
+	if err := proxied.Add(req.Hash, item); err != nil {
+		return "", err
 	}
+	if u, err := url.Parse(req.URL); err == nil {
+		keyStats.RecordRegistration(principal, u.Host)
+	}
+	return item.ShadowHash, nil
+}
 
-	headers.Set("Host", u.Host)
-	headers.Set("Origin", "https://"+u.Host)
-	headers.Set("User-Agent", "Mozilla/5.0")
-	headers.Set("Accept-Encoding", "gzip, deflate, br")
-	headers.Set("Accept-Language", "en-US,en;q=0.9")
-	headers.Set("Cache-Control", "no-cache")
-	headers.Set("Pragma", "no-cache")
+// DELETE /api/proxy/:hash removes a registration before its TTL ends;
+// ?terminate=true also closes the sessions already using it
+func revokeProxyHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
 
-	fmt.Printf("[INFO] Connecting to Proxmox backend: %s\n", u.Host)
-	if cfg.Debug {
-		fmt.Printf("[DEBUG] Full backend URL: %s\n", targetURL)
-		fmt.Printf("[DEBUG] Request headers:\n")
-		for k, v := range headers {
-			// Don't log the full token for security
-			if k == "Authorization" {
-				fmt.Printf("  %s: PVEAPIToken=***[%d chars]\n", k, len(token))
-			} else {
-				fmt.Printf("  %s: %v\n", k, v)
-			}
+		hash := c.Param("hash")
+		if err := authorizeNamespaceAccess(cfg, hash, principalOf(c)); err != nil {
+			fmt.Printf("[ERROR] Revocation by %s rejected: %v\n", principalOf(c), err)
+			c.JSON(http.StatusForbidden, gin.H{
+				"status": "error",
+				"errors": []string{err.Error()},
+			})
+			return
 		}
-	}
 
-	backendConn, resp, err := dialer.Dial(targetURL, headers)
-	if err != nil {
-		fmt.Printf("[ERROR] Failed to connect to Proxmox backend: %v\n", err)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Backend connection error details: %v\n", err)
-			if resp != nil {
-				fmt.Printf("[DEBUG] HTTP response status: %s\n", resp.Status)
-				fmt.Printf("[DEBUG] Response headers:\n")
-				for k, v := range resp.Header {
-					fmt.Printf("  %s: %v\n", k, v)
-				}
-				body, _ := io.ReadAll(resp.Body)
-				if len(body) > 0 {
-					fmt.Printf("[DEBUG] Response body: %s\n", string(body))
-				}
-				resp.Body.Close()
+		// A consumed single-use hash is gone from the store but may still have sessions
+		terminate := c.Query("terminate") == "true"
+		item, err := proxied.Get(hash)
+		if err != nil {
+			_, notFound := err.(*notFoundError)
+			if !notFound {
+				c.JSON(http.StatusServiceUnavailable, gin.H{
+					"status": "error",
+					"errors": []string{"Storage unavailable"},
+				})
+				return
+			}
+			if !terminate || sessions.CountHash(hash) == 0 {
+				c.JSON(http.StatusNotFound, gin.H{
+					"status": "error",
+					"errors": []string{"Hash not found"},
+				})
+				return
 			}
 		}
-		clientConn.Close()
-		return
-	}
-	defer backendConn.Close()
-
-	fmt.Printf("[INFO] Successfully connected to Proxmox backend\n")
-	if cfg.Debug && resp != nil {
-		fmt.Printf("[DEBUG] Backend connection response status: %s\n", resp.Status)
-		fmt.Printf("[DEBUG] Backend response headers:\n")
-		for k, v := range resp.Header {
-			fmt.Printf("  %s: %v\n", k, v)
+		proxied.Remove(hash)
+		if item != nil && item.ShadowHash != "" {
+			proxied.Remove(item.ShadowHash)
 		}
-	}
 
-	// Clear all deadlines
-	clientConn.SetReadDeadline(time.Time{})
-	clientConn.SetWriteDeadline(time.Time{})
-	backendConn.SetReadDeadline(time.Time{})
-	backendConn.SetWriteDeadline(time.Time{})
+		terminated := 0
+		if terminate {
+			terminated = sessions.KillHash(hash, "registration revoked")
+		}
 
-	if cfg.Debug {
-		fmt.Printf("[DEBUG] All connection deadlines cleared\n")
+		fmt.Printf("[INFO] Hash %s revoked by %s, %d sessions terminated\n", hashTag(hash), principalOf(c), terminated)
+		c.JSON(http.StatusOK, gin.H{
+			"status":              "success",
+			"message":             "Proxied entry revoked",
+			"sessions_terminated": terminated,
+		})
 	}
+}
 
-	// Close handlers
-	clientConn.SetCloseHandler(func(code int, text string) error {
-		fmt.Printf("[INFO] Client connection closing with code %d\n", code)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Client close details: code=%d, text='%s'\n", code, text)
+// GET /api/proxy/:hash reports whether a registration is still valid, without its credentials
+func proxyStatusHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
 		}
-		backendConn.WriteControl(websocket.CloseMessage,
-			websocket.FormatCloseMessage(code, text),
-			time.Now().Add(time.Second))
-		return nil
-	})
 
-	backendConn.SetCloseHandler(func(code int, text string) error {
-		fmt.Printf("[INFO] Backend connection closing with code %d\n", code)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Backend close details: code=%d, text='%s'\n", code, text)
+		hash := c.Param("hash")
+		if err := authorizeNamespaceAccess(cfg, hash, principalOf(c)); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{
+				"status": "error",
+				"errors": []string{err.Error()},
+			})
+			return
 		}
-		clientConn.WriteControl(websocket.CloseMessage,
-			websocket.FormatCloseMessage(code, text),
-			time.Now().Add(time.Second))
-		return nil
-	})
 
-	// Ping/pong routine
-	fmt.Printf("[INFO] Starting WebSocket keep-alive routine\n")
-	pingDone := make(chan struct{})
-	var pingOnce sync.Once
-	go func() {
-		ticker := time.NewTicker(20 * time.Second)
-		defer ticker.Stop()
+		item, err := proxied.Get(hash)
+		var expires time.Time
+		if err == nil {
+			expires, err = proxied.Expiry(hash)
+		}
+		if _, notFound := err.(*notFoundError); notFound || (err == nil && !item.ExpiresAt.IsZero() && expiredWithSkew(cfg, item.ExpiresAt)) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"errors": []string{"Hash not found"},
+				"exists": false,
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "error",
+				"errors": []string{"Storage unavailable"},
+			})
+			return
+		}
 
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Keep-alive routine started with 20-second intervals\n")
+		// The store keeps entries with an expires_at past it by the skew allowance
+		if !item.ExpiresAt.IsZero() {
+			expires = item.ExpiresAt
+		}
+		remaining := time.Until(expires)
+		if remaining < 0 {
+			remaining = 0
 		}
 
-		for {
-			select {
-			case <-ticker.C:
-				if cfg.Debug {
-					fmt.Printf("[DEBUG] Sending keep-alive pings\n")
+		// Only the endpoint; the query carries the VNC ticket
+		target := gin.H{}
+		if u, err := url.Parse(item.URL); err == nil {
+			target["host"] = u.Host
+			target["path"] = u.Path
+		}
+		if len(item.FallbackURLs) > 0 {
+			hosts := []string{}
+			for _, fallback := range item.FallbackURLs {
+				if u, err := url.Parse(fallback); err == nil {
+					hosts = append(hosts, u.Host)
 				}
+			}
+			target["fallback_hosts"] = hosts
+		}
+		if item.Product != "" {
+			target["product"] = item.Product
+		}
 
-				if err := clientConn.WriteControl(websocket.PingMessage, []byte("client-ping"), time.Now().Add(5*time.Second)); err != nil {
-					fmt.Printf("[ERROR] Failed to send client ping: %v\n", err)
-					if cfg.Debug {
-						fmt.Printf("[DEBUG] Client ping error details: %v\n", err)
-					}
-					return
-				}
+		active := sessions.CountHash(hash)
+		resp := gin.H{
+			"status":                "success",
+			"exists":                true,
+			"ttl_remaining_seconds": int(remaining / time.Second),
+			"used":                  !item.FirstUsed.IsZero() || active > 0,
+			"active_sessions":       active,
+			"max_viewers":           maxViewers(cfg, item),
+			"single_use":            item.SingleUse,
+			"read_only":             item.ReadOnly,
+			"record":                item.Record,
+			"native_vnc":            item.NativePassword != "",
+			"block_clipboard":       clipboardBlocked(cfg, item),
+			"max_clipboard_bytes":   maxClipboardBytes(cfg, item),
+			"idle_timeout_seconds":  int(idleTimeout(cfg, item) / time.Second),
+			"uses":                  item.Uses,
+			"principal":             item.Principal,
+			"target":                target,
+		}
+		if !item.FirstUsed.IsZero() {
+			resp["first_used"] = item.FirstUsed
+		}
+		if item.MaxUses > 0 {
+			resp["max_uses"] = item.MaxUses
+		}
+		if len(item.ViewerNetworks) > 0 {
+			resp["viewer_ip"] = strings.Join(item.ViewerNetworks, ",")
+		}
+		if keys := blockedKeys(cfg, item); len(keys) > 0 {
+			resp["blocked_keys"] = strings.Join(keys, ",")
+		}
+		if len(item.Metadata) > 0 {
+			resp["metadata"] = item.Metadata
+		}
+		if item.Console != consoleXterm && item.Console != consoleSpice {
+			resp["viewer"] = viewerOptions(item)
+		}
+		if u := consoleURL(cfg, hash, item.Console); u != "" {
+			resp["url"] = u
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
 
-				if err := backendConn.WriteControl(websocket.PingMessage, []byte("backend-ping"), time.Now().Add(5*time.Second)); err != nil {
-					fmt.Printf("[ERROR] Failed to send backend ping: %v\n", err)
-					if cfg.Debug {
-						fmt.Printf("[DEBUG] Backend ping error details: %v\n", err)
-					}
-					return
-				}
-			case <-pingDone:
-				if cfg.Debug {
-					fmt.Printf("[DEBUG] Keep-alive routine stopping\n")
-				}
-				return
-			}
+// GET /api/registrations/watch streams registrations added and removed (or
+// expired) on any node sharing the store as server-sent events; keys bound to
+// namespaces only see their namespaces
+func watchRegistrationsHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
 		}
-	}()
 
-	fmt.Printf("[INFO] Starting WebSocket proxy data forwarding\n")
-	errc := make(chan error, 2)
-	go proxyWS(clientConn, backendConn, errc, "client->backend", cfg.Debug)
-	go proxyWS(backendConn, clientConn, errc, "backend->client", cfg.Debug)
+		events, cancel := proxied.Watch()
+		defer cancel()
 
-	// Wait for one of the proxy routines to finish
-	err2 := <-errc
-	pingOnce.Do(func() { close(pingDone) })
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Writer.Flush()
 
-	fmt.Printf("[INFO] WebSocket proxy session ending, sending close messages\n")
-	if cfg.Debug {
-		fmt.Printf("[DEBUG] Sending graceful close messages to both connections\n")
+		fmt.Printf("[INFO] Registration watch started by %s (%s)\n", c.ClientIP(), principalOf(c))
+		defer fmt.Printf("[INFO] Registration watch ended for %s\n", c.ClientIP())
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case ev := <-events:
+				if !hashVisible(cfg, principalOf(c), ev.Key) {
+					continue
+				}
+				// Only the hash prefix, the full hash grants access
+				c.SSEvent(ev.Type, gin.H{"hash": hashTag(ev.Key), "time": time.Now()})
+				c.Writer.Flush()
+			case <-keepAlive.C:
+				fmt.Fprint(c.Writer, ": keep-alive\n\n")
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return
+			case <-stopping:
+				return
+			}
+		}
 	}
+}
 
-	clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
-	backendConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+// GET /api/metrics, ?cluster=true adds every cluster node's metrics and their
+// totals; keys bound to namespaces only see their own sessions and counters
+func metricsHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
 
-	if err2 != nil {
-		fmt.Printf("[ERROR] WebSocket proxy session ended with error: %v\n", err2)
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Proxy error details: %v\n", err2)
+		principal := principalOf(c)
+		principals := keyStats.Snapshot()
+		if len(cfg.boundNamespaces(principal)) > 0 {
+			own := make(map[string]interface{}, 1)
+			if stats, ok := principals[principal]; ok {
+				own[principal] = stats
+			}
+			principals = own
 		}
-	} else {
-		fmt.Printf("[INFO] WebSocket proxy session completed successfully\n")
-		if cfg.Debug {
-			fmt.Printf("[DEBUG] Both proxy routines finished without errors\n")
+		resp := gin.H{
+			"status":      "success",
+			"sessions":    len(visibleSessions(cfg, principal, sessions.List())),
+			"first_frame": firstFrameLatency.Percentiles(),
+			"principals":  principals,
+		}
+		if clusterWide(cfg, c) {
+			resp["cluster"] = clusterMetrics(cfg, c, resp)
 		}
+		c.JSON(http.StatusOK, resp)
 	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staticAsset is an in-memory file served with an ETag, optional pre-compressed
+// gzip body and a content-hashed name that can be cached forever
+type staticAsset struct {
+	contentType string
+	body        []byte
+	gz          []byte
+	etag        string
+	hashedName  string
+}
+
+// newStaticAsset prepares name (e.g. "embed.js") for serving; the hashed name
+// becomes "embed.<hash>.js"
+func newStaticAsset(name, contentType string, body []byte) *staticAsset {
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])[:12]
+
+	ext := path.Ext(name)
+	a := &staticAsset{
+		contentType: contentType,
+		body:        body,
+		etag:        `"` + digest + `"`,
+		hashedName:  strings.TrimSuffix(name, ext) + "." + digest + ext,
+	}
+
+	// Small or incompressible files are not worth a second copy
+	if len(body) > 1024 {
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(body)
+		zw.Close()
+		if buf.Len() < len(body) {
+			a.gz = buf.Bytes()
+		}
+	}
+	return a
+}
+
+// serve writes the asset; immutable marks content-hashed URLs that never change
+func (a *staticAsset) serve(c *gin.Context, immutable bool) {
+	if immutable {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+	c.Header("ETag", a.etag)
+	c.Header("Vary", "Accept-Encoding")
+
+	if match := c.GetHeader("If-None-Match"); match != "" && strings.Contains(match, a.etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	if a.gz != nil && strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(http.StatusOK, a.contentType, a.gz)
+		return
+	}
+	c.Data(http.StatusOK, a.contentType, a.body)
+}
+
+// mountAsset serves the asset at dir/name (revalidated) and dir/<hashed name> (immutable)
+func mountAsset(r *gin.Engine, dir, name string, a *staticAsset) {
+	r.GET(dir+name, func(c *gin.Context) { a.serve(c, false) })
+	r.GET(dir+a.hashedName, func(c *gin.Context) { a.serve(c, true) })
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BanList temporarily blocks source IPs flagged by honeypots or limiters
+type BanList struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// NewBanList creates an empty ban list
+func NewBanList() *BanList {
+	return &BanList{until: make(map[string]time.Time)}
+}
+
+// Ban blocks ip for d, extending an existing ban if it would end sooner
+func (bl *BanList) Ban(ip string, d time.Duration, reason string) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if current, ok := bl.until[ip]; ok && current.After(until) {
+		return
+	}
+	bl.until[ip] = until
+
+	fmt.Printf("[WARN] Banned %s for %v: %s\n", ip, d, reason)
+}
+
+// IsBanned reports whether ip is currently blocked
+func (bl *BanList) IsBanned(ip string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	until, ok := bl.until[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(bl.until, ip)
+		return false
+	}
+	return true
+}
+
+// List returns the active bans and their expiry
+func (bl *BanList) List() map[string]time.Time {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	now := time.Now()
+	out := make(map[string]time.Time, len(bl.until))
+	for ip, until := range bl.until {
+		if now.After(until) {
+			delete(bl.until, ip)
+			continue
+		}
+		out[ip] = until
+	}
+	return out
+}
+
+// Global ban list shared by honeypots and rate limiters
+var bans = NewBanList()
+
+// banGuard rejects requests from banned IPs; PUQcloud controllers are never blocked
+func banGuard(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ip := c.ClientIP(); !cfg.IsControlIP(ip) && bans.IsBanned(ip) {
+			if cfg.Debug {
+				fmt.Printf("[DEBUG] Rejected request from banned IP %s: %s\n", ip, c.Request.URL.Path)
+			}
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+// honeypot bans sources requesting decoy paths that no legitimate client uses
+func honeypot(cfg *Config) gin.HandlerFunc {
+	decoys := make(map[string]bool, len(cfg.HoneypotPaths))
+	for _, p := range cfg.HoneypotPaths {
+		decoys[p] = true
+	}
+
+	return func(c *gin.Context) {
+		if !decoys[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		ip := c.ClientIP()
+		fmt.Printf("[WARN] Honeypot hit: ip=%s path=%s user_agent=%q\n", ip, c.Request.URL.Path, c.Request.UserAgent())
+		bans.Ban(ip, cfg.BanDuration, "honeypot "+c.Request.URL.Path)
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Base64 ed25519 public key that offline bundles must be signed with, set at build time:
+// go build -ldflags "-X main.bundlePublicKey=<key>"
+var bundlePublicKey = ""
+
+// Bundle entries: the proxy binary and, optionally, noVNC files for an external
+// web server and a GeoIP database
+const (
+	bundleBinary   = "vncwebproxy"
+	bundleNoVNCDir = "novnc/"
+	bundleGeoIP    = "geoip.mmdb"
+)
+
+// renameFile moves staged files into place; tests swap it to fail part way
+var renameFile = os.Rename
+
+// applyBundleCommand implements "vncwebproxy apply-bundle [options] <bundle.tar.gz>"
+func applyBundleCommand(args []string) int {
+	fs := flag.NewFlagSet("apply-bundle", flag.ExitOnError)
+	sigPath := fs.String("sig", "", "Detached signature file (default: <bundle>.sig)")
+	binPath := fs.String("binary", "", "Where to install the binary (default: the running executable)")
+	noVNCDir := fs.String("novnc_dir", "", "Where to install noVNC files from the bundle, e.g. /var/www/html; binaries built with make novnc serve their own (required if the bundle has novnc/)")
+	geoIPPath := fs.String("geoip_db", "", "Where to install the GeoIP database from the bundle (required if the bundle has "+bundleGeoIP+")")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: vncwebproxy apply-bundle [options] <bundle.tar.gz>\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	bundlePath := fs.Arg(0)
+	if *sigPath == "" {
+		*sigPath = bundlePath + ".sig"
+	}
+	if *binPath == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Printf("Error: cannot locate running executable: %v\n", err)
+			return 1
+		}
+		*binPath = exe
+	}
+
+	data, err := verifyBundle(bundlePath, *sigPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("[INFO] Bundle signature verified: %s\n", bundlePath)
+
+	if err := installBundle(data, bundleTargets{binary: *binPath, noVNCDir: *noVNCDir, geoIP: *geoIPPath}); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("[INFO] Bundle installed, send SIGUSR2 to the running proxy to switch without dropping sessions\n")
+	return 0
+}
+
+// verifyBundle reads the bundle and checks its detached signature against bundlePublicKey
+func verifyBundle(bundlePath, sigPath string) ([]byte, error) {
+	if bundlePublicKey == "" {
+		return nil, fmt.Errorf("this build has no bundle public key, rebuild with -ldflags \"-X main.bundlePublicKey=...\"")
+	}
+	pub, err := base64.StdEncoding.DecodeString(bundlePublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("built-in bundle public key is invalid")
+	}
+
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	rawSig, err := os.ReadFile(sigPath)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(rawSig)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature file %s: %v", sigPath, err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		return nil, fmt.Errorf("bundle signature verification failed")
+	}
+	return data, nil
+}
+
+// bundleTargets are the install locations of bundle entries; empty optional
+// ones make a bundle carrying that entry fail
+type bundleTargets struct {
+	binary   string
+	noVNCDir string
+	geoIP    string
+}
+
+// destination maps a bundle entry to where it is installed, with its mode
+func (bt bundleTargets) destination(entry string) (string, os.FileMode, error) {
+	// Only clean relative names, so ".." and absolute paths can't climb out of
+	// the noVNC directory; "./" from tar -C dir . is fine
+	name := strings.TrimPrefix(entry, "./")
+	if name != path.Clean(name) || path.IsAbs(name) {
+		return "", 0, fmt.Errorf("invalid bundle entry %q", entry)
+	}
+	switch {
+	case name == bundleBinary:
+		return bt.binary, 0755, nil
+	case name == bundleGeoIP:
+		if bt.geoIP == "" {
+			return "", 0, fmt.Errorf("bundle contains %s, pass -geoip_db", bundleGeoIP)
+		}
+		return bt.geoIP, 0644, nil
+	case strings.HasPrefix(name, bundleNoVNCDir):
+		if bt.noVNCDir == "" {
+			return "", 0, fmt.Errorf("bundle contains noVNC files, pass -novnc_dir")
+		}
+		return filepath.Join(bt.noVNCDir, filepath.FromSlash(strings.TrimPrefix(name, bundleNoVNCDir))), 0644, nil
+	}
+	return "", 0, fmt.Errorf("unexpected bundle entry %q", entry)
+}
+
+// installBundle unpacks a verified bundle; every file is staged first and the
+// files it replaces are kept until all are in place, so a broken archive or a
+// failure part way leaves the current installation as it was
+func installBundle(data []byte, targets bundleTargets) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("bundle is not gzip: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	staged := make(map[string]string) // final path -> staged path
+	defer func() {
+		for _, tmp := range staged {
+			os.Remove(tmp)
+		}
+	}()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading bundle: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		dest, mode, err := targets.destination(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		tmp := dest + ".bundle-new"
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("extracting %s: %v", hdr.Name, err)
+		}
+		staged[dest] = tmp
+	}
+
+	if _, ok := staged[targets.binary]; !ok {
+		return fmt.Errorf("bundle does not contain %s", bundleBinary)
+	}
+
+	// The binary goes last, so it is never switched without its files
+	dests := make([]string, 0, len(staged))
+	for dest := range staged {
+		if dest != targets.binary {
+			dests = append(dests, dest)
+		}
+	}
+	sort.Strings(dests)
+	dests = append(dests, targets.binary)
+
+	type swap struct{ dest, backup string }
+	var done []swap
+	rollback := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			if done[i].backup != "" {
+				renameFile(done[i].backup, done[i].dest)
+			} else {
+				os.Remove(done[i].dest)
+			}
+		}
+	}
+	for _, dest := range dests {
+		sw := swap{dest: dest}
+		if _, err := os.Lstat(dest); err == nil {
+			sw.backup = dest + ".bundle-old"
+			if err := renameFile(dest, sw.backup); err != nil {
+				rollback()
+				return fmt.Errorf("installing %s: %v", dest, err)
+			}
+		}
+		if err := renameFile(staged[dest], dest); err != nil {
+			if sw.backup != "" {
+				renameFile(sw.backup, dest)
+			}
+			rollback()
+			return fmt.Errorf("installing %s: %v", dest, err)
+		}
+		delete(staged, dest)
+		done = append(done, sw)
+	}
+
+	for _, sw := range done {
+		if sw.backup != "" {
+			os.Remove(sw.backup)
+		}
+		fmt.Printf("[INFO] Installed %s\n", sw.dest)
+	}
+	return nil
+}
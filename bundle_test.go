@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type bundleEntry struct {
+	name string
+	body string
+	link bool
+}
+
+// makeBundle builds a .tar.gz with the given entries
+func makeBundle(t *testing.T, entries ...bundleEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.link {
+			hdr = &tar.Header{Name: e.name, Linkname: e.body, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if !e.link {
+			tw.Write([]byte(e.body))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestVerifyBundle(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	old := bundlePublicKey
+	defer func() { bundlePublicKey = old }()
+
+	dir := t.TempDir()
+	data := makeBundle(t, bundleEntry{name: bundleBinary, body: "new"})
+	bundlePath := filepath.Join(dir, "bundle.tar.gz")
+	os.WriteFile(bundlePath, data, 0644)
+	writeSig := func(name string, sig []byte) string {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644)
+		return p
+	}
+	valid := writeSig("valid.sig", ed25519.Sign(priv, data))
+	otherKey := writeSig("other.sig", ed25519.Sign(otherPriv, data))
+	tampered := writeSig("tampered.sig", ed25519.Sign(priv, append([]byte{0}, data...)))
+	notBase64 := filepath.Join(dir, "bad.sig")
+	os.WriteFile(notBase64, []byte("!!!"), 0644)
+
+	tests := []struct {
+		name    string
+		key     string
+		sig     string
+		wantErr bool
+	}{
+		{name: "valid", key: base64.StdEncoding.EncodeToString(pub), sig: valid},
+		{name: "other key", key: base64.StdEncoding.EncodeToString(pub), sig: otherKey, wantErr: true},
+		{name: "signature of other data", key: base64.StdEncoding.EncodeToString(pub), sig: tampered, wantErr: true},
+		{name: "signature not base64", key: base64.StdEncoding.EncodeToString(pub), sig: notBase64, wantErr: true},
+		{name: "missing signature", key: base64.StdEncoding.EncodeToString(pub), sig: filepath.Join(dir, "none.sig"), wantErr: true},
+		{name: "no built-in key", key: "", sig: valid, wantErr: true},
+		{name: "short built-in key", key: base64.StdEncoding.EncodeToString(pub[:31]), sig: valid, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundlePublicKey = tt.key
+			got, err := verifyBundle(bundlePath, tt.sig)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("bundle accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("verified data differs from the bundle")
+			}
+		})
+	}
+}
+
+// installDirs returns targets in a fresh directory holding an installed "old" binary
+func installDirs(t *testing.T) (string, bundleTargets) {
+	t.Helper()
+	dir := t.TempDir()
+	targets := bundleTargets{
+		binary:   filepath.Join(dir, "bin", "vncwebproxy"),
+		noVNCDir: filepath.Join(dir, "www"),
+		geoIP:    filepath.Join(dir, "geoip", "city.mmdb"),
+	}
+	os.MkdirAll(filepath.Dir(targets.binary), 0755)
+	os.WriteFile(targets.binary, []byte("old"), 0755)
+	return dir, targets
+}
+
+// dirFiles lists the regular files under dir with their contents
+func dirFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			body, _ := os.ReadFile(p)
+			rel, _ := filepath.Rel(dir, p)
+			files[filepath.ToSlash(rel)] = string(body)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestInstallBundle(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []bundleEntry
+		targets func(bundleTargets) bundleTargets
+		want    map[string]string // files after the install, nil when it must fail
+	}{
+		{
+			name:    "binary only",
+			entries: []bundleEntry{{name: bundleBinary, body: "new"}},
+			want:    map[string]string{"bin/vncwebproxy": "new"},
+		},
+		{
+			name:    "dot prefix",
+			entries: []bundleEntry{{name: "./novnc/vnc.html", body: "html"}, {name: "./" + bundleBinary, body: "new"}},
+			want:    map[string]string{"bin/vncwebproxy": "new", "www/vnc.html": "html"},
+		},
+		{
+			name: "all entries",
+			entries: []bundleEntry{
+				{name: "novnc/vnc.html", body: "html"},
+				{name: "novnc/core/rfb.js", body: "js"},
+				{name: bundleGeoIP, body: "db"},
+				{name: bundleBinary, body: "new"},
+			},
+			want: map[string]string{"bin/vncwebproxy": "new", "www/vnc.html": "html", "www/core/rfb.js": "js", "geoip/city.mmdb": "db"},
+		},
+		{
+			name:    "symlinks skipped",
+			entries: []bundleEntry{{name: "novnc/passwd", body: "/etc/passwd", link: true}, {name: bundleBinary, body: "new"}},
+			want:    map[string]string{"bin/vncwebproxy": "new"},
+		},
+		{name: "missing binary", entries: []bundleEntry{{name: "novnc/vnc.html", body: "html"}}},
+		{name: "unexpected entry", entries: []bundleEntry{{name: bundleBinary, body: "new"}, {name: "etc/cron.d/x", body: "x"}}},
+		{name: "traversal from novnc", entries: []bundleEntry{{name: "novnc/../../escaped", body: "x"}, {name: bundleBinary, body: "new"}}},
+		{name: "traversal to binary", entries: []bundleEntry{{name: "novnc/../vncwebproxy", body: "x"}}},
+		{name: "parent entry", entries: []bundleEntry{{name: "../escaped", body: "x"}, {name: bundleBinary, body: "new"}}},
+		{name: "absolute entry", entries: []bundleEntry{{name: "/novnc/vnc.html", body: "x"}, {name: bundleBinary, body: "new"}}},
+		{
+			name:    "novnc without -novnc_dir",
+			entries: []bundleEntry{{name: "novnc/vnc.html", body: "html"}, {name: bundleBinary, body: "new"}},
+			targets: func(bt bundleTargets) bundleTargets { bt.noVNCDir = ""; return bt },
+		},
+		{
+			name:    "geoip without -geoip_db",
+			entries: []bundleEntry{{name: bundleGeoIP, body: "db"}, {name: bundleBinary, body: "new"}},
+			targets: func(bt bundleTargets) bundleTargets { bt.geoIP = ""; return bt },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, targets := installDirs(t)
+			if tt.targets != nil {
+				targets = tt.targets(targets)
+			}
+			err := installBundle(makeBundle(t, tt.entries...), targets)
+			want := tt.want
+			if want == nil {
+				if err == nil {
+					t.Fatal("bundle installed")
+				}
+				want = map[string]string{"bin/vncwebproxy": "old"}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := dirFiles(t, filepath.Dir(dir))
+			for name, body := range want {
+				if got[filepath.Base(dir)+"/"+name] != body {
+					t.Errorf("%s = %q, want %q", name, got[filepath.Base(dir)+"/"+name], body)
+				}
+			}
+			if len(got) != len(want) {
+				t.Errorf("files after install = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestInstallBundleInterrupted(t *testing.T) {
+	full := makeBundle(t,
+		bundleEntry{name: "novnc/a.js", body: "new a"},
+		bundleEntry{name: "novnc/b.js", body: "new b"},
+		bundleEntry{name: bundleBinary, body: "new"},
+	)
+	installed := func(t *testing.T, targets bundleTargets) {
+		os.MkdirAll(targets.noVNCDir, 0755)
+		os.WriteFile(filepath.Join(targets.noVNCDir, "a.js"), []byte("old a"), 0644)
+	}
+	old := map[string]string{"bin/vncwebproxy": "old", "www/a.js": "old a"}
+
+	t.Run("truncated archive", func(t *testing.T) {
+		dir, targets := installDirs(t)
+		installed(t, targets)
+		if err := installBundle(full[:len(full)-40], targets); err == nil {
+			t.Fatal("truncated bundle installed")
+		}
+		if got := dirFiles(t, dir); !equalFiles(got, old) {
+			t.Errorf("files after failed install = %v, want %v", got, old)
+		}
+	})
+
+	// Every rename of the swap phase failing in turn must restore what was there
+	for fail := 1; fail <= 6; fail++ {
+		t.Run("swap fails", func(t *testing.T) {
+			dir, targets := installDirs(t)
+			installed(t, targets)
+			calls := 0
+			renameFile = func(from, to string) error {
+				calls++
+				if calls == fail {
+					return errors.New("disk full")
+				}
+				return os.Rename(from, to)
+			}
+			defer func() { renameFile = os.Rename }()
+
+			err := installBundle(full, targets)
+			if calls < fail {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "disk full") {
+				t.Fatalf("got %v, want the rename error", err)
+			}
+			if got := dirFiles(t, dir); !equalFiles(got, old) {
+				t.Errorf("rename %d failing left %v, want %v", fail, got, old)
+			}
+		})
+	}
+}
+
+func equalFiles(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+//go:build !norecording
+// +build !norecording
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Debug captures, transcripts and the history API are left out with -tags norecording
+const featureRecording = true
+
+// Bytes of each frame included in a capture artifact
+const captureFrameBytes = 256
+
+// frameCapture buffers handshake details and the first frames of a session and
+// writes them to -capture_dir only if the session fails within -capture_window.
+// A nil *frameCapture is valid and records nothing.
+type frameCapture struct {
+	cfg      *Config
+	hashTag  string
+	viewerIP string
+	started  time.Time
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	frames int
+	done   bool
+}
+
+func newFrameCapture(cfg *Config, hash, viewerIP string) *frameCapture {
+	if cfg.CaptureDir == "" {
+		return nil
+	}
+
+	tag := hashTag(hash)
+
+	fc := &frameCapture{cfg: cfg, hashTag: tag, viewerIP: viewerIP, started: time.Now()}
+	fmt.Fprintf(&fc.buf, "session hash=%s... viewer=%s started=%s\n\n", tag, viewerIP, fc.started.Format(time.RFC3339Nano))
+	return fc
+}
+
+func (fc *frameCapture) recordHeaders(title string, h http.Header) {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(&fc.buf, "== %s\n", title)
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		switch http.CanonicalHeaderKey(k) {
+		case "Authorization", "Cookie", "Csrfpreventiontoken", "X-Api-Key":
+			v = fmt.Sprintf("***[%d chars]", len(v))
+		}
+		fmt.Fprintf(&fc.buf, "%s: %s\n", k, v)
+	}
+	fc.buf.WriteString("\n")
+}
+
+// recordResponse stores the backend handshake response; on failure the body is
+// read so the artifact shows what pveproxy answered
+func (fc *frameCapture) recordResponse(resp *http.Response) {
+	if fc == nil || resp == nil {
+		return
+	}
+
+	var body []byte
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.Body != nil {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	fc.mu.Lock()
+	fmt.Fprintf(&fc.buf, "== Backend handshake response: %s (+%v)\n", resp.Status, time.Since(fc.started))
+	fc.mu.Unlock()
+
+	fc.recordHeaders("Backend response headers", resp.Header)
+
+	if len(body) > 0 {
+		fc.mu.Lock()
+		fmt.Fprintf(&fc.buf, "== Backend response body\n%s\n\n", body)
+		fc.mu.Unlock()
+	}
+}
+
+func (fc *frameCapture) recordFrame(label string, count, mt int, msg []byte) {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.done || fc.frames >= fc.cfg.CaptureFrames {
+		return
+	}
+	fc.frames++
+
+	dump := msg
+	if len(dump) > captureFrameBytes {
+		dump = dump[:captureFrameBytes]
+	}
+	fmt.Fprintf(&fc.buf, "== %s #%d ws_type=%d length=%d (+%v)\n%s\n",
+		label, count, mt, len(msg), time.Since(fc.started), hex.Dump(dump))
+}
+
+// finish writes the artifact when the session ended early; later calls are ignored
+func (fc *frameCapture) finish(sessionErr error) {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.done {
+		return
+	}
+	fc.done = true
+
+	elapsed := time.Since(fc.started)
+	if elapsed > fc.cfg.CaptureWindow {
+		return
+	}
+
+	fmt.Fprintf(&fc.buf, "== Session ended after %v: %v\n", elapsed, sessionErr)
+
+	name := fmt.Sprintf("%s_%s.txt", fc.started.UTC().Format("20060102T150405.000Z"), fc.hashTag)
+	path := filepath.Join(fc.cfg.CaptureDir, name)
+	if err := os.WriteFile(path, fc.buf.Bytes(), 0600); err != nil {
+		fmt.Printf("[ERROR] Failed to write session capture %s: %v\n", path, err)
+		return
+	}
+	fmt.Printf("[INFO] Session failed after %v, capture written to %s\n", elapsed, path)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// What happens to cut text over the -max_clipboard_bytes limit
+const (
+	clipboardTruncate = "truncate"
+	clipboardDrop     = "drop"
+)
+
+// clipboardBlocked reports whether cut text is stripped from sessions of item
+func clipboardBlocked(cfg *Config, item *ProxiedItem) bool {
+	return cfg.BlockClipboard || item.BlockClipboard
+}
+
+// maxClipboardBytes returns the cut text limit of a registration, falling back
+// to -max_clipboard_bytes; 0 means no limit
+func maxClipboardBytes(cfg *Config, item *ProxiedItem) int {
+	if item.MaxClipboardBytes > 0 {
+		return item.MaxClipboardBytes
+	}
+	return cfg.MaxClipboardBytes
+}
+
+// cutTextPolicy is what happens to ClientCutText and ServerCutText of a session
+type cutTextPolicy struct {
+	hash     string
+	strip    bool // remove all cut text
+	limit    int  // longest text passed on, 0 for any length
+	truncate bool // cut longer texts down to limit instead of removing them
+}
+
+// clipboardPolicy returns the cut text policy of a VNC session of item, nil
+// when cut text passes untouched
+func clipboardPolicy(cfg *Config, hash string, item *ProxiedItem) *cutTextPolicy {
+	p := &cutTextPolicy{
+		hash:     hash,
+		strip:    clipboardBlocked(cfg, item),
+		limit:    maxClipboardBytes(cfg, item),
+		truncate: cfg.ClipboardOversize == clipboardTruncate,
+	}
+	if !p.strip && p.limit == 0 {
+		return nil
+	}
+	return p
+}
+
+// keep returns how much of a cut text of length bytes is passed on, -1 to remove it
+func (c *cutTextPolicy) keep(length int, from string) int {
+	switch {
+	case c.strip:
+		return -1
+	case c.limit == 0 || length <= c.limit:
+		return length
+	case c.truncate:
+		fmt.Printf("[WARN] Clipboard of %d bytes from %s of hash %s truncated to %d\n", length, from, hashTag(c.hash), c.limit)
+		return c.limit
+	}
+	fmt.Printf("[WARN] Clipboard of %d bytes from %s of hash %s dropped, over %d\n", length, from, hashTag(c.hash), c.limit)
+	return -1
+}
+
+// clientCutText applies the policy to a whole ClientCutText message, nil when
+// it is removed
+func (c *cutTextPolicy) clientCutText(m []byte) []byte {
+	if c == nil {
+		return m
+	}
+	keep := c.keep(len(m)-8, "viewer")
+	if keep < 0 {
+		return nil
+	}
+	out := append([]byte(nil), m[:8+keep]...)
+	binary.BigEndian.PutUint32(out[4:], uint32(keep))
+	return out
+}
+
+// clipboardFilter applies a cutTextPolicy to a VNC session. Server messages can
+// only be told apart by following the stream, so the viewer's SetEncodings is
+// narrowed to the encodings rfbStream can follow
+type clipboardFilter struct {
+	policy *cutTextPolicy
+
+	mu     sync.Mutex
+	stream *rfbStream // nil until the viewer's handshake is done
+	closed bool
+}
+
+// start is called when the viewer sends ClientInit: what the backend sends next starts with ServerInit
+func (f *clipboardFilter) start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.stream = newRFBStream(f.policy)
+	}
+}
+
+// serverInit returns a ServerInit for the current framebuffer, nil until the
+// stream is being followed
+func (f *clipboardFilter) serverInit() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stream == nil || !f.stream.ready || f.stream.err != nil {
+		return nil
+	}
+	return f.stream.init.encode()
+}
+
+func (f *clipboardFilter) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+}
+
+// fromBackend returns a backend frame with the policy applied and whether it
+// ends between two server messages; the session must end when the stream
+// can't be followed, as cut text could slip through
+func (f *clipboardFilter) fromBackend(msg []byte) ([]byte, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stream == nil {
+		return msg, false, nil
+	}
+	boundary := f.stream.Feed(msg)
+	if f.stream.err != nil {
+		return nil, false, &sessionCloseError{code: websocket.CloseInternalServerErr, reason: "can't follow the VNC stream to filter the clipboard"}
+	}
+	return f.stream.out, boundary, nil
+}
+
+// fromClient returns a viewer frame with the policy applied. Frames that can't
+// be split are forwarded whole unless they start with ClientCutText
+func (f *clipboardFilter) fromClient(msg []byte) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		size := rfbClientMessageSize(msg)
+		if size < 0 {
+			if msg[0] != 6 {
+				out = append(out, msg...)
+			}
+			break
+		}
+		m := msg[:size]
+		msg = msg[size:]
+
+		switch m[0] {
+		case 0: // SetPixelFormat
+			f.mu.Lock()
+			if f.stream != nil {
+				f.stream.setPixelFormat(m)
+			}
+			f.mu.Unlock()
+			out = append(out, m...)
+		case 2: // SetEncodings
+			out = append(out, filterEncodings(m)...)
+		case 6: // ClientCutText
+			out = append(out, f.policy.clientCutText(m)...)
+		default:
+			out = append(out, m...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// expiredWithSkew reports whether expiresAt has passed, allowing for the configured
+// clock skew between PUQcloud and this proxy
+func expiredWithSkew(cfg *Config, expiresAt time.Time) bool {
+	return time.Now().After(expiresAt.Add(cfg.ClockSkew))
+}
+
+// GET /api/time
+// Optional ?client_time=<unix ms> makes the response include the measured drift
+func timeHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+
+		now := time.Now()
+		resp := gin.H{
+			"status":          "success",
+			"time":            now.UTC().Format(time.RFC3339Nano),
+			"unix_ms":         now.UnixNano() / int64(time.Millisecond),
+			"clock_skew_ms":   int64(cfg.ClockSkew / time.Millisecond),
+			"drift_tolerated": true,
+		}
+
+		if offset, ok := ntpOffset(); ok {
+			resp["ntp_offset_ms"] = int64(offset / time.Millisecond)
+		}
+
+		if raw := c.Query("client_time"); raw != "" {
+			clientMs, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "error",
+					"errors": []string{"client_time must be unix milliseconds"},
+				})
+				return
+			}
+
+			drift := time.Duration(now.UnixNano()/int64(time.Millisecond)-clientMs) * time.Millisecond
+			resp["drift_ms"] = int64(drift / time.Millisecond)
+			if drift < 0 {
+				drift = -drift
+			}
+			resp["drift_tolerated"] = drift <= cfg.ClockSkew
+			if drift > cfg.ClockDriftWarn {
+				fmt.Printf("[WARN] Clock drift vs %s is %v, above %v\n", c.ClientIP(), drift, cfg.ClockDriftWarn)
+			}
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
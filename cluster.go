@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Virtual nodes per peer, so hashes spread evenly across a small cluster
+const ringReplicas = 64
+
+// hashRing maps console hashes to the peer that owns them by consistent hashing
+type hashRing struct {
+	mu      sync.RWMutex
+	members []string
+	points  []uint32
+	owners  map[uint32]string
+}
+
+// Global ring, filled from -peers or -peers_srv
+var peers = &hashRing{}
+
+// Set replaces the ring members
+func (r *hashRing) Set(members []string) {
+	points := make([]uint32, 0, len(members)*ringReplicas)
+	owners := make(map[uint32]string, len(members)*ringReplicas)
+	for _, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			p := crc32.ChecksumIEEE([]byte(m + "#" + strconv.Itoa(i)))
+			points = append(points, p)
+			owners[p] = m
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	r.mu.Lock()
+	r.members, r.points, r.owners = members, points, owners
+	r.mu.Unlock()
+}
+
+// Others returns the members other than self
+func (r *hashRing) Others(self string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var others []string
+	for _, m := range r.members {
+		if m != self {
+			others = append(others, m)
+		}
+	}
+	return others
+}
+
+// Owner returns the member responsible for key, or "" for an empty ring
+func (r *hashRing) Owner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// startPeerDiscovery fills the ring from the static list and keeps it updated from DNS SRV
+func startPeerDiscovery(cfg *Config) {
+	if cfg.SelfURL == "" {
+		return
+	}
+	static := append([]string{cfg.SelfURL}, cfg.Peers...)
+	peers.Set(static)
+	if cfg.Store == "" || cfg.Store == "memory" {
+		fmt.Printf("[WARN] Cluster nodes don't share -store=memory, consoles of a lost node can't be reopened on another\n")
+	}
+
+	if cfg.PeersSRV == "" {
+		fmt.Printf("[INFO] Cluster peers: %v\n", static)
+		return
+	}
+
+	go func() {
+		var last string
+		for {
+			members := static
+			_, addrs, err := net.LookupSRV("", "", cfg.PeersSRV)
+			if err != nil {
+				fmt.Printf("[WARN] Peer discovery via %s failed: %v\n", cfg.PeersSRV, err)
+			}
+			for _, a := range addrs {
+				u := "https://" + net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port)))
+				if u != cfg.SelfURL {
+					members = append(members, u)
+				}
+			}
+			sort.Strings(members[1:])
+
+			if joined := strings.Join(members, ","); joined != last {
+				peers.Set(members)
+				last = joined
+				fmt.Printf("[INFO] Cluster peers: %v\n", members)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// How a node passes on viewers of hashes it doesn't hold, -cluster_routing
+const (
+	routeRedirect = "redirect"
+	routeForward  = "forward"
+)
+
+// routeToOwner hands a viewer whose hash is not held here to the owning peer,
+// with a 307 before the upgrade or by forwarding the WebSocket; the hop
+// parameter stops loops. It reports whether the request was handled
+func routeToOwner(cfg *Config, ctx *gin.Context, data string) bool {
+	// Any node can open a stateless token
+	if cfg.SelfURL == "" || ctx.Query("hop") != "" || isStatelessToken(cfg, data) {
+		return false
+	}
+	if _, err := proxied.Get(data); err == nil {
+		return false
+	}
+
+	owner := peers.Owner(data)
+	if owner == "" || owner == cfg.SelfURL {
+		return false
+	}
+
+	location := strings.TrimSuffix(owner, "/") + "/vncproxy/" + url.PathEscape(data) + "?hop=1"
+	if cfg.ClusterRouting == routeForward {
+		forwardToOwner(cfg, ctx, owner, location)
+		return true
+	}
+	fmt.Printf("[INFO] Hash not held locally, redirecting viewer %s to %s\n", ctx.ClientIP(), owner)
+	ctx.Redirect(http.StatusTemporaryRedirect, location)
+	return true
+}
+
+// forwardToOwner connects to the owner's /vncproxy first and, once it accepted
+// the hash, upgrades the viewer and relays messages both ways. The owner sees
+// the viewer's address in X-Forwarded-For
+func forwardToOwner(cfg *Config, ctx *gin.Context, owner, location string) {
+	viewerIP := ctx.ClientIP()
+	target := "ws" + strings.TrimPrefix(location, "http")
+
+	header := http.Header{}
+	header.Set("X-Forwarded-For", viewerIP)
+	if origin := ctx.GetHeader("Origin"); origin != "" {
+		header.Set("Origin", origin)
+	}
+	// The subprotocols carry the viewer's request for a reconnect token or the one it resumes with
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		ReadBufferSize:   8192,
+		WriteBufferSize:  8192,
+		Subprotocols:     websocket.Subprotocols(ctx.Request),
+	}
+	ownerConn, resp, err := dialer.Dial(target, header)
+	if err != nil {
+		if resp == nil {
+			fmt.Printf("[ERROR] Failed to forward viewer %s to %s: %v\n", viewerIP, owner, err)
+			ctx.String(http.StatusBadGateway, "console node unavailable")
+			return
+		}
+		// The owner's refusal, e.g. an unknown hash, goes back to the viewer as it is
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		ctx.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		return
+	}
+	defer ownerConn.Close()
+
+	// The viewer gets the subprotocol the owner selected; the reconnect token
+	// follows in-band like any other message
+	var upgradeHeader http.Header
+	if protocol := ownerConn.Subprotocol(); protocol != "" {
+		upgradeHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+	clientConn, err := clientUpgrader(cfg).Upgrade(ctx.Writer, ctx.Request, upgradeHeader)
+	if err != nil {
+		fmt.Printf("[ERROR] Client WebSocket upgrade failed: %v\n", err)
+		return
+	}
+	defer clientConn.Close()
+
+	activeSessions.Add(1)
+	defer activeSessions.Done()
+
+	fmt.Printf("[INFO] Forwarding viewer %s to %s\n", viewerIP, owner)
+	done := make(chan error, 2)
+	go relayMessages(ownerConn, clientConn, done, true)
+	go relayMessages(clientConn, ownerConn, done, false)
+
+	select {
+	case err = <-done:
+	case <-stopping:
+		err = fmt.Errorf("proxy stopping")
+	}
+	fmt.Printf("[INFO] Forwarded viewer %s to %s disconnected: %v\n", viewerIP, owner, err)
+}
+
+// relayMessages copies messages from src to dst until src ends, then passes its
+// close frame on. With passLoss a src connection lost without one is passed on
+// as lost too, so the owner can hold a resumable session for the viewer
+func relayMessages(dst, src *websocket.Conn, done chan<- error, passLoss bool) {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			code, text := websocket.CloseGoingAway, ""
+			ce, ok := err.(*websocket.CloseError)
+			if ok && ce.Code != websocket.CloseNoStatusReceived && ce.Code != websocket.CloseAbnormalClosure {
+				code, text = ce.Code, ce.Text
+			} else if passLoss && (!ok || ce.Code == websocket.CloseAbnormalClosure) {
+				dst.Close()
+				done <- err
+				return
+			}
+			dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+			done <- err
+			return
+		}
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			done <- err
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Longest answer read from a peer, well above any session list
+const maxPeerResponse = 8 << 20
+
+// peerResponse is the answer of one cluster node to a forwarded control API call
+type peerResponse struct {
+	node   string
+	status int
+	body   []byte
+	err    error
+}
+
+// decode checks the peer answered 200 and unmarshals its body into v
+func (pr *peerResponse) decode(v interface{}) error {
+	if pr.err != nil {
+		return pr.err
+	}
+	if pr.status != http.StatusOK {
+		return fmt.Errorf("status %d", pr.status)
+	}
+	return json.Unmarshal(pr.body, v)
+}
+
+// clusterWide reports whether a control API call asks for every node with ?cluster=true
+func clusterWide(cfg *Config, c *gin.Context) bool {
+	return cfg.SelfURL != "" && c.Query("cluster") == "true"
+}
+
+// askPeers sends a control API call to every other cluster node in parallel
+// with the caller's API key; without ?cluster the peers answer for themselves
+func askPeers(cfg *Config, c *gin.Context, method, path string) []peerResponse {
+	others := peers.Others(cfg.SelfURL)
+	out := make([]peerResponse, len(others))
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	var wg sync.WaitGroup
+	for i, node := range others {
+		out[i].node = node
+		wg.Add(1)
+		go func(pr *peerResponse) {
+			defer wg.Done()
+			req, err := http.NewRequest(method, pr.node+path, nil)
+			if err != nil {
+				pr.err = err
+				return
+			}
+			req.Header.Set("X-API-Key", c.GetHeader("X-API-Key"))
+			resp, err := client.Do(req)
+			if err != nil {
+				pr.err = err
+				return
+			}
+			defer resp.Body.Close()
+			pr.status = resp.StatusCode
+			pr.body, pr.err = io.ReadAll(io.LimitReader(resp.Body, maxPeerResponse))
+		}(&out[i])
+	}
+	wg.Wait()
+	return out
+}
+
+// clusterSessions adds the sessions of the other nodes to the local list,
+// returning the nodes that could not be asked
+func clusterSessions(cfg *Config, c *gin.Context, list []SessionInfo) ([]SessionInfo, []string) {
+	for i := range list {
+		list[i].Node = cfg.SelfURL
+	}
+	unreachable := []string{}
+	for _, pr := range askPeers(cfg, c, http.MethodGet, "/api/sessions") {
+		var body struct {
+			Sessions []SessionInfo `json:"sessions"`
+		}
+		if err := pr.decode(&body); err != nil {
+			fmt.Printf("[WARN] Cluster node %s did not list its sessions: %v\n", pr.node, err)
+			unreachable = append(unreachable, pr.node)
+			continue
+		}
+		for _, s := range body.Sessions {
+			s.Node = pr.node
+			list = append(list, s)
+		}
+	}
+	return list, unreachable
+}
+
+// killOnPeers asks the other nodes to kill session id, returning the node that held it
+func killOnPeers(cfg *Config, c *gin.Context, id string) string {
+	for _, pr := range askPeers(cfg, c, http.MethodDelete, "/api/sessions/"+id) {
+		switch {
+		case pr.err != nil:
+			fmt.Printf("[WARN] Cluster node %s could not be asked to kill session %s: %v\n", pr.node, id, pr.err)
+		case pr.status == http.StatusOK:
+			return pr.node
+		case pr.status != http.StatusNotFound:
+			fmt.Printf("[WARN] Cluster node %s refused to kill session %s: status %d\n", pr.node, id, pr.status)
+		}
+	}
+	return ""
+}
+
+// clusterTotals is what /api/metrics?cluster=true adds up across nodes
+type clusterTotals struct {
+	Nodes      int                         `json:"nodes"`
+	Sessions   int                         `json:"sessions"`
+	Principals map[string]*principalTotals `json:"principals"`
+}
+
+// principalTotals are the counters of one principal summed over the cluster
+type principalTotals struct {
+	Registrations int64 `json:"registrations"`
+	Sessions      int64 `json:"sessions"`
+}
+
+// add counts the metrics one node reported
+func (t *clusterTotals) add(body []byte) error {
+	var m struct {
+		Sessions   int                        `json:"sessions"`
+		Principals map[string]principalTotals `json:"principals"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return err
+	}
+	t.Nodes++
+	t.Sessions += m.Sessions
+	for name, p := range m.Principals {
+		sum := t.Principals[name]
+		if sum == nil {
+			sum = &principalTotals{}
+			t.Principals[name] = sum
+		}
+		sum.Registrations += p.Registrations
+		sum.Sessions += p.Sessions
+	}
+	return nil
+}
+
+// clusterMetrics collects the metrics of every node next to their totals;
+// latency percentiles can't be added up and are only reported per node
+func clusterMetrics(cfg *Config, c *gin.Context, local gin.H) gin.H {
+	totals := &clusterTotals{Principals: make(map[string]*principalTotals)}
+	nodes := make(map[string]json.RawMessage)
+	unreachable := []string{}
+
+	body, _ := json.Marshal(local)
+	totals.add(body)
+	nodes[cfg.SelfURL] = body
+
+	for _, pr := range askPeers(cfg, c, http.MethodGet, "/api/metrics") {
+		var raw json.RawMessage
+		err := pr.decode(&raw)
+		if err == nil {
+			err = totals.add(raw)
+		}
+		if err != nil {
+			fmt.Printf("[WARN] Cluster node %s did not report its metrics: %v\n", pr.node, err)
+			unreachable = append(unreachable, pr.node)
+			continue
+		}
+		nodes[pr.node] = raw
+	}
+	return gin.H{"totals": totals, "nodes": nodes, "unreachable": unreachable}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Modes for -client_compression and -backend_compression
+const (
+	compressionOff     = "off"
+	compressionDeflate = "deflate"
+)
+
+func validCompression(mode string) bool {
+	return mode == compressionOff || mode == compressionDeflate
+}
+
+// offersDeflate reports whether handshake headers carry permessage-deflate, i.e.
+// the viewer offered it or the backend accepted it
+func offersDeflate(h http.Header) bool {
+	for _, ext := range h["Sec-Websocket-Extensions"] {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// setupCompression configures each leg for what it negotiated. Messages are
+// decompressed when read, so a leg without deflate still gets plain frames and
+// a leg with it gets compressed ones whatever the other side does
+func (s *vncSession) setupCompression(r *http.Request, clientConn, backendConn *websocket.Conn) {
+	cfg := s.cfg
+	client := cfg.ClientCompression == compressionDeflate && offersDeflate(r.Header)
+	backend := cfg.BackendCompression == compressionDeflate && s.backendDeflate
+
+	for _, leg := range []struct {
+		conn *websocket.Conn
+		on   bool
+	}{{clientConn, client}, {backendConn, backend}} {
+		leg.conn.EnableWriteCompression(leg.on)
+		if leg.on {
+			leg.conn.SetCompressionLevel(cfg.CompressionLevel)
+		}
+	}
+
+	if cfg.Debug || client != backend {
+		fmt.Printf("[INFO] Compression: client=%v backend=%v\n", client, backend)
+	}
+}
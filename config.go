@@ -1,16 +1,154 @@
 package main
 
 import (
+	"crypto/cipher"
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	PuqcloudIP string
-	ApiKey     string
-	Port       int
-	Debug      bool
+	PuqcloudIP      string
+	AllowedNetworks []*net.IPNet
+	APIKeys         *KeyRing
+	AdminKeys       []string
+	ListenAddr      string
+	Port            int
+	APIListen       string
+	Debug           bool
+	PprofPort       int
+
+	ProxyProtocol  bool
+	TrustedProxies []string
+
+	FirstFrameSLO time.Duration
+
+	HandshakeMessages     int
+	HandshakeReadTimeout  time.Duration
+	HandshakeWriteTimeout time.Duration
+
+	FrameAncestors string
+	HSTSMaxAge     int
+
+	EmbedOrigins []string
+	NoVNCBase    string
+
+	ClockSkew      time.Duration
+	NTPServer      string
+	NTPInterval    time.Duration
+	ClockDriftWarn time.Duration
+
+	HoneypotPaths  []string
+	BanDuration    time.Duration
+	HashFailLimit  int
+	HashFailWindow time.Duration
+
+	ReconnectWindow  time.Duration
+	ReconnectRate    float64
+	ReconnectBurst   int
+	ReconnectWebhook string
+
+	CaptureDir    string
+	CaptureFrames int
+	CaptureWindow time.Duration
+
+	TranscriptDir   string
+	TranscriptIndex bool
+	RecordingDir    string
+
+	RecordingS3Endpoint  string
+	RecordingS3Bucket    string
+	RecordingS3Prefix    string
+	RecordingS3Region    string
+	RecordingS3AccessKey string
+	RecordingS3SecretKey string
+
+	RecordingMaxAge            time.Duration
+	RecordingMaxBytes          int64
+	RecordingRetentionInterval time.Duration
+
+	TTL           time.Duration
+	MaxTTL        time.Duration
+	SlidingTTL    bool
+	Store         string
+	EtcdEndpoints []string
+	EtcdPrefix    string
+	RedisURL      string
+	RedisPrefix   string
+	StateFile     string
+	CredentialKey *credentialSealer
+	StatelessKey  cipher.AEAD
+
+	StatelessReplayWindow time.Duration
+
+	SelfURL        string
+	Peers          []string
+	PeersSRV       string
+	ClusterRouting string
+
+	TargetTemplate      string
+	RenewTickets        bool
+	BackendProbeTimeout time.Duration
+	BackendDialRetries  int
+	BackendDialBackoff  time.Duration
+	TCPBackends         bool
+
+	TLSCert         string
+	TLSKey          string
+	ClientCA        string
+	ClientCertMode  string
+	GRPCListen      string
+	SpiceListen     string
+	SpiceProxyURL   string
+	NativeVNCListen string
+
+	SigningSecret   string
+	SignatureWindow time.Duration
+
+	ExternalURL         string
+	Namespaces          map[string]*Namespace
+	KeyQuotas           map[string]*KeyQuota
+	GeneratedHashesOnly bool
+	DuplicateSessions   string
+	MaxViewers          int
+	MaxConnsPerIP       int
+	FanoutInputIdle     time.Duration
+	IdleTimeout         time.Duration
+	IdleWarning         time.Duration
+	ResumeGrace         time.Duration
+	BlockClipboard      bool
+	MaxClipboardBytes   int
+	ClipboardOversize   string
+	BlockedKeys         []string
+
+	RegisterRate        float64
+	RegisterBurst       int
+	RegisterGlobalRate  float64
+	RegisterGlobalBurst int
+
+	WebAuthn        *WebAuthn
+	WebAuthnOrigin  string
+	AdminSessionTTL time.Duration
+
+	SessionWebhooks []string
+
+	UsageURL      string
+	UsageSecret   string
+	UsageSpoolDir string
+
+	AnomalyWebhook   string
+	AnomalyWindow    time.Duration
+	AnomalyWindows   int
+	AnomalyInputRate int
+	AnomalyEntropy   float64
+
+	ClientCompression  string
+	BackendCompression string
+	CompressionLevel   int
 }
 
 // ParseFlags parses CLI flags and returns a Config struct
@@ -18,12 +156,126 @@ func ParseFlags() *Config {
 	cfg := &Config{}
 
 	// Flags
-	puqcloudIP := flag.String("puqcloud_ip", "", "IP address of PUQcloud (required)")
-	apiKey := flag.String("api_key", "", "API key for authentication (required)")
+	puqcloudIP := flag.String("puqcloud_ip", "", "IP address of PUQcloud (required unless -allowed_networks is set)")
+	allowedNetworks := flag.String("allowed_networks", "", "Comma separated CIDRs allowed to use the control API, e.g. 10.0.0.0/8,192.0.2.5/32 (optional)")
+	apiKey := flag.String("api_key", "", "API key for authentication, plaintext or sha256:<salt>:<hash> from vncwebproxy hash-key, labelled \"default\" (required unless -api_keys or -api_keys_file is set)")
+	apiKeys := flag.String("api_keys", "", "Comma separated label:key pairs of additional API keys (optional)")
+	apiKeysFile := flag.String("api_keys_file", "", "File with one label:key API key per line (optional)")
+	adminKeys := flag.String("admin_keys", "", "Comma separated API key labels (or cert:<CN> principals) allowed to manage keys through /api/keys, none when empty (optional)")
+	listenAddr := flag.String("listen_addr", "", "Address to bind, e.g. 127.0.0.1 or ::1 (optional, default: all interfaces)")
 	port := flag.Int("port", 8080, "Port for the proxy (optional, default: 8080)")
+	apiListen := flag.String("api_listen", "", "Separate host:port for the /api control endpoints, e.g. 10.0.0.5:8081 (optional)")
+	proxyProtocol := flag.Bool("proxy_protocol", false, "Require a HAProxy PROXY protocol v1/v2 header on incoming connections (optional)")
+	trustedProxies := flag.String("trusted_proxies", "127.0.0.1,::1", "Comma separated reverse proxy IPs/CIDRs whose X-Forwarded-For is honored, empty trusts none (optional)")
 	debug := flag.Bool("debug", false, "Enable debug mode (optional)")
+	pprofPort := flag.Int("pprof", 0, "Serve pprof on 127.0.0.1:<port> (optional, disabled by default)")
+	firstFrameSLO := flag.Duration("first_frame_slo", 0, "Log sessions whose first frame takes longer than this (optional, e.g. 2s)")
+	frameAncestors := flag.String("frame_ancestors", "'self'", "CSP frame-ancestors sources allowed to embed the console, space separated (optional)")
+	hstsMaxAge := flag.Int("hsts_max_age", 31536000, "Strict-Transport-Security max-age in seconds, 0 disables (optional)")
+	embedOrigins := flag.String("embed_origins", "", "Comma separated panel origins allowed to start the /embed console via postMessage (optional)")
+	noVNCBase := flag.String("novnc_base", "/", "URL path where noVNC is served, used by the /embed page (optional)")
+	clockSkew := flag.Duration("clock_skew", 30*time.Second, "Clock skew tolerated when checking expiry times from PUQcloud (optional)")
+	ntpServer := flag.String("ntp_server", "", "NTP server used to monitor local clock drift, e.g. pool.ntp.org (optional)")
+	ntpInterval := flag.Duration("ntp_interval", 10*time.Minute, "How often to check clock drift against -ntp_server (optional)")
+	clockDriftWarn := flag.Duration("clock_drift_warn", 2*time.Second, "Warn when the local clock drifts more than this (optional)")
+	honeypotPaths := flag.String("honeypot_paths", "", "Comma separated decoy paths that ban the requesting IP, e.g. /admin.php,/vncproxy/test (optional)")
+	banDuration := flag.Duration("ban_duration", time.Hour, "How long banned IPs are blocked (optional)")
+	captureDir := flag.String("capture_dir", "", "Directory for debug captures of sessions that fail early (optional)")
+	captureFrames := flag.Int("capture_frames", 20, "Number of frames kept in a debug capture (optional)")
+	transcriptDir := flag.String("transcript_dir", "", "Directory for text transcripts of xterm console sessions (optional)")
+	recordingDir := flag.String("recording_dir", "", "Directory for FBS recordings of VNC sessions registered with record (optional)")
+	recordingS3Endpoint := flag.String("recording_s3_endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint recordings are uploaded to, e.g. http://minio:9000 (optional)")
+	recordingS3Bucket := flag.String("recording_s3_bucket", "", "Bucket finished recordings are uploaded to, then deleted locally (optional)")
+	recordingS3Prefix := flag.String("recording_s3_prefix", "", "Prefix of uploaded recording object names, e.g. vnc/node1/ (optional)")
+	recordingS3Region := flag.String("recording_s3_region", "us-east-1", "Region requests to -recording_s3_endpoint are signed for (optional)")
+	recordingS3AccessKey := flag.String("recording_s3_access_key", "", "Access key ID for -recording_s3_bucket (optional)")
+	recordingS3SecretKeyFile := flag.String("recording_s3_secret_key_file", "", "File containing the secret access key for -recording_s3_bucket (optional)")
+	recordingMaxAge := flag.Duration("recording_max_age", 0, "Delete recordings, local and uploaded, older than this, e.g. 720h (optional)")
+	recordingMaxBytes := flag.Int64("recording_max_bytes", 0, "Delete the oldest recordings once -recording_dir, and separately the bucket, hold more than this many bytes (optional)")
+	recordingRetentionInterval := flag.Duration("recording_retention_interval", time.Hour, "How often -recording_max_age and -recording_max_bytes are applied (optional)")
+	transcriptIndexFlag := flag.Bool("transcript_index", false, "Keep a full-text index of -transcript_dir for /api/history/search (optional)")
+	captureWindow := flag.Duration("capture_window", 10*time.Second, "Sessions ending within this time are written to -capture_dir (optional)")
+	ttl := flag.Duration("ttl", time.Minute, "How long a registered hash remains connectable (optional)")
+	maxTTL := flag.Duration("max_ttl", time.Hour, "Longest ttl_seconds a registration may request (optional)")
+	slidingTTL := flag.Bool("sliding_ttl", false, "Restart a hash's TTL whenever it is used and while its session runs (optional)")
+	store := flag.String("store", "memory", "Where registered consoles are kept: memory, etcd or redis (optional)")
+	etcdEndpoints := flag.String("etcd_endpoints", "", "Comma separated etcd endpoints for -store=etcd, e.g. http://10.0.0.5:2379 (optional)")
+	etcdPrefix := flag.String("etcd_prefix", "/vncwebproxy/entries/", "Key prefix used in etcd (optional)")
+	redisURL := flag.String("redis_url", "", "Redis for -store=redis, e.g. redis://:password@10.0.0.5:6379/0 or rediss:// for TLS (optional)")
+	redisPrefix := flag.String("redis_prefix", "vncwebproxy:entries:", "Key prefix used in Redis (optional)")
+	stateFile := flag.String("state_file", "", "Save registrations of the memory store here on shutdown and restore them on startup (optional)")
+	credentialsKeyFile := flag.String("credentials_key_file", "", "File with a 64 hex character AES-256 key encrypting Proxmox credentials in etcd, Redis and -state_file (optional)")
+	statelessKeyFile := flag.String("stateless_key_file", "", "File with a 64 hex character AES-256 key shared with PUQcloud to accept stateless console tokens (optional)")
+	statelessReplayWindow := flag.Duration("stateless_replay_window", 0, "Accept each stateless token once; tokens may expire at most this far ahead, e.g. 2m (optional)")
+	clusterRouting := flag.String("cluster_routing", "redirect", "How viewers of hashes owned by another cluster node reach it: redirect (307) or forward (relayed WebSocket) (optional)")
+	targetTemplate := flag.String("target_url_template", defaultTargetTemplate, "Backend URL of registrations by node and vmid, with {host} {node} {vmtype} {vmid} {port} {vncticket} (optional)")
+	renewTickets := flag.Bool("renew_tickets", true, "Request a fresh VNC ticket with the registration's API token when its ticket was used or is refused (optional)")
+	backendProbeTimeout := flag.Duration("backend_probe_timeout", 0, "Check the backend accepts TCP and TLS within this time before upgrading a viewer, 0 disables (optional)")
+	backendDialRetries := flag.Int("backend_dial_retries", 0, "Dial the backend again this many times when the connection or TLS handshake fails (optional)")
+	backendDialBackoff := flag.Duration("backend_dial_backoff", 500*time.Millisecond, "Wait before the first backend dial retry, doubled for each further one (optional)")
+	tcpBackends := flag.Bool("tcp_backends", false, "Accept tcp://host:port backends, raw VNC servers the proxy bridges like websockify (optional)")
+	selfURL := flag.String("self_url", "", "Public base URL of this node in a cluster, e.g. https://vnc1.example.com (optional)")
+	peerList := flag.String("peers", "", "Comma separated base URLs of the other cluster nodes (optional)")
+	peersSRV := flag.String("peers_srv", "", "DNS SRV name to discover cluster nodes, e.g. _vncwebproxy._tcp.example.com (optional)")
+	tlsCert := flag.String("tls_cert", "", "Certificate to serve the /api listener over TLS, needed for client certificates (optional)")
+	tlsKey := flag.String("tls_key", "", "Private key for -tls_cert (optional)")
+	clientCA := flag.String("client_ca", "", "CA bundle that /api client certificates must be signed by (optional)")
+	clientCertMode := flag.String("client_cert", "", "Client certificate authentication for /api: required (with the API key) or alternative (instead of it) (optional)")
+	signingSecret := flag.String("signing_secret", "", "Shared secret; when set POST /api/proxy must carry an HMAC-SHA256 X-Signature (optional)")
+	signingSecretFile := flag.String("signing_secret_file", "", "File containing -signing_secret (optional)")
+	signatureWindow := flag.Duration("signature_window", 5*time.Minute, "Maximum age of a signed registration (optional)")
+	grpcListen := flag.String("grpc_listen", "", "host:port for the gRPC control API, requires -tls_cert and -client_ca (optional)")
+	spiceListen := flag.String("spice_listen", "", "host:port of the HTTP CONNECT proxy tunneling SPICE consoles to Proxmox's spiceproxy, e.g. :3128 (optional)")
+	spicePublicURL := flag.String("spice_proxy_url", "", "Public URL of -spice_listen written to .vv files, e.g. http://vnc.example.com:3128 (optional)")
+	nativeVNCListen := flag.String("native_vnc_listen", "", "host:port where native VNC viewers connect to native_vnc registrations with their password, e.g. :5900 (optional)")
+	registerRate := flag.Float64("register_rate", 0, "Registrations per second allowed per controller IP, 0 disables (optional)")
+	registerBurst := flag.Int("register_burst", 20, "Registrations a controller IP may send at once (optional)")
+	registerGlobalRate := flag.Float64("register_global_rate", 0, "Registrations per second allowed in total, 0 disables (optional)")
+	registerGlobalBurst := flag.Int("register_global_burst", 100, "Registrations accepted at once in total (optional)")
+	hashFailLimit := flag.Int("hash_fail_limit", 20, "Unknown /vncproxy hashes from one IP within -hash_fail_window before it is banned, 0 disables (optional)")
+	hashFailWindow := flag.Duration("hash_fail_window", time.Minute, "Window for -hash_fail_limit (optional)")
+	namespacesFile := flag.String("namespaces_file", "", "JSON file defining hash namespaces with their API keys and policies (optional)")
+	keyQuotasFile := flag.String("key_quotas_file", "", "JSON file of registrations per minute and concurrent sessions allowed per API key label (optional)")
+	generatedHashesOnly := flag.Bool("generated_hashes_only", false, "Reject caller-supplied hashes, registrations must let the proxy generate one (optional)")
+	handshakeMessages := flag.Int("handshake_messages", 3, "Messages each side must send before handshake deadlines are lifted, 0 disables (optional)")
+	handshakeReadTimeout := flag.Duration("handshake_read_timeout", 15*time.Second, "Time each side has to send its handshake messages (optional)")
+	handshakeWriteTimeout := flag.Duration("handshake_write_timeout", 10*time.Second, "Write deadline during the handshake phase (optional)")
+	externalURL := flag.String("external_url", "", "Public base URL of the viewer WebSocket, e.g. wss://vnc.example.com, returned with registrations (optional)")
+	maxViewers := flag.Int("max_viewers", 1, "Simultaneous viewers of one hash unless its registration sets max_viewers, 0 for no limit (optional)")
+	maxConnsPerIP := flag.Int("max_conns_per_ip", 0, "Concurrent /vncproxy connections one viewer IP may hold, 0 for no limit (optional)")
+	duplicateSessions := flag.String("duplicate_sessions", duplicateAllow, "When a hash is opened again while its session is live: allow, reject, replace, share (view-only) or fanout (optional)")
+	blockClipboard := flag.Bool("block_clipboard", false, "Strip clipboard messages from every VNC session, regardless of block_clipboard in registrations (optional)")
+	maxClipboardBytes := flag.Int("max_clipboard_bytes", 0, "Longest clipboard text passed between viewer and VM unless the registration sets max_clipboard_bytes, 0 for no limit (optional)")
+	clipboardOversize := flag.String("clipboard_oversize", clipboardTruncate, "What happens to clipboard text over the limit: truncate or drop (optional)")
+	blockedKeys := flag.String("blocked_keys", "", "Comma-separated key combinations dropped from VNC sessions unless the registration sets blocked_keys, e.g. ctrl+alt+delete,ctrl+alt+f* (optional)")
+	idleTimeout := flag.Duration("idle_timeout", 0, "Disconnect viewers that send no input for this long unless the registration sets idle_timeout_seconds, 0 disables (optional)")
+	idleWarning := flag.Duration("idle_warning", 0, "Ring the VNC viewer's bell this long before an idle disconnect, 0 disables (optional)")
+	resumeGrace := flag.Duration("resume_grace", 0, "How long a VNC session whose viewer lost its connection waits for it to come back with its reconnect token, 0 disables (optional)")
+	fanoutInputIdle := flag.Duration("fanout_input_idle", 3*time.Second, "How long the fanout viewer in control must be idle before another viewer's input is accepted (optional)")
+	webauthnRPID := flag.String("webauthn_rp_id", "", "WebAuthn relying party ID, e.g. vnc.example.com; when set killing sessions needs an admin session (optional)")
+	webauthnOrigin := flag.String("webauthn_origin", "", "Origin operators open /admin/webauthn from, e.g. https://vnc.example.com (required with -webauthn_rp_id)")
+	webauthnCredentials := flag.String("webauthn_credentials_file", "webauthn_credentials.json", "File where enrolled admin authenticators are kept (optional)")
+	adminSessionTTL := flag.Duration("admin_session_ttl", 15*time.Minute, "How long a WebAuthn admin session lasts (optional)")
+	sessionWebhooks := flag.String("session_webhooks", "", "Comma separated URLs that receive a JSON event when a session starts, ends or fails (optional)")
+	usageURL := flag.String("usage_url", "", "PUQcloud endpoint that receives a signed usage record of every closed session for billing (optional)")
+	usageSecretFile := flag.String("usage_secret_file", "", "File containing the secret usage records are signed with, default -signing_secret (optional)")
+	usageSpoolDir := flag.String("usage_spool_dir", "usage_spool", "Directory where usage records that could not be delivered wait to be resent (optional)")
+	anomalyWebhook := flag.String("anomaly_webhook", "", "URL that receives a JSON alert when a session's input looks like data exfiltration (optional)")
+	anomalyWindow := flag.Duration("anomaly_window", 30*time.Second, "Length of the windows input traffic is profiled in (optional)")
+	anomalyWindows := flag.Int("anomaly_windows", 3, "Suspicious windows in a row before an alert is sent (optional)")
+	anomalyInputRate := flag.Int("anomaly_input_rate", 100, "Typed or pasted bytes per second that make a window suspicious (optional)")
+	anomalyEntropy := flag.Float64("anomaly_entropy", 3.5, "Minimum entropy in bits per byte of that input, lower looks like prose or a held key (optional)")
+	clientCompression := flag.String("client_compression", compressionOff, "permessage-deflate towards viewers: off or deflate (optional)")
+	backendCompression := flag.String("backend_compression", compressionOff, "permessage-deflate towards Proxmox: off or deflate (optional)")
+	compressionLevel := flag.Int("compression_level", 1, "Deflate level 1-9 for legs that negotiated compression (optional)")
+	reconnectWindow := flag.Duration("reconnect_window", 0, "After startup, treat unknown hashes as viewers of dropped entries for this long, e.g. 5m (optional)")
+	reconnectRate := flag.Float64("reconnect_rate", 0.2, "Unknown-hash reconnects per second allowed per viewer IP during -reconnect_window (optional)")
+	reconnectBurst := flag.Int("reconnect_burst", 3, "Burst for -reconnect_rate (optional)")
+	reconnectWebhook := flag.String("reconnect_webhook", "", "URL that receives batches of hashes viewers tried to reopen during -reconnect_window (optional)")
 	showVersion := flag.Bool("v", false, "Show version and exit")
 
+	registerDeprecatedFlags(flag.CommandLine)
+
 	// Custom usage message
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: vncwebproxy [options]\n\n")
@@ -38,12 +290,13 @@ func ParseFlags() *Config {
 	// Version check
 	if *showVersion {
 		fmt.Println("Proxy version:", Version)
+		fmt.Println("Features:", featureList())
 		os.Exit(0)
 	}
 
 	// Required flags validation
-	if *puqcloudIP == "" || *apiKey == "" {
-		fmt.Println("Error: -puqcloud_ip and -api_key are required")
+	if (*puqcloudIP == "" && *allowedNetworks == "") || (*apiKey == "" && *apiKeys == "" && *apiKeysFile == "") {
+		fmt.Println("Error: -puqcloud_ip (or -allowed_networks) and -api_key (or -api_keys/-api_keys_file) are required")
 		fmt.Println()
 		flag.Usage()
 		os.Exit(1)
@@ -51,9 +304,411 @@ func ParseFlags() *Config {
 
 	// Fill config struct
 	cfg.PuqcloudIP = *puqcloudIP
-	cfg.ApiKey = *apiKey
+	networks := splitList(*allowedNetworks)
+	if *puqcloudIP != "" {
+		networks = append(networks, *puqcloudIP)
+	}
+	for _, n := range networks {
+		ipNet, err := parseNetwork(n)
+		if err != nil {
+			fmt.Printf("Error: invalid network %q: %v\n", n, err)
+			os.Exit(1)
+		}
+		cfg.AllowedNetworks = append(cfg.AllowedNetworks, ipNet)
+	}
+	var keys []APIKey
+	if *apiKey != "" {
+		keys = append(keys, APIKey{Label: "default", Key: *apiKey})
+	}
+	extra, err := parseAPIKeys(*apiKeys)
+	if err != nil {
+		fmt.Printf("Error: invalid -api_keys: %v\n", err)
+		os.Exit(1)
+	}
+	keys = append(keys, extra...)
+	var fromFile []APIKey
+	if *apiKeysFile != "" {
+		fromFile, err = loadAPIKeysFile(*apiKeysFile)
+		if err != nil {
+			fmt.Printf("Error: invalid -api_keys_file: %v\n", err)
+			os.Exit(1)
+		}
+		keys = append(keys, fromFile...)
+	}
+	if cfg.APIKeys, err = NewKeyRing(keys); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *apiKeysFile != "" {
+		cfg.APIKeys.Persist(*apiKeysFile, fromFile)
+	}
+	cfg.AdminKeys = splitList(*adminKeys)
+	cfg.ListenAddr = *listenAddr
 	cfg.Port = *port
+	cfg.APIListen = *apiListen
+	cfg.ProxyProtocol = *proxyProtocol
+	cfg.TrustedProxies = splitList(*trustedProxies)
 	cfg.Debug = *debug
+	cfg.PprofPort = *pprofPort
+	cfg.FirstFrameSLO = *firstFrameSLO
+	cfg.HandshakeMessages = *handshakeMessages
+	cfg.HandshakeReadTimeout = *handshakeReadTimeout
+	cfg.HandshakeWriteTimeout = *handshakeWriteTimeout
+	cfg.FrameAncestors = *frameAncestors
+	cfg.HSTSMaxAge = *hstsMaxAge
+	cfg.EmbedOrigins = splitList(*embedOrigins)
+	cfg.NoVNCBase = *noVNCBase
+	if !strings.HasSuffix(cfg.NoVNCBase, "/") {
+		cfg.NoVNCBase += "/"
+	}
+	cfg.ClockSkew = *clockSkew
+	cfg.NTPServer = *ntpServer
+	cfg.NTPInterval = *ntpInterval
+	if cfg.NTPInterval <= 0 {
+		fmt.Println("Error: -ntp_interval must be positive")
+		os.Exit(1)
+	}
+	cfg.ClockDriftWarn = *clockDriftWarn
+	cfg.HoneypotPaths = splitList(*honeypotPaths)
+	cfg.BanDuration = *banDuration
+	cfg.HashFailLimit = *hashFailLimit
+	cfg.HashFailWindow = *hashFailWindow
+	cfg.ReconnectWindow = *reconnectWindow
+	cfg.ReconnectRate = *reconnectRate
+	cfg.ReconnectBurst = *reconnectBurst
+	cfg.ReconnectWebhook = *reconnectWebhook
+	cfg.CaptureDir = *captureDir
+	if cfg.CaptureDir != "" {
+		requireFeature(featureRecording, "-capture_dir", "norecording")
+	}
+	cfg.CaptureFrames = *captureFrames
+	cfg.CaptureWindow = *captureWindow
+	cfg.TranscriptDir = *transcriptDir
+	if cfg.TranscriptDir != "" {
+		requireFeature(featureRecording, "-transcript_dir", "norecording")
+	}
+	cfg.RecordingDir = *recordingDir
+	if cfg.RecordingDir != "" {
+		requireFeature(featureRecording, "-recording_dir", "norecording")
+	}
+	cfg.RecordingS3Endpoint = strings.TrimSuffix(*recordingS3Endpoint, "/")
+	cfg.RecordingS3Bucket = *recordingS3Bucket
+	cfg.RecordingS3Prefix = *recordingS3Prefix
+	cfg.RecordingS3Region = *recordingS3Region
+	cfg.RecordingS3AccessKey = *recordingS3AccessKey
+	if cfg.RecordingS3Bucket != "" {
+		if cfg.RecordingDir == "" {
+			fmt.Println("Error: -recording_s3_bucket requires -recording_dir")
+			os.Exit(1)
+		}
+		if u, err := url.Parse(cfg.RecordingS3Endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			fmt.Println("Error: -recording_s3_endpoint must be an http:// or https:// URL")
+			os.Exit(1)
+		}
+		secret, err := os.ReadFile(*recordingS3SecretKeyFile)
+		if err != nil || cfg.RecordingS3AccessKey == "" {
+			fmt.Println("Error: -recording_s3_bucket requires -recording_s3_access_key and a readable -recording_s3_secret_key_file")
+			os.Exit(1)
+		}
+		cfg.RecordingS3SecretKey = strings.TrimSpace(string(secret))
+	}
+	cfg.RecordingMaxAge = *recordingMaxAge
+	cfg.RecordingMaxBytes = *recordingMaxBytes
+	cfg.RecordingRetentionInterval = *recordingRetentionInterval
+	if (cfg.RecordingMaxAge > 0 || cfg.RecordingMaxBytes > 0) && cfg.RecordingDir == "" {
+		fmt.Println("Error: -recording_max_age and -recording_max_bytes require -recording_dir")
+		os.Exit(1)
+	}
+	if cfg.RecordingMaxAge < 0 || cfg.RecordingMaxBytes < 0 || cfg.RecordingRetentionInterval < time.Minute {
+		fmt.Println("Error: -recording_max_age and -recording_max_bytes must not be negative, -recording_retention_interval must be at least 1m")
+		os.Exit(1)
+	}
+	cfg.TranscriptIndex = *transcriptIndexFlag
+	if cfg.TranscriptIndex && cfg.TranscriptDir == "" {
+		fmt.Println("Error: -transcript_index requires -transcript_dir")
+		os.Exit(1)
+	}
+	cfg.TTL = *ttl
+	if cfg.TTL < time.Second {
+		fmt.Println("Error: -ttl must be at least 1s")
+		os.Exit(1)
+	}
+	cfg.MaxTTL = *maxTTL
+	cfg.SlidingTTL = *slidingTTL
+	cfg.Store = *store
+	cfg.EtcdEndpoints = splitList(*etcdEndpoints)
+	cfg.EtcdPrefix = *etcdPrefix
+	cfg.RedisURL = *redisURL
+	cfg.RedisPrefix = *redisPrefix
+	cfg.StateFile = *stateFile
+	if cfg.StateFile != "" && cfg.Store != "" && cfg.Store != "memory" {
+		fmt.Println("Error: -state_file only applies to -store=memory, the other stores keep registrations themselves")
+		os.Exit(1)
+	}
+	if *credentialsKeyFile != "" {
+		key, err := loadCredentialKey(*credentialsKeyFile)
+		if err != nil {
+			fmt.Printf("Error: failed to load -credentials_key_file: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.CredentialKey = key
+	}
+	if *statelessKeyFile != "" {
+		key, err := loadStatelessKey(*statelessKeyFile)
+		if err != nil {
+			fmt.Printf("Error: failed to load -stateless_key_file: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.StatelessKey = key
+	}
+	cfg.StatelessReplayWindow = *statelessReplayWindow
+	if cfg.StatelessReplayWindow > 0 && cfg.StatelessReplayWindow < cfg.ClockSkew {
+		fmt.Println("Error: -stateless_replay_window must be at least -clock_skew")
+		os.Exit(1)
+	}
+	cfg.SelfURL = strings.TrimSuffix(*selfURL, "/")
+	for _, p := range splitList(*peerList) {
+		cfg.Peers = append(cfg.Peers, strings.TrimSuffix(p, "/"))
+	}
+	cfg.PeersSRV = *peersSRV
+	cfg.ClusterRouting = *clusterRouting
+	cfg.TargetTemplate = *targetTemplate
+	cfg.RenewTickets = *renewTickets
+	cfg.BackendProbeTimeout = *backendProbeTimeout
+	if cfg.BackendProbeTimeout < 0 {
+		fmt.Println("Error: -backend_probe_timeout must not be negative")
+		os.Exit(1)
+	}
+	cfg.TCPBackends = *tcpBackends
+	cfg.BackendDialRetries = *backendDialRetries
+	cfg.BackendDialBackoff = *backendDialBackoff
+	if cfg.BackendDialRetries < 0 || cfg.BackendDialBackoff <= 0 {
+		fmt.Println("Error: -backend_dial_retries must not be negative and -backend_dial_backoff must be positive")
+		os.Exit(1)
+	}
+	if err := validateTargetTemplate(cfg.TargetTemplate); err != nil {
+		fmt.Printf("Error: invalid -target_url_template: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.ClusterRouting != routeRedirect && cfg.ClusterRouting != routeForward {
+		fmt.Println("Error: -cluster_routing must be redirect or forward")
+		os.Exit(1)
+	}
+	cfg.TLSCert = *tlsCert
+	cfg.TLSKey = *tlsKey
+	cfg.ClientCA = *clientCA
+	cfg.ClientCertMode = *clientCertMode
+	switch cfg.ClientCertMode {
+	case "", clientCertRequired, clientCertAlternative:
+	default:
+		fmt.Printf("Error: -client_cert must be %s or %s\n", clientCertRequired, clientCertAlternative)
+		os.Exit(1)
+	}
+	if cfg.ClientCertMode != "" && (cfg.TLSCert == "" || cfg.ClientCA == "") {
+		fmt.Println("Error: -client_cert requires -tls_cert, -tls_key and -client_ca")
+		os.Exit(1)
+	}
+	cfg.GRPCListen = *grpcListen
+	if cfg.GRPCListen != "" {
+		requireFeature(featureGRPC, "-grpc_listen", "nogrpc")
+	}
+	if cfg.GRPCListen != "" && (cfg.TLSCert == "" || cfg.ClientCA == "") {
+		fmt.Println("Error: -grpc_listen requires -tls_cert, -tls_key and -client_ca")
+		os.Exit(1)
+	}
+	cfg.SpiceListen = *spiceListen
+	cfg.NativeVNCListen = *nativeVNCListen
+	cfg.SpiceProxyURL = *spicePublicURL
+	if cfg.SpiceProxyURL != "" {
+		proxy, err := spiceProxyURL(cfg.SpiceProxyURL)
+		if err != nil || cfg.SpiceListen == "" {
+			fmt.Println("Error: -spice_proxy_url must be an http://host[:port] URL and needs -spice_listen")
+			os.Exit(1)
+		}
+		cfg.SpiceProxyURL = proxy
+	}
+	cfg.SigningSecret = *signingSecret
+	if *signingSecretFile != "" {
+		secret, err := os.ReadFile(*signingSecretFile)
+		if err != nil {
+			fmt.Printf("Error: invalid -signing_secret_file: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.SigningSecret = strings.TrimSpace(string(secret))
+	}
+	cfg.SignatureWindow = *signatureWindow
+	cfg.UsageURL = *usageURL
+	cfg.UsageSpoolDir = *usageSpoolDir
+	if cfg.UsageURL != "" {
+		if !strings.HasPrefix(cfg.UsageURL, "https://") && !strings.HasPrefix(cfg.UsageURL, "http://") {
+			fmt.Println("Error: -usage_url must be an http:// or https:// URL")
+			os.Exit(1)
+		}
+		cfg.UsageSecret = cfg.SigningSecret
+		if *usageSecretFile != "" {
+			secret, err := os.ReadFile(*usageSecretFile)
+			if err != nil {
+				fmt.Printf("Error: invalid -usage_secret_file: %v\n", err)
+				os.Exit(1)
+			}
+			cfg.UsageSecret = strings.TrimSpace(string(secret))
+		}
+		if cfg.UsageSecret == "" {
+			fmt.Println("Error: -usage_url requires -usage_secret_file or -signing_secret")
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(cfg.UsageSpoolDir, 0700); err != nil {
+			fmt.Printf("Error: invalid -usage_spool_dir: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *namespacesFile != "" {
+		if cfg.Namespaces, err = loadNamespaces(*namespacesFile); err != nil {
+			fmt.Printf("Error: invalid -namespaces_file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *keyQuotasFile != "" {
+		if cfg.KeyQuotas, err = loadKeyQuotas(*keyQuotasFile); err != nil {
+			fmt.Printf("Error: invalid -key_quotas_file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	cfg.GeneratedHashesOnly = *generatedHashesOnly
+	cfg.DuplicateSessions = *duplicateSessions
+	if !validDuplicatePolicy(cfg.DuplicateSessions) {
+		fmt.Println("Error: -duplicate_sessions must be allow, reject, replace, share or fanout")
+		os.Exit(1)
+	}
+	cfg.FanoutInputIdle = *fanoutInputIdle
+	cfg.IdleTimeout = *idleTimeout
+	cfg.IdleWarning = *idleWarning
+	if cfg.IdleTimeout < 0 || cfg.IdleWarning < 0 {
+		fmt.Println("Error: -idle_timeout and -idle_warning must not be negative")
+		os.Exit(1)
+	}
+	cfg.ResumeGrace = *resumeGrace
+	if cfg.ResumeGrace < 0 {
+		fmt.Println("Error: -resume_grace must not be negative")
+		os.Exit(1)
+	}
+	cfg.BlockClipboard = *blockClipboard
+	cfg.MaxClipboardBytes = *maxClipboardBytes
+	if cfg.MaxClipboardBytes < 0 {
+		fmt.Println("Error: -max_clipboard_bytes must not be negative")
+		os.Exit(1)
+	}
+	cfg.BlockedKeys = splitList(*blockedKeys)
+	if _, err := parseKeyRules(cfg.BlockedKeys); err != nil {
+		fmt.Printf("Error: invalid -blocked_keys: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.ClipboardOversize = *clipboardOversize
+	if cfg.ClipboardOversize != clipboardTruncate && cfg.ClipboardOversize != clipboardDrop {
+		fmt.Println("Error: -clipboard_oversize must be truncate or drop")
+		os.Exit(1)
+	}
+	cfg.MaxViewers = *maxViewers
+	if cfg.MaxViewers < 0 {
+		fmt.Println("Error: -max_viewers must not be negative")
+		os.Exit(1)
+	}
+	cfg.MaxConnsPerIP = *maxConnsPerIP
+	if cfg.MaxConnsPerIP < 0 {
+		fmt.Println("Error: -max_conns_per_ip must not be negative")
+		os.Exit(1)
+	}
+	cfg.ExternalURL = strings.TrimSuffix(*externalURL, "/")
+	if cfg.ExternalURL != "" && !strings.HasPrefix(cfg.ExternalURL, "wss://") && !strings.HasPrefix(cfg.ExternalURL, "ws://") {
+		fmt.Println("Error: -external_url must start with wss:// or ws://")
+		os.Exit(1)
+	}
+	cfg.RegisterRate = *registerRate
+	cfg.RegisterBurst = *registerBurst
+	cfg.RegisterGlobalRate = *registerGlobalRate
+	cfg.RegisterGlobalBurst = *registerGlobalBurst
+	cfg.SessionWebhooks = splitList(*sessionWebhooks)
+	for _, u := range cfg.SessionWebhooks {
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			fmt.Println("Error: -session_webhooks must be http:// or https:// URLs")
+			os.Exit(1)
+		}
+	}
+	cfg.AnomalyWebhook = *anomalyWebhook
+	cfg.AnomalyWindow = *anomalyWindow
+	cfg.AnomalyWindows = *anomalyWindows
+	cfg.AnomalyInputRate = *anomalyInputRate
+	cfg.AnomalyEntropy = *anomalyEntropy
+	if cfg.AnomalyWebhook != "" && (cfg.AnomalyWindow < time.Second || cfg.AnomalyWindows < 1) {
+		fmt.Println("Error: -anomaly_window must be at least 1s and -anomaly_windows at least 1")
+		os.Exit(1)
+	}
+	cfg.ClientCompression = *clientCompression
+	cfg.BackendCompression = *backendCompression
+	cfg.CompressionLevel = *compressionLevel
+	if !validCompression(cfg.ClientCompression) || !validCompression(cfg.BackendCompression) {
+		fmt.Println("Error: -client_compression and -backend_compression must be off or deflate")
+		os.Exit(1)
+	}
+	if cfg.CompressionLevel < 1 || cfg.CompressionLevel > 9 {
+		fmt.Println("Error: -compression_level must be between 1 and 9")
+		os.Exit(1)
+	}
+	cfg.WebAuthnOrigin = strings.TrimSuffix(*webauthnOrigin, "/")
+	cfg.AdminSessionTTL = *adminSessionTTL
+	if *webauthnRPID != "" {
+		requireFeature(featureAdminUI, "-webauthn_rp_id", "noadminui")
+		if cfg.WebAuthnOrigin == "" {
+			fmt.Println("Error: -webauthn_rp_id requires -webauthn_origin")
+			os.Exit(1)
+		}
+		if cfg.WebAuthn, err = NewWebAuthn(*webauthnRPID, cfg.WebAuthnOrigin, *webauthnCredentials, cfg.AdminSessionTTL); err != nil {
+			fmt.Printf("Error: invalid -webauthn_credentials_file: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	return cfg
 }
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseNetwork parses a CIDR, treating a bare IP as a single-host network
+func parseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("not an IP address")
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(value)
+	return ipNet, err
+}
+
+// IsControlIP reports whether ip belongs to one of the allowed PUQcloud networks
+func (cfg *Config) IsControlIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range cfg.AllowedNetworks {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
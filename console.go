@@ -0,0 +1,33 @@
+package main
+
+import "bytes"
+
+// Console types a registration can declare
+const (
+	consoleVNC   = "vnc"
+	consoleXterm = "xterm"
+	consoleSpice = "spice"
+)
+
+func validConsole(console string) bool {
+	return console == "" || console == consoleVNC || console == consoleXterm || console == consoleSpice
+}
+
+// termproxy (xterm.js) frames: the first client frame is "user:ticket\n", then
+// input is sent as "0:<length>:<data>", resizes as "1:<cols>:<rows>:" and
+// pings as "2"; the backend answers "OK" and then sends raw terminal output
+const termproxyInput = "0:"
+
+// termproxyData returns the typed data of a termproxy client frame, nil for
+// resizes and pings
+func termproxyData(msg []byte) []byte {
+	if !bytes.HasPrefix(msg, []byte(termproxyInput)) {
+		return nil
+	}
+	rest := msg[len(termproxyInput):]
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return nil
+	}
+	return rest[i+1:]
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of credential values encrypted with -credentials_key_file
+const sealedPrefix = "enc:v1:"
+
+// credentialSealer encrypts the Proxmox credentials of registrations leaving
+// the process (etcd, Redis, -state_file) with AES-256-GCM
+type credentialSealer struct {
+	aead cipher.AEAD
+}
+
+// Key set from -credentials_key_file in NewServer; nil stores credentials in clear
+var credentialKey *credentialSealer
+
+// loadCredentialKey reads a 32-byte key written as 64 hex characters, e.g. by `openssl rand -hex 32`
+func loadCredentialKey(path string) (*credentialSealer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain 64 hex characters (32 bytes)", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &credentialSealer{aead: aead}, nil
+}
+
+// seal encrypts value bound to the hash it is stored under, so sealed values
+// can't be moved to another entry
+func (cs *credentialSealer) seal(hash, value string) string {
+	if value == "" {
+		return ""
+	}
+	nonce := make([]byte, cs.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := cs.aead.Seal(nonce, nonce, []byte(value), []byte(hash))
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// open decrypts a sealed value; values stored in clear are returned as they are
+func (cs *credentialSealer) open(hash, value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	if cs == nil {
+		return "", fmt.Errorf("credentials of %s are encrypted, -credentials_key_file is needed", hashTag(hash))
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(value[len(sealedPrefix):])
+	if err != nil || len(sealed) < cs.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted credentials of %s", hashTag(hash))
+	}
+	n := cs.aead.NonceSize()
+	plain, err := cs.aead.Open(nil, sealed[:n], sealed[n:], []byte(hash))
+	if err != nil {
+		return "", fmt.Errorf("credentials of %s can't be decrypted with this key", hashTag(hash))
+	}
+	return string(plain), nil
+}
+
+// sealItem returns a copy of item with its credentials, including the URL
+// carrying the VNC ticket, encrypted for storage under hash
+func sealItem(hash string, item *ProxiedItem) *ProxiedItem {
+	if credentialKey == nil {
+		return item
+	}
+	sealed := *item
+	sealed.Token = credentialKey.seal(hash, item.Token)
+	sealed.Cookie = credentialKey.seal(hash, item.Cookie)
+	sealed.CSRFPreventionToken = credentialKey.seal(hash, item.CSRFPreventionToken)
+	sealed.URL = credentialKey.seal(hash, item.URL)
+	sealed.NativePassword = credentialKey.seal(hash, item.NativePassword)
+	sealed.VNCPassword = credentialKey.seal(hash, item.VNCPassword)
+	if len(item.FallbackURLs) > 0 {
+		sealed.FallbackURLs = make([]string, len(item.FallbackURLs))
+		for i, u := range item.FallbackURLs {
+			sealed.FallbackURLs[i] = credentialKey.seal(hash, u)
+		}
+	}
+	if item.Spice != nil {
+		spice := *item.Spice
+		spice.Host = credentialKey.seal(hash, spice.Host)
+		spice.Password = credentialKey.seal(hash, spice.Password)
+		sealed.Spice = &spice
+	}
+	return &sealed
+}
+
+// openItem decrypts the credentials of an item read from storage in place
+func openItem(hash string, item *ProxiedItem) error {
+	fields := []*string{&item.Token, &item.Cookie, &item.CSRFPreventionToken, &item.URL, &item.NativePassword, &item.VNCPassword}
+	for i := range item.FallbackURLs {
+		fields = append(fields, &item.FallbackURLs[i])
+	}
+	if item.Spice != nil {
+		fields = append(fields, &item.Spice.Host, &item.Spice.Password)
+	}
+	for _, field := range fields {
+		plain, err := credentialKey.open(hash, *field)
+		if err != nil {
+			return err
+		}
+		*field = plain
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+//go:build !noadminui
+// +build !noadminui
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Throughput samples kept for the dashboard graphs, one per sessionSampleInterval (one hour)
+const dashboardSamples = 360
+
+// Status page; its script is a separate file as the CSP forbids inline scripts
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>vncwebproxy status</title>
+<style>
+body{font-family:sans-serif;margin:1em 2em}table{border-collapse:collapse;margin-bottom:1.5em}
+td,th{border-bottom:1px solid #ddd;padding:.2em .6em;text-align:left;font-size:90%%}
+svg{border:1px solid #ddd;margin-right:1em}#err{color:#b00}
+</style>
+</head>
+<body>
+<h1>vncwebproxy <span id="version"></span></h1>
+<input id="key" type="password" placeholder="API key" autocomplete="off">
+<span id="err"></span>
+<p id="summary"></p>
+<h2>Throughput (last hour)</h2>
+<svg id="toClient" width="480" height="120"></svg><svg id="toBackend" width="480" height="120"></svg>
+<h2>Sessions</h2>
+<table id="sessions"></table>
+<h2>Registrations</h2>
+<table id="registrations"></table>
+<script src="/admin/%s"></script>
+</body>
+</html>
+`
+
+// dashboardScript polls /api/dashboard with the API key typed into the page;
+// an admin session cookie from /admin/webauthn is sent along
+const dashboardScript = `const key = document.getElementById('key');
+key.value = sessionStorage.getItem('vncwebproxy_key') || '';
+key.onchange = () => { sessionStorage.setItem('vncwebproxy_key', key.value); refresh(); };
+
+const esc = (s) => String(s ?? '').replace(/[&<>"]/g, (c) => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c]));
+const bytes = (n) => n >= 1e6 ? (n / 1e6).toFixed(1) + ' MB' : n >= 1e3 ? (n / 1e3).toFixed(1) + ' kB' : Math.round(n) + ' B';
+
+function table(id, cols, rows) {
+  document.getElementById(id).innerHTML = '<tr>' + cols.map((c) => '<th>' + c[0] + '</th>').join('') + '</tr>' +
+    rows.map((r) => '<tr>' + cols.map((c) => '<td>' + esc(c[1](r)) + '</td>').join('') + '</tr>').join('');
+}
+
+function graph(id, label, samples, field) {
+  const svg = document.getElementById(id), w = svg.width.baseVal.value, h = svg.height.baseVal.value;
+  const max = Math.max(1, ...samples.map((s) => s[field]));
+  const pts = samples.map((s, i) => (i * w / Math.max(1, samples.length - 1)) + ',' + (h - 14 - s[field] / max * (h - 20)));
+  svg.innerHTML = '<polyline fill="none" stroke="#36c" points="' + pts.join(' ') + '"/>' +
+    '<text x="4" y="' + (h - 2) + '" font-size="11">' + label + ', peak ' + bytes(max) + '/s</text>';
+}
+
+async function refresh() {
+  try {
+    const r = await fetch('/api/dashboard', {credentials: 'same-origin', headers: {'X-API-Key': key.value}});
+    const j = await r.json();
+    if (j.status !== 'success') throw new Error((j.errors || []).join(', '));
+    document.getElementById('err').textContent = '';
+    document.getElementById('version').textContent = j.version;
+    document.getElementById('summary').textContent = 'Up ' + j.uptime + ', ' + j.sessions.length + ' sessions, ' +
+      (j.registrations ? j.registrations.length + ' registrations' : 'registrations unavailable') +
+      ', features: ' + j.features;
+    graph('toClient', 'to viewers', j.throughput, 'bytes_per_sec_to_client');
+    graph('toBackend', 'to backends', j.throughput, 'bytes_per_sec_to_backend');
+    table('sessions', [
+      ['ID', (s) => s.id], ['Hash', (s) => s.hash], ['Principal', (s) => s.principal], ['Viewer', (s) => s.viewer_ip],
+      ['Backend', (s) => s.backend_host], ['Started', (s) => new Date(s.started).toLocaleString()],
+      ['To viewer', (s) => bytes(s.bytes_to_client)], ['To backend', (s) => bytes(s.bytes_to_backend)],
+    ], j.sessions);
+    table('registrations', [
+      ['Hash', (e) => e.hash], ['Principal', (e) => e.principal], ['Backend', (e) => e.backend_host],
+      ['Console', (e) => e.console], ['Uses', (e) => e.uses], ['Expires', (e) => new Date(e.expires).toLocaleString()],
+    ], j.registrations || []);
+  } catch (e) { document.getElementById('err').textContent = e.message; }
+}
+
+refresh();
+setInterval(refresh, 10000);
+`
+
+// ThroughputSample is the proxy's total load at one sample
+type ThroughputSample struct {
+	Time                 time.Time `json:"time"`
+	Sessions             int       `json:"sessions"`
+	BytesPerSecToClient  float64   `json:"bytes_per_sec_to_client"`
+	BytesPerSecToBackend float64   `json:"bytes_per_sec_to_backend"`
+}
+
+// RegistrationSummary describes a registered console without its credentials or full hash
+type RegistrationSummary struct {
+	Hash        string    `json:"hash"`
+	Principal   string    `json:"principal"`
+	BackendHost string    `json:"backend_host"`
+	Console     string    `json:"console,omitempty"`
+	Uses        int       `json:"uses"`
+	Expires     time.Time `json:"expires"`
+}
+
+// throughputHistory keeps the latest dashboardSamples samples
+type throughputHistory struct {
+	mu      sync.Mutex
+	samples []ThroughputSample
+}
+
+var (
+	throughput     = &throughputHistory{}
+	dashboardStart = time.Now()
+)
+
+// record adds up the registry's latest per-principal sample
+func (th *throughputHistory) record(now time.Time) {
+	s := ThroughputSample{Time: now}
+	for _, u := range sessions.Tenants() {
+		s.Sessions += u.Sessions
+		s.BytesPerSecToClient += u.BytesPerSecToClient
+		s.BytesPerSecToBackend += u.BytesPerSecToBackend
+	}
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if len(th.samples) == dashboardSamples {
+		copy(th.samples, th.samples[1:])
+		th.samples = th.samples[:dashboardSamples-1]
+	}
+	th.samples = append(th.samples, s)
+}
+
+func (th *throughputHistory) list() []ThroughputSample {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return append([]ThroughputSample{}, th.samples...)
+}
+
+// registrationSummaries lists the registration cache, nil when the store can't be read
+func registrationSummaries() []RegistrationSummary {
+	list, err := proxied.List()
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to list registrations: %v\n", err)
+		return nil
+	}
+	out := []RegistrationSummary{}
+	for hash, item := range list {
+		r := RegistrationSummary{
+			Hash:      hashTag(hash),
+			Principal: item.Principal,
+			Console:   item.Console,
+			Uses:      item.Uses,
+		}
+		r.Expires, _ = proxied.Expiry(hash)
+		if u, err := url.Parse(item.URL); err == nil {
+			r.BackendHost = u.Host
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Expires.Before(out[j].Expires) })
+	return out
+}
+
+// registerDashboardRoutes mounts the status page and its data
+func registerDashboardRoutes(api *gin.Engine, cfg *Config) {
+	go func() {
+		for now := range time.Tick(sessionSampleInterval) {
+			throughput.record(now)
+		}
+	}()
+
+	script := newStaticAsset("dashboard.js", "text/javascript; charset=utf-8", []byte(dashboardScript))
+	page := fmt.Sprintf(dashboardPage, script.hashedName)
+
+	api.GET("/admin/dashboard", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+	})
+	mountAsset(api, "/admin/", "dashboard.js", script)
+	api.GET("/api/dashboard", dashboardHandler(cfg))
+}
+
+// GET /api/dashboard returns what the status page shows
+func dashboardHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) || !requireAdminSession(cfg, c) {
+			return
+		}
+
+		list := sessions.List()
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{
+			"status":        "success",
+			"version":       Version,
+			"features":      featureList(),
+			"uptime":        time.Since(dashboardStart).Round(time.Second).String(),
+			"sessions":      list,
+			"registrations": registrationSummaries(),
+			"throughput":    throughput.list(),
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// flagRename maps a flag that was renamed to its current name
+type flagRename struct {
+	Old string
+	New string
+}
+
+// Old flag names that are still accepted with a deprecation warning; add an
+// entry when a flag is renamed
+var renamedFlags = []flagRename{}
+
+// deprecatedFlag forwards an old flag name to its replacement
+type deprecatedFlag struct {
+	rename flagRename
+	target flag.Value
+}
+
+func (d *deprecatedFlag) String() string {
+	if d.target == nil {
+		return ""
+	}
+	return d.target.String()
+}
+
+func (d *deprecatedFlag) Set(value string) error {
+	fmt.Printf("[WARN] -%s is deprecated, use -%s (vncwebproxy migrate-flags rewrites old invocations)\n",
+		d.rename.Old, d.rename.New)
+	return d.target.Set(value)
+}
+
+// IsBoolFlag keeps "-old" without a value working for renamed bool flags
+func (d *deprecatedFlag) IsBoolFlag() bool {
+	b, ok := d.target.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// registerDeprecatedFlags defines the old names in fs; call it after the current flags are defined
+func registerDeprecatedFlags(fs *flag.FlagSet) {
+	for _, r := range renamedFlags {
+		target := fs.Lookup(r.New)
+		if target == nil {
+			panic("renamed flag -" + r.New + " is not defined")
+		}
+		fs.Var(&deprecatedFlag{rename: r, target: target.Value}, r.Old, "Deprecated, use -"+r.New)
+	}
+}
+
+// migrateFlag rewrites one argument if it names a renamed flag, reporting whether it did
+func migrateFlag(arg string) (string, bool) {
+	dashes := "-"
+	if strings.HasPrefix(arg, "--") {
+		dashes = "--"
+	} else if !strings.HasPrefix(arg, "-") {
+		return arg, false
+	}
+
+	name, value := strings.TrimPrefix(arg, dashes), ""
+	if i := strings.Index(name, "="); i >= 0 {
+		name, value = name[:i], name[i:]
+	}
+	for _, r := range renamedFlags {
+		if name == r.Old {
+			return dashes + r.New + value, true
+		}
+	}
+	return arg, false
+}
+
+// migrateFlagsCommand implements "vncwebproxy migrate-flags [args...]": it prints the
+// given invocation with current flag names, or rewrites each line read from stdin
+// (e.g. a systemd ExecStart line or a wrapper script) when no arguments are given
+func migrateFlagsCommand(args []string) int {
+	if len(args) > 0 {
+		out := make([]string, len(args))
+		for i, arg := range args {
+			out[i] = migrateArg(arg)
+		}
+		fmt.Println(strings.Join(out, " "))
+		return 0
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fmt.Println(migrateLine(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// migrateLine rewrites the whitespace separated words of line, keeping the spacing
+func migrateLine(line string) string {
+	var b strings.Builder
+	for line != "" {
+		start := strings.IndexFunc(line, func(r rune) bool { return !unicode.IsSpace(r) })
+		if start < 0 {
+			b.WriteString(line)
+			break
+		}
+		b.WriteString(line[:start])
+		line = line[start:]
+
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end < 0 {
+			end = len(line)
+		}
+		b.WriteString(migrateArg(line[:end]))
+		line = line[end:]
+	}
+	return b.String()
+}
+
+// migrateArg rewrites an argument and reports the change on stderr
+func migrateArg(arg string) string {
+	migrated, changed := migrateFlag(arg)
+	if changed {
+		fmt.Fprintf(os.Stderr, "%s -> %s\n", arg, migrated)
+	}
+	return migrated
+}
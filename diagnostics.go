@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Number of recent RTTs and message sizes kept per session
+const diagHistory = 8
+
+// CloseSnapshot is attached to sessions that end with an unexpected error
+type CloseSnapshot struct {
+	Error              string     `json:"error"`
+	ClientRTTMillis    []float64  `json:"client_rtt_ms"`
+	BackendRTTMillis   []float64  `json:"backend_rtt_ms"`
+	LastToClientSizes  []int      `json:"last_to_client_sizes"`
+	LastToBackendSizes []int      `json:"last_to_backend_sizes"`
+	HeapAllocBytes     uint64     `json:"heap_alloc_bytes"`
+	SysBytes           uint64     `json:"sys_bytes"`
+	Goroutines         int        `json:"goroutines"`
+	BackendTLS         *TLSDetail `json:"backend_tls,omitempty"`
+}
+
+// TLSDetail describes the backend TLS connection
+type TLSDetail struct {
+	Version     string    `json:"version"`
+	CipherSuite string    `json:"cipher_suite"`
+	ServerName  string    `json:"server_name"`
+	PeerSubject string    `json:"peer_subject,omitempty"`
+	PeerExpires time.Time `json:"peer_expires,omitempty"`
+}
+
+// sessionDiag keeps the recent history a CloseSnapshot is built from
+type sessionDiag struct {
+	mu            sync.Mutex
+	clientRTT     []float64
+	backendRTT    []float64
+	toClientSize  []int
+	toBackendSize []int
+}
+
+func pushFloat(list []float64, v float64) []float64 {
+	list = append(list, v)
+	if len(list) > diagHistory {
+		list = list[1:]
+	}
+	return list
+}
+
+func pushInt(list []int, v int) []int {
+	list = append(list, v)
+	if len(list) > diagHistory {
+		list = list[1:]
+	}
+	return list
+}
+
+func (d *sessionDiag) recordSize(toClient bool, size int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if toClient {
+		d.toClientSize = pushInt(d.toClientSize, size)
+	} else {
+		d.toBackendSize = pushInt(d.toBackendSize, size)
+	}
+}
+
+// pingPayload carries the send time so the pong handler can compute the RTT
+func pingPayload() []byte {
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// trackRTT installs a pong handler on conn recording round trips of pingPayload pings
+func (d *sessionDiag) trackRTT(conn *websocket.Conn, client bool) {
+	conn.SetPongHandler(func(data string) error {
+		sent, err := strconv.ParseInt(data, 10, 64)
+		if err != nil {
+			return nil
+		}
+		rtt := float64(time.Since(time.Unix(0, sent)).Microseconds()) / 1000
+
+		d.mu.Lock()
+		if client {
+			d.clientRTT = pushFloat(d.clientRTT, rtt)
+		} else {
+			d.backendRTT = pushFloat(d.backendRTT, rtt)
+		}
+		d.mu.Unlock()
+		return nil
+	})
+}
+
+// snapshot captures the session history together with process and backend TLS state
+func (d *sessionDiag) snapshot(sessionErr error, backendConn *websocket.Conn) *CloseSnapshot {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	d.mu.Lock()
+	snap := &CloseSnapshot{
+		Error:              sessionErr.Error(),
+		ClientRTTMillis:    append([]float64{}, d.clientRTT...),
+		BackendRTTMillis:   append([]float64{}, d.backendRTT...),
+		LastToClientSizes:  append([]int{}, d.toClientSize...),
+		LastToBackendSizes: append([]int{}, d.toBackendSize...),
+		HeapAllocBytes:     mem.HeapAlloc,
+		SysBytes:           mem.Sys,
+		Goroutines:         runtime.NumGoroutine(),
+	}
+	d.mu.Unlock()
+
+	if tc, ok := backendConn.UnderlyingConn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		detail := &TLSDetail{
+			Version:     tls.VersionName(state.Version),
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			ServerName:  state.ServerName,
+		}
+		if len(state.PeerCertificates) > 0 {
+			detail.PeerSubject = state.PeerCertificates[0].Subject.String()
+			detail.PeerExpires = state.PeerCertificates[0].NotAfter
+		}
+		snap.BackendTLS = detail
+	}
+	return snap
+}
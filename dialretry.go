@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Longest wait between two dials of the same backend
+const maxDialBackoff = 10 * time.Second
+
+// retryableDial reports whether a failed backend dial may be repeated: the TCP
+// connection or TLS handshake failed or timed out before Proxmox answered, so
+// the ticket wasn't presented. Refusals over HTTP are left to ticket renewal
+func retryableDial(resp *http.Response, err error) bool {
+	return err != nil && resp == nil
+}
+
+// dialBackoff is the wait before retry n (from 1): base doubled each time up
+// to maxDialBackoff, of which a random half is taken so viewers of a console
+// that just started don't all dial again at once
+func dialBackoff(base time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < maxDialBackoff; i++ {
+		d *= 2
+	}
+	if d > maxDialBackoff {
+		d = maxDialBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// dialWithRetry dials the backend of t, repeating transient failures up to -backend_dial_retries times
+func dialWithRetry(cfg *Config, dialer *websocket.Dialer, t *backendTarget, headers http.Header) (*websocket.Conn, *http.Response, error) {
+	conn, resp, err := dialer.Dial(t.dialURL(), headers)
+	for n := 1; n <= cfg.BackendDialRetries && retryableDial(resp, err); n++ {
+		wait := dialBackoff(cfg.BackendDialBackoff, n)
+		fmt.Printf("[WARN] Backend %s not reachable (retry %d of %d in %v): %v\n", t.url.Host, n, cfg.BackendDialRetries, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		conn, resp, err = dialer.Dial(t.dialURL(), headers)
+	}
+	return conn, resp, err
+}
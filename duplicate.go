@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Policies for a viewer opening a hash that already has a live session
+const (
+	duplicateAllow   = "allow"   // independent sessions, the historical behavior
+	duplicateReject  = "reject"  // refuse the newcomer
+	duplicateReplace = "replace" // kick the existing sessions
+	duplicateShare   = "share"   // let the newcomer watch without input
+	duplicateFanout  = "fanout"  // attach the newcomer to the existing backend connection
+)
+
+func validDuplicatePolicy(policy string) bool {
+	switch policy {
+	case duplicateAllow, duplicateReject, duplicateReplace, duplicateShare, duplicateFanout:
+		return true
+	}
+	return false
+}
+
+// duplicatePolicy returns the policy of a registration, falling back to -duplicate_sessions
+func duplicatePolicy(cfg *Config, item *ProxiedItem) string {
+	if item.DuplicatePolicy != "" {
+		return item.DuplicatePolicy
+	}
+	return cfg.DuplicateSessions
+}
+
+// maxViewers returns the concurrent viewer limit of a registration, falling
+// back to -max_viewers; 0 means no limit
+func maxViewers(cfg *Config, item *ProxiedItem) int {
+	if item.MaxViewers > 0 {
+		return item.MaxViewers
+	}
+	return cfg.MaxViewers
+}
+
+// reserveViewer refuses a viewer before the upgrade when its hash is open and
+// the policy is reject, or when the hash already has as many viewers as it
+// may. Otherwise the viewer holds a slot of the hash until its session is
+// added, released on failure. replace is exempt from the limit as it closes
+// the others, and gets no slot
+func reserveViewer(cfg *Config, hash string, item *ProxiedItem) (*viewerSlot, error) {
+	policy := duplicatePolicy(cfg, item)
+	if policy == duplicateReplace {
+		return nil, nil
+	}
+	limit := maxViewers(cfg, item)
+	slot, open, ok := sessions.Reserve(hash, limit, policy == duplicateReject)
+	if ok {
+		return slot, nil
+	}
+	if policy == duplicateReject {
+		return nil, fmt.Errorf("console %s is already open", hashTag(hash))
+	}
+	return nil, fmt.Errorf("console %s already has %d of %d viewers", hashTag(hash), open, limit)
+}
+
+// takeOverDuplicates applies replace and share once the newcomer's backend is
+// connected, reporting whether it must be view-only
+func takeOverDuplicates(cfg *Config, target *backendTarget) bool {
+	switch duplicatePolicy(cfg, target.item) {
+	case duplicateReplace:
+		if n := sessions.KillHash(target.hash, "replaced by a new connection"); n > 0 {
+			fmt.Printf("[INFO] Replaced %d existing session(s) of hash %s\n", n, hashTag(target.hash))
+		}
+	case duplicateShare:
+		if sessions.CountHash(target.hash) > 0 {
+			fmt.Printf("[INFO] Hash %s already open, new viewer is view-only\n", hashTag(target.hash))
+			return true
+		}
+	}
+	return false
+}
+
+// errSkipMessage from a messageHook drops the message without ending the session
+var errSkipMessage = errors.New("message skipped")
+
+// Client frames of the RFB handshake (version, security type, auth response,
+// ClientInit), forwarded to the backend untouched by view-only sessions; one
+// less when the viewer chose security type None
+const rfbClientHandshakeFrames = 4
+
+// rfbClientInput reports whether a frame sent by a viewer after the handshake
+// carries input; frames that can't be parsed count as input so nothing slips through
+func rfbClientInput(msg []byte) bool {
+	for len(msg) > 0 {
+		var size int
+		switch msg[0] {
+		case 0: // SetPixelFormat
+			size = 20
+		case 2: // SetEncodings
+			if len(msg) < 4 {
+				return true
+			}
+			size = 4 + 4*int(binary.BigEndian.Uint16(msg[2:4]))
+		case 3: // FramebufferUpdateRequest
+			size = 10
+		case 150: // EnableContinuousUpdates
+			size = 10
+		case 248: // ClientFence
+			if len(msg) < 9 {
+				return true
+			}
+			size = 9 + int(msg[8])
+		default: // KeyEvent, PointerEvent, ClientCutText, QEMU key events, xvp, SetDesktopSize...
+			return true
+		}
+		if len(msg) < size {
+			return true
+		}
+		msg = msg[size:]
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Page loaded inside the PUQcloud panel iframe; the console hash arrives via postMessage
+const embedPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Console</title>
+<style>html,body{margin:0;height:100%%;background:#000}#screen{height:100%%}</style>
+</head>
+<body>
+<div id="screen"></div>
+<script type="module" src="/%s"></script>
+</body>
+</html>
+`
+
+// embedScript waits for a {type: "vncwebproxy:connect", hash} message from an allowed
+// parent origin, opens /vncproxy, sends the hash as the first frame and hands the socket to noVNC
+const embedScript = `import RFB from %s;
+
+const allowedOrigins = %s;
+let started = false;
+
+window.addEventListener('message', (ev) => {
+  const msg = ev.data || {};
+  if (started || !allowedOrigins.includes(ev.origin)) return;
+  if (msg.type !== 'vncwebproxy:connect' || typeof msg.hash !== 'string') return;
+  started = true;
+
+  const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+  const ws = new WebSocket(proto + '//' + location.host + '/vncproxy');
+  ws.binaryType = 'arraybuffer';
+  ws.addEventListener('open', () => {
+    ws.send(JSON.stringify({hash: msg.hash}));
+    const rfb = new RFB(document.getElementById('screen'), ws);
+    rfb.scaleViewport = true;
+    rfb.addEventListener('disconnect', () => {
+      ev.source.postMessage({type: 'vncwebproxy:disconnected'}, ev.origin);
+    });
+  });
+});
+
+window.parent.postMessage({type: 'vncwebproxy:ready'}, '*');
+`
+
+// Message the embed page sends as the first WebSocket frame
+type embedHello struct {
+	Hash string `json:"hash"`
+}
+
+// registerEmbedRoutes mounts the iframe page and its WebSocket when -embed_origins is set
+func registerEmbedRoutes(r *gin.Engine, cfg *Config) {
+	if len(cfg.EmbedOrigins) == 0 {
+		return
+	}
+
+	origins, _ := json.Marshal(cfg.EmbedOrigins)
+	rfbPath, _ := json.Marshal(cfg.NoVNCBase + "core/rfb.js")
+	script := newStaticAsset("embed.js", "text/javascript; charset=utf-8",
+		[]byte(fmt.Sprintf(embedScript, rfbPath, origins)))
+	page := fmt.Sprintf(embedPage, script.hashedName)
+
+	r.GET("/embed", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+	})
+	mountAsset(r, "/", "embed.js", script)
+	r.GET("/vncproxy", func(ctx *gin.Context) {
+		handleVNCEmbedWebSocket(cfg, ctx)
+	})
+
+	fmt.Printf("[INFO] Embedded console enabled for origins: %v\n", cfg.EmbedOrigins)
+}
+
+// handleVNCEmbedWebSocket serves viewers started by the embed page, which send
+// the hash as the first message instead of putting it in the URL
+func handleVNCEmbedWebSocket(cfg *Config, ctx *gin.Context) {
+	fmt.Printf("[INFO] Starting embedded VNC WebSocket connection\n")
+
+	if rejectIfMaintenance(ctx) {
+		return
+	}
+
+	viewerIP := ctx.ClientIP()
+	if !viewerConns.Acquire(viewerIP) {
+		fmt.Printf("[WARN] Embedded viewer %s refused, already holds %d connections\n", viewerIP, cfg.MaxConnsPerIP)
+		ctx.String(http.StatusTooManyRequests, "too many console connections from your address")
+		return
+	}
+	defer viewerConns.Release(viewerIP)
+
+	// Leaving CheckOrigin unset makes gorilla enforce same-origin, i.e. the embed page itself
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: 30 * time.Second,
+		ReadBufferSize:   8192,
+		WriteBufferSize:  8192,
+	}
+
+	clientConn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		fmt.Printf("[ERROR] Embedded client WebSocket upgrade failed: %v\n", err)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Origin header: %s\n", ctx.GetHeader("Origin"))
+		}
+		return
+	}
+	defer clientConn.Close()
+
+	activeSessions.Add(1)
+	defer activeSessions.Done()
+
+	upgradedAt := time.Now()
+
+	var hello embedHello
+	clientConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := clientConn.ReadJSON(&hello); err != nil || hello.Hash == "" {
+		fmt.Printf("[ERROR] Embedded client did not send a console hash: %v\n", err)
+		clientConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "hash expected"),
+			time.Now().Add(time.Second))
+		return
+	}
+
+	admission, status, err := admitViewer(cfg, ctx, hello.Hash)
+	if err != nil {
+		reason := err.Error()
+		if status == http.StatusBadRequest {
+			reason = "invalid console hash"
+		}
+		clientConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+			time.Now().Add(time.Second))
+		return
+	}
+	target := admission.target
+	defer target.slot.release()
+	if admission.hub != nil {
+		session := &vncSession{cfg: cfg, target: target, viewerIP: viewerIP}
+		session.runFanoutViewer(clientConn, admission.hub, admission.viewOnly)
+		return
+	}
+
+	session := newVNCSession(cfg, target, ctx)
+	session.upgradedAt = upgradedAt
+	if cfg.BackendProbeTimeout > 0 {
+		if err := session.probeTargets(); err != nil {
+			notifyBackendFailure(cfg, session.target, session.viewerIP, upgradedAt, err)
+			clientConn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "backend unavailable"),
+				time.Now().Add(time.Second))
+			return
+		}
+	}
+
+	backendConn, err := session.connectBackend(session.dialBackend())
+	if err != nil {
+		return
+	}
+	defer backendConn.Close()
+
+	session.run(clientConn, backendConn)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Most backends a registration may list in proxmox_ws_urls
+const maxTargetURLs = 8
+
+// expandTargetList moves the proxmox_ws_urls of a registration to
+// proxmox_ws_url, the first of them, and the fallbacks dialed after it
+func expandTargetList(req *ProxyRequest) error {
+	if len(req.URLs) == 0 {
+		return nil
+	}
+	switch {
+	case req.URL != "":
+		return fmt.Errorf("use either proxmox_ws_url or proxmox_ws_urls")
+	case req.Node != "" || req.VMID != 0 || req.ProxmoxHost != "":
+		return fmt.Errorf("proxmox_ws_urls can't be combined with node and vmid")
+	case len(req.URLs) > maxTargetURLs:
+		return fmt.Errorf("proxmox_ws_urls takes at most %d URLs", maxTargetURLs)
+	}
+	for _, u := range req.URLs {
+		if err := validateProxmoxURL(u); err != nil {
+			return fmt.Errorf("proxmox_ws_urls: %v", err)
+		}
+	}
+	req.URL = req.URLs[0]
+	return nil
+}
+
+// targetURLs returns every backend URL of a validated registration
+func (req *ProxyRequest) targetURLs() []string {
+	if len(req.URLs) > 0 {
+		return req.URLs
+	}
+	return []string{req.URL}
+}
+
+// fallbackURLs returns the backends dialed when the first can't be reached
+func fallbackURLs(req *ProxyRequest) []string {
+	if len(req.URLs) < 2 {
+		return nil
+	}
+	return req.URLs[1:]
+}
+
+// withURL returns a copy of t dialing rawURL instead
+func (t *backendTarget) withURL(rawURL string) (*backendTarget, error) {
+	if err := validateProxmoxURL(rawURL); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	item := *t.item
+	item.URL = rawURL
+	return &backendTarget{hash: t.hash, item: &item, url: u}, nil
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames queued for a joined viewer before it is dropped as too slow
+const fanoutQueueFrames = 256
+
+// messageWriter is the sending side of a proxied connection
+type messageWriter interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+// lockedWriter lets several viewers write to one backend connection
+type lockedWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (lw *lockedWriter) WriteMessage(mt int, data []byte) error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.conn.WriteMessage(mt, data)
+}
+
+// fanoutViewer is a viewer attached to a fanout session
+type fanoutViewer struct {
+	live     *liveSession
+	viewOnly bool // a shadow observer, its input never reaches the backend
+	out      chan []byte
+	reason   string // why out was closed, sent to the viewer
+}
+
+// fanoutHub shares the backend connection of the first viewer of a hash (the
+// owner) with viewers that join later. Joiners get a ServerInit describing the
+// current framebuffer and then every server message from the next message
+// boundary on; input reaches the backend from one viewer at a time
+type fanoutHub struct {
+	cfg     *Config
+	hash    string
+	owner   *fanoutViewer
+	backend *lockedWriter
+	cutText *cutTextPolicy // applied to the ClientCutText of joined viewers
+
+	mu        sync.Mutex
+	stream    *rfbStream // nil until the owner's handshake is done
+	boundary  bool
+	viewers   map[*fanoutViewer]struct{}
+	pending   []*fanoutViewer
+	control   *fanoutViewer
+	lastInput time.Time
+	closed    bool
+}
+
+// fanoutRegistry maps hashes to their fanout sessions
+type fanoutRegistry struct {
+	mu   sync.Mutex
+	hubs map[string]*fanoutHub
+}
+
+// Fanout sessions of the running process
+var fanoutHubs = &fanoutRegistry{hubs: make(map[string]*fanoutHub)}
+
+// open makes owner's session of hash shareable, nil if the hash already has one
+func (fr *fanoutRegistry) open(cfg *Config, hash string, backendConn *websocket.Conn, owner *liveSession, cutText *cutTextPolicy) *fanoutHub {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.hubs[hash] != nil {
+		return nil
+	}
+	h := &fanoutHub{
+		cfg:     cfg,
+		hash:    hash,
+		owner:   &fanoutViewer{live: owner},
+		backend: &lockedWriter{conn: backendConn},
+		viewers: make(map[*fanoutViewer]struct{}),
+		cutText: cutText,
+	}
+	fr.hubs[hash] = h
+	return h
+}
+
+// joinable returns the fanout session of hash once viewers can attach to it
+func (fr *fanoutRegistry) joinable(hash string) *fanoutHub {
+	fr.mu.Lock()
+	h := fr.hubs[hash]
+	fr.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || h.stream == nil || !h.stream.ready || h.stream.err != nil {
+		return nil
+	}
+	return h
+}
+
+// startStream is called when the owner sends ClientInit: what the backend sends next starts with ServerInit
+func (h *fanoutHub) startStream() {
+	h.mu.Lock()
+	h.stream = newRFBStream(nil)
+	h.mu.Unlock()
+}
+
+// fromBackend passes a backend frame to the joined viewers, attaching waiting
+// viewers once the frame ends at a message boundary
+func (h *fanoutHub) fromBackend(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stream == nil || h.closed {
+		return
+	}
+
+	failed := h.stream.err != nil
+	h.boundary = h.stream.Feed(msg)
+	if !failed && h.stream.err != nil {
+		fmt.Printf("[WARN] Fanout of hash %s can't follow the VNC stream, no more viewers can join: %v\n",
+			hashTag(h.hash), h.stream.err)
+	}
+
+	for v := range h.viewers {
+		h.send(v, msg)
+	}
+	if h.boundary {
+		h.attachPending()
+	}
+}
+
+// send queues a frame for a joined viewer, dropping the viewer if it fell behind
+func (h *fanoutHub) send(v *fanoutViewer, msg []byte) {
+	select {
+	case v.out <- msg:
+	default:
+		fmt.Printf("[WARN] Session %s dropped from fanout of hash %s, too slow\n", v.live.info.ID, hashTag(h.hash))
+		h.drop(v, "viewer too slow")
+	}
+}
+
+// drop detaches a viewer, closing its queue; the caller holds h.mu
+func (h *fanoutHub) drop(v *fanoutViewer, reason string) {
+	if _, ok := h.viewers[v]; ok {
+		delete(h.viewers, v)
+	} else {
+		found := false
+		for i, p := range h.pending {
+			if p == v {
+				h.pending = append(h.pending[:i], h.pending[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+	v.reason = reason
+	close(v.out)
+	if h.control == v {
+		h.control = nil
+	}
+}
+
+// attachPending starts waiting viewers at the current boundary; the caller holds h.mu
+func (h *fanoutHub) attachPending() {
+	if len(h.pending) == 0 || h.stream.err != nil {
+		return
+	}
+	init := h.stream.init.encode()
+	for _, v := range h.pending {
+		v.out <- init
+		h.viewers[v] = struct{}{}
+	}
+	h.pending = nil
+}
+
+// join attaches a viewer that completed the RFB handshake, nil if the session ended
+func (h *fanoutHub) join(live *liveSession, viewOnly bool) *fanoutViewer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	v := &fanoutViewer{live: live, viewOnly: viewOnly, out: make(chan []byte, fanoutQueueFrames)}
+	h.pending = append(h.pending, v)
+	if h.boundary {
+		h.attachPending()
+	}
+	return v
+}
+
+// leave detaches a viewer that disconnected
+func (h *fanoutHub) leave(v *fanoutViewer) {
+	h.mu.Lock()
+	h.drop(v, "")
+	h.mu.Unlock()
+}
+
+// close ends the fanout when the owner disconnects, joined viewers are disconnected too
+func (h *fanoutHub) close() {
+	fanoutHubs.mu.Lock()
+	if fanoutHubs.hubs[h.hash] == h {
+		delete(fanoutHubs.hubs, h.hash)
+	}
+	fanoutHubs.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for v := range h.viewers {
+		h.drop(v, "console owner left")
+	}
+	for len(h.pending) > 0 {
+		h.drop(h.pending[0], "console owner left")
+	}
+	if h.stream != nil {
+		h.stream.Close()
+	}
+}
+
+// claimInput reports whether input of v may reach the backend: the viewer in
+// control keeps it until it has been idle for -fanout_input_idle
+func (h *fanoutHub) claimInput(v *fanoutViewer) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if h.control != v {
+		if h.control != nil && now.Sub(h.lastInput) < h.cfg.FanoutInputIdle {
+			return false
+		}
+		fmt.Printf("[INFO] Session %s took control of hash %s\n", v.live.info.ID, hashTag(h.hash))
+		h.control = v
+	}
+	h.lastInput = now
+	return true
+}
+
+// filter returns what of a viewer frame may be sent to the backend. Joined
+// viewers share the owner's pixel format and encodings, so their SetPixelFormat,
+// SetEncodings, fences and continuous update requests are dropped; the owner's
+// SetEncodings is narrowed to encodings the stream can be followed in. Shadow
+// observers only get to request updates
+func (h *fanoutHub) filter(v *fanoutViewer, msg []byte) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		size := rfbClientMessageSize(msg)
+		if size < 0 {
+			// Can't be split, forward it whole as input
+			if !v.viewOnly && h.claimInput(v) {
+				out = append(out, msg...)
+			}
+			break
+		}
+		m := msg[:size]
+		msg = msg[size:]
+		if v.viewOnly && m[0] != 3 {
+			continue
+		}
+
+		switch m[0] {
+		case 0: // SetPixelFormat
+			if v == h.owner {
+				h.mu.Lock()
+				if h.stream != nil {
+					h.stream.setPixelFormat(m)
+				}
+				h.mu.Unlock()
+				out = append(out, m...)
+			}
+		case 2: // SetEncodings
+			if v == h.owner {
+				out = append(out, filterEncodings(m)...)
+			}
+		case 150, 248: // EnableContinuousUpdates, ClientFence
+			if v == h.owner {
+				out = append(out, m...)
+			}
+		case 3: // FramebufferUpdateRequest
+			out = append(out, m...)
+		case 6: // ClientCutText, the owner's already went through its clipboardFilter
+			if v != h.owner {
+				m = h.cutText.clientCutText(m)
+			}
+			if len(m) > 0 && h.claimInput(v) {
+				out = append(out, m...)
+			}
+		default:
+			if h.claimInput(v) {
+				out = append(out, m...)
+			}
+		}
+	}
+	return out
+}
+
+// forwardRewritten is the end of a messageHook that rewrote msg to out: out is
+// written instead and msg skipped, unless nothing changed
+func forwardRewritten(dst messageWriter, mt int, msg, out []byte) error {
+	if bytes.Equal(out, msg) {
+		return nil
+	}
+	if len(out) > 0 {
+		if err := dst.WriteMessage(mt, out); err != nil {
+			return err
+		}
+	}
+	return errSkipMessage
+}
+
+// fanoutHandshake completes the RFB handshake with a joining viewer on behalf
+// of the backend, offering no authentication as the hash was already checked
+func fanoutHandshake(cfg *Config, conn *websocket.Conn) error {
+	if cfg.HandshakeReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(cfg.HandshakeReadTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	var buf []byte
+	read := func(n int) ([]byte, error) {
+		for len(buf) < n {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, msg...)
+		}
+		b := buf[:n]
+		buf = buf[n:]
+		return b, nil
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("RFB 003.008\n")); err != nil {
+		return err
+	}
+	version, err := read(12)
+	if err != nil {
+		return err
+	}
+	if string(version) != "RFB 003.008\n" && string(version) != "RFB 003.007\n" {
+		return fmt.Errorf("unsupported viewer version %q", version)
+	}
+	// One security type: None
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{1, 1}); err != nil {
+		return err
+	}
+	if t, err := read(1); err != nil {
+		return err
+	} else if t[0] != 1 {
+		return fmt.Errorf("viewer chose security type %d", t[0])
+	}
+	if string(version) == "RFB 003.008\n" {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0, 0, 0, 0}); err != nil {
+			return err
+		}
+	}
+	// ClientInit, the shared flag doesn't matter here
+	_, err = read(1)
+	return err
+}
+
+// runFanoutViewer attaches an upgraded viewer to a fanout session, viewOnly for shadow observers
+func (s *vncSession) runFanoutViewer(clientConn *websocket.Conn, hub *fanoutHub, viewOnly bool) {
+	cfg, target := s.cfg, s.target
+
+	if _, ok := s.consume(clientConn); !ok {
+		return
+	}
+	keyStats.RecordSession(target.item.Principal)
+
+	live := sessions.Add(target.hash, target.item.Principal, s.viewerIP, target.url.Host, target.item.Metadata)
+	defer sessions.Remove(live)
+	target.slot.release()
+	role := "joined"
+	if viewOnly {
+		role = "observing"
+	}
+	fmt.Printf("[INFO] Session %s %s hash %s: viewer=%s backend=%s%s\n",
+		live.info.ID, role, hashTag(hub.hash), s.viewerIP, target.url.Host, formatMetadata(target.item.Metadata))
+
+	if err := fanoutHandshake(cfg, clientConn); err != nil {
+		fmt.Printf("[ERROR] Handshake with viewer %s failed: %v\n", s.viewerIP, err)
+		return
+	}
+	v := hub.join(live, viewOnly)
+	if v == nil {
+		clientConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "console owner left"),
+			time.Now().Add(time.Second))
+		return
+	}
+	defer hub.leave(v)
+
+	analyzer := newTrafficAnalyzer(cfg, live)
+	keys := newKeyFilter(cfg, target.item, live.info.ID)
+	errc := make(chan error, 2)
+
+	// Joined viewers are disconnected when idle, without a Bell warning
+	if idle := idleTimeout(cfg, target.item); idle > 0 {
+		idleDone := make(chan struct{})
+		defer close(idleDone)
+		go live.watchIdle(idle, 0, nil, idleDone)
+	}
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case msg, ok := <-v.out:
+				if !ok {
+					errc <- &sessionCloseError{code: websocket.CloseGoingAway, reason: v.reason}
+					return
+				}
+				if err := clientConn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+					errc <- err
+					return
+				}
+				atomic.AddInt64(&live.bytesToClient, int64(len(msg)))
+			case <-ticker.C:
+				if err := clientConn.WriteControl(websocket.PingMessage, pingPayload(), time.Now().Add(5*time.Second)); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			mt, msg, err := clientConn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
+					err = nil
+				}
+				errc <- err
+				return
+			}
+			atomic.AddInt64(&live.bytesToBackend, int64(len(msg)))
+			if rfbClientInput(msg) {
+				live.touchInput()
+			}
+			if !viewOnly {
+				live.activity.observeRFB(msg)
+			}
+			out := hub.filter(v, keys.filter(msg))
+			if len(out) == 0 {
+				continue
+			}
+			analyzer.observe(out)
+			if err := hub.backend.WriteMessage(mt, out); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-live.kill:
+		fmt.Printf("[INFO] Session %s killed: %s\n", live.info.ID, live.killReason)
+		err = &sessionCloseError{code: live.killCode, reason: live.killReason}
+	}
+
+	closeCode, closeReason := websocket.CloseNormalClosure, ""
+	if ce, ok := err.(*sessionCloseError); ok {
+		closeCode, closeReason = ce.code, ce.reason
+	} else if err != nil {
+		fmt.Printf("[ERROR] Session %s ended with error: %v\n", live.info.ID, err)
+		live.closeError = err.Error()
+	}
+	live.closeCode, live.closeReason = closeCode, closeReason
+	clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason), time.Now().Add(time.Second))
+	fmt.Printf("[INFO] Session %s left hash %s\n", live.info.ID, live.info.Hash)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Optional subsystems and whether this binary was built with them; each one is
+// left out by building with the tag "no" + name
+var features = []struct {
+	name  string
+	built bool
+}{
+	{"recording", featureRecording},
+	{"adminui", featureAdminUI},
+	{"grpc", featureGRPC},
+	{"etcd", featureEtcd},
+	{"redis", featureRedis},
+}
+
+// featureList describes the subsystems of this binary for -v
+func featureList() string {
+	var parts []string
+	for _, f := range features {
+		mark := "+"
+		if !f.built {
+			mark = "-"
+		}
+		parts = append(parts, mark+f.name)
+	}
+	return strings.Join(parts, " ")
+}
+
+// requireFeature exits when a flag is set that needs a subsystem this binary
+// was built without
+func requireFeature(built bool, flagName, tag string) {
+	if !built {
+		fmt.Printf("Error: %s is not available, this binary was built with -tags %s\n", flagName, tag)
+		os.Exit(1)
+	}
+}
@@ -1,9 +1,9 @@
 module example
 
-go 1.12
+go 1.16
 
 require (
 	github.com/evangwt/go-vncproxy v1.1.0 // indirect
-	github.com/gin-gonic/gin v1.8.1 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/gin-gonic/gin v1.8.1
+	github.com/gorilla/websocket v1.5.3
 )
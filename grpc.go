@@ -0,0 +1,499 @@
+//go:build !nogrpc
+// +build !nogrpc
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC service path from control.proto
+// The gRPC control API is left out with -tags nogrpc
+const featureGRPC = true
+
+const grpcService = "/vncwebproxy.v1.Control/"
+
+// gRPC status codes used by the control service
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// Protobuf encoding of the few message shapes in control.proto; small enough
+// to write by hand instead of depending on generated code
+
+type pbWriter struct {
+	buf []byte
+}
+
+// uvarint appends v as a protobuf varint
+func (w *pbWriter) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func (w *pbWriter) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.uvarint(uint64(field << 3))
+	w.uvarint(v)
+}
+
+func (w *pbWriter) bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	w.uvarint(uint64(field<<3 | 2))
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *pbWriter) string(field int, s string) {
+	w.bytes(field, []byte(s))
+}
+
+// pbWalk calls fn with each string field of a message, and varints as decimal
+// text (bools are "1"), skipping anything else
+func pbWalk(b []byte, fn func(field int, value string)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("malformed field key")
+		}
+		b = b[n:]
+		if key>>3 == 0 || key>>3 > 1<<29-1 {
+			return fmt.Errorf("invalid field number %d", key>>3)
+		}
+
+		field, wireType := int(key>>3), key&7
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("malformed varint")
+			}
+			fn(field, strconv.FormatUint(v, 10))
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return fmt.Errorf("truncated fixed64")
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			fn(field, string(b[n:n+int(l)]))
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return fmt.Errorf("truncated fixed32")
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+	}
+	return nil
+}
+
+// pbStrings decodes the string and varint fields of a message, the last value
+// of a repeated field wins
+func pbStrings(b []byte) (map[int]string, error) {
+	fields := make(map[int]string)
+	if err := pbWalk(b, func(field int, value string) { fields[field] = value }); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// pbMap decodes a map<string, string> field of a message
+func pbMap(b []byte, field int) (map[string]string, error) {
+	var entries []string
+	if err := pbWalk(b, func(f int, value string) {
+		if f == field {
+			entries = append(entries, value)
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	var m map[string]string
+	for _, e := range entries {
+		kv, err := pbStrings([]byte(e))
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			m = make(map[string]string)
+		}
+		m[kv[1]] = kv[2]
+	}
+	return m, nil
+}
+
+// pbRepeated decodes a repeated string field of a message
+func pbRepeated(b []byte, field int) ([]string, error) {
+	var values []string
+	err := pbWalk(b, func(f int, value string) {
+		if f == field {
+			values = append(values, value)
+		}
+	})
+	return values, err
+}
+
+func encodeSession(info SessionInfo) []byte {
+	var w pbWriter
+	w.string(1, info.ID)
+	w.string(2, info.Hash)
+	w.string(3, info.Principal)
+	w.string(4, info.ViewerIP)
+	w.string(5, info.BackendHost)
+	w.varint(6, uint64(info.Started.Unix()))
+	w.varint(7, uint64(info.BytesToClient))
+	w.varint(8, uint64(info.BytesToBackend))
+	w.string(9, info.Namespace)
+	for k, v := range info.Metadata {
+		var entry pbWriter
+		entry.string(1, k)
+		entry.string(2, v)
+		w.bytes(10, entry.buf)
+	}
+	if a := info.Activity; a != nil {
+		var activity pbWriter
+		for i, c := range []ActivityCounter{a.Keys, a.Pointer, a.Clipboard} {
+			activity.bytes(i+1, encodeActivityCounter(c))
+		}
+		w.bytes(11, activity.buf)
+	}
+	return w.buf
+}
+
+func encodeActivityCounter(c ActivityCounter) []byte {
+	var w pbWriter
+	w.varint(1, uint64(c.Count))
+	if c.First != nil {
+		w.varint(2, uint64(c.First.Unix()))
+		w.varint(3, uint64(c.Last.Unix()))
+	}
+	return w.buf
+}
+
+// grpcCall is one request on the control service
+type grpcCall struct {
+	cfg *Config
+	w   http.ResponseWriter
+	r   *http.Request
+}
+
+// readMessage reads the single length-prefixed request message
+func (call *grpcCall) readMessage() ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(call.r.Body, prefix[:]); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > 1<<20 {
+		return nil, fmt.Errorf("message too large")
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(call.r.Body, msg)
+	return msg, err
+}
+
+func (call *grpcCall) writeMessage(msg []byte) {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	call.w.Write(prefix[:])
+	call.w.Write(msg)
+	if f, ok := call.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends the status trailers that end every gRPC call
+func (call *grpcCall) finish(code int, msg string) {
+	call.w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		call.w.Header().Set(http.TrailerPrefix+"Grpc-Message", msg)
+	}
+}
+
+// grpcHandler serves the control service; callers need a verified client
+// certificate and an address from the control allowlist
+func grpcHandler(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		call := &grpcCall{cfg: cfg, w: w, r: r}
+
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			call.finish(grpcUnauthenticated, "client certificate required")
+			return
+		}
+		principal := "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !cfg.IsControlIP(host) {
+			fmt.Printf("[ERROR] gRPC call from forbidden address %s (%s)\n", host, principal)
+			call.finish(grpcPermissionDenied, "forbidden IP")
+			return
+		}
+
+		msg, err := call.readMessage()
+		if err != nil {
+			call.finish(grpcInvalidArgument, err.Error())
+			return
+		}
+		fields, err := pbStrings(msg)
+		if err != nil {
+			call.finish(grpcInvalidArgument, err.Error())
+			return
+		}
+
+		method := strings.TrimPrefix(r.URL.Path, grpcService)
+		fmt.Printf("[INFO] gRPC %s from %s (%s)\n", method, host, principal)
+
+		switch method {
+		case "RegisterProxy":
+			if ok, _ := registrationLimiter.Allow(host); !ok {
+				fmt.Printf("[WARN] Registration rate limit exceeded by %s\n", host)
+				call.finish(grpcResourceExhausted, "too many registrations")
+				return
+			}
+			grpcRegisterProxy(call, msg, fields, principal)
+		case "ListSessions":
+			var resp pbWriter
+			for _, info := range visibleSessions(cfg, principal, sessions.List()) {
+				resp.bytes(1, encodeSession(info))
+			}
+			call.writeMessage(resp.buf)
+			call.finish(grpcOK, "")
+		case "KillSession":
+			if cfg.WebAuthn != nil && !cfg.WebAuthn.ValidSession(r.Header.Get(adminSessionHeader)) {
+				call.finish(grpcUnauthenticated, "WebAuthn admin session required")
+				return
+			}
+			var resp pbWriter
+			if info, ok := sessions.Get(fields[1]); ok && sessionVisible(cfg, principal, info) && sessions.Kill(fields[1]) {
+				fmt.Printf("[INFO] Session %s killed over gRPC by %s\n", fields[1], principal)
+				resp.varint(1, 1)
+			}
+			call.writeMessage(resp.buf)
+			call.finish(grpcOK, "")
+		case "Watch":
+			grpcWatch(call, principal)
+		default:
+			call.finish(grpcUnimplemented, "unknown method "+method)
+		}
+	})
+}
+
+// grpcRegisterProxy is POST /api/proxy over gRPC. -signing_secret doesn't
+// apply: the caller is authenticated by its client certificate, and TLS
+// already keeps captured requests from being replayed
+func grpcRegisterProxy(call *grpcCall, msg []byte, fields map[int]string, principal string) {
+	if currentMaintenance().Enabled {
+		call.finish(grpcUnavailable, "proxy is in maintenance mode")
+		return
+	}
+
+	req := &ProxyRequest{
+		Hash:                fields[1],
+		Token:               fields[2],
+		Cookie:              fields[3],
+		CSRFPreventionToken: fields[4],
+		URL:                 fields[5],
+		Namespace:           fields[6],
+		SingleUse:           fields[7] == "1",
+		DuplicatePolicy:     fields[8],
+	}
+	if fields[9] != "" {
+		req.TTLSeconds, _ = strconv.Atoi(fields[9])
+	}
+	req.ExpiresAt = fields[10]
+	req.Console = fields[11]
+	req.Metadata, _ = pbMap(msg, 12)
+	if fields[13] != "" {
+		req.MaxUses, _ = strconv.Atoi(fields[13])
+	}
+	req.ViewerIP = fields[14]
+	if fields[15] != "" {
+		req.MaxViewers, _ = strconv.Atoi(fields[15])
+	}
+	req.Shadow = fields[16] == "1"
+	req.ReadOnly = fields[17] == "1"
+	req.BlockClipboard = fields[18] == "1"
+	if fields[19] != "" {
+		req.MaxClipboardBytes, _ = strconv.Atoi(fields[19])
+	}
+	req.BlockedKeys = fields[20]
+	req.Record = fields[21] == "1"
+	if fields[22] != "" {
+		req.IdleTimeoutSeconds, _ = strconv.Atoi(fields[22])
+	}
+	if fields[23] != "" {
+		viewer, err := decodeViewerOptions(fields[23])
+		if err != nil {
+			call.finish(grpcInvalidArgument, "malformed viewer options")
+			return
+		}
+		req.Viewer = viewer
+	}
+	req.Node = fields[24]
+	if fields[25] != "" {
+		req.VMID, _ = strconv.Atoi(fields[25])
+	}
+	req.ProxmoxHost = fields[26]
+	req.VMType = fields[27]
+	if fields[28] != "" {
+		req.Port, _ = strconv.Atoi(fields[28])
+	}
+	req.VNCTicket = fields[29]
+	req.URLs, _ = pbRepeated(msg, 30)
+	req.Product = fields[32]
+	req.NativeVNC = fields[33] == "1"
+	req.VNCPassword = fields[34]
+	if fields[31] != "" {
+		spice, err := decodeSpiceParams(fields[31])
+		if err != nil {
+			call.finish(grpcInvalidArgument, "malformed spice parameters")
+			return
+		}
+		req.Spice = spice
+	}
+	if ok, _ := keyRegistrations.Allow(call.cfg, principal); !ok {
+		fmt.Printf("[WARN] Registration quota of key %s exceeded\n", principal)
+		call.finish(grpcResourceExhausted, "registration quota of this key exceeded")
+		return
+	}
+	err := validateProxyRequest(call.cfg, req)
+	if err == nil {
+		err = assignHash(call.cfg, req, principal)
+	}
+	if err == nil {
+		err = assignNativePassword(req)
+	}
+	if err != nil {
+		call.finish(grpcInvalidArgument, err.Error())
+		return
+	}
+	if err := authorizeNamespace(call.cfg, req.Hash, principal, req.targetURLs()...); err != nil {
+		fmt.Printf("[ERROR] Registration by %s rejected: %v\n", principal, err)
+		call.finish(grpcPermissionDenied, err.Error())
+		return
+	}
+	shadowHash, err := registerProxy(call.cfg, req, principal)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to store proxy entry for hash %s: %v\n", req.Hash, err)
+		call.finish(grpcUnavailable, "storage unavailable")
+		return
+	}
+
+	var resp pbWriter
+	resp.string(1, "Proxied entry added successfully")
+	resp.string(2, req.Hash)
+	resp.string(3, consoleURL(call.cfg, req.Hash, req.Console))
+	if shadowHash != "" {
+		resp.string(4, shadowHash)
+		resp.string(5, consoleURL(call.cfg, shadowHash, req.Console))
+	}
+	resp.string(6, req.NativePassword)
+	call.writeMessage(resp.buf)
+	call.finish(grpcOK, "")
+}
+
+// grpcWatch streams the session events principal may see until the client cancels
+func grpcWatch(call *grpcCall, principal string) {
+	events, cancel := sessions.Subscribe()
+	defer cancel()
+
+	if f, ok := call.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	for {
+		select {
+		case ev := <-events:
+			if !sessionVisible(call.cfg, principal, ev.Session) {
+				continue
+			}
+			var msg pbWriter
+			msg.string(1, ev.Type)
+			msg.varint(2, uint64(ev.Time.Unix()))
+			msg.bytes(3, encodeSession(ev.Session))
+			if ev.Snapshot != nil {
+				data, _ := json.Marshal(ev.Snapshot)
+				msg.bytes(4, data)
+			}
+			call.writeMessage(msg.buf)
+		case <-call.r.Context().Done():
+			call.finish(grpcOK, "")
+			return
+		case <-stopping:
+			call.finish(grpcUnavailable, "server shutting down")
+			return
+		}
+	}
+}
+
+// decodeViewerOptions reads the ViewerOptions message of a gRPC registration
+func decodeViewerOptions(msg string) (*ViewerOptions, error) {
+	fields, err := pbStrings([]byte(msg))
+	if err != nil {
+		return nil, err
+	}
+	o := &ViewerOptions{Scaling: fields[1], ViewOnly: fields[4] == "1"}
+	if v, ok := fields[2]; ok {
+		q, _ := strconv.Atoi(v)
+		o.Quality = &q
+	}
+	if v, ok := fields[3]; ok {
+		c, _ := strconv.Atoi(v)
+		o.Compression = &c
+	}
+	return o, nil
+}
+
+// decodeSpiceParams reads the SpiceParams message of a gRPC registration
+func decodeSpiceParams(msg string) (*SpiceParams, error) {
+	fields, err := pbStrings([]byte(msg))
+	if err != nil {
+		return nil, err
+	}
+	sp := &SpiceParams{
+		Host:        fields[1],
+		Proxy:       fields[2],
+		Password:    fields[3],
+		HostSubject: fields[5],
+		CA:          fields[6],
+		Title:       fields[7],
+	}
+	sp.TLSPort, _ = strconv.Atoi(fields[4])
+	return sp, nil
+}
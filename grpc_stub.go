@@ -0,0 +1,13 @@
+//go:build nogrpc
+// +build nogrpc
+
+package main
+
+import "net/http"
+
+const featureGRPC = false
+
+// grpcHandler is never served, ParseFlags refuses -grpc_listen in these builds
+func grpcHandler(cfg *Config) http.Handler {
+	return http.NotFoundHandler()
+}
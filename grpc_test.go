@@ -0,0 +1,120 @@
+//go:build !nogrpc
+// +build !nogrpc
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type pbField struct {
+	field int
+	value string
+}
+
+func TestPbWalk(t *testing.T) {
+	var w pbWriter
+	w.string(1, "hash")
+	w.varint(2, 300)
+	w.string(1, "again")
+	w.bytes(30, []byte{0, 0xff})
+	valid := w.buf
+
+	uvarint := func(v uint64) []byte {
+		var w pbWriter
+		w.uvarint(v)
+		return w.buf
+	}
+	key := func(field int, wireType uint64) []byte {
+		return uvarint(uint64(field)<<3 | wireType)
+	}
+	join := func(parts ...[]byte) []byte {
+		var out []byte
+		for _, p := range parts {
+			out = append(out, p...)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []pbField
+		wantErr string
+	}{
+		{name: "empty", input: nil},
+		{name: "fields in order", input: valid, want: []pbField{{1, "hash"}, {2, "300"}, {1, "again"}, {30, "\x00\xff"}}},
+		{name: "bool", input: join(key(5, 0), []byte{1}), want: []pbField{{5, "1"}}},
+		{name: "max varint", input: join(key(1, 0), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}), want: []pbField{{1, "18446744073709551615"}}},
+		{name: "empty string", input: join(key(3, 2), []byte{0}), want: []pbField{{3, ""}}},
+		{name: "fixed64 and fixed32 skipped", input: join(key(1, 1), make([]byte, 8), key(2, 5), make([]byte, 4), key(3, 2), []byte{1, 'x'}), want: []pbField{{3, "x"}}},
+		{name: "max field number", input: join(key(1<<29-1, 0), []byte{7}), want: []pbField{{1<<29 - 1, "7"}}},
+		{name: "field number 0", input: join(key(0, 0), []byte{1}), wantErr: "invalid field number"},
+		{name: "field number too large", input: join(key(1<<29, 0), []byte{1}), wantErr: "invalid field number"},
+		{name: "truncated key", input: []byte{0x80}, wantErr: "malformed field key"},
+		{name: "overlong key", input: []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, wantErr: "malformed field key"},
+		{name: "truncated varint", input: join(key(1, 0), []byte{0x80}), wantErr: "malformed varint"},
+		{name: "missing varint", input: key(1, 0), wantErr: "malformed varint"},
+		{name: "overlong varint", input: join(key(1, 0), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}), wantErr: "malformed varint"},
+		{name: "truncated string", input: join(key(1, 2), []byte{5, 'a', 'b'}), wantErr: "truncated field 1"},
+		{name: "missing length", input: key(1, 2), wantErr: "truncated field 1"},
+		{name: "huge length", input: join(key(1, 2), uvarint(1<<63), []byte("x")), wantErr: "truncated field 1"},
+		{name: "max length", input: join(key(1, 2), uvarint(1<<64-1), []byte("x")), wantErr: "truncated field 1"},
+		{name: "truncated fixed64", input: join(key(1, 1), make([]byte, 7)), wantErr: "truncated fixed64"},
+		{name: "truncated fixed32", input: join(key(1, 5), make([]byte, 3)), wantErr: "truncated fixed32"},
+		{name: "group wire type", input: join(key(1, 3), []byte{0}), wantErr: "unsupported wire type 3"},
+		{name: "wire type 7", input: join(key(1, 7), []byte{0}), wantErr: "unsupported wire type 7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []pbField
+			err := pbWalk(tt.input, func(field int, value string) {
+				got = append(got, pbField{field, value})
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPbMap(t *testing.T) {
+	entry := func(k, v string) []byte {
+		var e pbWriter
+		e.string(1, k)
+		e.string(2, v)
+		return e.buf
+	}
+	var w pbWriter
+	w.bytes(10, entry("vm", "100"))
+	w.string(1, "other")
+	w.bytes(10, entry("vm", "101"))
+	w.bytes(10, entry("node", ""))
+
+	got, err := pbMap(w.buf, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"vm": "101", "node": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var bad pbWriter
+	bad.bytes(10, []byte{0x0a, 0x05, 'x'})
+	if _, err := pbMap(bad.buf, 10); err == nil {
+		t.Error("truncated map entry accepted")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variable listing listeners inherited by a freshly exec'd binary as name=fd pairs
+const listenFDsEnv = "VNCWEBPROXY_LISTEN_FDS"
+
+// activeSessions tracks proxied WebSocket sessions; hijacked connections are
+// invisible to http.Server.Shutdown, so draining waits on this instead
+var activeSessions sync.WaitGroup
+
+// deliveries tracks usage records and session webhooks still being sent, so
+// draining doesn't exit with them in flight
+var deliveries sync.WaitGroup
+
+// stopping is closed when the process stops serving, ending long-lived API streams
+// that http.Server.Shutdown would otherwise wait for
+var stopping = make(chan struct{})
+
+var (
+	inheritedOnce sync.Once
+	inherited     map[string]net.Listener
+)
+
+// loadInherited collects listeners passed by a previous process or by systemd
+func loadInherited() {
+	inherited = make(map[string]net.Listener)
+
+	spec := os.Getenv(listenFDsEnv)
+	if spec == "" {
+		ls, err := systemdListeners()
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+		}
+		for name, ln := range ls {
+			inherited[name] = ln
+		}
+		return
+	}
+	os.Unsetenv(listenFDsEnv)
+
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil {
+			fmt.Printf("[ERROR] Invalid inherited listener %q: %v\n", pair, err)
+			continue
+		}
+
+		f := os.NewFile(uintptr(fd), "inherited-"+parts[0])
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to inherit %s listener: %v\n", parts[0], err)
+			continue
+		}
+
+		fmt.Printf("[INFO] Inherited %s listener on %s from previous process\n", parts[0], ln.Addr())
+		inherited[parts[0]] = ln
+	}
+}
+
+// listen returns the named listener inherited from a previous process or systemd, or opens a new one
+func listen(name, addr string) (net.Listener, error) {
+	inheritedOnce.Do(loadInherited)
+
+	if ln, ok := inherited[name]; ok {
+		delete(inherited, name)
+		return ln, nil
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// drainSessions blocks until all proxied WebSocket sessions have finished and
+// their usage records and webhooks were sent
+func drainSessions() {
+	fmt.Printf("[INFO] Waiting for active VNC sessions to finish\n")
+	activeSessions.Wait()
+	fmt.Printf("[INFO] All VNC sessions drained\n")
+	deliveries.Wait()
+}
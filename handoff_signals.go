@@ -0,0 +1,100 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// spawnSuccessor starts a new copy of the current binary that takes over the listeners
+func spawnSuccessor(listeners map[string]net.Listener) error {
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var spec []string
+	for _, name := range names {
+		tl, ok := listeners[name].(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("%s listener %T cannot be handed off", name, listeners[name])
+		}
+
+		f, err := tl.File()
+		if err != nil {
+			return fmt.Errorf("%s listener file: %v", name, err)
+		}
+		// ExtraFiles[i] becomes FD 3+i in the child
+		spec = append(spec, fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate executable: %v", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strings.Join(spec, ","))
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start successor: %v", err)
+	}
+
+	fmt.Printf("[INFO] Started successor process pid=%d\n", cmd.Process.Pid)
+	sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid))
+	return nil
+}
+
+// handleLifecycleSignals hands the listeners to a new binary on SIGUSR2 and
+// stops accepting on SIGINT/SIGTERM; in both cases Run returns once sessions drained
+func handleLifecycleSignals(srv *Server) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range sigc {
+		if sig == syscall.SIGUSR2 {
+			fmt.Printf("[INFO] Received SIGUSR2, handing listeners off to new binary\n")
+			// The successor restores them while starting and owns the file from then on
+			saveRegistrations(srv.cfg)
+			if err := spawnSuccessor(srv.Listeners()); err != nil {
+				fmt.Printf("[ERROR] Listener handoff failed, keeping current process: %v\n", err)
+				continue
+			}
+			atomic.StoreInt32(&srv.handedOff, 1)
+		} else {
+			fmt.Printf("[INFO] Received %v, shutting down\n", sig)
+		}
+
+		signal.Stop(sigc)
+		if sig != syscall.SIGUSR2 {
+			sdNotify("STOPPING=1")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		srv.Shutdown(ctx)
+		cancel()
+		return
+	}
+}
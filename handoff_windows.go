@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handleLifecycleSignals stops accepting on SIGINT/SIGTERM; Windows has no
+// SIGUSR2 and can't pass listeners to a new process, so upgrades restart
+func handleLifecycleSignals(srv *Server) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigc
+	fmt.Printf("[INFO] Received %v, shutting down\n", sig)
+	signal.Stop(sigc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	srv.Shutdown(ctx)
+	cancel()
+}
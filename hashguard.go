@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FailureTracker counts failures per source IP within a sliding window
+type FailureTracker struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	fails  map[string][]time.Time
+}
+
+func NewFailureTracker(limit int, window time.Duration) *FailureTracker {
+	return &FailureTracker{limit: limit, window: window, fails: make(map[string][]time.Time)}
+}
+
+// Fail records a failure for ip, returning the count in the window and whether
+// the limit was reached; reaching it resets the count
+func (ft *FailureTracker) Fail(ip string) (int, bool) {
+	if ft.limit <= 0 {
+		return 0, false
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	now := time.Now()
+	recent := ft.fails[ip][:0]
+	for _, t := range ft.fails[ip] {
+		if now.Sub(t) < ft.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) >= ft.limit {
+		delete(ft.fails, ip)
+		return len(recent), true
+	}
+	ft.fails[ip] = recent
+
+	// Drop IPs that stopped failing so the map does not grow without bound
+	if len(ft.fails) > 10000 {
+		for k, ts := range ft.fails {
+			if now.Sub(ts[len(ts)-1]) >= ft.window {
+				delete(ft.fails, k)
+			}
+		}
+	}
+	return len(recent), false
+}
+
+// Unknown hash lookups per viewer IP, configured in main
+var hashFailures = NewFailureTracker(0, time.Minute)
+
+// recordHashFailure counts lookups of unregistered hashes and bans sources
+// that exceed -hash_fail_limit, stopping enumeration of the :data parameter
+func recordHashFailure(cfg *Config, ip, hash string, err error) {
+	if _, ok := err.(*notFoundError); !ok || cfg.IsControlIP(ip) {
+		return
+	}
+
+	count, exceeded := hashFailures.Fail(ip)
+	fmt.Printf("[WARN] Unknown console hash: ip=%s hash=%s... failures=%d limit=%d window=%v\n",
+		ip, hashTag(hash), count, cfg.HashFailLimit, cfg.HashFailWindow)
+	if exceeded {
+		bans.Ban(ip, cfg.BanDuration, fmt.Sprintf("%d unknown console hashes within %v", count, cfg.HashFailWindow))
+	}
+}
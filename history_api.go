@@ -0,0 +1,176 @@
+//go:build !norecording
+// +build !norecording
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most transcripts returned by one history listing
+const historyLimit = 100
+
+// Session IDs are 16 hex characters, anything else can't name a transcript
+var sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// TranscriptInfo describes a recorded terminal session
+type TranscriptInfo struct {
+	Session SessionInfo `json:"session"`
+	Size    int64       `json:"size"`
+}
+
+// registerHistoryRoutes mounts the transcript history API
+func registerHistoryRoutes(api *gin.Engine, cfg *Config) {
+	api.GET("/api/history", historyHandler(cfg))
+	api.GET("/api/history/search", historySearchHandler(cfg))
+	api.GET("/api/history/:id", historyTranscriptHandler(cfg))
+}
+
+// transcriptPath finds the transcript of a session, "" if there is none
+func transcriptPath(cfg *Config, id string) string {
+	if !sessionIDPattern.MatchString(id) {
+		return ""
+	}
+	matches, _ := filepath.Glob(filepath.Join(cfg.TranscriptDir, "*_"+id+".log"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// readTranscriptHeader returns the session a transcript file was recorded for
+func readTranscriptHeader(path string) (SessionInfo, error) {
+	var info SessionInfo
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return info, err
+	}
+	err = json.Unmarshal(bytes.TrimPrefix(line, []byte("# ")), &info)
+	return info, err
+}
+
+// transcriptContains reports whether a transcript contains q, ignoring case
+func transcriptContains(path, q string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(bytes.ToLower(data), []byte(strings.ToLower(q)))
+}
+
+// GET /api/history lists terminal transcripts, newest first; ?hash= narrows to a
+// hash (its first 8 characters are enough) and ?q= to transcripts containing the text
+func historyHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+		if cfg.TranscriptDir == "" {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"errors": []string{"Transcripts are disabled"},
+			})
+			return
+		}
+
+		hash, q := hashTag(c.Query("hash")), c.Query("q")
+		paths, _ := filepath.Glob(filepath.Join(cfg.TranscriptDir, "*.log"))
+		// Names start with the UTC start time
+		sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+		list := []TranscriptInfo{}
+		for _, path := range paths {
+			if len(list) >= historyLimit {
+				break
+			}
+			info, err := readTranscriptHeader(path)
+			if err != nil || (hash != "" && info.Hash != hash) {
+				continue
+			}
+			if q != "" && !transcriptContains(path, q) {
+				continue
+			}
+			entry := TranscriptInfo{Session: info}
+			if st, err := os.Stat(path); err == nil {
+				entry.Size = st.Size()
+			}
+			list = append(list, entry)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "success",
+			"transcripts": list,
+		})
+	}
+}
+
+// GET /api/history/:id returns the transcript of a session as text
+func historyTranscriptHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+
+		path := ""
+		if cfg.TranscriptDir != "" {
+			path = transcriptPath(cfg, c.Param("id"))
+		}
+		if path == "" {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"errors": []string{"Transcript not found"},
+			})
+			return
+		}
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.File(path)
+	}
+}
+
+// GET /api/history/search?q= finds the transcript lines containing a text, e.g. a
+// command; ?direction=input only searches what viewers typed
+func historySearchHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+		if transcriptIndex == nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"errors": []string{"Transcript index is disabled"},
+			})
+			return
+		}
+
+		q, direction := c.Query("q"), c.Query("direction")
+		if len(searchTokens(q)) == 0 || (direction != "" && direction != "input" && direction != "output") {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"errors": []string{"q must contain a word and direction must be input or output"},
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"results": transcriptIndex.Search(q, direction),
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close code sent to viewers disconnected for being idle, in the private use
+// range so embedding pages can tell it from other closes
+const closeIdleTimeout = 4000
+
+// idleTimeout returns how long a session of item may go without viewer input, 0 for no limit
+func idleTimeout(cfg *Config, item *ProxiedItem) time.Duration {
+	if item.IdleTimeout > 0 {
+		return item.IdleTimeout
+	}
+	return cfg.IdleTimeout
+}
+
+// touchInput records viewer input now
+func (ls *liveSession) touchInput() {
+	atomic.StoreInt64(&ls.lastInput, time.Now().UnixNano())
+}
+
+// idleFor is how long the viewer has sent no input
+func (ls *liveSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&ls.lastInput)))
+}
+
+// watchIdle ends the session once it has been idle for timeout, calling warn
+// (if set) when warning is left; it returns early when done is closed
+func (ls *liveSession) watchIdle(timeout, warning time.Duration, warn func(), done <-chan struct{}) {
+	if warning >= timeout {
+		warning = 0
+	}
+	warned := false
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+
+		idle := ls.idleFor()
+		if idle >= timeout {
+			fmt.Printf("[INFO] Session %s idle for %v, disconnecting\n", ls.info.ID, idle.Round(time.Second))
+			ls.terminateWith(closeIdleTimeout, "session idle")
+			return
+		}
+		if warning > 0 && idle < timeout-warning {
+			// Input arrived since the last warning
+			warned = false
+		}
+		next := timeout - idle
+		if warning > 0 && !warned {
+			if idle >= timeout-warning {
+				fmt.Printf("[INFO] Session %s idle for %v, disconnecting in %v\n", ls.info.ID, idle.Round(time.Second), next.Round(time.Second))
+				if warn != nil {
+					warn()
+				}
+				warned = true
+			} else {
+				next -= warning
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// bellWriter writes backend frames to the viewer and slips an RFB Bell in
+// between two server messages when asked to, warning the viewer before an
+// idle disconnect. The goroutine forwarding backend frames calls next with
+// whether the frame it is about to write ends at a message boundary
+type bellWriter struct {
+	conn messageWriter
+
+	mu       sync.Mutex
+	boundary bool // the viewer got whole server messages so far
+	pending  bool
+
+	nextBoundary bool // only used by the forwarding goroutine
+}
+
+// next tells the writer whether the frame written next ends at a message boundary
+func (bw *bellWriter) next(boundary bool) {
+	bw.nextBoundary = boundary
+}
+
+func (bw *bellWriter) WriteMessage(mt int, data []byte) error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.boundary = false
+	if err := bw.conn.WriteMessage(mt, data); err != nil {
+		return err
+	}
+	bw.boundary = bw.nextBoundary
+	bw.nextBoundary = false
+	if bw.pending && bw.boundary {
+		bw.pending = false
+		return bw.conn.WriteMessage(websocket.BinaryMessage, []byte{2})
+	}
+	return nil
+}
+
+// ring sends a Bell now if the viewer is between messages, otherwise after
+// the next frame that ends at one
+func (bw *bellWriter) ring() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if !bw.boundary {
+		bw.pending = true
+		return
+	}
+	if err := bw.conn.WriteMessage(websocket.BinaryMessage, []byte{2}); err != nil {
+		fmt.Printf("[ERROR] Failed to send idle warning: %v\n", err)
+	}
+}
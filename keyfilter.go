@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Modifiers a blocked key combination can require
+const (
+	keyModCtrl = 1 << iota
+	keyModAlt
+	keyModShift
+	keyModSuper
+)
+
+// Keysyms of the modifier keys, left and right
+var modifierKeysyms = map[uint32]int{
+	0xffe3: keyModCtrl, 0xffe4: keyModCtrl,
+	0xffe9: keyModAlt, 0xffea: keyModAlt, 0xffe7: keyModAlt, 0xffe8: keyModAlt, // Meta counts as Alt
+	0xffe1: keyModShift, 0xffe2: keyModShift,
+	0xffeb: keyModSuper, 0xffec: keyModSuper,
+}
+
+// Named keys of blocked_keys; letters and digits stand for themselves
+var keyNames = map[string][]uint32{
+	"delete":    {0xffff, 0xff9f},
+	"del":       {0xffff, 0xff9f},
+	"backspace": {0xff08},
+	"tab":       {0xff09},
+	"enter":     {0xff0d, 0xff8d},
+	"return":    {0xff0d, 0xff8d},
+	"escape":    {0xff1b},
+	"esc":       {0xff1b},
+	"insert":    {0xff63, 0xff9e},
+	"home":      {0xff50},
+	"end":       {0xff57},
+	"pageup":    {0xff55},
+	"pagedown":  {0xff56},
+	"print":     {0xff61},
+	"sysrq":     {0xff15},
+	"pause":     {0xff13},
+	"break":     {0xff6b},
+	"space":     {0x20},
+}
+
+// Keysyms of F1 and F24, the range of the f* wildcard
+const (
+	keysymF1  = 0xffbe
+	keysymF24 = 0xffd5
+)
+
+// keyRule is one blocked combination, e.g. ctrl+alt+delete
+type keyRule struct {
+	text    string
+	mods    int
+	keysyms []uint32
+}
+
+func (r *keyRule) matches(mods int, keysym uint32) bool {
+	if mods&r.mods != r.mods {
+		return false
+	}
+	for _, k := range r.keysyms {
+		if k == keysym {
+			return true
+		}
+	}
+	return false
+}
+
+// parseKeyRule parses a combination of modifiers (ctrl, alt, shift, super)
+// and one key joined with +; the key may be a name, a letter or digit, f1 to
+// f24, f* for any of those, or a keysym in hex such as 0xffff
+func parseKeyRule(text string) (*keyRule, error) {
+	r := &keyRule{text: strings.ToLower(strings.TrimSpace(text))}
+	parts := strings.Split(r.text, "+")
+	for _, part := range parts[:len(parts)-1] {
+		switch strings.TrimSpace(part) {
+		case "ctrl", "control":
+			r.mods |= keyModCtrl
+		case "alt", "meta":
+			r.mods |= keyModAlt
+		case "shift":
+			r.mods |= keyModShift
+		case "super", "win", "cmd":
+			r.mods |= keyModSuper
+		default:
+			return nil, fmt.Errorf("unknown modifier %q in %q", part, text)
+		}
+	}
+
+	key := strings.TrimSpace(parts[len(parts)-1])
+	switch {
+	case key == "f*":
+		for k := uint32(keysymF1); k <= keysymF24; k++ {
+			r.keysyms = append(r.keysyms, k)
+		}
+	case keyNames[key] != nil:
+		r.keysyms = keyNames[key]
+	case len(key) == 1 && (key[0] >= 'a' && key[0] <= 'z' || key[0] >= '0' && key[0] <= '9'):
+		r.keysyms = []uint32{uint32(key[0])}
+	case len(key) > 1 && key[0] == 'f':
+		n, err := strconv.Atoi(key[1:])
+		if err != nil || n < 1 || n > 24 {
+			return nil, fmt.Errorf("unknown key %q in %q", key, text)
+		}
+		r.keysyms = []uint32{keysymF1 + uint32(n) - 1}
+	case strings.HasPrefix(key, "0x"):
+		k, err := strconv.ParseUint(key[2:], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keysym %q in %q", key, text)
+		}
+		r.keysyms = []uint32{uint32(k)}
+	default:
+		return nil, fmt.Errorf("unknown key %q in %q", key, text)
+	}
+	return r, nil
+}
+
+// parseKeyRules parses a blocked_keys list
+func parseKeyRules(list []string) ([]*keyRule, error) {
+	var rules []*keyRule
+	for _, text := range list {
+		r, err := parseKeyRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// blockedKeys returns the blocked combinations of a registration, falling
+// back to -blocked_keys
+func blockedKeys(cfg *Config, item *ProxiedItem) []string {
+	if len(item.BlockedKeys) > 0 {
+		return item.BlockedKeys
+	}
+	return cfg.BlockedKeys
+}
+
+// keyFilter drops the KeyEvents of blocked combinations sent by one viewer.
+// It follows which modifiers are held; a blocked key's release is dropped too
+type keyFilter struct {
+	session string
+	rules   []*keyRule
+	held    map[uint32]bool // modifier keys currently down
+	blocked map[uint32]bool // keys whose press was dropped
+}
+
+// newKeyFilter returns the filter for a viewer of item, nil when no combination is blocked
+func newKeyFilter(cfg *Config, item *ProxiedItem, session string) *keyFilter {
+	// Validated when registered or at startup
+	rules, _ := parseKeyRules(blockedKeys(cfg, item))
+	if len(rules) == 0 {
+		return nil
+	}
+	return &keyFilter{session: session, rules: rules, held: make(map[uint32]bool), blocked: make(map[uint32]bool)}
+}
+
+// allow reports whether a key press or release may reach the backend
+func (f *keyFilter) allow(down bool, keysym uint32) bool {
+	if _, ok := modifierKeysyms[keysym]; ok {
+		f.held[keysym] = down
+		return true
+	}
+	// Shift turns letters into capitals
+	if keysym >= 'A' && keysym <= 'Z' {
+		keysym += 'a' - 'A'
+	}
+	if !down {
+		if f.blocked[keysym] {
+			delete(f.blocked, keysym)
+			return false
+		}
+		return true
+	}
+
+	mods := 0
+	for k, isDown := range f.held {
+		if isDown {
+			mods |= modifierKeysyms[k]
+		}
+	}
+	for _, r := range f.rules {
+		if r.matches(mods, keysym) {
+			fmt.Printf("[INFO] Session %s: blocked key combination %s\n", f.session, r.text)
+			f.blocked[keysym] = true
+			return false
+		}
+	}
+	return true
+}
+
+// filter returns a viewer frame without the KeyEvents of blocked combinations.
+// Frames that can't be split are forwarded whole
+func (f *keyFilter) filter(msg []byte) []byte {
+	if f == nil {
+		return msg
+	}
+	var out []byte
+	for len(msg) > 0 {
+		size := rfbClientMessageSize(msg)
+		if size < 0 {
+			out = append(out, msg...)
+			break
+		}
+		m := msg[:size]
+		msg = msg[size:]
+
+		switch m[0] {
+		case 4: // KeyEvent
+			if !f.allow(m[1] != 0, binary.BigEndian.Uint32(m[4:8])) {
+				continue
+			}
+		case 255: // QEMU extended KeyEvent
+			if !f.allow(binary.BigEndian.Uint16(m[2:4]) != 0, binary.BigEndian.Uint32(m[4:8])) {
+				continue
+			}
+		}
+		out = append(out, m...)
+	}
+	return out
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prefix of API keys stored as salted hashes: sha256:<salt hex>:<hash hex>
+const hashedKeyPrefix = "sha256:"
+
+// Labels of keys added through the API; -api_keys_file stores label:key per
+// line, so separators in a label would not survive a restart
+var keyLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// unknownKeyError is returned for a label that names no key
+type unknownKeyError struct {
+	label string
+}
+
+func (e *unknownKeyError) Error() string {
+	return fmt.Sprintf("unknown API key label %q", e.label)
+}
+
+// duplicateKeyError is returned when adding a label that is already in use
+type duplicateKeyError struct {
+	label string
+}
+
+func (e *duplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate API key label %q", e.label)
+}
+
+// keySaveError is returned when -api_keys_file could not be written; the
+// change that needed saving has been undone
+type keySaveError struct {
+	err error
+}
+
+func (e *keySaveError) Error() string {
+	return fmt.Sprintf("saving API keys: %v", e.err)
+}
+
+// hashAPIKey returns the stored form of a plaintext key with a random salt
+func hashAPIKey(plain string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return encodeKeyHash(salt, plain)
+}
+
+func encodeKeyHash(salt []byte, plain string) string {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), plain...))
+	return hashedKeyPrefix + hex.EncodeToString(salt) + ":" + hex.EncodeToString(sum[:])
+}
+
+// normalizeAPIKey hashes plaintext keys and validates already hashed ones
+func normalizeAPIKey(value string) (string, error) {
+	if !strings.HasPrefix(value, hashedKeyPrefix) {
+		return hashAPIKey(value), nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, hashedKeyPrefix), ":")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("hashed API key must be sha256:<salt>:<hash>")
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return "", fmt.Errorf("invalid API key salt: %v", err)
+	}
+	if sum, err := hex.DecodeString(parts[1]); err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("invalid API key hash")
+	}
+	return value, nil
+}
+
+// matchAPIKey compares candidate with a stored key in constant time
+func matchAPIKey(stored, candidate string) bool {
+	parts := strings.Split(strings.TrimPrefix(stored, hashedKeyPrefix), ":")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, _ := hex.DecodeString(parts[0])
+	return subtle.ConstantTimeCompare([]byte(encodeKeyHash(salt, candidate)), []byte(stored)) == 1
+}
+
+// APIKey is a control API credential identified by a label. Key holds the salted
+// hash; after a rotation the previous hash keeps working until PreviousExpires
+type APIKey struct {
+	Label           string
+	Key             string
+	Previous        string
+	PreviousExpires time.Time
+
+	// Kept in -api_keys_file; keys given on the command line are never written there
+	persisted bool
+}
+
+// KeyRing holds the API keys accepted by the control API
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys []APIKey
+
+	// File the ring is written back to after runtime changes, if any
+	path string
+}
+
+// NewKeyRing creates a key ring, rejecting duplicate labels
+func NewKeyRing(keys []APIKey) (*KeyRing, error) {
+	kr := &KeyRing{}
+	for _, k := range keys {
+		if err := kr.Add(k); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// Add registers a new key, persisting it once the ring is backed by a file
+func (kr *KeyRing) Add(k APIKey) error {
+	if k.Label == "" || k.Key == "" {
+		return fmt.Errorf("API key label and value must not be empty")
+	}
+	hashed, err := normalizeAPIKey(k.Key)
+	if err != nil {
+		return fmt.Errorf("API key %q: %v", k.Label, err)
+	}
+	k.Key = hashed
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for _, existing := range kr.keys {
+		if existing.Label == k.Label {
+			return &duplicateKeyError{label: k.Label}
+		}
+	}
+	if kr.path != "" {
+		k.persisted = true
+	}
+	kr.keys = append(kr.keys, k)
+	if err := kr.saveLocked(); err != nil {
+		kr.keys = kr.keys[:len(kr.keys)-1]
+		return err
+	}
+	return nil
+}
+
+// Lookup returns the label of the key matching value; every key is compared
+// so the time taken does not reveal which one matched
+func (kr *KeyRing) Lookup(value string) (string, bool) {
+	if value == "" {
+		return "", false
+	}
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	now := time.Now()
+	label, found := "", false
+	for _, k := range kr.keys {
+		match := k.Key != "" && matchAPIKey(k.Key, value)
+		if k.Previous != "" && matchAPIKey(k.Previous, value) && now.Before(k.PreviousExpires) {
+			match = true
+		}
+		if match && !found {
+			label, found = k.Label, true
+		}
+	}
+	return label, found
+}
+
+// Rotate replaces the key of label with newKey; the old value stays valid for overlap
+func (kr *KeyRing) Rotate(label, newKey string, overlap time.Duration) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for i := range kr.keys {
+		if kr.keys[i].Label != label {
+			continue
+		}
+		if kr.keys[i].Key != "" && matchAPIKey(kr.keys[i].Key, newKey) {
+			return fmt.Errorf("new key must differ from the current one")
+		}
+		hashed, err := normalizeAPIKey(newKey)
+		if err != nil {
+			return err
+		}
+		old := kr.keys[i]
+		kr.keys[i].Previous = kr.keys[i].Key
+		kr.keys[i].PreviousExpires = time.Now().Add(overlap)
+		kr.keys[i].Key = hashed
+		if err := kr.saveLocked(); err != nil {
+			kr.keys[i] = old
+			return err
+		}
+		return nil
+	}
+	return &unknownKeyError{label: label}
+}
+
+// Remove revokes a key; with a positive overlap it keeps working until then
+func (kr *KeyRing) Remove(label string, overlap time.Duration) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for i := range kr.keys {
+		if kr.keys[i].Label != label {
+			continue
+		}
+		old := append([]APIKey(nil), kr.keys...)
+		if overlap > 0 {
+			kr.keys[i].Previous = kr.keys[i].Key
+			kr.keys[i].PreviousExpires = time.Now().Add(overlap)
+			kr.keys[i].Key = ""
+		} else {
+			kr.keys = append(kr.keys[:i], kr.keys[i+1:]...)
+		}
+		if err := kr.saveLocked(); err != nil {
+			kr.keys = old
+			return err
+		}
+		return nil
+	}
+	return &unknownKeyError{label: label}
+}
+
+// Info describes the keys without their values
+func (kr *KeyRing) Info() []gin.H {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	now := time.Now()
+	out := make([]gin.H, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		info := gin.H{"label": k.Label, "active": k.Key != ""}
+		if k.Previous != "" && now.Before(k.PreviousExpires) {
+			info["previous_expires"] = k.PreviousExpires.UTC().Format(time.RFC3339)
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// Persist makes later runtime changes to file-backed keys survive a restart
+func (kr *KeyRing) Persist(path string, fromFile []APIKey) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	kr.path = path
+	for i := range kr.keys {
+		for _, f := range fromFile {
+			if f.Label == kr.keys[i].Label {
+				kr.keys[i].persisted = true
+			}
+		}
+	}
+}
+
+// Persisted reports whether changes to label are written to -api_keys_file
+func (kr *KeyRing) Persisted(label string) bool {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	for _, k := range kr.keys {
+		if k.Label == label {
+			return k.persisted
+		}
+	}
+	return false
+}
+
+// saveLocked writes file-backed keys back to -api_keys_file
+func (kr *KeyRing) saveLocked() error {
+	if kr.path == "" {
+		return nil
+	}
+
+	var buf strings.Builder
+	buf.WriteString("# Managed by vncwebproxy, label:sha256:<salt>:<hash> per line\n")
+	for _, k := range kr.keys {
+		if k.Key != "" && k.persisted {
+			fmt.Fprintf(&buf, "%s:%s\n", k.Label, k.Key)
+		}
+	}
+
+	tmp := kr.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0600); err != nil {
+		return &keySaveError{err: err}
+	}
+	if err := os.Rename(tmp, kr.path); err != nil {
+		return &keySaveError{err: err}
+	}
+	return nil
+}
+
+// Labels returns the labels of all keys
+func (kr *KeyRing) Labels() []string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	labels := make([]string, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		labels = append(labels, k.Label)
+	}
+	return labels
+}
+
+// parseAPIKeys parses "label:key" pairs separated by commas; key may be plaintext or hashed
+func parseAPIKeys(value string) ([]APIKey, error) {
+	var keys []APIKey
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected label:key, got %q", item)
+		}
+		keys = append(keys, APIKey{Label: strings.TrimSpace(parts[0]), Key: strings.TrimSpace(parts[1])})
+	}
+	return keys, nil
+}
+
+// loadAPIKeysFile reads "label:key" lines, ignoring blanks and # comments
+func loadAPIKeysFile(path string) ([]APIKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []APIKey
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parsed, err := parseAPIKeys(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, parsed...)
+	}
+	return keys, scanner.Err()
+}
+
+// hashKeyCommand implements "vncwebproxy hash-key <key>", printing the value to put in config
+func hashKeyCommand(args []string) int {
+	if len(args) != 1 || args[0] == "" {
+		fmt.Fprintf(os.Stderr, "Usage: vncwebproxy hash-key <key>\n")
+		return 2
+	}
+	fmt.Println(hashAPIKey(args[0]))
+	return 0
+}
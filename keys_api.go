@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default time an old key keeps working after rotation
+const defaultKeyOverlap = 5 * time.Minute
+
+// Body for adding or rotating a key; an empty key is generated by the proxy
+type keyRequest struct {
+	Label          string `json:"label"`
+	Key            string `json:"key"`
+	OverlapSeconds int    `json:"overlap_seconds"`
+}
+
+func generateAPIKey() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func keyError(c *gin.Context, status int, msg string) {
+	c.JSON(status, gin.H{
+		"status": "error",
+		"errors": []string{msg},
+	})
+}
+
+// keyErrorStatus maps a KeyRing error to the HTTP status answering it
+func keyErrorStatus(err error) int {
+	switch err.(type) {
+	case *unknownKeyError:
+		return http.StatusNotFound
+	case *duplicateKeyError:
+		return http.StatusConflict
+	case *keySaveError:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// isAdminKey reports whether principal is listed in -admin_keys
+func (cfg *Config) isAdminKey(principal string) bool {
+	for _, k := range cfg.AdminKeys {
+		if k == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeKeyAdmin limits key management to the principals in -admin_keys, so
+// one leaked integration key can't mint keys or lock out the others; principals
+// bound to namespaces are refused too, a key they added would escape the binding
+func authorizeKeyAdmin(cfg *Config, c *gin.Context) bool {
+	principal := principalOf(c)
+	if len(cfg.boundNamespaces(principal)) > 0 {
+		fmt.Printf("[WARN] Key management refused to %s, bound to namespaces\n", principal)
+		keyError(c, http.StatusForbidden, "keys bound to namespaces can't manage API keys")
+		return false
+	}
+	if !cfg.isAdminKey(principal) {
+		fmt.Printf("[WARN] Key management refused to %s, not in -admin_keys\n", principal)
+		keyError(c, http.StatusForbidden, "key management needs a key listed in -admin_keys")
+		return false
+	}
+	return true
+}
+
+// GET /api/keys
+func listKeysHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) || !authorizeKeyAdmin(cfg, c) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "keys": cfg.APIKeys.Info()})
+	}
+}
+
+// POST /api/keys
+func addKeyHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) || !authorizeKeyAdmin(cfg, c) {
+			return
+		}
+
+		var req keyRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Label == "" {
+			keyError(c, http.StatusBadRequest, "Invalid JSON or missing label")
+			return
+		}
+		if !keyLabelPattern.MatchString(req.Label) {
+			keyError(c, http.StatusBadRequest, "label may only contain letters, digits, '_', '.' and '-'")
+			return
+		}
+		if req.Key == "" {
+			req.Key = generateAPIKey()
+		}
+
+		if err := cfg.APIKeys.Add(APIKey{Label: req.Label, Key: req.Key}); err != nil {
+			if _, ok := err.(*keySaveError); ok {
+				fmt.Printf("[ERROR] API key %s not added: %v\n", req.Label, err)
+			}
+			keyError(c, keyErrorStatus(err), err.Error())
+			return
+		}
+
+		fmt.Printf("[INFO] API key %s added by %s\n", req.Label, principalOf(c))
+		c.JSON(http.StatusOK, gin.H{"status": "success", "label": req.Label, "key": req.Key})
+	}
+}
+
+// POST /api/keys/:label/rotate
+func rotateKeyHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) || !authorizeKeyAdmin(cfg, c) {
+			return
+		}
+
+		var req keyRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				keyError(c, http.StatusBadRequest, "Invalid JSON")
+				return
+			}
+		}
+		if req.Key == "" {
+			req.Key = generateAPIKey()
+		}
+		overlap := defaultKeyOverlap
+		if req.OverlapSeconds > 0 {
+			overlap = time.Duration(req.OverlapSeconds) * time.Second
+		}
+
+		label := c.Param("label")
+		if err := cfg.APIKeys.Rotate(label, req.Key, overlap); err != nil {
+			if _, ok := err.(*keySaveError); ok {
+				fmt.Printf("[ERROR] API key %s not rotated: %v\n", label, err)
+			}
+			keyError(c, keyErrorStatus(err), err.Error())
+			return
+		}
+
+		fmt.Printf("[INFO] API key %s rotated by %s, old key valid for %v\n", label, principalOf(c), overlap)
+		if !cfg.APIKeys.Persisted(label) {
+			fmt.Printf("[WARN] API key %s comes from the command line, the rotation is lost on restart\n", label)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":           "success",
+			"label":            label,
+			"key":              req.Key,
+			"previous_expires": time.Now().Add(overlap).UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// DELETE /api/keys/:label?overlap_seconds=N
+func deleteKeyHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) || !authorizeKeyAdmin(cfg, c) {
+			return
+		}
+
+		var overlap time.Duration
+		if raw := c.Query("overlap_seconds"); raw != "" {
+			d, err := time.ParseDuration(raw + "s")
+			if err != nil {
+				keyError(c, http.StatusBadRequest, "overlap_seconds must be a number")
+				return
+			}
+			overlap = d
+		}
+
+		label := c.Param("label")
+		if err := cfg.APIKeys.Remove(label, overlap); err != nil {
+			if _, ok := err.(*keySaveError); ok {
+				fmt.Printf("[ERROR] API key %s not retired: %v\n", label, err)
+			}
+			keyError(c, keyErrorStatus(err), err.Error())
+			return
+		}
+
+		fmt.Printf("[INFO] API key %s retired by %s (overlap %v)\n", label, principalOf(c), overlap)
+		c.JSON(http.StatusOK, gin.H{"status": "success", "label": label})
+	}
+}
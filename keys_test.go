@@ -0,0 +1,161 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeAPIKey(t *testing.T) {
+	valid := encodeKeyHash([]byte("0123456789abcdef"), "secret")
+
+	tests := []struct {
+		name    string
+		value   string
+		hashed  bool // the result is value itself
+		wantErr bool
+	}{
+		{name: "plaintext", value: "secret"},
+		{name: "plaintext with colon", value: "se:cret"},
+		{name: "already hashed", value: valid, hashed: true},
+		{name: "empty salt", value: hashedKeyPrefix + ":" + strings.Repeat("00", 32), hashed: true},
+		{name: "missing hash", value: hashedKeyPrefix + "00", wantErr: true},
+		{name: "extra field", value: valid + ":00", wantErr: true},
+		{name: "salt not hex", value: hashedKeyPrefix + "zz:" + strings.Repeat("00", 32), wantErr: true},
+		{name: "hash not hex", value: hashedKeyPrefix + "00:" + strings.Repeat("zz", 32), wantErr: true},
+		{name: "hash too short", value: hashedKeyPrefix + "00:" + strings.Repeat("00", 31), wantErr: true},
+		{name: "hash too long", value: hashedKeyPrefix + "00:" + strings.Repeat("00", 33), wantErr: true},
+		{name: "prefix only", value: hashedKeyPrefix, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeAPIKey(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.hashed && got != tt.value {
+				t.Errorf("hashed key changed to %q", got)
+			}
+			if !tt.hashed && !matchAPIKey(got, tt.value) {
+				t.Errorf("stored form %q doesn't match the plaintext", got)
+			}
+		})
+	}
+}
+
+func TestMatchAPIKey(t *testing.T) {
+	stored := hashAPIKey("secret")
+
+	tests := []struct {
+		name      string
+		stored    string
+		candidate string
+		want      bool
+	}{
+		{name: "match", stored: stored, candidate: "secret", want: true},
+		{name: "wrong key", stored: stored, candidate: "secreT"},
+		{name: "prefix of key", stored: stored, candidate: "secre"},
+		{name: "empty candidate", stored: stored, candidate: ""},
+		{name: "stored hash as candidate", stored: stored, candidate: stored},
+		{name: "malformed stored", stored: hashedKeyPrefix + "00", candidate: "secret"},
+		{name: "empty stored", stored: "", candidate: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchAPIKey(tt.stored, tt.candidate); got != tt.want {
+				t.Errorf("matchAPIKey = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashAPIKeySalted(t *testing.T) {
+	if hashAPIKey("secret") == hashAPIKey("secret") {
+		t.Error("two hashes of one key are equal, the salt is not random")
+	}
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []APIKey
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{name: "one", value: "prod:k1", want: []APIKey{{Label: "prod", Key: "k1"}}},
+		{name: "spaces", value: " prod : k1 , dev:k2", want: []APIKey{{Label: "prod", Key: "k1"}, {Label: "dev", Key: "k2"}}},
+		{name: "hashed key", value: "prod:sha256:00:11", want: []APIKey{{Label: "prod", Key: "sha256:00:11"}}},
+		{name: "missing key", value: "prod", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAPIKeys(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d keys, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i].Label != tt.want[i].Label || got[i].Key != tt.want[i].Key {
+					t.Errorf("key %d = %s:%s, want %s:%s", i, got[i].Label, got[i].Key, tt.want[i].Label, tt.want[i].Key)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyRingErrors(t *testing.T) {
+	kr, err := NewKeyRing([]APIKey{{Label: "prod", Key: "k1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := kr.Add(APIKey{Label: "prod", Key: "k2"}).(*duplicateKeyError); !ok {
+		t.Error("duplicate label not reported as duplicateKeyError")
+	}
+	if _, ok := kr.Rotate("dev", "k2", time.Minute).(*unknownKeyError); !ok {
+		t.Error("rotating an unknown label not reported as unknownKeyError")
+	}
+	if _, ok := kr.Remove("dev", 0).(*unknownKeyError); !ok {
+		t.Error("removing an unknown label not reported as unknownKeyError")
+	}
+
+	// Writes into a missing directory fail and leave the ring unchanged
+	kr.Persist(filepath.Join(t.TempDir(), "missing", "keys"), nil)
+	if _, ok := kr.Add(APIKey{Label: "dev", Key: "k2"}).(*keySaveError); !ok {
+		t.Error("failed write not reported as keySaveError")
+	}
+	if _, ok := kr.Lookup("k2"); ok {
+		t.Error("key kept after its write failed")
+	}
+	if _, ok := kr.Rotate("prod", "k3", time.Minute).(*keySaveError); !ok {
+		t.Error("failed rotation write not reported as keySaveError")
+	}
+	if _, ok := kr.Lookup("k3"); ok {
+		t.Error("rotated key kept after its write failed")
+	}
+	if _, ok := kr.Remove("prod", 0).(*keySaveError); !ok {
+		t.Error("failed removal write not reported as keySaveError")
+	}
+	if label, ok := kr.Lookup("k1"); !ok || label != "prod" {
+		t.Error("key lost after its removal failed to save")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Minute buckets kept per principal for rate and baseline calculations
+const statsWindowMinutes = 60
+
+// principalStats holds registration/session counters for one API key
+type principalStats struct {
+	registrations int64
+	sessions      int64
+	buckets       [statsWindowMinutes]int64
+	bucketMinute  [statsWindowMinutes]int64
+	hosts         map[string]int64
+	lastSpikeWarn time.Time
+}
+
+// KeyStats attributes control-plane activity to the authenticating principal
+type KeyStats struct {
+	mu         sync.Mutex
+	principals map[string]*principalStats
+
+	spikeFactor  float64
+	spikeMinimum int64
+	hostsWarmup  int64
+}
+
+// NewKeyStats creates a tracker; a spike is flagged when the current minute exceeds
+// both spikeMinimum and spikeFactor times the hourly per-minute average
+func NewKeyStats(spikeFactor float64, spikeMinimum, hostsWarmup int64) *KeyStats {
+	return &KeyStats{
+		principals:   make(map[string]*principalStats),
+		spikeFactor:  spikeFactor,
+		spikeMinimum: spikeMinimum,
+		hostsWarmup:  hostsWarmup,
+	}
+}
+
+func (ks *KeyStats) get(principal string) *principalStats {
+	ps, ok := ks.principals[principal]
+	if !ok {
+		ps = &principalStats{hosts: make(map[string]int64)}
+		ks.principals[principal] = ps
+	}
+	return ps
+}
+
+// RecordRegistration counts a registration and checks it for anomalies
+func (ks *KeyStats) RecordRegistration(principal, targetHost string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	minute := now.Unix() / 60
+	ps := ks.get(principal)
+
+	idx := minute % statsWindowMinutes
+	if ps.bucketMinute[idx] != minute {
+		ps.bucketMinute[idx] = minute
+		ps.buckets[idx] = 0
+	}
+	ps.buckets[idx]++
+	ps.registrations++
+
+	if _, seen := ps.hosts[targetHost]; !seen && ps.registrations > ks.hostsWarmup {
+		fmt.Printf("[WARN] Anomaly: principal %s registered unusual target host %s\n", principal, targetHost)
+	}
+	ps.hosts[targetHost]++
+
+	current, avg := ps.rates(minute)
+	if current >= ks.spikeMinimum && float64(current) > ks.spikeFactor*avg && now.Sub(ps.lastSpikeWarn) > time.Minute {
+		ps.lastSpikeWarn = now
+		fmt.Printf("[WARN] Anomaly: principal %s registration spike %d/min (hourly average %.1f/min)\n",
+			principal, current, avg)
+	}
+}
+
+// RecordSession counts a WebSocket session opened for a principal's registration
+func (ks *KeyStats) RecordSession(principal string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.get(principal).sessions++
+}
+
+// rates returns registrations in the current minute and the per-minute average of the previous hour
+func (ps *principalStats) rates(minute int64) (int64, float64) {
+	var current, previous int64
+	for i := 0; i < statsWindowMinutes; i++ {
+		m := ps.bucketMinute[i]
+		switch {
+		case m == minute:
+			current = ps.buckets[i]
+		case m > minute-statsWindowMinutes:
+			previous += ps.buckets[i]
+		}
+	}
+	return current, float64(previous) / float64(statsWindowMinutes-1)
+}
+
+// Snapshot returns counters and rates for every principal
+func (ks *KeyStats) Snapshot() map[string]interface{} {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	minute := time.Now().Unix() / 60
+	out := make(map[string]interface{}, len(ks.principals))
+	for name, ps := range ks.principals {
+		current, avg := ps.rates(minute)
+		out[name] = map[string]interface{}{
+			"registrations":            ps.registrations,
+			"sessions":                 ps.sessions,
+			"registrations_per_minute": current,
+			"hourly_average":           avg,
+			"target_hosts":             len(ps.hosts),
+		}
+	}
+	return out
+}
+
+// Per-principal activity counters
+var keyStats = NewKeyStats(5, 30, 20)
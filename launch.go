@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scaling modes of the launcher page: noVNC scales the picture to the window
+// (local), asks the VM to resize its display (remote) or shows it 1:1 (none)
+const (
+	scalingLocal  = "local"
+	scalingRemote = "remote"
+	scalingNone   = "none"
+)
+
+// ViewerOptions are the noVNC settings /launch/:hash starts the viewer with,
+// registered with the console as "viewer"
+type ViewerOptions struct {
+	Scaling string `json:"scaling,omitempty"`
+	// JPEG quality and compression levels, 0-9; unset keeps noVNC's defaults
+	Quality     *int `json:"quality,omitempty"`
+	Compression *int `json:"compression,omitempty"`
+	ViewOnly    bool `json:"view_only,omitempty"`
+}
+
+// validate checks the options of a registration for console
+func (o *ViewerOptions) validate(console string) error {
+	if console == consoleXterm {
+		return fmt.Errorf("viewer is only available for VNC consoles")
+	}
+	switch o.Scaling {
+	case "", scalingLocal, scalingRemote, scalingNone:
+	default:
+		return fmt.Errorf("viewer.scaling must be local, remote or none")
+	}
+	if o.Quality != nil && (*o.Quality < 0 || *o.Quality > 9) {
+		return fmt.Errorf("viewer.quality must be between 0 and 9")
+	}
+	if o.Compression != nil && (*o.Compression < 0 || *o.Compression > 9) {
+		return fmt.Errorf("viewer.compression must be between 0 and 9")
+	}
+	return nil
+}
+
+// launchOptions are what the launcher page gets: the viewer options and, with
+// -resume_grace, how long it may reconnect after losing its connection
+type launchOptions struct {
+	ViewerOptions
+	ResumeGrace float64 `json:"resume_grace,omitempty"`
+}
+
+// viewerOptions returns the settings the launcher passes to noVNC for item;
+// viewers of read-only and observer hashes always start view-only
+func viewerOptions(item *ProxiedItem) ViewerOptions {
+	var o ViewerOptions
+	if item.Viewer != nil {
+		o = *item.Viewer
+	}
+	if o.Scaling == "" {
+		o.Scaling = scalingLocal
+	}
+	o.ViewOnly = o.ViewOnly || item.ReadOnly || item.ShadowOf != ""
+	return o
+}
+
+// GET /launch/:hash renders the console page with the registration's viewer options
+func launchHandler(cfg *Config, script string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		hash := c.Param("hash")
+
+		item, err := lookupItem(cfg, hash)
+		if err == nil && !item.ExpiresAt.IsZero() && expiredWithSkew(cfg, item.ExpiresAt) {
+			err = &notFoundError{key: hash}
+		}
+		if err != nil {
+			if _, notFound := err.(*notFoundError); notFound {
+				recordHashFailure(cfg, c.ClientIP(), hash, err)
+				c.String(http.StatusNotFound, "Console not found or expired\n")
+				return
+			}
+			if isStatelessToken(cfg, hash) {
+				fmt.Printf("[WARN] Launcher refused %s: %v\n", hashTag(hash), err)
+				c.String(http.StatusBadRequest, "Invalid console token\n")
+				return
+			}
+			fmt.Printf("[ERROR] Failed to look up %s for the launcher: %v\n", hashTag(hash), err)
+			c.String(http.StatusServiceUnavailable, "Storage unavailable\n")
+			return
+		}
+		if item.Console == consoleXterm {
+			c.String(http.StatusBadRequest, "Terminal consoles can't be opened with the VNC viewer\n")
+			return
+		}
+		if item.Console == consoleSpice {
+			c.String(http.StatusBadRequest, "SPICE consoles open with /spice/<hash>/console.vv in remote-viewer\n")
+			return
+		}
+
+		opts := launchOptions{ViewerOptions: viewerOptions(item)}
+		if cfg.ResumeGrace > 0 {
+			opts.ResumeGrace = cfg.ResumeGrace.Seconds()
+		}
+		options, _ := json.Marshal(opts)
+		page := fmt.Sprintf(consolePage, html.EscapeString(string(options)), script)
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Log lines kept for ?tail= of /api/logs
+const logBacklog = 500
+
+// Levels of the [LEVEL] prefixes, in increasing severity
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// LogLine is one line of the proxy's log as streamed by /api/logs
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// parseLogLine splits the [LEVEL] prefix off a line; lines without one are info
+func parseLogLine(now time.Time, line string) LogLine {
+	l := LogLine{Time: now, Level: "info", Message: line}
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			level := strings.ToLower(line[1:i])
+			if _, ok := logLevels[level]; ok {
+				l.Level, l.Message = level, line[i+2:]
+			}
+		}
+	}
+	return l
+}
+
+// logHub tees the process's stdout, where every log line is printed, to
+// /api/logs subscribers; slow subscribers miss lines rather than blocking logging
+type logHub struct {
+	mu          sync.Mutex
+	recent      []LogLine
+	subscribers map[chan LogLine]struct{}
+}
+
+var (
+	logs        = &logHub{subscribers: make(map[chan LogLine]struct{})}
+	captureOnce sync.Once
+
+	// Set by captureLogs for flushLogs
+	captureWriter *os.File
+	captureStdout *os.File
+	captureDone   = make(chan struct{})
+)
+
+// captureLogs replaces os.Stdout with a pipe feeding logs, copying everything to the real stdout
+func captureLogs() {
+	captureOnce.Do(func() {
+		r, w, err := os.Pipe()
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to capture the log for /api/logs: %v\n", err)
+			return
+		}
+		captureWriter, captureStdout = w, os.Stdout
+		os.Stdout = w
+
+		go func() {
+			defer close(captureDone)
+			br := bufio.NewReader(r)
+			for {
+				line, err := br.ReadString('\n')
+				if line != "" {
+					captureStdout.WriteString(line)
+					logs.publish(parseLogLine(time.Now(), strings.TrimRight(line, "\r\n")))
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+}
+
+// flushLogs puts the real stdout back and waits until every captured line was
+// written to it; called before the process exits
+func flushLogs() {
+	if captureWriter == nil {
+		return
+	}
+	os.Stdout = captureStdout
+	captureWriter.Close()
+	<-captureDone
+}
+
+func (lh *logHub) publish(l LogLine) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+
+	if len(lh.recent) == logBacklog {
+		copy(lh.recent, lh.recent[1:])
+		lh.recent = lh.recent[:logBacklog-1]
+	}
+	lh.recent = append(lh.recent, l)
+	for ch := range lh.subscribers {
+		select {
+		case ch <- l:
+		default:
+		}
+	}
+}
+
+// Subscribe returns up to tail recent lines, a channel of new ones and a function to stop receiving them
+func (lh *logHub) Subscribe(tail int) ([]LogLine, <-chan LogLine, func()) {
+	ch := make(chan LogLine, 256)
+
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+
+	if tail > len(lh.recent) {
+		tail = len(lh.recent)
+	}
+	backlog := append([]LogLine(nil), lh.recent[len(lh.recent)-tail:]...)
+	lh.subscribers[ch] = struct{}{}
+
+	return backlog, ch, func() {
+		lh.mu.Lock()
+		delete(lh.subscribers, ch)
+		lh.mu.Unlock()
+	}
+}
+
+// logFilter selects the lines a /api/logs client asked for
+type logFilter struct {
+	minLevel int
+	session  string
+}
+
+func (f logFilter) match(l LogLine) bool {
+	return logLevels[l.Level] >= f.minLevel && (f.session == "" || strings.Contains(l.Message, f.session))
+}
+
+// GET /api/logs upgrades to a WebSocket streaming log lines as JSON;
+// ?level= sets the lowest level, ?session= keeps lines mentioning a session
+// ID (or hash prefix) and ?tail= first sends that many recent lines
+func logsHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) || !requireAdminSession(cfg, c) {
+			return
+		}
+
+		filter := logFilter{minLevel: logLevels["info"], session: c.Query("session")}
+		if level := strings.ToLower(c.Query("level")); level != "" {
+			min, ok := logLevels[level]
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "error",
+					"errors": []string{"level must be debug, info, warn or error"},
+				})
+				return
+			}
+			filter.minLevel = min
+		}
+		tail, _ := strconv.Atoi(c.Query("tail"))
+
+		conn, err := (&websocket.Upgrader{HandshakeTimeout: 10 * time.Second}).Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			fmt.Printf("[ERROR] Log stream upgrade failed: %v\n", err)
+			return
+		}
+		defer conn.Close()
+
+		backlog, lines, cancel := logs.Subscribe(tail)
+		defer cancel()
+
+		fmt.Printf("[INFO] Log stream started by %s (%s)\n", c.ClientIP(), principalOf(c))
+		defer fmt.Printf("[INFO] Log stream ended for %s\n", c.ClientIP())
+
+		// Reading is only needed to notice the client going away
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for _, l := range backlog {
+			if filter.match(l) {
+				if err := conn.WriteJSON(l); err != nil {
+					return
+				}
+			}
+		}
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case l := <-lines:
+				if !filter.match(l) {
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err := conn.WriteJSON(l); err != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			case <-stopping:
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "proxy stopping"),
+					time.Now().Add(time.Second))
+				return
+			}
+		}
+	}
+}
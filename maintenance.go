@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaintenanceState describes whether new registrations and sessions are refused
+type MaintenanceState struct {
+	Enabled    bool       `json:"enabled"`
+	RetryAfter int        `json:"retry_after"`
+	Message    string     `json:"message,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+var (
+	maintenanceMu sync.RWMutex
+	maintenance   MaintenanceState
+)
+
+func currentMaintenance() MaintenanceState {
+	maintenanceMu.RLock()
+	defer maintenanceMu.RUnlock()
+	return maintenance
+}
+
+// rejectIfMaintenance answers 503 with Retry-After while maintenance is enabled;
+// existing sessions are unaffected because only new requests pass through here
+func rejectIfMaintenance(c *gin.Context) bool {
+	m := currentMaintenance()
+	if !m.Enabled {
+		return false
+	}
+
+	fmt.Printf("[INFO] Rejected %s %s from %s: maintenance mode\n", c.Request.Method, c.Request.URL.Path, c.ClientIP())
+	c.Header("Retry-After", strconv.Itoa(m.RetryAfter))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"status":      "error",
+		"code":        "maintenance",
+		"errors":      []string{"Proxy is in maintenance mode"},
+		"message":     m.Message,
+		"retry_after": m.RetryAfter,
+	})
+	return true
+}
+
+// PUT /api/maintenance
+func maintenanceHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+
+		var req MaintenanceState
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"errors": []string{"Invalid JSON or missing fields"},
+			})
+			return
+		}
+		if req.RetryAfter <= 0 {
+			req.RetryAfter = 300
+		}
+
+		maintenanceMu.Lock()
+		if req.Enabled && !maintenance.Enabled {
+			now := time.Now()
+			req.Since = &now
+		} else if req.Enabled {
+			req.Since = maintenance.Since
+		}
+		if !req.Enabled {
+			req = MaintenanceState{}
+		}
+		maintenance = req
+		maintenanceMu.Unlock()
+
+		if req.Enabled {
+			fmt.Printf("[INFO] Maintenance mode enabled by %s (retry after %ds)\n", c.ClientIP(), req.RetryAfter)
+		} else {
+			fmt.Printf("[INFO] Maintenance mode disabled by %s\n", c.ClientIP())
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "success",
+			"maintenance": req,
+		})
+	}
+}
+
+// GET /api/maintenance
+func maintenanceStatusHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "success",
+			"maintenance": currentMaintenance(),
+		})
+	}
+}
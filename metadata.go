@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Limits of the metadata a registration may carry
+const (
+	metadataMaxKeys  = 16
+	metadataMaxValue = 256
+)
+
+// Metadata keys are short identifiers so they work as log fields and labels
+var metadataKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// validateMetadata checks the metadata of a registration
+func validateMetadata(m map[string]string) error {
+	if len(m) > metadataMaxKeys {
+		return fmt.Errorf("metadata may have at most %d keys", metadataMaxKeys)
+	}
+	for k, v := range m {
+		if !metadataKeyPattern.MatchString(k) {
+			return fmt.Errorf("metadata key %q must be lower case letters, digits and _", k)
+		}
+		if len(v) > metadataMaxValue {
+			return fmt.Errorf("metadata value of %q is longer than %d bytes", k, metadataMaxValue)
+		}
+	}
+	return nil
+}
+
+// formatMetadata renders metadata as " key=value ..." in key order for log lines
+func formatMetadata(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%q", k, m[k])
+	}
+	return b.String()
+}
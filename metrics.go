@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyStats keeps a rolling window of latency samples for percentile reporting
+type LatencyStats struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   int64
+}
+
+// NewLatencyStats creates a window holding the last size samples
+func NewLatencyStats(size int) *LatencyStats {
+	return &LatencyStats{samples: make([]time.Duration, 0, size)}
+}
+
+// Observe records a single sample
+func (ls *LatencyStats) Observe(d time.Duration) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if len(ls.samples) < cap(ls.samples) {
+		ls.samples = append(ls.samples, d)
+	} else {
+		ls.samples[ls.next] = d
+		ls.next = (ls.next + 1) % len(ls.samples)
+	}
+	ls.count++
+}
+
+// Percentiles returns the total sample count and p50/p90/p99 in milliseconds
+func (ls *LatencyStats) Percentiles() map[string]interface{} {
+	ls.mu.Lock()
+	sorted := make([]time.Duration, len(ls.samples))
+	copy(sorted, ls.samples)
+	count := ls.count
+	ls.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	pct := func(p float64) float64 {
+		if len(sorted) == 0 {
+			return 0
+		}
+		idx := int(p * float64(len(sorted)-1))
+		return float64(sorted[idx]) / float64(time.Millisecond)
+	}
+
+	return map[string]interface{}{
+		"count":  count,
+		"window": len(sorted),
+		"p50_ms": pct(0.50),
+		"p90_ms": pct(0.90),
+		"p99_ms": pct(0.99),
+	}
+}
+
+// Time from client upgrade to the first backend->client message
+var firstFrameLatency = NewLatencyStats(1024)
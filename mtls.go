@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Values of -client_cert
+const (
+	clientCertRequired    = "required"
+	clientCertAlternative = "alternative"
+)
+
+// loadAPITLS builds the TLS config of the listener serving /api, asking for
+// client certificates signed by -client_ca when one is configured
+func loadAPITLS(cfg *Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading -tls_cert/-tls_key: %v", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading -client_ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCA)
+		}
+		tlsCfg.ClientCAs = pool
+		// Viewers sharing the listener connect without a certificate
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsCfg, nil
+}
+
+// clientCertPrincipal returns "cert:<CN>" for a request with a verified client certificate
+func clientCertPrincipal(c *gin.Context) (string, bool) {
+	tlsState := c.Request.TLS
+	if tlsState == nil || len(tlsState.VerifiedChains) == 0 {
+		return "", false
+	}
+	return "cert:" + tlsState.VerifiedChains[0][0].Subject.CommonName, true
+}
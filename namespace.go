@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Namespace groups the hashes of one integration, e.g. "whmcs:abc123", with its own policy
+type Namespace struct {
+	// API key labels (or cert:<CN> principals) allowed to register into the namespace
+	Keys []string `json:"keys"`
+	// Proxmox hosts consoles may point at, empty allows any
+	AllowedHosts []string `json:"allowed_hosts"`
+	// Concurrent sessions across the namespace, 0 is unlimited
+	MaxSessions int `json:"max_sessions"`
+}
+
+// loadNamespaces reads a JSON object of namespace name to policy
+func loadNamespaces(path string) (map[string]*Namespace, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces map[string]*Namespace
+	if err := json.Unmarshal(data, &namespaces); err != nil {
+		return nil, err
+	}
+	for name := range namespaces {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("invalid namespace name %q", name)
+		}
+	}
+	return namespaces, nil
+}
+
+// splitNamespace returns the namespace prefix of a hash, "" when it has none
+func splitNamespace(hash string) string {
+	if i := strings.Index(hash, ":"); i > 0 {
+		return hash[:i]
+	}
+	return ""
+}
+
+// boundNamespaces returns the namespaces a principal is restricted to
+func (cfg *Config) boundNamespaces(principal string) []string {
+	var names []string
+	for name, ns := range cfg.Namespaces {
+		for _, k := range ns.Keys {
+			if k == principal {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// authorizeNamespaceAccess checks that principal may manage hash; principals bound
+// to namespaces only manage prefixed hashes, others only unprefixed ones
+func authorizeNamespaceAccess(cfg *Config, hash, principal string) error {
+	if len(cfg.Namespaces) == 0 {
+		return nil
+	}
+
+	name := splitNamespace(hash)
+	bound := cfg.boundNamespaces(principal)
+	if name == "" {
+		if len(bound) > 0 {
+			return fmt.Errorf("hash must be prefixed with one of the namespaces %v", bound)
+		}
+		return nil
+	}
+
+	if _, ok := cfg.Namespaces[name]; !ok {
+		return fmt.Errorf("unknown namespace %q", name)
+	}
+	for _, b := range bound {
+		if b == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("key %s may not use namespace %q", principal, name)
+}
+
+// authorizeNamespace checks that principal may register hash for targetURLs
+func authorizeNamespace(cfg *Config, hash, principal string, targetURLs ...string) error {
+	if err := authorizeNamespaceAccess(cfg, hash, principal); err != nil {
+		return err
+	}
+
+	name := splitNamespace(hash)
+	ns, ok := cfg.Namespaces[name]
+	if !ok {
+		return nil
+	}
+	if len(ns.AllowedHosts) == 0 {
+		return nil
+	}
+	for _, targetURL := range targetURLs {
+		u, err := url.Parse(targetURL)
+		if err != nil {
+			return fmt.Errorf("invalid URL: %v", err)
+		}
+		hostOK := false
+		for _, h := range ns.AllowedHosts {
+			if strings.EqualFold(h, u.Hostname()) {
+				hostOK = true
+			}
+		}
+		if !hostOK {
+			return fmt.Errorf("host %s is not allowed in namespace %q", u.Hostname(), name)
+		}
+	}
+	return nil
+}
+
+// checkNamespaceCapacity refuses a new session when its namespace is at max_sessions
+func checkNamespaceCapacity(cfg *Config, hash string) error {
+	name := splitNamespace(hash)
+	ns, ok := cfg.Namespaces[name]
+	if !ok || ns.MaxSessions == 0 {
+		return nil
+	}
+	if n := sessions.CountNamespace(name); n >= ns.MaxSessions {
+		return fmt.Errorf("namespace %s session limit reached (%d)", name, ns.MaxSessions)
+	}
+	return nil
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RFB security types the proxy offers native viewers and answers backends with
+const (
+	rfbSecurityNone    = 1
+	rfbSecurityVNCAuth = 2
+)
+
+// Time a native viewer has to authenticate before it is dropped
+const nativeVNCHandshakeTimeout = 30 * time.Second
+
+// assignNativePassword generates the password of a native_vnc registration:
+// 8 characters, as many as VNC authentication uses, unlike those of the
+// registrations already indexed
+func assignNativePassword(req *ProxyRequest) error {
+	if !req.NativeVNC {
+		return nil
+	}
+	b := make([]byte, 6)
+	for tries := 0; tries < 8; tries++ {
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("generating native_vnc password: %v", err)
+		}
+		password := base64.RawURLEncoding.EncodeToString(b)
+		if !nativePasswords.taken(password) {
+			req.NativePassword = password
+			return nil
+		}
+	}
+	return fmt.Errorf("generating native_vnc password: no unique password found")
+}
+
+// vncAuthResponse encrypts challenge as VNC authentication does: DES keyed
+// with the first 8 bytes of password, the bits of each byte reversed
+func vncAuthResponse(password string, challenge []byte) []byte {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	block, _ := des.NewCipher(key)
+	out := make([]byte, len(challenge))
+	for i := 0; i+8 <= len(challenge); i += 8 {
+		block.Encrypt(out[i:i+8], challenge[i:i+8])
+	}
+	return out
+}
+
+// Native viewers may try VNC authentication nativeAuthBurst times in a row,
+// then once per nativeAuthInterval, whatever the result
+const (
+	nativeAuthBurst    = 5
+	nativeAuthInterval = 10 * time.Second
+)
+
+// Authentication attempts of native viewers per IP, taken before the lookup
+var nativeAuthAttempts = NewRateLimiter(float64(time.Second)/float64(nativeAuthInterval), nativeAuthBurst, 0, 0)
+
+// Interval between full reloads of nativePasswords, picking up what its
+// watch missed
+const nativeIndexReload = time.Minute
+
+// nativePasswordIndex holds the passwords of native_vnc registrations by hash,
+// so authenticating a viewer neither lists nor decrypts the store
+type nativePasswordIndex struct {
+	mu     sync.RWMutex
+	byHash map[string]string
+}
+
+// Passwords of the native_vnc registrations, kept by startNativeIndex
+var nativePasswords = &nativePasswordIndex{byHash: make(map[string]string)}
+
+// taken reports whether a registration already uses password
+func (ni *nativePasswordIndex) taken(password string) bool {
+	ni.mu.RLock()
+	defer ni.mu.RUnlock()
+
+	for _, p := range ni.byHash {
+		if p == password {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the hashes whose password produced response to challenge;
+// every password is tried so the time taken does not reveal which matched
+func (ni *nativePasswordIndex) match(challenge, response []byte) []string {
+	ni.mu.RLock()
+	defer ni.mu.RUnlock()
+
+	var hashes []string
+	for hash, password := range ni.byHash {
+		if subtle.ConstantTimeCompare(vncAuthResponse(password, challenge), response) == 1 {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// update indexes the registration of hash as the store has it now
+func (ni *nativePasswordIndex) update(hash string) {
+	item, err := proxied.Get(hash)
+	if err != nil {
+		if _, ok := err.(*notFoundError); !ok {
+			fmt.Printf("[ERROR] Failed to index native_vnc registration %s: %v\n", hashTag(hash), err)
+			return
+		}
+	}
+
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	if err != nil || item.NativePassword == "" {
+		delete(ni.byHash, hash)
+		return
+	}
+	ni.byHash[hash] = item.NativePassword
+}
+
+// reload rebuilds the index from a listing of the store
+func (ni *nativePasswordIndex) reload() error {
+	items, err := proxied.List()
+	if err != nil {
+		return err
+	}
+	byHash := make(map[string]string)
+	for hash, item := range items {
+		if item.NativePassword != "" {
+			byHash[hash] = item.NativePassword
+		}
+	}
+
+	ni.mu.Lock()
+	ni.byHash = byHash
+	ni.mu.Unlock()
+	return nil
+}
+
+// startNativeIndex loads nativePasswords and follows the registrations added
+// and removed by any node, reloading every nativeIndexReload
+func startNativeIndex(cfg *Config) {
+	if cfg.NativeVNCListen == "" {
+		return
+	}
+
+	if err := nativePasswords.reload(); err != nil {
+		fmt.Printf("[ERROR] Failed to load native_vnc registrations: %v\n", err)
+	}
+	events, _ := proxied.Watch()
+	go func() {
+		ticker := time.NewTicker(nativeIndexReload)
+		defer ticker.Stop()
+		for {
+			select {
+			case ev := <-events:
+				nativePasswords.update(ev.Key)
+			case <-ticker.C:
+				if err := nativePasswords.reload(); err != nil {
+					fmt.Printf("[ERROR] Failed to reload native_vnc registrations: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// nativeVNCLookup finds the native_vnc registration whose password produced
+// response to challenge, confirming it with the store
+func nativeVNCLookup(challenge, response []byte) (string, *ProxiedItem, error) {
+	hashes := nativePasswords.match(challenge, response)
+	switch {
+	case len(hashes) == 0:
+		return "", nil, &notFoundError{}
+	case len(hashes) > 1:
+		// Passwords are unique per node; registrations of other nodes can still collide
+		fmt.Printf("[ERROR] %d native_vnc registrations share a password, refusing the viewer\n", len(hashes))
+		return "", nil, fmt.Errorf("password is not unique")
+	}
+
+	hash := hashes[0]
+	item, err := proxied.Get(hash)
+	if _, ok := err.(*notFoundError); ok || (err == nil && subtle.ConstantTimeCompare(vncAuthResponse(item.NativePassword, challenge), response) != 1) {
+		// Expired or replaced without the index hearing of it
+		nativePasswords.update(hash)
+		return "", nil, &notFoundError{key: hash}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return hash, item, nil
+}
+
+// nativeViewer marks the in-process upgrade of a native viewer in its request
+// context, where outside requests can't set it. The session reports the
+// ticket of the backend it connected to, the VNC password Proxmox asks for
+type nativeViewer struct {
+	mu     sync.Mutex
+	ticket string
+}
+
+type nativeViewerKey struct{}
+
+func nativeViewerOf(r *http.Request) *nativeViewer {
+	v, _ := r.Context().Value(nativeViewerKey{}).(*nativeViewer)
+	return v
+}
+
+func (v *nativeViewer) connected(t *backendTarget) {
+	v.mu.Lock()
+	v.ticket = t.url.Query().Get("vncticket")
+	v.mu.Unlock()
+}
+
+func (v *nativeViewer) backendTicket() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.ticket
+}
+
+// nativeVNCServer serves -native_vnc_listen: a VNC viewer such as TigerVNC or
+// RealVNC authenticates with the password of a native_vnc registration and is
+// then proxied like a noVNC viewer of its hash, over an in-process WebSocket
+// to handler, so limits, filters, fanout and recordings apply alike
+type nativeVNCServer struct {
+	cfg     *Config
+	handler http.Handler
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+func (s *nativeVNCServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting viewers; sessions already proxied drain with the others
+func (s *nativeVNCServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.ln != nil {
+		return s.ln.Close()
+	}
+	return nil
+}
+
+func (s *nativeVNCServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	cfg := s.cfg
+
+	viewerIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !cfg.IsControlIP(viewerIP) && bans.IsBanned(viewerIP) {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(nativeVNCHandshakeTimeout))
+
+	version, hash, item, err := nativeViewerAuth(cfg, conn, viewerIP)
+	if err != nil {
+		fmt.Printf("[WARN] Native VNC viewer %s refused: %v\n", viewerIP, err)
+		return
+	}
+	fmt.Printf("[INFO] Native VNC viewer %s authenticated for hash %s\n", viewerIP, hashTag(hash))
+
+	native := &nativeViewer{}
+	backend, err := s.dial(conn, hash, native)
+	if err == nil {
+		err = nativeBackendAuth(backend, item, native)
+		if err != nil {
+			backend.Close()
+		}
+	}
+	if err != nil {
+		fmt.Printf("[WARN] Native VNC viewer %s of %s not connected: %v\n", viewerIP, hashTag(hash), err)
+		rfbSecurityFailed(conn, version, err.Error())
+		return
+	}
+	defer backend.Close()
+
+	// SecurityResult OK, then the viewer's ClientInit goes to the backend as is
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return
+	}
+	clientInit := make([]byte, 1)
+	if _, err := io.ReadFull(conn, clientInit); err != nil {
+		return
+	}
+	if err := backend.WriteMessage(websocket.BinaryMessage, clientInit); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, &wsStream{conn: backend})
+		done <- struct{}{}
+	}()
+	go func() {
+		if err := forwardNativeViewer(conn, backend); err == io.EOF {
+			backend.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		}
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// nativeViewerAuth completes the RFB handshake with a native viewer up to its
+// VNC authentication response and finds the registration it is for
+func nativeViewerAuth(cfg *Config, conn net.Conn, viewerIP string) (string, string, *ProxiedItem, error) {
+	if _, err := conn.Write([]byte("RFB 003.008\n")); err != nil {
+		return "", "", nil, err
+	}
+	v := make([]byte, 12)
+	if _, err := io.ReadFull(conn, v); err != nil {
+		return "", "", nil, err
+	}
+	version := string(v)
+	if version != "RFB 003.008\n" && version != "RFB 003.007\n" {
+		return "", "", nil, fmt.Errorf("unsupported viewer version %q", v)
+	}
+
+	// One security type: VNC authentication, the password finds the registration
+	if _, err := conn.Write([]byte{1, rfbSecurityVNCAuth}); err != nil {
+		return "", "", nil, err
+	}
+	t := make([]byte, 1)
+	if _, err := io.ReadFull(conn, t); err != nil {
+		return "", "", nil, err
+	}
+	if t[0] != rfbSecurityVNCAuth {
+		return "", "", nil, fmt.Errorf("viewer chose security type %d", t[0])
+	}
+
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", "", nil, err
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return "", "", nil, err
+	}
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return "", "", nil, err
+	}
+
+	if !cfg.IsControlIP(viewerIP) {
+		if ok, _ := nativeAuthAttempts.AllowIP(viewerIP); !ok {
+			rfbSecurityFailed(conn, version, "too many authentication attempts")
+			return "", "", nil, fmt.Errorf("too many authentication attempts")
+		}
+	}
+	hash, item, err := nativeVNCLookup(challenge, response)
+	if _, ok := err.(*notFoundError); ok {
+		if !cfg.IsControlIP(viewerIP) {
+			count, exceeded := hashFailures.Fail(viewerIP)
+			fmt.Printf("[WARN] Wrong native VNC password: ip=%s failures=%d limit=%d window=%v\n",
+				viewerIP, count, cfg.HashFailLimit, cfg.HashFailWindow)
+			if exceeded {
+				bans.Ban(viewerIP, cfg.BanDuration, fmt.Sprintf("%d wrong native VNC passwords within %v", count, cfg.HashFailWindow))
+			}
+		}
+		err = fmt.Errorf("wrong password")
+	} else if err != nil {
+		err = fmt.Errorf("looking up the registration: %v", err)
+	}
+	if err != nil {
+		rfbSecurityFailed(conn, version, "authentication failed")
+		return "", "", nil, err
+	}
+	return version, hash, item, nil
+}
+
+// rfbSecurityFailed ends a viewer's handshake with a failed SecurityResult,
+// with reason for RFB 3.8 viewers
+func rfbSecurityFailed(conn net.Conn, version, reason string) {
+	msg := []byte{0, 0, 0, 1}
+	if version == "RFB 003.008\n" {
+		msg = append(msg, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(msg[4:], uint32(len(reason)))
+		msg = append(msg, reason...)
+	}
+	conn.Write(msg)
+}
+
+// dial opens /vncproxy/<hash> for the viewer on conn through handler, over a
+// pipe instead of the network; the request carries the viewer's address
+func (s *nativeVNCServer) dial(conn net.Conn, hash string, native *nativeViewer) (*websocket.Conn, error) {
+	remoteAddr := conn.RemoteAddr().String()
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+		ReadBufferSize:   8192,
+		WriteBufferSize:  8192,
+		NetDial: func(string, string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go s.serveUpgrade(server, remoteAddr, native)
+			return client, nil
+		},
+	}
+	ws, resp, err := dialer.Dial("ws://"+conn.LocalAddr().String()+"/vncproxy/"+url.PathEscape(hash), nil)
+	if err != nil && resp != nil {
+		// The viewer gets the reason a noVNC viewer would have
+		if body, _ := io.ReadAll(resp.Body); len(body) > 0 {
+			err = fmt.Errorf("%s", strings.TrimSpace(string(body)))
+		}
+	}
+	return ws, err
+}
+
+// serveUpgrade hands the in-process upgrade request on conn to the handler
+func (s *nativeVNCServer) serveUpgrade(conn net.Conn, remoteAddr string, native *nativeViewer) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	req.RemoteAddr = remoteAddr
+	req = req.WithContext(context.WithValue(req.Context(), nativeViewerKey{}, native))
+
+	w := &bridgeResponse{conn: conn, brw: bufio.NewReadWriter(br, bufio.NewWriter(conn)), header: http.Header{}}
+	s.handler.ServeHTTP(w, req)
+	if !w.hijacked {
+		conn.Close()
+	}
+}
+
+// nativeBackendAuth completes the RFB handshake with the backend on behalf of
+// the native viewer, which authenticated with the proxy instead. VNC
+// authentication is answered with the registration's vnc_password, or the
+// ticket as Proxmox's own noVNC does
+func nativeBackendAuth(ws *websocket.Conn, item *ProxiedItem, native *nativeViewer) error {
+	stream := &wsStream{conn: ws}
+	read := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(stream, b)
+		return b, err
+	}
+	readReason := func() string {
+		n, err := read(4)
+		if err != nil {
+			return ""
+		}
+		size := binary.BigEndian.Uint32(n)
+		if size > 1024 {
+			return ""
+		}
+		reason, _ := read(int(size))
+		return string(reason)
+	}
+
+	v, err := read(12)
+	if err != nil {
+		return fmt.Errorf("backend handshake: %v", err)
+	}
+	version := "RFB 003.008\n"
+	switch {
+	case string(v) == "RFB 003.007\n":
+		version = string(v)
+	case string(v) < "RFB 003.007\n":
+		return fmt.Errorf("unsupported backend version %q", v)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte(version)); err != nil {
+		return err
+	}
+
+	n, err := read(1)
+	if err != nil {
+		return fmt.Errorf("backend handshake: %v", err)
+	}
+	if n[0] == 0 {
+		return fmt.Errorf("backend refused the connection: %s", readReason())
+	}
+	types, err := read(int(n[0]))
+	if err != nil {
+		return fmt.Errorf("backend handshake: %v", err)
+	}
+	choice := byte(0)
+	for _, t := range types {
+		if t == rfbSecurityNone || (t == rfbSecurityVNCAuth && choice == 0) {
+			choice = t
+		}
+	}
+	if choice == 0 {
+		return fmt.Errorf("backend offers no security type the proxy can answer: %v", types)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte{choice}); err != nil {
+		return err
+	}
+
+	if choice == rfbSecurityVNCAuth {
+		password := item.VNCPassword
+		if password == "" {
+			password = native.backendTicket()
+		}
+		if password == "" {
+			return fmt.Errorf("backend asks for a VNC password, register one with vnc_password")
+		}
+		challenge, err := read(16)
+		if err != nil {
+			return fmt.Errorf("backend handshake: %v", err)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, vncAuthResponse(password, challenge)); err != nil {
+			return err
+		}
+	}
+
+	// RFB 3.7 only reports the result of an actual authentication
+	if choice == rfbSecurityVNCAuth || version == "RFB 003.008\n" {
+		result, err := read(4)
+		if err != nil {
+			return fmt.Errorf("backend handshake: %v", err)
+		}
+		if binary.BigEndian.Uint32(result) != 0 {
+			reason := "VNC authentication failed"
+			if version == "RFB 003.008\n" {
+				if r := readReason(); r != "" {
+					reason = r
+				}
+			}
+			return fmt.Errorf("backend refused: %s", reason)
+		}
+	}
+	return nil
+}
+
+// forwardNativeViewer sends the viewer's byte stream to ws one RFB message per
+// WebSocket message, as noVNC does, so the proxy's filters see whole messages
+func forwardNativeViewer(conn net.Conn, ws *websocket.Conn) error {
+	var buf []byte
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		for len(buf) > 0 {
+			size := rfbClientMessageSize(buf)
+			if size < 0 {
+				if rfbClientMessageTruncated(buf) {
+					break
+				}
+				// Unknown message, its end can't be found
+				size = len(buf)
+			}
+			if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:size]); werr != nil {
+				return werr
+			}
+			buf = buf[size:]
+		}
+		buf = append([]byte(nil), buf...)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rfbClientMessageTruncated reports whether msg, which rfbClientMessageSize
+// couldn't measure, starts a message of a known type still missing bytes
+func rfbClientMessageTruncated(msg []byte) bool {
+	switch msg[0] {
+	case 0, 2, 3, 4, 5, 6, 150, 248, 250, 251:
+		return true
+	case 255:
+		return len(msg) < 2 || msg[1] == 0
+	}
+	return false
+}
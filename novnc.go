@@ -0,0 +1,122 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// noVNC as fetched by `make novnc`; only novnc/README.md when it wasn't
+//
+//go:embed novnc
+var noVNCFiles embed.FS
+
+// Console page for /console/:hash and /launch/:hash, connecting noVNC to
+// /vncproxy/:hash with the viewer options in data-options
+const consolePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Console</title>
+<style>html,body{margin:0;height:100%%;background:#000}#screen{height:100%%}
+#status{position:fixed;top:0;left:0;right:0;color:#fff;background:#333;font:14px sans-serif;padding:.3em;text-align:center}#status:empty{display:none}</style>
+</head>
+<body data-options="%s">
+<div id="status"></div>
+<div id="screen"></div>
+<script type="module" src="/%s"></script>
+</body>
+</html>
+`
+
+// consoleScript takes the hash from the page URL and applies ViewerOptions;
+// with -resume_grace it asks for a reconnect token, which the proxy sends in a
+// text frame, and reconnects with it after losing the connection. It opens
+// the WebSocket itself to read that frame. The CSP forbids inline scripts
+const consoleScript = `import RFB from %s;
+
+const opts = JSON.parse(document.body.dataset.options || '{}');
+const hash = decodeURIComponent(location.pathname.split('/').pop());
+const status = document.getElementById('status');
+const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+const url = proto + '//' + location.host + '/vncproxy/' + encodeURIComponent(hash);
+const resumeProtocol = '` + resumeProtocol + `';
+let token = '';
+let connected = false;
+let lostAt = 0;
+
+function connect() {
+  const protocols = opts.resume_grace ? [resumeProtocol] : [];
+  if (token) protocols.push(resumeProtocol + '.' + token);
+  const ws = new WebSocket(url, protocols);
+  ws.addEventListener('message', (ev) => {
+    if (typeof ev.data !== 'string') return;
+    try { token = JSON.parse(ev.data).resume_token || token; } catch (e) {}
+  });
+  const rfb = new RFB(document.getElementById('screen'), ws);
+  rfb.viewOnly = !!opts.view_only;
+  rfb.resizeSession = opts.scaling === 'remote';
+  rfb.scaleViewport = opts.scaling !== 'remote' && opts.scaling !== 'none';
+  if (opts.quality !== undefined) rfb.qualityLevel = opts.quality;
+  if (opts.compression !== undefined) rfb.compressionLevel = opts.compression;
+  rfb.addEventListener('connect', () => { status.textContent = ''; connected = true; lostAt = 0; });
+  rfb.addEventListener('disconnect', (ev) => {
+    if (!ev.detail.clean && connected && token) {
+      lostAt = lostAt || Date.now();
+      if (Date.now() - lostAt < opts.resume_grace * 1000) {
+        status.textContent = 'Reconnecting...';
+        setTimeout(connect, 1000);
+        return;
+      }
+    }
+    status.textContent = ev.detail.clean ? 'Disconnected' : 'Connection lost';
+  });
+}
+
+status.textContent = 'Connecting...';
+connect();
+`
+
+// registerConsoleRoutes serves the launcher and, when the binary contains noVNC,
+// noVNC itself and the console page
+func registerConsoleRoutes(r *gin.Engine, cfg *Config) {
+	_, err := fs.Stat(noVNCFiles, "novnc/core/rfb.js")
+	bundled := err == nil
+
+	// Without the bundle the viewer comes from -novnc_base
+	rfbPath := cfg.NoVNCBase + "core/rfb.js"
+	if bundled {
+		rfbPath = "/novnc/core/rfb.js"
+	}
+	rfbModule, _ := json.Marshal(rfbPath)
+	script := newStaticAsset("console.js", "text/javascript; charset=utf-8", []byte(fmt.Sprintf(consoleScript, rfbModule)))
+	mountAsset(r, "/", "console.js", script)
+	r.GET("/launch/:hash", launchHandler(cfg, script.hashedName))
+
+	if !bundled {
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] noVNC is not bundled (make novnc), /console is disabled\n")
+		}
+		return
+	}
+	sub, _ := fs.Sub(noVNCFiles, "novnc")
+	files := http.StripPrefix("/novnc", http.FileServer(http.FS(sub)))
+	page := fmt.Sprintf(consolePage, html.EscapeString("{}"), script.hashedName)
+
+	r.GET("/novnc/*path", func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=3600")
+		files.ServeHTTP(c.Writer, c.Request)
+	})
+	// The page is the same for every hash, whether registered or not
+	r.GET("/console/:hash", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+	})
+
+	fmt.Printf("[INFO] Bundled noVNC console served at /console/:hash\n")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Seconds between the NTP epoch (1900) and the Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// Last measured offset to the NTP server in nanoseconds, valid once ntpMeasured is 1
+var (
+	ntpOffsetNanos int64
+	ntpMeasured    int32
+)
+
+// ntpOffset returns the last measured clock offset and whether one is available
+func ntpOffset() (time.Duration, bool) {
+	if atomic.LoadInt32(&ntpMeasured) == 0 {
+		return 0, false
+	}
+	return time.Duration(atomic.LoadInt64(&ntpOffsetNanos)), true
+}
+
+func ntpTime(b []byte) time.Time {
+	secs := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	nanos := (int64(frac) * int64(time.Second)) >> 32
+	return time.Unix(int64(secs)-ntpEpochOffset, nanos)
+}
+
+// queryNTP performs a single SNTP exchange and returns the local clock offset
+// (positive when the local clock is behind the server)
+func queryNTP(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI=0, VN=4, Mode=3 (client)
+
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+
+	if mode := resp[0] & 0x07; mode != 4 {
+		return 0, fmt.Errorf("unexpected NTP mode %d", mode)
+	}
+	if stratum := resp[1]; stratum == 0 || stratum > 15 {
+		return 0, fmt.Errorf("NTP server unsynchronized (stratum %d)", stratum)
+	}
+
+	t2 := ntpTime(resp[32:40])
+	t3 := ntpTime(resp[40:48])
+
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// startDriftMonitor periodically checks the local clock against -ntp_server
+// and warns when the offset exceeds -clock_drift_warn
+func startDriftMonitor(cfg *Config) {
+	if cfg.NTPServer == "" {
+		return
+	}
+
+	fmt.Printf("[INFO] Monitoring clock drift against %s every %v\n", cfg.NTPServer, cfg.NTPInterval)
+
+	check := func() {
+		offset, err := queryNTP(cfg.NTPServer)
+		if err != nil {
+			fmt.Printf("[ERROR] NTP query to %s failed: %v\n", cfg.NTPServer, err)
+			return
+		}
+
+		atomic.StoreInt64(&ntpOffsetNanos, int64(offset))
+		atomic.StoreInt32(&ntpMeasured, 1)
+
+		abs := offset
+		if abs < 0 {
+			abs = -abs
+		}
+		if abs > cfg.ClockDriftWarn {
+			fmt.Printf("[WARN] ==== CLOCK DRIFT %v vs %s exceeds %v; TTL and expiry checks are unreliable ====\n",
+				offset, cfg.NTPServer, cfg.ClockDriftWarn)
+		} else if cfg.Debug {
+			fmt.Printf("[DEBUG] Clock offset vs %s: %v\n", cfg.NTPServer, offset)
+		}
+	}
+
+	go func() {
+		check()
+		ticker := time.NewTicker(cfg.NTPInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			check()
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// probeBackend checks that the host of t accepts a TCP connection and, for
+// wss, completes a TLS handshake within timeout; nothing is sent beyond that
+func probeBackend(t *backendTarget, timeout time.Duration) error {
+	port := t.url.Port()
+	if port == "" {
+		port = "80"
+		if t.url.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(t.url.Hostname(), port)
+	dialer := &net.Dialer{Timeout: timeout}
+
+	if t.url.Scheme != "wss" {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	// Same trust as the backend WebSocket dial
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: t.url.Hostname()})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeTargets checks the backend before the viewer is upgraded, so an
+// unreachable one is answered with an HTTP error instead of a console that
+// fails mid-handshake. s.target moves to the first reachable fallback URL
+func (s *vncSession) probeTargets() error {
+	timeout := s.cfg.BackendProbeTimeout
+	err := probeBackend(s.target, timeout)
+	if err == nil {
+		return nil
+	}
+	fmt.Printf("[WARN] Backend %s of %s unreachable: %v\n", s.target.url.Host, hashTag(s.target.hash), err)
+
+	fallbacks := s.target.item.FallbackURLs
+	for i, next := range fallbacks {
+		target, terr := s.target.withURL(next)
+		if terr != nil {
+			fmt.Printf("[ERROR] Skipping fallback backend of %s: %v\n", hashTag(s.target.hash), terr)
+			continue
+		}
+		// Dialing fails over to the URLs after this one only
+		target.item.FallbackURLs = fallbacks[i+1:]
+		if err = probeBackend(target, timeout); err == nil {
+			fmt.Printf("[INFO] Using fallback backend %s for %s\n", target.url.Host, hashTag(s.target.hash))
+			s.target = target
+			return nil
+		}
+		fmt.Printf("[WARN] Backend %s of %s unreachable: %v\n", target.url.Host, hashTag(s.target.hash), err)
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+// Proxmox products a registration can target
+const (
+	productPVE = "pve"
+	productPBS = "pbs"
+	productPMG = "pmg"
+)
+
+// Port of the Proxmox Backup Server API when proxmox_host doesn't name one;
+// Mail Gateway listens on 8006 like Proxmox VE
+const pbsDefaultPort = "8007"
+
+// Backend URL of node shells registered by node, the only consoles of Backup
+// Server and Mail Gateway, which have no guests
+const nodeShellTemplate = "wss://{host}/api2/json/nodes/{node}/vncwebsocket?port={port}&vncticket={vncticket}"
+
+func validProduct(product string) bool {
+	return product == "" || product == productPVE || product == productPBS || product == productPMG
+}
+
+// shellOnly reports whether product only offers node shells
+func shellOnly(product string) bool {
+	return product == productPBS || product == productPMG
+}
+
+// productName is how errors refer to product
+func productName(product string) string {
+	switch product {
+	case productPBS:
+		return "Proxmox Backup Server"
+	case productPMG:
+		return "Proxmox Mail Gateway"
+	}
+	return "Proxmox VE"
+}
+
+// authNames returns the API token scheme and ticket cookie of the product item
+// runs on; Mail Gateway has no API tokens
+func authNames(item *ProxiedItem) (tokenScheme, cookie string) {
+	switch item.Product {
+	case productPBS:
+		return "PBSAPIToken", "PBSAuthCookie"
+	case productPMG:
+		return "", "PMGAuthCookie"
+	}
+	return "PVEAPIToken", "PVEAuthCookie"
+}
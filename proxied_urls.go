@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"net"
 	"sync"
 	"time"
 )
@@ -12,13 +12,60 @@ type ProxiedItem struct {
 	Cookie              string
 	CSRFPreventionToken string
 	URL                 string
+	Principal           string
+	SingleUse           bool
+	DuplicatePolicy     string
+	Console             string            // consoleXterm for termproxy, consoleSpice for SPICE, otherwise VNC
+	Product             string            // productPBS or productPMG for Backup Server and Mail Gateway, otherwise Proxmox VE
+	Metadata            map[string]string // copied to the session, its logs and webhooks
+	TTL                 time.Duration     // overrides the store's TTL when set
+	ExpiresAt           time.Time         // absolute expiry requested by PUQcloud, if any
+	MaxUses             int               // connections before the item is removed, 0 for no limit
+	Uses                int               // connections so far, counted through Use
+	FirstUsed           time.Time         // first viewer connection, set through Use
+	ViewerNetworks      []string          // IPs/CIDRs viewers must connect from, any when empty
+	MaxViewers          int               // concurrent connections, 0 uses -max_viewers
+	ReadOnly            bool              // viewers only watch, their input is dropped
+	BlockClipboard      bool              // cut text is stripped in both directions
+	MaxClipboardBytes   int               // longest cut text passed on, 0 uses -max_clipboard_bytes
+	BlockedKeys         []string          // key combinations dropped, none uses -blocked_keys
+	Record              bool              // sessions are recorded to -recording_dir
+	IdleTimeout         time.Duration     // viewers without input are disconnected after it, 0 uses -idle_timeout
+	Viewer              *ViewerOptions    // noVNC settings of /launch/:hash, defaults when nil
+	TicketAPI           string            // Proxmox call issuing the ticket the URL lacks, for every viewer
+	FallbackURLs        []string          // dialed in order when URL can't be reached
+	Spice               *SpiceParams      // spiceproxy parameters of SPICE consoles, URL is their proxy
+	NativePassword      string            // password of native VNC viewers on -native_vnc_listen, none when empty
+	VNCPassword         string            // answers the backend's VNC authentication for native viewers instead of the ticket
+	ShadowHash          string            // view-only observer hash issued with the registration
+	ShadowOf            string            // set on observer entries: the hash whose session they watch
 	timer               *time.Timer
+	expires             time.Time // when the in-memory list drops the item
+}
+
+// AllowsViewer reports whether a viewer at ip may open the item
+func (item *ProxiedItem) AllowsViewer(ip string) bool {
+	if len(item.ViewerNetworks) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range item.ViewerNetworks {
+		if ipNet, err := parseNetwork(n); err == nil && ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
 }
 
 // ProxiedList is a thread-safe in-memory list of proxied URLs
 type ProxiedList struct {
-	data sync.Map
-	ttl  time.Duration
+	data     sync.Map
+	ttl      time.Duration
+	mu       sync.Mutex // guards expires, Uses and FirstUsed of stored items
+	watchers storeWatchers
 }
 
 // NewProxiedList creates a list with a given TTL
@@ -27,36 +74,92 @@ func NewProxiedList(ttl time.Duration) *ProxiedList {
 }
 
 // Add stores an item with auto-deletion after TTL
-func (pl *ProxiedList) Add(key, token, cookie, csrfp_revention_token, url string) {
+func (pl *ProxiedList) Add(key string, item *ProxiedItem) error {
+	ttl := pl.ttl
+	if item.TTL > 0 {
+		ttl = item.TTL
+	}
+	pl.add(key, item, ttl)
+	return nil
+}
+
+// add stores an item that is deleted after ttl
+func (pl *ProxiedList) add(key string, item *ProxiedItem, ttl time.Duration) {
 	// Stop old timer if key exists
 	if old, ok := pl.data.Load(key); ok {
 		oldItem := old.(*ProxiedItem)
 		oldItem.timer.Stop()
 	}
 
-	// Create new item
-	item := &ProxiedItem{
-		Token:               token,
-		Cookie:              cookie,
-		CSRFPreventionToken: csrfp_revention_token,
-		URL:                 url,
-	}
-
 	// Timer to delete the key after TTL
-	item.timer = time.AfterFunc(pl.ttl, func() {
-		pl.data.Delete(key)
+	item.timer = time.AfterFunc(ttl, func() {
+		// Only this item, not one added under the key since
+		if v, ok := pl.data.Load(key); ok && v == item {
+			pl.data.Delete(key)
+			pl.watchers.publish(StoreEvent{Type: storeRemoved, Key: key})
+		}
 	})
+	item.expires = time.Now().Add(ttl)
 
 	pl.data.Store(key, item)
+	pl.watchers.publish(StoreEvent{Type: storeAdded, Key: key})
 }
 
-// Get retrieves an item, returns nil if not found
-func (pl *ProxiedList) Get(key string) (string, string, string, string, error) {
+// Get retrieves a copy of an item, returns an error if not found
+func (pl *ProxiedList) Get(key string) (*ProxiedItem, error) {
 	if v, ok := pl.data.Load(key); ok {
-		item := v.(*ProxiedItem)
-		return item.Token, item.Cookie, item.CSRFPreventionToken, item.URL, nil
+		pl.mu.Lock()
+		item := *v.(*ProxiedItem)
+		pl.mu.Unlock()
+		item.timer = nil
+		return &item, nil
 	}
-	return "", "", "", "", fmt.Errorf("key %s not found", key)
+	return nil, &notFoundError{key: key}
+}
+
+// Touch restarts the TTL of an item
+func (pl *ProxiedList) Touch(key string) error {
+	v, ok := pl.data.Load(key)
+	if !ok {
+		return &notFoundError{key: key}
+	}
+	item := v.(*ProxiedItem)
+	ttl := pl.ttl
+	if item.TTL > 0 {
+		ttl = item.TTL
+	}
+	pl.mu.Lock()
+	item.timer.Reset(ttl)
+	item.expires = time.Now().Add(ttl)
+	pl.mu.Unlock()
+	return nil
+}
+
+// Expiry returns when an item will be dropped unless touched again
+func (pl *ProxiedList) Expiry(key string) (time.Time, error) {
+	v, ok := pl.data.Load(key)
+	if !ok {
+		return time.Time{}, &notFoundError{key: key}
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return v.(*ProxiedItem).expires, nil
+}
+
+// Use counts a viewer connection of an item
+func (pl *ProxiedList) Use(key string) (int, error) {
+	v, ok := pl.data.Load(key)
+	if !ok {
+		return 0, &notFoundError{key: key}
+	}
+	item := v.(*ProxiedItem)
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	item.Uses++
+	if item.FirstUsed.IsZero() {
+		item.FirstUsed = time.Now()
+	}
+	return item.Uses, nil
 }
 
 // Remove deletes an item manually
@@ -65,23 +168,28 @@ func (pl *ProxiedList) Remove(key string) {
 		item := v.(*ProxiedItem)
 		item.timer.Stop()
 		pl.data.Delete(key)
+		pl.watchers.publish(StoreEvent{Type: storeRemoved, Key: key})
 	}
 }
 
-func (pl *ProxiedList) List() map[string]ProxiedItem {
+// List returns copies of all items
+func (pl *ProxiedList) List() (map[string]ProxiedItem, error) {
 	snapshot := make(map[string]ProxiedItem)
 
 	pl.data.Range(func(key, value interface{}) bool {
 		k := key.(string)
 		v := value.(*ProxiedItem)
-		snapshot[k] = ProxiedItem{
-			Token:               v.Token,
-			Cookie:              v.Cookie,
-			CSRFPreventionToken: v.CSRFPreventionToken,
-			URL:                 v.URL,
-			timer:               nil,
-		}
+		pl.mu.Lock()
+		item := *v
+		pl.mu.Unlock()
+		item.timer = nil
+		snapshot[k] = item
 		return true
 	})
-	return snapshot
+	return snapshot, nil
+}
+
+// Watch reports items added, removed and expired
+func (pl *ProxiedList) Watch() (<-chan StoreEvent, func()) {
+	return pl.watchers.watch()
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port of the Proxmox API when proxmox_host doesn't name one
+const proxmoxDefaultPort = "8006"
+
+// vncProxyResponse is the data of POST .../vncproxy and .../termproxy;
+// older Proxmox versions return the port as a string
+type vncProxyResponse struct {
+	Data struct {
+		Port   json.Number `json:"port"`
+		Ticket string      `json:"ticket"`
+	} `json:"data"`
+}
+
+// Default -target_url_template, the vncwebsocket URL of Proxmox VE 6 to 8
+const defaultTargetTemplate = "wss://{host}/api2/json/nodes/{node}/{vmtype}/{vmid}/vncwebsocket?port={port}&vncticket={vncticket}"
+
+// Guest types registrations by node and vmid may name
+const (
+	vmtypeQEMU = "qemu"
+	vmtypeLXC  = "lxc"
+)
+
+// validateTargetTemplate checks -target_url_template yields a VNC WebSocket URL
+// carrying the port and ticket
+func validateTargetTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, "{port}") || !strings.Contains(tmpl, "{vncticket}") {
+		return fmt.Errorf("it must contain {port} and {vncticket}")
+	}
+	sample := strings.NewReplacer("{host}", "pve.example.com:8006", "{node}", "pve", "{vmtype}", vmtypeQEMU,
+		"{vmid}", "100", "{port}", "5900", "{vncticket}", "ticket").Replace(tmpl)
+	return validateProxmoxURL(sample)
+}
+
+// expandProxmoxTarget builds the target URL of a registration by node and vmid
+// from -target_url_template. Without vncticket the {port} and {vncticket}
+// placeholders stay, requestVNCTicket fills them in for every viewer
+func expandProxmoxTarget(cfg *Config, req *ProxyRequest) error {
+	if req.Node == "" && req.VMID == 0 && req.ProxmoxHost == "" {
+		if req.URL == "" {
+			return fmt.Errorf("proxmox_ws_url, or node, vmid and proxmox_host, are required")
+		}
+		return nil
+	}
+	shell := shellOnly(req.Product)
+	if req.VMType == "" && !shell {
+		req.VMType = vmtypeQEMU
+	}
+	switch {
+	case req.URL != "":
+		return fmt.Errorf("use either proxmox_ws_url or node and vmid")
+	case shell && (req.VMID != 0 || req.VMType != ""):
+		return fmt.Errorf("%s has no guests, name only node and proxmox_host", productName(req.Product))
+	case shell && (req.Node == "" || req.ProxmoxHost == ""):
+		return fmt.Errorf("node and proxmox_host are both required")
+	case !shell && (req.Node == "" || req.VMID <= 0 || req.ProxmoxHost == ""):
+		return fmt.Errorf("node, vmid and proxmox_host are all required")
+	case !shell && req.VMType != vmtypeQEMU && req.VMType != vmtypeLXC:
+		return fmt.Errorf("vmtype must be qemu or lxc")
+	case req.Port < 0 || req.Port > 65535 || (req.Port == 0) != (req.VNCTicket == ""):
+		return fmt.Errorf("port and vncticket go together, leave both out to have the proxy request the ticket")
+	case req.Token == "" && req.Cookie == "":
+		return fmt.Errorf("node and vmid need proxmox_token (or cookie)")
+	}
+
+	host, port := req.ProxmoxHost, proxmoxDefaultPort
+	if req.Product == productPBS {
+		port = pbsDefaultPort
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	if u, err := url.Parse("wss://" + host); err != nil || u.Host != host || u.Path != "" {
+		return fmt.Errorf("proxmox_host must be a host name or host:port")
+	}
+	req.ProxmoxHost = host
+
+	values := []string{
+		"{host}", host,
+		"{node}", url.PathEscape(req.Node),
+		"{vmtype}", req.VMType,
+		"{vmid}", strconv.Itoa(req.VMID),
+	}
+	if req.VNCTicket != "" {
+		values = append(values, "{port}", strconv.Itoa(req.Port), "{vncticket}", url.QueryEscape(req.VNCTicket))
+	}
+	tmpl := cfg.TargetTemplate
+	if shell {
+		tmpl = nodeShellTemplate
+	}
+	req.URL = strings.NewReplacer(values...).Replace(tmpl)
+	return nil
+}
+
+// ticketAPI is the Proxmox API call returning the VNC ticket of a registration
+// by node and vmid, "" when the registration brought its own ticket
+func ticketAPI(req *ProxyRequest) string {
+	if req.Node == "" || req.VNCTicket != "" {
+		return ""
+	}
+	endpoint := "vncproxy"
+	if req.Console == consoleXterm {
+		endpoint = "termproxy"
+	}
+	if shellOnly(req.Product) {
+		if endpoint == "vncproxy" {
+			endpoint = "vncshell"
+		}
+		return fmt.Sprintf("https://%s/api2/json/nodes/%s/%s", req.ProxmoxHost, url.PathEscape(req.Node), endpoint)
+	}
+	return fmt.Sprintf("https://%s/api2/json/nodes/%s/%s/%d/%s", req.ProxmoxHost, url.PathEscape(req.Node), req.VMType, req.VMID, endpoint)
+}
+
+// proxmoxAuthHeaders sets the API token, or the cookie and CSRF token, of item
+// as its Proxmox product expects them
+func proxmoxAuthHeaders(headers http.Header, item *ProxiedItem) {
+	tokenScheme, cookie := authNames(item)
+	if item.Token != "" && tokenScheme != "" {
+		headers.Set("Authorization", tokenScheme+"="+item.Token)
+		return
+	}
+	if item.Cookie != "" {
+		headers.Set("Cookie", cookie+"="+item.Cookie)
+	}
+	if item.CSRFPreventionToken != "" {
+		headers.Set("CSRFPreventionToken", item.CSRFPreventionToken)
+	}
+}
+
+// requestVNCTicket asks Proxmox for a fresh VNC ticket for an item with a
+// TicketAPI and returns a copy whose URL carries it, so the ticket can't expire
+// between registration and connection
+func requestVNCTicket(cfg *Config, item *ProxiedItem) (*ProxiedItem, error) {
+	port, ticket, err := fetchVNCTicket(cfg, item.TicketAPI, item)
+	if err != nil {
+		return nil, err
+	}
+	ticketed := *item
+	ticketed.URL = strings.NewReplacer(
+		"{port}", url.QueryEscape(port),
+		"{vncticket}", url.QueryEscape(ticket),
+	).Replace(item.URL)
+	return &ticketed, nil
+}
+
+// Path of the Proxmox vncwebsocket of a guest or, without the guest, a node
+// shell (the only console of Proxmox Backup Server), whose ticket the proxy can renew
+var proxmoxWebSocketPath = regexp.MustCompile(`^/api2/json/nodes/[^/]+(/(qemu|lxc)/[0-9]+)?/vncwebsocket$`)
+
+// renewalAPI returns the Proxmox call issuing a new ticket for a registration
+// that brought its own, "" when the proxy can't renew it: -renew_tickets is
+// off, there are no credentials or the URL isn't a Proxmox vncwebsocket
+func renewalAPI(cfg *Config, item *ProxiedItem) string {
+	if !cfg.RenewTickets || item.TicketAPI != "" || (item.Token == "" && item.Cookie == "") {
+		return ""
+	}
+	u, err := url.Parse(item.URL)
+	if err != nil {
+		return ""
+	}
+	m := proxmoxWebSocketPath.FindStringSubmatch(u.EscapedPath())
+	if m == nil {
+		return ""
+	}
+	endpoint := "vncproxy"
+	switch {
+	case item.Console == consoleXterm:
+		endpoint = "termproxy"
+	case m[1] == "":
+		endpoint = "vncshell"
+	}
+	return "https://" + u.Host + strings.TrimSuffix(u.EscapedPath(), "/vncwebsocket") + "/" + endpoint
+}
+
+// renewTicket returns a copy of item whose URL carries a fresh port and ticket
+func renewTicket(cfg *Config, item *ProxiedItem) (*ProxiedItem, error) {
+	port, ticket, err := fetchVNCTicket(cfg, renewalAPI(cfg, item), item)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(item.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("port", port)
+	query.Set("vncticket", ticket)
+	u.RawQuery = query.Encode()
+
+	renewed := *item
+	renewed.URL = u.String()
+	return &renewed, nil
+}
+
+// fetchVNCTicket calls vncproxy or termproxy at api with item's credentials
+func fetchVNCTicket(cfg *Config, api string, item *ProxiedItem) (port, ticket string, err error) {
+	form := url.Values{}
+	if strings.HasSuffix(api, "/vncproxy") || strings.HasSuffix(api, "/vncshell") {
+		form.Set("websocket", "1")
+	}
+	req, err := http.NewRequest(http.MethodPost, api, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	proxmoxAuthHeaders(req.Header, item)
+
+	// Same trust as the backend WebSocket dial
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Requesting VNC ticket: POST %s\n", api)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("ticket request returned %s", resp.Status)
+	}
+
+	var data vncProxyResponse
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", "", fmt.Errorf("ticket response: %v", err)
+	}
+	if data.Data.Ticket == "" || data.Data.Port == "" {
+		return "", "", fmt.Errorf("ticket response has no ticket")
+	}
+	fmt.Printf("[INFO] Obtained VNC ticket for port %s\n", data.Data.Port)
+	return data.Data.Port.String(), data.Data.Ticket, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a v2 header with verCmd, family and payload
+func proxyV2Header(verCmd, family byte, payload []byte) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(payload)))
+	return append(hdr, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xd4, 0x31, 0x1f, 0x90}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(ipv6[32:], 443)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string // "" for no address
+		wantErr bool
+	}{
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 54321 8080\r\nGET /"), want: "203.0.113.7:54321"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 443 8080\r\n"), want: "[2001:db8::7]:443"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 port boundary", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 65535 8080\r\n"), want: "203.0.113.7:65535"},
+		{name: "v1 port out of range", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 65536 8080\r\n"), wantErr: true},
+		{name: "v1 negative port", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 -1 8080\r\n"), wantErr: true},
+		{name: "v1 bad address", input: []byte("PROXY TCP4 203.0.113 10.0.0.1 1 8080\r\n"), wantErr: true},
+		{name: "v1 bad protocol", input: []byte("PROXY UDP4 203.0.113.7 10.0.0.1 1 8080\r\n"), wantErr: true},
+		{name: "v1 missing field", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 1\r\n"), wantErr: true},
+		{name: "v1 bare newline", input: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 1 8080\n"), wantErr: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 203.0.113.7"), wantErr: true},
+		{name: "v1 too long", input: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), wantErr: true},
+		{name: "v2 ipv4", input: proxyV2Header(0x21, 0x11, ipv4), want: "203.0.113.7:54321"},
+		{name: "v2 ipv6", input: proxyV2Header(0x21, 0x21, ipv6), want: "[2001:db8::7]:443"},
+		{name: "v2 local", input: proxyV2Header(0x20, 0x11, ipv4)},
+		{name: "v2 unspec family", input: proxyV2Header(0x21, 0x00, nil)},
+		{name: "v2 tlvs after address", input: proxyV2Header(0x21, 0x11, append(append([]byte{}, ipv4...), 0x04, 0, 1, 'x')), want: "203.0.113.7:54321"},
+		{name: "v2 short ipv4 block", input: proxyV2Header(0x21, 0x11, ipv4[:11]), wantErr: true},
+		{name: "v2 short ipv6 block", input: proxyV2Header(0x21, 0x21, ipv6[:35]), wantErr: true},
+		{name: "v2 version 1", input: proxyV2Header(0x11, 0x11, ipv4), wantErr: true},
+		{name: "v2 unknown command", input: proxyV2Header(0x2f, 0x11, ipv4), wantErr: true},
+		{name: "v2 truncated payload", input: proxyV2Header(0x21, 0x11, ipv4)[:20], wantErr: true},
+		{name: "v2 truncated header", input: proxyV2Signature, wantErr: true},
+		{name: "no header", input: []byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"), wantErr: true},
+		{name: "empty", input: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("got address %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderLeavesPayload(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 203.0.113.7 10.0.0.1 54321 8080\r\nGET / HTTP/1.1\r\n"))
+	if _, err := readProxyHeader(br); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := br.ReadString('\n')
+	if rest != "GET / HTTP/1.1\r\n" {
+		t.Errorf("payload after header = %q", rest)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Principal whose quota applies to keys without one of their own
+const defaultQuotaPrincipal = "*"
+
+// KeyQuota limits what registrations of one API key (or cert:<CN> principal)
+// may use, so one tenant's controller can't starve the others
+type KeyQuota struct {
+	// Registrations accepted per minute, 0 is unlimited
+	RegistrationsPerMinute int `json:"registrations_per_minute"`
+	// Concurrent sessions of consoles the key registered, 0 is unlimited
+	MaxSessions int `json:"max_sessions"`
+}
+
+// loadKeyQuotas reads a JSON object of key label (or "*") to quota
+func loadKeyQuotas(path string) (map[string]*KeyQuota, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var quotas map[string]*KeyQuota
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, err
+	}
+	for label, q := range quotas {
+		if label == "" || q == nil {
+			return nil, fmt.Errorf("invalid quota for %q", label)
+		}
+		if q.RegistrationsPerMinute < 0 || q.MaxSessions < 0 {
+			return nil, fmt.Errorf("quota of %q must not be negative", label)
+		}
+	}
+	return quotas, nil
+}
+
+// keyQuota returns the quota of principal, nil when it has none
+func (cfg *Config) keyQuota(principal string) *KeyQuota {
+	if q, ok := cfg.KeyQuotas[principal]; ok {
+		return q
+	}
+	return cfg.KeyQuotas[defaultQuotaPrincipal]
+}
+
+// quotaLimiter keeps a registration token bucket per principal
+type quotaLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// Registrations per principal under -key_quotas_file
+var keyRegistrations = &quotaLimiter{buckets: make(map[string]*tokenBucket)}
+
+// Allow reports whether principal may register another console and, if not, when to retry
+func (ql *quotaLimiter) Allow(cfg *Config, principal string) (bool, time.Duration) {
+	q := cfg.keyQuota(principal)
+	if q == nil || q.RegistrationsPerMinute == 0 {
+		return true, 0
+	}
+
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	now := time.Now()
+	b, ok := ql.buckets[principal]
+	if !ok {
+		b = &tokenBucket{tokens: float64(q.RegistrationsPerMinute), last: now}
+		ql.buckets[principal] = b
+	}
+	return b.take(now, float64(q.RegistrationsPerMinute)/60, q.RegistrationsPerMinute)
+}
+
+// checkKeyCapacity refuses a new session when the key that registered it is at max_sessions
+func checkKeyCapacity(cfg *Config, principal string) error {
+	q := cfg.keyQuota(principal)
+	if q == nil || q.MaxSessions == 0 {
+		return nil
+	}
+	if n := sessions.CountPrincipal(principal); n >= q.MaxSessions {
+		return fmt.Errorf("session limit of key %s reached (%d)", principal, q.MaxSessions)
+	}
+	return nil
+}
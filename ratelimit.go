@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and consumes one token, returning the wait until
+// the next token when the bucket is empty
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// RateLimiter applies a per-IP and a global token bucket; a zero rate disables either
+type RateLimiter struct {
+	mu          sync.Mutex
+	ipRate      float64
+	ipBurst     int
+	globalRate  float64
+	globalBurst int
+	global      *tokenBucket
+	perIP       map[string]*tokenBucket
+	lastPrune   time.Time
+}
+
+func NewRateLimiter(ipRate float64, ipBurst int, globalRate float64, globalBurst int) *RateLimiter {
+	now := time.Now()
+	return &RateLimiter{
+		ipRate:      ipRate,
+		ipBurst:     ipBurst,
+		globalRate:  globalRate,
+		globalBurst: globalBurst,
+		global:      &tokenBucket{tokens: float64(globalBurst), last: now},
+		perIP:       make(map[string]*tokenBucket),
+		lastPrune:   now,
+	}
+}
+
+// Allow reports whether a request from ip may proceed and, if not, when to retry
+func (rl *RateLimiter) Allow(ip string) (bool, time.Duration) {
+	if ok, wait := rl.AllowIP(ip); !ok {
+		return false, wait
+	}
+	return rl.AllowGlobal()
+}
+
+// AllowIP applies only the per-IP bucket, e.g. before a request is authenticated
+func (rl *RateLimiter) AllowIP(ip string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+
+	if rl.ipRate > 0 {
+		b, ok := rl.perIP[ip]
+		if !ok {
+			b = &tokenBucket{tokens: float64(rl.ipBurst), last: now}
+			rl.perIP[ip] = b
+		}
+		return b.take(now, rl.ipRate, rl.ipBurst)
+	}
+	return true, 0
+}
+
+// AllowGlobal applies only the global bucket; take it once a request is
+// authenticated, so strangers can't use it up for everyone
+func (rl *RateLimiter) AllowGlobal() (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.globalRate > 0 {
+		return rl.global.take(time.Now(), rl.globalRate, rl.globalBurst)
+	}
+	return true, 0
+}
+
+// prune forgets per-IP buckets that have refilled completely
+func (rl *RateLimiter) prune(now time.Time) {
+	if rl.ipRate == 0 || now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+
+	full := time.Duration(float64(rl.ipBurst) / rl.ipRate * float64(time.Second))
+	for ip, b := range rl.perIP {
+		if now.Sub(b.last) > full {
+			delete(rl.perIP, ip)
+		}
+	}
+}
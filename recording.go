@@ -0,0 +1,160 @@
+//go:build !norecording
+// +build !norecording
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Header of an FBS file, followed by chunks of length, data padded to 4
+// bytes and milliseconds since the recording started
+const fbsHeader = "FBS 001.000\n"
+
+// Handshake written in place of the backend's: RFB 3.3 with security type
+// None, so players need no password
+var fbsHandshake = []byte("RFB 003.003\n\x00\x00\x00\x01")
+
+// sessionRecording writes what the backend sends a VNC viewer to
+// -recording_dir in FBS format, from ServerInit on, with a JSON file of the
+// session next to it. A nil *sessionRecording is valid and records nothing.
+type sessionRecording struct {
+	base    string // path without .fbs and .json
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	started time.Time // when the viewer sent ClientInit, zero before
+	gotInit bool
+	pending []byte // ServerInit, held until the viewer sets its pixel format
+	failed  bool
+}
+
+// newRecording starts a recording for registrations made with record
+func newRecording(cfg *Config, target *backendTarget, info SessionInfo) *sessionRecording {
+	if cfg.RecordingDir == "" || !target.item.Record || target.item.Console == consoleXterm {
+		return nil
+	}
+
+	base := filepath.Join(cfg.RecordingDir, fmt.Sprintf("%s_%s", info.Started.UTC().Format("20060102T150405Z"), info.ID))
+	header, _ := json.Marshal(info)
+	if err := os.WriteFile(base+".json", append(header, '\n'), 0600); err != nil {
+		fmt.Printf("[ERROR] Failed to create recording %s.json: %v\n", base, err)
+		return nil
+	}
+	f, err := os.OpenFile(base+".fbs", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to create recording %s.fbs: %v\n", base, err)
+		return nil
+	}
+
+	r := &sessionRecording{base: base, f: f, w: bufio.NewWriter(f)}
+	activeRecordings.Store(base, true)
+	r.w.WriteString(fbsHeader)
+	fmt.Printf("[INFO] Recording session %s to %s.fbs\n", info.ID, base)
+	return r
+}
+
+// start is called when the viewer sends ClientInit: the backend answers with ServerInit
+func (r *sessionRecording) start() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = time.Now()
+	r.writeChunk(fbsHandshake)
+}
+
+// recordOutput records a frame as sent to the viewer
+func (r *sessionRecording) recordOutput(msg []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started.IsZero() || len(msg) == 0 {
+		return
+	}
+	if !r.gotInit {
+		r.gotInit = true
+		r.pending = append([]byte(nil), msg...)
+		return
+	}
+	if r.pending != nil {
+		r.writeChunk(r.pending)
+		r.pending = nil
+	}
+	r.writeChunk(msg)
+}
+
+// recordInput follows the viewer's SetPixelFormat: a player has no viewer to
+// ask for it, so the recorded ServerInit announces the format updates use
+func (r *sessionRecording) recordInput(msg []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(msg) > 0 {
+		size := rfbClientMessageSize(msg)
+		if size < 0 {
+			return
+		}
+		if msg[0] == 0 && len(r.pending) >= 20 {
+			copy(r.pending[4:20], msg[4:20])
+		}
+		msg = msg[size:]
+	}
+}
+
+// writeChunk appends one FBS chunk; after a write error the recording stops
+func (r *sessionRecording) writeChunk(data []byte) {
+	if r.failed {
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+	r.w.Write(b[:])
+	r.w.Write(data)
+	r.w.Write(make([]byte, (4-len(data)%4)%4))
+	binary.BigEndian.PutUint32(b[:], uint32(time.Since(r.started)/time.Millisecond))
+	if _, err := r.w.Write(b[:]); err != nil {
+		fmt.Printf("[ERROR] Failed to write recording %s, stopped: %v\n", r.f.Name(), err)
+		r.failed = true
+	}
+}
+
+// close writes a ServerInit that was never followed by anything and closes the file
+func (r *sessionRecording) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending != nil {
+		r.writeChunk(r.pending)
+		r.pending = nil
+	}
+	if err := r.w.Flush(); err != nil && !r.failed {
+		fmt.Printf("[ERROR] Failed to write recording %s: %v\n", r.f.Name(), err)
+	}
+	r.f.Close()
+	fmt.Printf("[INFO] Recording %s finished\n", r.f.Name())
+
+	if recordingUploader == nil {
+		activeRecordings.Delete(r.base)
+		return
+	}
+	go func() {
+		recordingUploader.uploadRecording(r.base)
+		activeRecordings.Delete(r.base)
+	}()
+}
@@ -0,0 +1,257 @@
+//go:build !norecording
+// +build !norecording
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SHA-256 of an empty body, signed for requests without one
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Recordings still being written or uploaded, by base path; retention leaves them alone
+var activeRecordings sync.Map
+
+// storedRecording is one recording (its .fbs and .json) in -recording_dir or the bucket
+type storedRecording struct {
+	name     string   // <time>_<session id>
+	paths    []string // files or object keys
+	size     int64
+	modified time.Time
+}
+
+// startRecordingRetention deletes recordings older than -recording_max_age and,
+// oldest first, those beyond -recording_max_bytes, every -recording_retention_interval
+func startRecordingRetention(cfg *Config) {
+	if cfg.RecordingMaxAge <= 0 && cfg.RecordingMaxBytes <= 0 {
+		return
+	}
+
+	fmt.Printf("[INFO] Recording retention: max age %v, max bytes %d, checked every %v\n",
+		cfg.RecordingMaxAge, cfg.RecordingMaxBytes, cfg.RecordingRetentionInterval)
+
+	check := func() {
+		recordings, err := localRecordings(cfg.RecordingDir)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to list recordings in %s: %v\n", cfg.RecordingDir, err)
+		} else {
+			for _, r := range expiredRecordings(cfg, recordings) {
+				for _, p := range r.paths {
+					if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+						fmt.Printf("[ERROR] Failed to delete recording file %s: %v\n", p, err)
+					}
+				}
+				logRetention("local", r)
+			}
+		}
+
+		if recordingUploader == nil {
+			return
+		}
+		recordings, err = recordingUploader.listRecordings()
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to list recordings in bucket %s: %v\n", recordingUploader.bucket, err)
+			return
+		}
+		for _, r := range expiredRecordings(cfg, recordings) {
+			deleted := true
+			for _, key := range r.paths {
+				if err := recordingUploader.deleteObject(key); err != nil {
+					fmt.Printf("[ERROR] Failed to delete recording object %s: %v\n", key, err)
+					deleted = false
+				}
+			}
+			if deleted {
+				logRetention("bucket "+recordingUploader.bucket, r)
+			}
+		}
+	}
+
+	go func() {
+		check()
+		ticker := time.NewTicker(cfg.RecordingRetentionInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			check()
+		}
+	}()
+}
+
+// logRetention writes the audit line for a deleted recording
+func logRetention(where string, r storedRecording) {
+	fmt.Printf("[INFO] Recording retention deleted %s from %s: modified=%s bytes=%d\n",
+		r.name, where, r.modified.UTC().Format(time.RFC3339), r.size)
+}
+
+// expiredRecordings picks the recordings to delete: everything older than the
+// max age, then the oldest of the rest until they fit the size budget
+func expiredRecordings(cfg *Config, recordings []storedRecording) []storedRecording {
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].modified.Before(recordings[j].modified) })
+
+	var total int64
+	for _, r := range recordings {
+		total += r.size
+	}
+
+	var expired []storedRecording
+	for _, r := range recordings {
+		tooOld := cfg.RecordingMaxAge > 0 && time.Since(r.modified) > cfg.RecordingMaxAge
+		overBudget := cfg.RecordingMaxBytes > 0 && total > cfg.RecordingMaxBytes
+		if !tooOld && !overBudget {
+			break
+		}
+		expired = append(expired, r)
+		total -= r.size
+	}
+	return expired
+}
+
+// recordingName is the <time>_<session id> part of a recording file or object name
+func recordingName(path string) string {
+	name := filepath.Base(path)
+	if ext := filepath.Ext(name); ext == ".fbs" || ext == ".json" {
+		return strings.TrimSuffix(name, ext)
+	}
+	return ""
+}
+
+// localRecordings lists the finished recordings in dir
+func localRecordings(dir string) ([]storedRecording, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*storedRecording)
+	for _, e := range entries {
+		name := recordingName(e.Name())
+		if name == "" || e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if _, active := activeRecordings.Load(filepath.Join(dir, name)); active {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		r := byName[name]
+		if r == nil {
+			r = &storedRecording{name: name}
+			byName[name] = r
+		}
+		r.paths = append(r.paths, path)
+		r.size += fi.Size()
+		if fi.ModTime().After(r.modified) {
+			r.modified = fi.ModTime()
+		}
+	}
+
+	recordings := make([]storedRecording, 0, len(byName))
+	for _, r := range byName {
+		recordings = append(recordings, *r)
+	}
+	return recordings, nil
+}
+
+// listBucketResult is the part of a ListObjectsV2 response retention needs
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listRecordings lists the recordings under the upload prefix
+func (u *s3Uploader) listRecordings() ([]storedRecording, error) {
+	byName := make(map[string]*storedRecording)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {u.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var page listBucketResult
+		if err := u.do(http.MethodGet, u.bucketPath(""), query, &page); err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name := recordingName(obj.Key)
+			if name == "" {
+				continue
+			}
+			r := byName[name]
+			if r == nil {
+				r = &storedRecording{name: name}
+				byName[name] = r
+			}
+			r.paths = append(r.paths, obj.Key)
+			r.size += obj.Size
+			if obj.LastModified.After(r.modified) {
+				r.modified = obj.LastModified
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+
+	recordings := make([]storedRecording, 0, len(byName))
+	for _, r := range byName {
+		recordings = append(recordings, *r)
+	}
+	return recordings, nil
+}
+
+// deleteObject removes an object by its full key
+func (u *s3Uploader) deleteObject(key string) error {
+	return u.do(http.MethodDelete, u.bucketPath(key), nil, nil)
+}
+
+// bucketPath is the path-style URL path of a key, or of the bucket for ""
+func (u *s3Uploader) bucketPath(key string) string {
+	return strings.TrimSuffix(u.endpoint.Path, "/") + "/" + u.bucket + "/" + key
+}
+
+// do sends a signed request without a body, decoding an XML answer into out if set
+func (u *s3Uploader) do(method, path string, query url.Values, out interface{}) error {
+	target := *u.endpoint
+	target.Path = path
+	// SigV4 wants spaces as %20 in the canonical query
+	target.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequest(method, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	u.sign(req, emptyPayloadHash, time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out != nil {
+		return xml.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
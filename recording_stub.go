@@ -0,0 +1,53 @@
+//go:build norecording
+// +build norecording
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const featureRecording = false
+
+// frameCapture records nothing in builds without recording
+type frameCapture struct{}
+
+func newFrameCapture(cfg *Config, hash, viewerIP string) *frameCapture { return nil }
+
+func (fc *frameCapture) recordHeaders(title string, h http.Header)           {}
+func (fc *frameCapture) recordResponse(resp *http.Response)                  {}
+func (fc *frameCapture) recordFrame(label string, count, mt int, msg []byte) {}
+func (fc *frameCapture) finish(sessionErr error)                             {}
+
+// sessionTranscript records nothing in builds without recording
+type sessionTranscript struct{}
+
+func newTranscript(cfg *Config, target *backendTarget, info SessionInfo) *sessionTranscript {
+	return nil
+}
+
+func (t *sessionTranscript) recordInput(msg []byte)  {}
+func (t *sessionTranscript) recordOutput(msg []byte) {}
+func (t *sessionTranscript) close()                  {}
+
+// sessionRecording records nothing in builds without recording
+type sessionRecording struct{}
+
+func newRecording(cfg *Config, target *backendTarget, info SessionInfo) *sessionRecording {
+	return nil
+}
+
+func (r *sessionRecording) start()                  {}
+func (r *sessionRecording) recordOutput(msg []byte) {}
+func (r *sessionRecording) recordInput(msg []byte)  {}
+func (r *sessionRecording) close()                  {}
+
+func startTranscriptIndex(cfg *Config) {}
+
+func startRecordingUploads(cfg *Config) {}
+
+func startRecordingRetention(cfg *Config) {}
+
+func registerHistoryRoutes(api *gin.Engine, cfg *Config) {}
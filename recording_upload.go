@@ -0,0 +1,194 @@
+//go:build !norecording
+// +build !norecording
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Upload attempts per recording, the first retry after recordingUploadBackoff,
+// doubling each time; a recording that could not be uploaded stays on disk
+const (
+	recordingUploadAttempts = 5
+	recordingUploadBackoff  = 10 * time.Second
+)
+
+// Uploads recordings when -recording_s3_bucket is set, configured in NewServer
+var recordingUploader *s3Uploader
+
+// s3Uploader puts recordings into an S3-compatible bucket (AWS, MinIO...) with
+// path-style URLs, signing requests with AWS Signature Version 4 so no SDK is
+// needed
+type s3Uploader struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// startRecordingUploads sets up the uploader for -recording_s3_bucket
+func startRecordingUploads(cfg *Config) {
+	recordingUploader = nil
+	if cfg.RecordingS3Bucket == "" {
+		return
+	}
+	// Validated at startup
+	endpoint, _ := url.Parse(cfg.RecordingS3Endpoint)
+	recordingUploader = &s3Uploader{
+		endpoint:  endpoint,
+		bucket:    cfg.RecordingS3Bucket,
+		prefix:    cfg.RecordingS3Prefix,
+		region:    cfg.RecordingS3Region,
+		accessKey: cfg.RecordingS3AccessKey,
+		secretKey: cfg.RecordingS3SecretKey,
+		client:    &http.Client{Timeout: 15 * time.Minute},
+	}
+}
+
+// uploadRecording uploads the .fbs and .json files of a finished recording,
+// removing them once both are stored; failed uploads are retried with backoff
+func (u *s3Uploader) uploadRecording(base string) {
+	backoff := recordingUploadBackoff
+	for attempt := 1; ; attempt++ {
+		err := u.putFile(base + ".fbs")
+		if err == nil {
+			err = u.putFile(base + ".json")
+		}
+		if err == nil {
+			os.Remove(base + ".fbs")
+			os.Remove(base + ".json")
+			fmt.Printf("[INFO] Uploaded recording %s to bucket %s\n", filepath.Base(base), u.bucket)
+			return
+		}
+		if attempt == recordingUploadAttempts {
+			fmt.Printf("[ERROR] Failed to upload recording %s, kept on disk: %v\n", base, err)
+			return
+		}
+		fmt.Printf("[WARN] Failed to upload recording %s (attempt %d), retrying in %v: %v\n", filepath.Base(base), attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// putFile stores a file as prefix + its name
+func (u *s3Uploader) putFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	target := *u.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + u.bucket + "/" + u.prefix + filepath.Base(path)
+	req, err := http.NewRequest(http.MethodPut, target.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	u.sign(req, hex.EncodeToString(h.Sum(nil)), time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PUT %s returned %s: %s", target.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign adds the SigV4 Authorization header, covering the host and every header already set
+func (u *s3Uploader) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3CanonicalURI(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + u.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + u.secretKey)
+	for _, part := range []string{date, u.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.accessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalURI encodes path as SigV4 expects for S3: every byte but the
+// unreserved characters and '/' percent-encoded, which is stricter than
+// url.URL.EscapedPath
+func s3CanonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// How long a frame may take to reach a resumable viewer before its connection
+// counts as lost; a stalled write would otherwise hold the session until TCP gives up
+const resumeWriteTimeout = 30 * time.Second
+
+// How long the attached viewer gets to answer a ping when another one presents
+// its token; one that doesn't is taken as lost
+var resumeProbeTimeout = 3 * time.Second
+
+// WebSocket subprotocol a viewer offers to be given a reconnect token. To
+// resume it offers resumeProtocol + "." + token as well; tokens never appear in URLs
+const resumeProtocol = "vncwebproxy.resume"
+
+// Errors of a viewer attaching to a resumable session
+var (
+	errResumeEnded    = errors.New("session ended")
+	errViewerAttached = errors.New("session still has its viewer")
+)
+
+// newResumeToken returns a random reconnect token
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// resumeRequest reports whether the viewer of r asked for a reconnect token
+// and returns the one it presents, "" if none
+func resumeRequest(r *http.Request) (wanted bool, token string) {
+	for _, p := range websocket.Subprotocols(r) {
+		if p == resumeProtocol {
+			wanted = true
+		} else if strings.HasPrefix(p, resumeProtocol+".") {
+			token = strings.TrimPrefix(p, resumeProtocol+".")
+		}
+	}
+	return wanted, token
+}
+
+// resumeToken returns a new reconnect token for a VNC session whose viewer
+// asked for one. It is "" when -resume_grace is off and for terminal consoles
+func resumeToken(cfg *Config, ctx *gin.Context, item *ProxiedItem) string {
+	if cfg.ResumeGrace <= 0 || item.Console == consoleXterm {
+		return ""
+	}
+	if wanted, _ := resumeRequest(ctx.Request); !wanted {
+		return ""
+	}
+	return newResumeToken()
+}
+
+// resumeHeader is the upgrade response header selecting resumeProtocol for a
+// session with a reconnect token
+func resumeHeader(token string) http.Header {
+	if token == "" {
+		return nil
+	}
+	return http.Header{"Sec-Websocket-Protocol": {resumeProtocol}}
+}
+
+// resumableClient is the viewer side of a session with a reconnect token.
+// When the viewer's connection is lost the session keeps its backend for
+// -resume_grace and a viewer presenting the token takes its place; backend
+// frames are dropped meanwhile. A viewer still answering pings is never replaced. Like a fanout viewer, the new one completes
+// the RFB handshake with the proxy and gets a ServerInit at the next message
+// boundary, then the stream from there on
+type resumableClient struct {
+	token      string
+	hash       string
+	item       *ProxiedItem
+	session    string
+	serverInit func() []byte // nil until the stream is being followed
+
+	wmu sync.Mutex // held while writing frames to conn
+
+	mu         sync.Mutex
+	conn       *websocket.Conn // nil while no viewer is attached
+	joining    bool            // conn hasn't had its ServerInit yet
+	start      bool            // the frame being written starts at a message boundary
+	boundary   bool            // the stream is between messages after that frame
+	closedConn *websocket.Conn // the viewer that sent a close frame
+	lostConn   *websocket.Conn // the viewer that didn't answer a probe
+	viewerIP   string          // address a resumed viewer holds a connection slot of
+	closed     bool
+	handoff    chan *websocket.Conn
+
+	probe sync.Mutex    // held while probing the attached viewer
+	heard chan struct{} // the attached viewer sent something
+}
+
+// resumeRegistry maps reconnect tokens to their sessions
+type resumeRegistry struct {
+	mu      sync.Mutex
+	clients map[string]*resumableClient
+}
+
+// Resumable sessions of the running process
+var resumables = &resumeRegistry{clients: make(map[string]*resumableClient)}
+
+// open makes the session of conn resumable with token, nil if the token is taken
+func (rr *resumeRegistry) open(token string, target *backendTarget, session string, conn *websocket.Conn, serverInit func() []byte) *resumableClient {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.clients[token] != nil {
+		return nil
+	}
+	rc := &resumableClient{
+		token:      token,
+		hash:       target.hash,
+		item:       target.item,
+		session:    session,
+		serverInit: serverInit,
+		conn:       conn,
+		handoff:    make(chan *websocket.Conn, 1),
+		heard:      make(chan struct{}, 1),
+	}
+	rr.clients[token] = rc
+	return rc
+}
+
+func (rr *resumeRegistry) get(token string) *resumableClient {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.clients[token]
+}
+
+// announce tells the viewer the reconnect token in a text frame, which noVNC ignores
+func (rc *resumableClient) announce() {
+	msg, _ := json.Marshal(map[string]string{"resume_token": rc.token})
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+	rc.mu.Lock()
+	conn := rc.conn
+	rc.mu.Unlock()
+	if conn != nil {
+		rc.write(conn, websocket.TextMessage, msg)
+	}
+}
+
+// alive records that conn sent a message or answered a ping
+func (rc *resumableClient) alive(conn *websocket.Conn) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.conn != conn {
+		return
+	}
+	select {
+	case rc.heard <- struct{}{}:
+	default:
+	}
+}
+
+// healthy pings the attached viewer and reports whether it answered within
+// resumeProbeTimeout. One that didn't is closed as lost: its session then
+// waits for a resuming viewer as it would once TCP gave up on it
+func (rc *resumableClient) healthy() bool {
+	rc.probe.Lock()
+	defer rc.probe.Unlock()
+
+	rc.mu.Lock()
+	conn := rc.conn
+	rc.mu.Unlock()
+	if conn == nil {
+		return false
+	}
+	select {
+	case <-rc.heard:
+	default:
+	}
+	if err := conn.WriteControl(websocket.PingMessage, pingPayload(), time.Now().Add(resumeProbeTimeout)); err == nil {
+		timer := time.NewTimer(resumeProbeTimeout)
+		defer timer.Stop()
+		select {
+		case <-rc.heard:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	rc.mu.Lock()
+	if rc.conn == conn {
+		rc.lostConn = conn
+	}
+	rc.mu.Unlock()
+	fmt.Printf("[INFO] Viewer of session %s didn't answer within %v, taking it as lost\n", rc.session, resumeProbeTimeout)
+	conn.Close()
+	return false
+}
+
+// next tells the client whether the backend frame written next ends at a
+// message boundary; called by the forwarding goroutine for every frame, even
+// those the clipboard policy removes entirely
+func (rc *resumableClient) next(boundary bool) {
+	rc.mu.Lock()
+	rc.start = rc.boundary
+	rc.boundary = boundary
+	rc.mu.Unlock()
+}
+
+// WriteMessage writes a frame to the attached viewer. Frames are dropped while
+// none is, and for a viewer that just attached until the next message starts.
+// A failed write closes the viewer's connection, so its reader sees it lost
+func (rc *resumableClient) WriteMessage(mt int, data []byte) error {
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+
+	rc.mu.Lock()
+	conn := rc.conn
+	var init []byte
+	if conn != nil && rc.joining {
+		switch {
+		case rc.start:
+			init = rc.serverInit()
+			rc.joining = false
+		case rc.boundary:
+			// The frame completes a message the viewer never saw the start of
+			rc.joining = false
+			rc.mu.Unlock()
+			rc.write(conn, websocket.BinaryMessage, rc.serverInit())
+			return nil
+		default:
+			conn = nil
+		}
+	}
+	rc.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if init != nil && !rc.write(conn, websocket.BinaryMessage, init) {
+		return nil
+	}
+	rc.write(conn, mt, data)
+	return nil
+}
+
+// write sends one message to conn, closing it if that fails; the caller holds rc.wmu
+func (rc *resumableClient) write(conn *websocket.Conn, mt int, data []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(resumeWriteTimeout))
+	if err := conn.WriteMessage(mt, data); err != nil {
+		rc.mu.Lock()
+		if !rc.closed {
+			fmt.Printf("[WARN] Session %s lost its viewer while writing: %v\n", rc.session, err)
+		}
+		rc.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// WriteControl sends a control message to the attached viewer, if any
+func (rc *resumableClient) WriteControl(mt int, data []byte, deadline time.Time) error {
+	rc.mu.Lock()
+	conn := rc.conn
+	rc.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if err := conn.WriteControl(mt, data, deadline); err != nil && mt == websocket.PingMessage {
+		conn.Close()
+	}
+	return nil
+}
+
+// leftCleanly records that conn sent a close frame: its viewer left on purpose
+func (rc *resumableClient) leftCleanly(conn *websocket.Conn) {
+	rc.mu.Lock()
+	rc.closedConn = conn
+	rc.mu.Unlock()
+}
+
+// resumable reports whether the session may wait for lost viewer conn to come back
+func (rc *resumableClient) resumable(conn *websocket.Conn) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return !rc.closed && rc.closedConn != conn && rc.serverInit() != nil
+}
+
+// attach makes conn, which completed the RFB handshake, the session's viewer;
+// viewerIP is the address whose connection slot it holds until it is detached.
+// It fails once the session has ended and while a viewer is attached that
+// wasn't found lost by healthy
+func (rc *resumableClient) attach(conn *websocket.Conn, viewerIP string) error {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return errResumeEnded
+	}
+	old := rc.conn
+	if old != nil && old != rc.lostConn {
+		rc.mu.Unlock()
+		return errViewerAttached
+	}
+	oldIP := rc.viewerIP
+	if old == nil {
+		oldIP = ""
+	}
+	rc.conn, rc.joining, rc.viewerIP = conn, true, viewerIP
+	select {
+	case <-rc.handoff:
+	default:
+	}
+	rc.handoff <- conn
+	rc.mu.Unlock()
+
+	// The lost viewer is already closed; its reader hasn't noticed yet
+	if old != nil {
+		old.Close()
+	}
+	if oldIP != "" {
+		viewerConns.Release(oldIP)
+	}
+
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+	rc.mu.Lock()
+	ready := rc.conn == conn && rc.joining && rc.boundary
+	if ready {
+		rc.joining = false
+	}
+	rc.mu.Unlock()
+	if ready {
+		rc.write(conn, websocket.BinaryMessage, rc.serverInit())
+	}
+	return nil
+}
+
+// await detaches lost viewer conn and waits up to grace for a resuming viewer,
+// nil if none came or the session ended
+func (rc *resumableClient) await(conn *websocket.Conn, grace time.Duration, done <-chan struct{}) *websocket.Conn {
+	rc.mu.Lock()
+	var viewerIP string
+	if rc.conn == conn {
+		rc.conn, viewerIP, rc.viewerIP = nil, rc.viewerIP, ""
+		fmt.Printf("[INFO] Session %s lost its viewer, holding the backend for %v\n", rc.session, grace)
+	}
+	rc.mu.Unlock()
+	conn.Close()
+	if viewerIP != "" {
+		viewerConns.Release(viewerIP)
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case next := <-rc.handoff:
+		return next
+	case <-timer.C:
+		fmt.Printf("[INFO] Session %s not resumed within %v\n", rc.session, grace)
+		return nil
+	case <-done:
+		return nil
+	}
+}
+
+// forward copies viewer frames to dst through onMessage like proxyWS, moving on
+// to a resuming viewer when one is lost; watch sets up the handlers of each
+// viewer's connection. onMessage sees the frames of all viewers counted as one stream
+func (rc *resumableClient) forward(cfg *Config, dst messageWriter, errc chan<- error, onMessage messageHook, watch func(*websocket.Conn), done <-chan struct{}) {
+	rc.mu.Lock()
+	conn := rc.conn
+	rc.mu.Unlock()
+
+	total := 0
+	for {
+		base, failed := total, false
+		hook := func(count, mt int, msg []byte) error {
+			rc.alive(conn)
+			total = base + count
+			err := onMessage(total, mt, msg)
+			failed = err != nil && err != errSkipMessage
+			return err
+		}
+		watch(conn)
+		pong, c := conn.PongHandler(), conn
+		conn.SetPongHandler(func(data string) error {
+			rc.alive(c)
+			return pong(data)
+		})
+		connErr := make(chan error, 1)
+		proxyWS(conn, dst, connErr, "client->backend", cfg.Debug, hook)
+		err := <-connErr
+
+		if failed || !rc.resumable(conn) {
+			errc <- err
+			return
+		}
+		if conn = rc.await(conn, cfg.ResumeGrace, done); conn == nil {
+			errc <- err
+			return
+		}
+	}
+}
+
+// close ends resumption when the session ends, closing the attached viewer
+func (rc *resumableClient) close() {
+	resumables.mu.Lock()
+	if resumables.clients[rc.token] == rc {
+		delete(resumables.clients, rc.token)
+	}
+	resumables.mu.Unlock()
+
+	rc.mu.Lock()
+	rc.closed = true
+	conn, viewerIP := rc.conn, rc.viewerIP
+	rc.viewerIP = ""
+	rc.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	if viewerIP != "" {
+		viewerConns.Release(viewerIP)
+	}
+}
+
+// resumeSession hands a viewer presenting the reconnect token of a live
+// session of hash data over to it and reports whether it did. The hash isn't
+// looked up again: a single-use hash is gone by now, the token stands for it.
+// Resuming never adds a viewer, it only takes the place of a lost one
+func resumeSession(cfg *Config, ctx *gin.Context, data string) bool {
+	if cfg.ResumeGrace <= 0 {
+		return false
+	}
+	_, token := resumeRequest(ctx.Request)
+	if token == "" {
+		return false
+	}
+	// Before its handshake is done a session has nothing to resume
+	rc := resumables.get(token)
+	if rc == nil || rc.hash != data || rc.serverInit() == nil {
+		return false
+	}
+
+	viewerIP := ctx.ClientIP()
+	if !rc.item.AllowsViewer(viewerIP) {
+		fmt.Printf("[WARN] Viewer %s refused to resume session %s, bound to %v\n", viewerIP, rc.session, rc.item.ViewerNetworks)
+		ctx.String(http.StatusForbidden, "console link is bound to another viewer address")
+		return true
+	}
+	if !viewerConns.Acquire(viewerIP) {
+		fmt.Printf("[WARN] Viewer %s refused to resume session %s, already holds %d connections\n",
+			viewerIP, rc.session, cfg.MaxConnsPerIP)
+		ctx.String(http.StatusTooManyRequests, "too many console connections from your address")
+		return true
+	}
+	attached := false
+	defer func() {
+		if !attached {
+			viewerConns.Release(viewerIP)
+		}
+	}()
+	if rc.healthy() {
+		fmt.Printf("[WARN] Viewer %s refused to resume session %s, its viewer is still connected\n", viewerIP, rc.session)
+		ctx.String(http.StatusConflict, "console is open in another window")
+		return true
+	}
+
+	conn, err := clientUpgrader(cfg).Upgrade(ctx.Writer, ctx.Request, resumeHeader(token))
+	if err != nil {
+		fmt.Printf("[ERROR] Client WebSocket upgrade failed: %v\n", err)
+		return true
+	}
+	if err := fanoutHandshake(cfg, conn); err != nil {
+		fmt.Printf("[ERROR] Handshake with resuming viewer %s failed: %v\n", viewerIP, err)
+		conn.Close()
+		return true
+	}
+	if err := rc.attach(conn, viewerIP); err != nil {
+		fmt.Printf("[WARN] Viewer %s couldn't resume session %s: %v\n", viewerIP, rc.session, err)
+		code, text := websocket.CloseGoingAway, "console closed"
+		if err == errViewerAttached {
+			code, text = websocket.CloseTryAgainLater, "console is open in another window"
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+		conn.Close()
+		return true
+	}
+	attached = true
+	fmt.Printf("[INFO] Viewer %s resumed session %s of hash %s\n", viewerIP, rc.session, hashTag(data))
+	return true
+}
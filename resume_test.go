@@ -0,0 +1,284 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestResumeRequest(t *testing.T) {
+	token := newResumeToken()
+	tests := []struct {
+		name      string
+		protocols string
+		wanted    bool
+		token     string
+	}{
+		{name: "none"},
+		{name: "other protocol", protocols: "binary"},
+		{name: "asks for a token", protocols: "binary, " + resumeProtocol, wanted: true},
+		{name: "resumes", protocols: resumeProtocol + ", " + resumeProtocol + "." + token, wanted: true, token: token},
+	}
+
+	cfg := &Config{ResumeGrace: time.Minute}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/vncproxy/abcd?resume="+token, nil)
+			if tt.protocols != "" {
+				r.Header.Set("Sec-WebSocket-Protocol", tt.protocols)
+			}
+			wanted, got := resumeRequest(r)
+			if wanted != tt.wanted || got != tt.token {
+				t.Errorf("resumeRequest = %v, %q, want %v, %q", wanted, got, tt.wanted, tt.token)
+			}
+
+			// The session's token is always a new one, never one the viewer offered
+			ctx := &gin.Context{Request: r}
+			issued := resumeToken(cfg, ctx, &ProxiedItem{})
+			if issued != "" && (!tt.wanted || issued == token) {
+				t.Errorf("resumeToken = %q", issued)
+			}
+			if tt.wanted && issued == "" {
+				t.Error("no token for a viewer asking for one")
+			}
+		})
+	}
+}
+
+// resumeTest is a resumable session of hash "abcd" whose first viewer is
+// connected, with /vncproxy/:data serving resumeSession
+type resumeTest struct {
+	cfg    *Config
+	rc     *resumableClient
+	url    string
+	viewer *websocket.Conn // the first viewer's end
+	errc   chan error      // the session's viewer side ended
+
+	mu       sync.Mutex
+	received []string // viewer frames reaching the backend
+}
+
+func newResumeTest(t *testing.T, grace time.Duration) *resumeTest {
+	t.Helper()
+	oldProbe := resumeProbeTimeout
+	resumeProbeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { resumeProbeTimeout = oldProbe })
+
+	rt := &resumeTest{cfg: &Config{ResumeGrace: grace, HandshakeReadTimeout: time.Second}, errc: make(chan error, 1)}
+	conns := make(chan *websocket.Conn, 1)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/first", func(c *gin.Context) {
+		conn, _ := (&websocket.Upgrader{}).Upgrade(c.Writer, c.Request, nil)
+		conns <- conn
+	})
+	r.GET("/vncproxy/:data", func(c *gin.Context) {
+		if !resumeSession(rt.cfg, c, c.Param("data")) {
+			c.String(http.StatusNotFound, "not resumed")
+		}
+	})
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	rt.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	viewer, _, err := websocket.DefaultDialer.Dial(rt.url+"/first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { viewer.Close() })
+	rt.viewer = viewer
+
+	target := &backendTarget{hash: "abcd", item: &ProxiedItem{}}
+	rt.rc = resumables.open(newResumeToken(), target, "s1", <-conns, func() []byte { return []byte("init") })
+	t.Cleanup(rt.rc.close)
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	hook := func(count, mt int, msg []byte) error {
+		rt.mu.Lock()
+		rt.received = append(rt.received, string(msg))
+		rt.mu.Unlock()
+		return nil
+	}
+	go rt.rc.forward(rt.cfg, discardWriter{}, rt.errc, hook, func(*websocket.Conn) {}, done)
+	return rt
+}
+
+type discardWriter struct{}
+
+func (discardWriter) WriteMessage(int, []byte) error { return nil }
+
+// readAll keeps reading conn, which answers pings, until it fails
+func readAll(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// resume connects presenting token to the session of hash
+func (rt *resumeTest) resume(hash, token string) (*websocket.Conn, int, error) {
+	dialer := websocket.Dialer{Subprotocols: []string{resumeProtocol, resumeProtocol + "." + token}}
+	conn, resp, err := dialer.Dial(rt.url+"/vncproxy/"+hash, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, resp.StatusCode, err
+		}
+		return nil, 0, err
+	}
+	return conn, resp.StatusCode, nil
+}
+
+// viewerHandshake is the viewer's side of the RFB handshake with the proxy
+func viewerHandshake(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	// ProtocolVersion, security types with None, SecurityResult
+	for _, reply := range [][]byte{[]byte("RFB 003.008\n"), {1}, {1}} {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		conn.WriteMessage(websocket.BinaryMessage, reply)
+	}
+}
+
+// waitAttached waits for a resuming viewer to be attached after its handshake
+func (rt *resumeTest) waitAttached(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		rt.rc.mu.Lock()
+		attached := rt.rc.viewerIP != ""
+		rt.rc.mu.Unlock()
+		if attached {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resuming viewer not attached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumeTakeover(t *testing.T) {
+	rt := newResumeTest(t, time.Minute)
+	go readAll(rt.viewer)
+
+	if _, status, _ := rt.resume("abcd", rt.rc.token); status != http.StatusConflict {
+		t.Fatalf("resuming past a healthy viewer: status %d, want 409", status)
+	}
+	if _, status, _ := rt.resume("other", rt.rc.token); status != http.StatusNotFound {
+		t.Errorf("token of another hash: status %d, want it ignored", status)
+	}
+	if _, status, _ := rt.resume("abcd", newResumeToken()); status != http.StatusNotFound {
+		t.Errorf("token the proxy didn't issue: status %d, want it ignored", status)
+	}
+
+	// The per-IP limit counts the resuming connection
+	old := viewerConns
+	viewerConns = NewConnLimiter(1)
+	viewerConns.Acquire("127.0.0.1")
+	_, status, _ := rt.resume("abcd", rt.rc.token)
+	viewerConns = old
+	if status != http.StatusTooManyRequests {
+		t.Errorf("over the per-IP limit: status %d, want 429", status)
+	}
+
+	// A viewer that stops answering pings, as when its network went away, is replaced
+	rt.viewer.SetReadDeadline(time.Now())
+	time.Sleep(20 * time.Millisecond)
+	conn, status, err := rt.resume("abcd", rt.rc.token)
+	if err != nil {
+		t.Fatalf("resuming past a lost viewer: status %d: %v", status, err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != resumeProtocol {
+		t.Errorf("subprotocol = %q, want %q", conn.Subprotocol(), resumeProtocol)
+	}
+	viewerHandshake(t, conn)
+	rt.waitAttached(t)
+
+	// The new viewer joins at the next message with a ServerInit
+	rt.rc.next(true)
+	rt.rc.next(true)
+	rt.rc.WriteMessage(websocket.BinaryMessage, []byte("update"))
+	for _, want := range []string{"init", "update"} {
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != want {
+			t.Fatalf("resumed viewer got %q, %v, want %q", msg, err, want)
+		}
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("key"))
+	deadline := time.Now().Add(time.Second)
+	for {
+		rt.mu.Lock()
+		n := len(rt.received)
+		rt.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resumed viewer's input didn't reach the backend")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The resumed viewer is healthy now and can't be taken over either
+	go readAll(conn)
+	if _, status, _ := rt.resume("abcd", rt.rc.token); status != http.StatusConflict {
+		t.Errorf("resuming past the resumed viewer: status %d, want 409", status)
+	}
+}
+
+func TestResumeGrace(t *testing.T) {
+	t.Run("lost and not resumed", func(t *testing.T) {
+		rt := newResumeTest(t, 100*time.Millisecond)
+		rt.viewer.UnderlyingConn().Close()
+		select {
+		case <-rt.errc:
+		case <-time.After(2 * time.Second):
+			t.Fatal("session still held after the grace period")
+		}
+	})
+
+	t.Run("lost and resumed", func(t *testing.T) {
+		rt := newResumeTest(t, time.Minute)
+		rt.viewer.UnderlyingConn().Close()
+		conn, status, err := rt.resume("abcd", rt.rc.token)
+		if err != nil {
+			t.Fatalf("status %d: %v", status, err)
+		}
+		defer conn.Close()
+		viewerHandshake(t, conn)
+		rt.waitAttached(t)
+		select {
+		case err := <-rt.errc:
+			t.Fatalf("session ended after its viewer resumed: %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("left cleanly", func(t *testing.T) {
+		rt := newResumeTest(t, time.Minute)
+		rt.rc.leftCleanly(rt.rc.conn)
+		rt.viewer.UnderlyingConn().Close()
+		select {
+		case <-rt.errc:
+		case <-time.After(2 * time.Second):
+			t.Fatal("session held for a viewer that closed it")
+		}
+	})
+
+	t.Run("ended", func(t *testing.T) {
+		rt := newResumeTest(t, time.Minute)
+		rt.rc.close()
+		if _, status, _ := rt.resume("abcd", rt.rc.token); status != http.StatusNotFound {
+			t.Errorf("token of an ended session: status %d, want it ignored", status)
+		}
+	})
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Encodings whose updates have a length the stream parser can work out without
+// decoding them, and that carry no compression state between updates, so a
+// viewer can start reading the stream at any message
+const (
+	rfbEncodingRaw                 = 0
+	rfbEncodingCopyRect            = 1
+	rfbEncodingRRE                 = 2
+	rfbEncodingHextile             = 5
+	rfbEncodingDesktopSize         = -223
+	rfbEncodingLastRect            = -224
+	rfbEncodingCursor              = -239
+	rfbEncodingQEMUExtendedKey     = -258
+	rfbEncodingQEMULEDState        = -261
+	rfbEncodingExtendedDesktopSize = -308
+	rfbEncodingXVP                 = -309
+)
+
+// Longest desktop name accepted in a ServerInit
+const rfbMaxNameLength = 4096
+
+func streamableEncoding(enc int32) bool {
+	switch enc {
+	case rfbEncodingRaw, rfbEncodingCopyRect, rfbEncodingRRE, rfbEncodingHextile,
+		rfbEncodingDesktopSize, rfbEncodingLastRect, rfbEncodingCursor,
+		rfbEncodingQEMUExtendedKey, rfbEncodingQEMULEDState,
+		rfbEncodingExtendedDesktopSize, rfbEncodingXVP:
+		return true
+	}
+	// JPEG quality and compression level hints never add data to the stream
+	return (enc >= -32 && enc <= -23) || (enc >= -256 && enc <= -247)
+}
+
+// filterEncodings rewrites a SetEncodings message to the streamable encodings
+func filterEncodings(msg []byte) []byte {
+	out := []byte{2, 0, 0, 0}
+	n := 0
+	for i := 4; i+4 <= len(msg); i += 4 {
+		if streamableEncoding(int32(binary.BigEndian.Uint32(msg[i:]))) {
+			out = append(out, msg[i:i+4]...)
+			n++
+		}
+	}
+	binary.BigEndian.PutUint16(out[2:], uint16(n))
+	return out
+}
+
+// rfbClientMessageSize returns the length of the first message of a viewer
+// frame, or -1 when it is of an unknown type or truncated
+func rfbClientMessageSize(msg []byte) int {
+	size := -1
+	switch msg[0] {
+	case 0: // SetPixelFormat
+		size = 20
+	case 2: // SetEncodings
+		if len(msg) >= 4 {
+			size = 4 + 4*int(binary.BigEndian.Uint16(msg[2:4]))
+		}
+	case 3, 150: // FramebufferUpdateRequest, EnableContinuousUpdates
+		size = 10
+	case 4: // KeyEvent
+		size = 8
+	case 5: // PointerEvent
+		size = 6
+	case 6: // ClientCutText
+		if len(msg) >= 8 {
+			size = 8 + int(binary.BigEndian.Uint32(msg[4:8]))
+		}
+	case 248: // ClientFence
+		if len(msg) >= 9 {
+			size = 9 + int(msg[8])
+		}
+	case 250: // xvp
+		size = 4
+	case 251: // SetDesktopSize
+		if len(msg) >= 8 {
+			size = 8 + 16*int(msg[6])
+		}
+	case 255: // QEMU extended key event
+		if len(msg) >= 2 && msg[1] == 0 {
+			size = 12
+		}
+	}
+	if size < 0 || len(msg) < size {
+		return -1
+	}
+	return size
+}
+
+// rfbServerInit is the framebuffer a joining viewer is told about
+type rfbServerInit struct {
+	width, height uint16
+	pixelFormat   [16]byte
+	name          []byte
+}
+
+func (si *rfbServerInit) encode() []byte {
+	b := make([]byte, 24, 24+len(si.name))
+	binary.BigEndian.PutUint16(b[0:], si.width)
+	binary.BigEndian.PutUint16(b[2:], si.height)
+	copy(b[4:20], si.pixelFormat[:])
+	binary.BigEndian.PutUint32(b[20:], uint32(len(si.name)))
+	return append(b, si.name...)
+}
+
+// rfbStream follows the server side of an RFB connection from ServerInit on,
+// reporting after each WebSocket frame whether the stream is between messages.
+// Parsing runs in its own goroutine reading the frames fed to it; Feed waits
+// until the goroutine has used up the frame, so the fields below may be read
+// by whoever serializes calls to Feed. With a cutText policy ServerCutText
+// messages are rewritten as it says, out holding what is left of each frame
+type rfbStream struct {
+	in   chan []byte
+	idle chan bool
+
+	buf      []byte
+	fed      bool
+	closed   bool
+	boundary bool
+	one      [1]byte
+
+	cutText *cutTextPolicy
+	cutting bool
+	out     []byte
+
+	// Current framebuffer, valid once ready is set
+	init  rfbServerInit
+	ready bool
+	err   error
+}
+
+func newRFBStream(cutText *cutTextPolicy) *rfbStream {
+	p := &rfbStream{in: make(chan []byte), idle: make(chan bool), cutText: cutText}
+	go p.parse()
+	return p
+}
+
+// Feed parses the next frame sent by the server and reports whether it ended
+// at a message boundary
+func (p *rfbStream) Feed(frame []byte) bool {
+	p.in <- frame
+	return <-p.idle
+}
+
+// Close stops the parsing goroutine; Feed must not be called afterwards
+func (p *rfbStream) Close() {
+	close(p.in)
+}
+
+// setPixelFormat applies a SetPixelFormat sent by the viewer owning the connection
+func (p *rfbStream) setPixelFormat(msg []byte) {
+	copy(p.init.pixelFormat[:], msg[4:20])
+}
+
+func (p *rfbStream) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.fed {
+			p.idle <- p.boundary
+		}
+		frame, ok := <-p.in
+		if !ok {
+			p.closed = true
+			return 0, io.EOF
+		}
+		p.fed = true
+		p.buf = frame
+		p.out = nil
+	}
+	n := copy(b, p.buf)
+	if p.cutText != nil && !p.cutting {
+		p.out = append(p.out, p.buf[:n]...)
+	}
+	p.buf = p.buf[n:]
+	p.boundary = false
+	return n, nil
+}
+
+func (p *rfbStream) parse() {
+	err := p.parseServerInit()
+	for err == nil {
+		p.boundary = true
+		p.cutting = false
+		err = p.parseMessage()
+	}
+	if p.closed {
+		return
+	}
+	// Keep answering Feed so the connection itself is unaffected
+	p.err = err
+	p.idle <- false
+	for range p.in {
+		p.idle <- false
+	}
+}
+
+func (p *rfbStream) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(p, b)
+	return b, err
+}
+
+func (p *rfbStream) readByte() (byte, error) {
+	_, err := io.ReadFull(p, p.one[:])
+	return p.one[0], err
+}
+
+func (p *rfbStream) skip(n int64) error {
+	_, err := io.CopyN(io.Discard, p, n)
+	return err
+}
+
+func (p *rfbStream) parseServerInit() error {
+	hdr, err := p.read(24)
+	if err != nil {
+		return err
+	}
+	nameLen := binary.BigEndian.Uint32(hdr[20:])
+	if nameLen > rfbMaxNameLength {
+		return fmt.Errorf("desktop name of %d bytes", nameLen)
+	}
+	name, err := p.read(int(nameLen))
+	if err != nil {
+		return err
+	}
+	p.init.width = binary.BigEndian.Uint16(hdr[0:])
+	p.init.height = binary.BigEndian.Uint16(hdr[2:])
+	copy(p.init.pixelFormat[:], hdr[4:20])
+	p.init.name = name
+	p.ready = true
+	return nil
+}
+
+func (p *rfbStream) parseMessage() error {
+	t, err := p.readByte()
+	if err != nil {
+		return err
+	}
+	switch t {
+	case 0: // FramebufferUpdate
+		hdr, err := p.read(3)
+		if err != nil {
+			return err
+		}
+		for n := binary.BigEndian.Uint16(hdr[1:]); n > 0; n-- {
+			last, err := p.parseRect()
+			if err != nil || last {
+				return err
+			}
+		}
+		return nil
+	case 1: // SetColourMapEntries
+		hdr, err := p.read(5)
+		if err != nil {
+			return err
+		}
+		return p.skip(6 * int64(binary.BigEndian.Uint16(hdr[3:])))
+	case 2: // Bell
+		return nil
+	case 3: // ServerCutText
+		if p.cutText != nil {
+			// The type byte was just read from the current frame, the message
+			// is held back until its length is known
+			p.out = p.out[:len(p.out)-1]
+			p.cutting = true
+		}
+		hdr, err := p.read(7)
+		if err != nil {
+			return err
+		}
+		length := int32(binary.BigEndian.Uint32(hdr[3:]))
+		if length < 0 {
+			return fmt.Errorf("extended clipboard message")
+		}
+		if p.cutText == nil {
+			return p.skip(int64(length))
+		}
+		keep := p.cutText.keep(int(length), "backend")
+		if keep < 0 {
+			return p.skip(int64(length))
+		}
+		p.out = append(p.out, 3)
+		p.out = append(p.out, hdr...)
+		binary.BigEndian.PutUint32(p.out[len(p.out)-4:], uint32(keep))
+		p.cutting = false
+		if err := p.skip(int64(keep)); err != nil {
+			return err
+		}
+		p.cutting = true
+		return p.skip(int64(length) - int64(keep))
+	case 250: // xvp
+		return p.skip(3)
+	}
+	return fmt.Errorf("unsupported server message type %d", t)
+}
+
+// parseRect skips one rectangle of a FramebufferUpdate, reporting whether it was the LastRect marker
+func (p *rfbStream) parseRect() (bool, error) {
+	hdr, err := p.read(12)
+	if err != nil {
+		return false, err
+	}
+	y := binary.BigEndian.Uint16(hdr[2:])
+	w, h := int64(binary.BigEndian.Uint16(hdr[4:])), int64(binary.BigEndian.Uint16(hdr[6:]))
+	enc := int32(binary.BigEndian.Uint32(hdr[8:]))
+	bpp := int64(p.init.pixelFormat[0] / 8)
+
+	switch enc {
+	case rfbEncodingRaw:
+		return false, p.skip(w * h * bpp)
+	case rfbEncodingCopyRect:
+		return false, p.skip(4)
+	case rfbEncodingRRE:
+		sub, err := p.read(4 + int(bpp))
+		if err != nil {
+			return false, err
+		}
+		return false, p.skip(int64(binary.BigEndian.Uint32(sub)) * (bpp + 8))
+	case rfbEncodingHextile:
+		return false, p.skipHextile(w, h, bpp)
+	case rfbEncodingDesktopSize:
+		p.init.width, p.init.height = uint16(w), uint16(h)
+		return false, nil
+	case rfbEncodingLastRect:
+		return true, nil
+	case rfbEncodingCursor:
+		return false, p.skip(w*h*bpp + (w+7)/8*h)
+	case rfbEncodingQEMUExtendedKey:
+		return false, nil
+	case rfbEncodingQEMULEDState:
+		return false, p.skip(1)
+	case rfbEncodingExtendedDesktopSize:
+		screens, err := p.read(4)
+		if err != nil {
+			return false, err
+		}
+		// y is the status of a resize request, the size only changed when it is 0
+		if y == 0 {
+			p.init.width, p.init.height = uint16(w), uint16(h)
+		}
+		return false, p.skip(16 * int64(screens[0]))
+	}
+	return false, fmt.Errorf("unsupported encoding %d", enc)
+}
+
+func (p *rfbStream) skipHextile(w, h, bpp int64) error {
+	for ty := int64(0); ty < h; ty += 16 {
+		th := h - ty
+		if th > 16 {
+			th = 16
+		}
+		for tx := int64(0); tx < w; tx += 16 {
+			tw := w - tx
+			if tw > 16 {
+				tw = 16
+			}
+			sub, err := p.readByte()
+			if err != nil {
+				return err
+			}
+			if sub&1 != 0 { // Raw tile
+				if err := p.skip(tw * th * bpp); err != nil {
+					return err
+				}
+				continue
+			}
+			var n int64
+			if sub&2 != 0 { // BackgroundSpecified
+				n += bpp
+			}
+			if sub&4 != 0 { // ForegroundSpecified
+				n += bpp
+			}
+			if err := p.skip(n); err != nil {
+				return err
+			}
+			if sub&8 != 0 { // AnySubrects
+				count, err := p.readByte()
+				if err != nil {
+					return err
+				}
+				per := int64(2)
+				if sub&16 != 0 { // SubrectsColoured
+					per += bpp
+				}
+				if err := p.skip(int64(count) * per); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
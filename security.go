@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// securityHeaders sets HSTS, nosniff and a CSP restricting who may frame the proxy
+func securityHeaders(cfg *Config) gin.HandlerFunc {
+	csp := fmt.Sprintf("default-src 'self'; connect-src 'self' ws: wss:; img-src 'self' data:; "+
+		"style-src 'self' 'unsafe-inline'; object-src 'none'; base-uri 'self'; frame-ancestors %s",
+		cfg.FrameAncestors)
+
+	return func(c *gin.Context) {
+		h := c.Writer.Header()
+		if cfg.HSTSMaxAge > 0 {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", cfg.HSTSMaxAge))
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Content-Security-Policy", csp)
+		c.Next()
+	}
+}
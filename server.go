@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listenerServer serves a listener: an *http.Server, or the native VNC server
+type listenerServer interface {
+	Serve(net.Listener) error
+	Shutdown(context.Context) error
+}
+
+// namedServer is one server with the listener name used for handoff
+type namedServer struct {
+	name string
+	addr string
+	srv  listenerServer
+	tls  *tls.Config
+
+	// Loopback-only, never reached through a -proxy_protocol load balancer
+	local bool
+}
+
+// Server is a complete proxy: stores, routes and listeners built from a Config.
+// Sessions, stores and limiters are process-wide, so run one Server per process
+type Server struct {
+	cfg       *Config
+	servers   []namedServer
+	listeners map[string]net.Listener
+	stopOnce  sync.Once
+
+	// Set once a successor process took over the listeners and -state_file
+	handedOff int32
+}
+
+// NewServer sets up the stores and routes and opens the listeners; nothing is served until Run
+func NewServer(cfg *Config) (*Server, error) {
+	captureLogs()
+	credentialKey = cfg.CredentialKey
+	store, err := newProxiedStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxied = store
+	if list, ok := store.(*ProxiedList); ok && cfg.StateFile != "" {
+		if err := restoreRegistrations(cfg, list); err != nil {
+			fmt.Printf("[ERROR] Failed to restore registrations: %v\n", err)
+		}
+	}
+	hashFailures = NewFailureTracker(cfg.HashFailLimit, cfg.HashFailWindow)
+	viewerConns = NewConnLimiter(cfg.MaxConnsPerIP)
+	reconnectGuard = NewReconnectGuard(cfg)
+	startTranscriptIndex(cfg)
+	startRecordingUploads(cfg)
+	startRecordingRetention(cfg)
+	registrationLimiter = NewRateLimiter(cfg.RegisterRate, cfg.RegisterBurst, cfg.RegisterGlobalRate, cfg.RegisterGlobalBurst)
+
+	gin.SetMode(gin.ReleaseMode)
+	r, err := newRouter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The control API shares the WebSocket listener unless -api_listen is set
+	api := r
+	if cfg.APIListen != "" {
+		if api, err = newRouter(cfg); err != nil {
+			return nil, err
+		}
+	}
+	registerAPIRoutes(api, cfg)
+
+	r.GET("/vncproxy/:data", func(ctx *gin.Context) {
+		handleVNCWebSocket(cfg, ctx)
+	})
+
+	registerEmbedRoutes(r, cfg)
+	registerConsoleRoutes(r, cfg)
+	registerSpiceRoutes(r, cfg)
+
+	s := &Server{cfg: cfg, listeners: make(map[string]net.Listener)}
+	s.servers = []namedServer{{
+		name: listenerMain,
+		addr: net.JoinHostPort(cfg.ListenAddr, strconv.Itoa(cfg.Port)),
+		srv:  &http.Server{Handler: r},
+	}}
+	if cfg.APIListen != "" {
+		s.servers = append(s.servers, namedServer{name: listenerAPI, addr: cfg.APIListen, srv: &http.Server{Handler: api}})
+	}
+
+	// TLS (and client certificates) apply to whichever listener serves /api
+	if cfg.TLSCert != "" {
+		apiTLS, err := loadAPITLS(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.servers[len(s.servers)-1].tls = apiTLS
+
+		if cfg.GRPCListen != "" {
+			grpcTLS := apiTLS.Clone()
+			grpcTLS.ClientAuth = tls.RequireAndVerifyClientCert
+			grpcTLS.NextProtos = []string{"h2"}
+			s.servers = append(s.servers, namedServer{name: listenerGRPC, addr: cfg.GRPCListen, srv: &http.Server{Handler: grpcHandler(cfg)}, tls: grpcTLS})
+		}
+	}
+
+	// remote-viewer speaks plain HTTP to the proxy, the SPICE channels carry their own TLS
+	if cfg.SpiceListen != "" {
+		s.servers = append(s.servers, namedServer{name: listenerSpice, addr: cfg.SpiceListen, srv: &http.Server{Handler: spiceConnectHandler(cfg)}})
+	}
+
+	// Native viewers are proxied through the /vncproxy route of r
+	if cfg.NativeVNCListen != "" {
+		s.servers = append(s.servers, namedServer{name: listenerVNC, addr: cfg.NativeVNCListen, srv: &nativeVNCServer{cfg: cfg, handler: r}})
+	}
+
+	// A named listener like the others, so a successor inherits it on handoff
+	if cfg.PprofPort != 0 {
+		s.servers = append(s.servers, namedServer{
+			name:  listenerPprof,
+			addr:  net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.PprofPort)),
+			srv:   &http.Server{Handler: pprofHandler()},
+			local: true,
+		})
+	}
+
+	for _, ns := range s.servers {
+		ln, err := listen(ns.name, ns.addr)
+		if err != nil {
+			s.closeListeners()
+			return nil, fmt.Errorf("failed to listen on %s: %v", ns.addr, err)
+		}
+		s.listeners[ns.name] = ln
+	}
+	return s, nil
+}
+
+// registerAPIRoutes mounts the control API endpoints
+func registerAPIRoutes(api *gin.Engine, cfg *Config) {
+	api.POST("/api/proxy", proxyHandler(cfg))
+	api.GET("/api/proxy/:hash", proxyStatusHandler(cfg))
+	api.DELETE("/api/proxy/:hash", revokeProxyHandler(cfg))
+	api.GET("/api/registrations/watch", watchRegistrationsHandler(cfg))
+	api.GET("/api/metrics", metricsHandler(cfg))
+	api.GET("/api/time", timeHandler(cfg))
+	api.GET("/api/maintenance", maintenanceStatusHandler(cfg))
+	api.PUT("/api/maintenance", maintenanceHandler(cfg))
+	api.GET("/api/keys", listKeysHandler(cfg))
+	api.POST("/api/keys", addKeyHandler(cfg))
+	api.POST("/api/keys/:label/rotate", rotateKeyHandler(cfg))
+	api.DELETE("/api/keys/:label", deleteKeyHandler(cfg))
+	api.GET("/api/sessions", listSessionsHandler(cfg))
+	api.DELETE("/api/sessions/:id", killSessionHandler(cfg))
+	api.GET("/api/sessions/watch", watchSessionsHandler(cfg))
+	api.GET("/api/tenants", tenantsHandler(cfg))
+	api.GET("/api/logs", logsHandler(cfg))
+	registerHistoryRoutes(api, cfg)
+	registerWebAuthnRoutes(api, cfg)
+	registerDashboardRoutes(api, cfg)
+}
+
+// Addr returns the address of a listener (listenerMain, listenerAPI, listenerGRPC, listenerSpice, listenerVNC or listenerPprof), nil if not open
+func (s *Server) Addr(name string) net.Addr {
+	if ln, ok := s.listeners[name]; ok {
+		return ln.Addr()
+	}
+	return nil
+}
+
+// Listeners returns the open listeners by name, e.g. to hand them to a successor process
+func (s *Server) Listeners() map[string]net.Listener {
+	return s.listeners
+}
+
+// Run serves until Shutdown is called or ctx is done, then waits for the
+// proxied sessions to drain
+func (s *Server) Run(ctx context.Context) error {
+	cfg := s.cfg
+
+	startPeerDiscovery(cfg)
+	sessions.startUpdates(sessionSampleInterval)
+	startSessionWebhooks(cfg)
+	startUsageReporting(cfg)
+	startDriftMonitor(cfg)
+	startNativeIndex(cfg)
+	reconnectGuard.Start()
+
+	errc := make(chan error, len(s.servers))
+	var wg sync.WaitGroup
+	for _, ns := range s.servers {
+		wg.Add(1)
+		go func(ns namedServer, ln net.Listener) {
+			defer wg.Done()
+			fmt.Printf("[INFO] Starting %s server on %s\n", ns.name, ln.Addr())
+			if cfg.ProxyProtocol && !ns.local {
+				// Wrap only the served listener; the raw one stays available for handoff
+				ln = &proxyProtoListener{Listener: ln, timeout: 5 * time.Second}
+			}
+			if ns.tls != nil {
+				ln = tls.NewListener(ln, ns.tls)
+			}
+			if err := ns.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				errc <- fmt.Errorf("%s server stopped: %v", ns.name, err)
+			}
+		}(ns, s.listeners[ns.name])
+	}
+
+	sdNotify("READY=1")
+	startWatchdog()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case err = <-errc:
+	case <-ctx.Done():
+	}
+	if err != nil || ctx.Err() != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		s.Shutdown(shutdownCtx)
+		cancel()
+	}
+	<-done
+
+	drainSessions()
+	return err
+}
+
+// Shutdown stops accepting connections and ends long-lived API streams;
+// sessions already proxied keep running until Run has drained them
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(stopping)
+		s.saveState()
+		for _, ns := range s.servers {
+			if serr := ns.srv.Shutdown(ctx); serr != nil {
+				fmt.Printf("[ERROR] %s server shutdown: %v\n", ns.name, serr)
+				err = serr
+			}
+		}
+	})
+	return err
+}
+
+// saveState writes -state_file for the next start, unless a successor already
+// restored it: saving again would bring back hashes revoked or used up there
+func (s *Server) saveState() {
+	if atomic.LoadInt32(&s.handedOff) != 0 {
+		return
+	}
+	saveRegistrations(s.cfg)
+}
+
+func (s *Server) closeListeners() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// parseTestFlags builds a Config from args as the command line would
+func parseTestFlags(t *testing.T, args ...string) *Config {
+	t.Helper()
+	oldFlags, oldArgs := flag.CommandLine, os.Args
+	t.Cleanup(func() { flag.CommandLine, os.Args = oldFlags, oldArgs })
+	flag.CommandLine = flag.NewFlagSet("vncwebproxy", flag.ContinueOnError)
+	os.Args = append([]string{"vncwebproxy"}, args...)
+	return ParseFlags()
+}
+
+// fakeBackend is a Proxmox vncwebsocket endpoint that sends the RFB version
+// and reports the first message and the ticket it got
+func fakeBackend(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	got := make(chan string, 2)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.URL.Query().Get("vncticket")
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.BinaryMessage, []byte("RFB 003.008\n"))
+		if _, msg, err := conn.ReadMessage(); err == nil {
+			got <- string(msg)
+		}
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	return "wss" + strings.TrimPrefix(srv.URL, "https"), got
+}
+
+func TestServerProxiesRegisteredHash(t *testing.T) {
+	cfg := parseTestFlags(t, "-puqcloud_ip=127.0.0.1", "-api_key=test-key", "-listen_addr=127.0.0.1", "-port=0")
+	oldProxied, oldStopping := proxied, stopping
+	t.Cleanup(func() { proxied, stopping = oldProxied, oldStopping })
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- srv.Run(ctx) }()
+	defer func() {
+		cancel()
+		select {
+		case <-runErr:
+		case <-time.After(15 * time.Second):
+			t.Error("Run didn't return after its context was cancelled")
+		}
+	}()
+	base := "http://" + srv.Addr(listenerMain).String()
+
+	backendURL, backend := fakeBackend(t)
+	body := `{"hash":"servertest1234","proxmox_token":"PVEAPIToken=u@pve!t=x","proxmox_ws_url":"` + backendURL + `/vncwebsocket?vncticket=ticket1"}`
+	req, _ := http.NewRequest("POST", base+"/api/proxy", bytes.NewBufferString(body))
+	req.Header.Set("X-API-Key", "test-key")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("registering: status %d", resp.StatusCode)
+	}
+
+	viewer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/vncproxy/servertest1234", nil)
+	if err != nil {
+		t.Fatalf("opening the console: %v", err)
+	}
+	defer viewer.Close()
+	if ticket := <-backend; ticket != "ticket1" {
+		t.Errorf("backend got ticket %q", ticket)
+	}
+
+	viewer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := viewer.ReadMessage(); err != nil || string(msg) != "RFB 003.008\n" {
+		t.Fatalf("viewer got %q, %v from the backend", msg, err)
+	}
+	viewer.WriteMessage(websocket.BinaryMessage, []byte("RFB 003.008\n"))
+	select {
+	case msg := <-backend:
+		if msg != "RFB 003.008\n" {
+			t.Errorf("backend got %q from the viewer", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("viewer's message didn't reach the backend")
+	}
+}
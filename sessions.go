@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// hashTag shortens a console hash for logs and listings, keeping its namespace;
+// the full hash grants access
+func hashTag(hash string) string {
+	prefix := ""
+	if ns := splitNamespace(hash); ns != "" {
+		prefix = ns + ":"
+		hash = hash[len(prefix):]
+	}
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+	return prefix + hash
+}
+
+// SessionInfo describes a live proxied console connection
+type SessionInfo struct {
+	ID             string    `json:"id"`
+	Namespace      string    `json:"namespace,omitempty"`
+	Hash           string    `json:"hash"`
+	Principal      string    `json:"principal"`
+	ViewerIP       string    `json:"viewer_ip"`
+	BackendHost    string    `json:"backend_host"`
+	Started        time.Time `json:"started"`
+	BytesToClient  int64     `json:"bytes_to_client"`
+	BytesToBackend int64     `json:"bytes_to_backend"`
+
+	// Registration metadata, e.g. vm_id, client_id, product_id
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Counts and times of the viewer's input
+	Activity *InputActivity `json:"activity,omitempty"`
+
+	// Cluster node serving the session, set in ?cluster=true listings
+	Node string `json:"node,omitempty"`
+}
+
+// SessionEvent is published when a session starts or ends, and periodically as "update" with its counters
+type SessionEvent struct {
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Session SessionInfo `json:"session"`
+
+	// Set on "end" events: the close frame sent to the viewer and, for
+	// sessions that failed, the error and a snapshot
+	CloseCode   int            `json:"close_code,omitempty"`
+	CloseReason string         `json:"close_reason,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Snapshot    *CloseSnapshot `json:"snapshot,omitempty"`
+}
+
+// TenantUsage is the current load of one principal, sampled by startUpdates
+type TenantUsage struct {
+	Sessions             int     `json:"sessions"`
+	BytesPerSecToClient  float64 `json:"bytes_per_sec_to_client"`
+	BytesPerSecToBackend float64 `json:"bytes_per_sec_to_backend"`
+}
+
+// add accounts a session at its latest sampled rates
+func (u *TenantUsage) add(ls *liveSession) {
+	u.Sessions++
+	u.BytesPerSecToClient += ls.rateToClient
+	u.BytesPerSecToBackend += ls.rateToBackend
+}
+
+// liveSession is the registry entry of a running session
+type liveSession struct {
+	info           SessionInfo
+	hash           string
+	bytesToClient  int64
+	bytesToBackend int64
+	kill           chan struct{}
+	killOnce       sync.Once
+	killReason     string
+	killCode       int
+	lastInput      int64 // unix nanoseconds of the latest viewer input
+	closeSnapshot  *CloseSnapshot
+	closeCode      int
+	closeReason    string
+	closeError     string
+	activity       sessionActivity
+
+	// Counters and rates at the previous sample, written by the sampler under the registry lock
+	sampledToClient  int64
+	sampledToBackend int64
+	rateToClient     float64
+	rateToBackend    float64
+}
+
+// terminate ends the session, reason is sent to the viewer in the close frame
+func (ls *liveSession) terminate(reason string) {
+	ls.terminateWith(websocket.ClosePolicyViolation, reason)
+}
+
+// terminateWith ends the session with a specific close code for the viewer
+func (ls *liveSession) terminateWith(code int, reason string) {
+	ls.killOnce.Do(func() {
+		ls.killCode, ls.killReason = code, reason
+		close(ls.kill)
+	})
+}
+
+func (ls *liveSession) snapshot() SessionInfo {
+	info := ls.info
+	info.BytesToClient = atomic.LoadInt64(&ls.bytesToClient)
+	info.BytesToBackend = atomic.LoadInt64(&ls.bytesToBackend)
+	info.Activity = ls.activity.snapshot()
+	return info
+}
+
+// SessionRegistry tracks live sessions and notifies subscribers of changes
+type SessionRegistry struct {
+	mu          sync.RWMutex
+	sessions    map[string]*liveSession
+	subscribers map[chan SessionEvent]struct{}
+	tenants     map[string]TenantUsage
+	reserved    map[string]int // viewers per hash still connecting, see Reserve
+
+	// Called with every start and end event, see OnLifecycle
+	lifecycle []func(SessionEvent)
+}
+
+// Global registry of running sessions
+var sessions = NewSessionRegistry()
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions:    make(map[string]*liveSession),
+		subscribers: make(map[chan SessionEvent]struct{}),
+		tenants:     make(map[string]TenantUsage),
+		reserved:    make(map[string]int),
+	}
+}
+
+// Add registers a new session under a random ID
+func (sr *SessionRegistry) Add(hash, principal, viewerIP, backendHost string, metadata map[string]string) *liveSession {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	ls := &liveSession{
+		info: SessionInfo{
+			ID:          hex.EncodeToString(id),
+			Namespace:   splitNamespace(hash),
+			Hash:        hashTag(hash),
+			Principal:   principal,
+			ViewerIP:    viewerIP,
+			BackendHost: backendHost,
+			Started:     time.Now(),
+			Metadata:    metadata,
+		},
+		hash: hash,
+		kill: make(chan struct{}),
+	}
+	ls.touchInput()
+
+	sr.mu.Lock()
+	sr.sessions[ls.info.ID] = ls
+	sr.mu.Unlock()
+
+	sr.notify(SessionEvent{Type: "start", Time: time.Now(), Session: ls.snapshot()})
+	return ls
+}
+
+// Remove drops a finished session
+func (sr *SessionRegistry) Remove(ls *liveSession) {
+	sr.mu.Lock()
+	delete(sr.sessions, ls.info.ID)
+	sr.mu.Unlock()
+
+	info := ls.snapshot()
+	fmt.Printf("[INFO] Session %s closed after %v:%s\n", info.ID, time.Since(info.Started).Round(time.Second), formatActivity(info.Activity))
+	sr.notify(SessionEvent{
+		Type:        "end",
+		Time:        time.Now(),
+		Session:     info,
+		CloseCode:   ls.closeCode,
+		CloseReason: ls.closeReason,
+		Error:       ls.closeError,
+		Snapshot:    ls.closeSnapshot,
+	})
+}
+
+// List returns a snapshot of all live sessions
+func (sr *SessionRegistry) List() []SessionInfo {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	out := make([]SessionInfo, 0, len(sr.sessions))
+	for _, ls := range sr.sessions {
+		out = append(out, ls.snapshot())
+	}
+	return out
+}
+
+// Get returns the description of a live session
+func (sr *SessionRegistry) Get(id string) (SessionInfo, bool) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	ls, ok := sr.sessions[id]
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return ls.snapshot(), true
+}
+
+// CountNamespace returns the number of live sessions in a hash namespace
+func (sr *SessionRegistry) CountNamespace(name string) int {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	n := 0
+	for _, ls := range sr.sessions {
+		if ls.info.Namespace == name {
+			n++
+		}
+	}
+	return n
+}
+
+// CountPrincipal returns the number of live sessions of consoles registered by principal
+func (sr *SessionRegistry) CountPrincipal(principal string) int {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	n := 0
+	for _, ls := range sr.sessions {
+		if ls.info.Principal == principal {
+			n++
+		}
+	}
+	return n
+}
+
+// CountHash returns the number of live sessions of a console hash
+func (sr *SessionRegistry) CountHash(hash string) int {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	n := 0
+	for _, ls := range sr.sessions {
+		if ls.hash == hash {
+			n++
+		}
+	}
+	return n
+}
+
+// viewerSlot is a viewer of a hash counted by Reserve until it is released
+type viewerSlot struct {
+	sr   *SessionRegistry
+	hash string
+	once sync.Once
+}
+
+// Reserve counts a viewer of hash that is still connecting, so viewers racing
+// for the same hash can't all pass the limit before their sessions are added.
+// It refuses when live and reserved viewers already number limit (0 for no
+// limit), or any when exclusive, returning how many there are
+func (sr *SessionRegistry) Reserve(hash string, limit int, exclusive bool) (*viewerSlot, int, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	n := sr.reserved[hash]
+	for _, ls := range sr.sessions {
+		if ls.hash == hash {
+			n++
+		}
+	}
+	if (exclusive && n > 0) || (limit > 0 && n >= limit) {
+		return nil, n, false
+	}
+	sr.reserved[hash]++
+	return &viewerSlot{sr: sr, hash: hash}, n, true
+}
+
+// release stops counting the viewer, once its session is added or it gave up;
+// it is safe to call more than once and on a nil slot
+func (vs *viewerSlot) release() {
+	if vs == nil {
+		return
+	}
+	vs.once.Do(func() {
+		vs.sr.mu.Lock()
+		defer vs.sr.mu.Unlock()
+		if vs.sr.reserved[vs.hash]--; vs.sr.reserved[vs.hash] <= 0 {
+			delete(vs.sr.reserved, vs.hash)
+		}
+	})
+}
+
+// Kill asks a session to close both legs, reporting whether it exists
+func (sr *SessionRegistry) Kill(id string) bool {
+	sr.mu.RLock()
+	ls, ok := sr.sessions[id]
+	sr.mu.RUnlock()
+
+	if ok {
+		ls.terminate("session terminated by operator")
+	}
+	return ok
+}
+
+// KillHash closes every live session of a console hash, returning how many there were
+func (sr *SessionRegistry) KillHash(hash, reason string) int {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	n := 0
+	for _, ls := range sr.sessions {
+		if ls.hash == hash {
+			ls.terminate(reason)
+			n++
+		}
+	}
+	return n
+}
+
+// OnLifecycle calls fn with every start and end event, synchronously from the
+// session's own goroutine, so unlike Subscribe none is ever missed; fn must not block
+func (sr *SessionRegistry) OnLifecycle(fn func(SessionEvent)) {
+	sr.mu.Lock()
+	sr.lifecycle = append(sr.lifecycle, fn)
+	sr.mu.Unlock()
+}
+
+// notify hands a start or end event to the lifecycle listeners, then to subscribers
+func (sr *SessionRegistry) notify(ev SessionEvent) {
+	sr.mu.RLock()
+	listeners := sr.lifecycle
+	sr.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn(ev)
+	}
+	sr.publishEvent(ev)
+}
+
+// Subscribe returns a channel of session events and a function to stop receiving them;
+// slow subscribers miss events rather than blocking sessions
+func (sr *SessionRegistry) Subscribe() (<-chan SessionEvent, func()) {
+	ch := make(chan SessionEvent, 64)
+
+	sr.mu.Lock()
+	sr.subscribers[ch] = struct{}{}
+	sr.mu.Unlock()
+
+	return ch, func() {
+		sr.mu.Lock()
+		delete(sr.subscribers, ch)
+		sr.mu.Unlock()
+	}
+}
+
+// Tenants returns the usage per principal from the latest sample
+func (sr *SessionRegistry) Tenants() map[string]TenantUsage {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	out := make(map[string]TenantUsage, len(sr.tenants))
+	for p, u := range sr.tenants {
+		out[p] = u
+	}
+	return out
+}
+
+// TenantsBy groups the latest sample by a metadata key instead of the principal;
+// sessions registered without that key are left out
+func (sr *SessionRegistry) TenantsBy(key string) map[string]TenantUsage {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	out := make(map[string]TenantUsage)
+	for _, ls := range sr.sessions {
+		v, ok := ls.info.Metadata[key]
+		if !ok {
+			continue
+		}
+		u := out[v]
+		u.add(ls)
+		out[v] = u
+	}
+	return out
+}
+
+// sample recomputes per-principal session counts and bandwidth over the last interval
+func (sr *SessionRegistry) sample(interval time.Duration) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	tenants := make(map[string]TenantUsage)
+	for _, ls := range sr.sessions {
+		toClient := atomic.LoadInt64(&ls.bytesToClient)
+		toBackend := atomic.LoadInt64(&ls.bytesToBackend)
+
+		ls.rateToClient = float64(toClient-ls.sampledToClient) / interval.Seconds()
+		ls.rateToBackend = float64(toBackend-ls.sampledToBackend) / interval.Seconds()
+		ls.sampledToClient, ls.sampledToBackend = toClient, toBackend
+
+		u := tenants[ls.info.Principal]
+		u.add(ls)
+		tenants[ls.info.Principal] = u
+	}
+	sr.tenants = tenants
+}
+
+// startUpdates samples tenant usage and publishes an update event for every
+// live session at each interval
+func (sr *SessionRegistry) startUpdates(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			sr.sample(interval)
+
+			sr.mu.RLock()
+			idle := len(sr.subscribers) == 0
+			sr.mu.RUnlock()
+			if idle {
+				continue
+			}
+			for _, info := range sr.List() {
+				sr.publish("update", info)
+			}
+		}
+	}()
+}
+
+func (sr *SessionRegistry) publish(eventType string, info SessionInfo) {
+	sr.publishEvent(SessionEvent{Type: eventType, Time: time.Now(), Session: info})
+}
+
+func (sr *SessionRegistry) publishEvent(ev SessionEvent) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	for ch := range sr.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
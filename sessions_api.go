@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Interval of the SSE keep-alive comment, below common proxy read timeouts
+const watchKeepAlive = 15 * time.Second
+
+// How often session updates are published and tenant usage is sampled
+const sessionSampleInterval = 10 * time.Second
+
+// hashVisible reports whether principal may see a hash: keys bound to
+// namespaces only reach the hashes of their namespaces
+func hashVisible(cfg *Config, principal, hash string) bool {
+	return len(cfg.boundNamespaces(principal)) == 0 || authorizeNamespaceAccess(cfg, hash, principal) == nil
+}
+
+// sessionVisible reports whether principal may see and kill a session
+func sessionVisible(cfg *Config, principal string, info SessionInfo) bool {
+	return hashVisible(cfg, principal, info.Hash)
+}
+
+// visibleSessions filters list down to the sessions principal may see
+func visibleSessions(cfg *Config, principal string, list []SessionInfo) []SessionInfo {
+	out := list[:0]
+	for _, info := range list {
+		if sessionVisible(cfg, principal, info) {
+			out = append(out, info)
+		}
+	}
+	return out
+}
+
+// GET /api/sessions lists live sessions, oldest first; ?cluster=true includes
+// the other cluster nodes
+func listSessionsHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+
+		list := sessions.List()
+		resp := gin.H{"status": "success"}
+		if clusterWide(cfg, c) {
+			list, resp["unreachable"] = clusterSessions(cfg, c, list)
+		}
+		list = visibleSessions(cfg, principalOf(c), list)
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+		resp["count"] = len(list)
+		resp["sessions"] = list
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// DELETE /api/sessions/:id sends close frames to both legs of a live session
+// and drops them; ?cluster=true finds the session on any cluster node
+func killSessionHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) || !requireAdminSession(cfg, c) {
+			return
+		}
+
+		id := c.Param("id")
+		node := ""
+		if info, ok := sessions.Get(id); ok && !sessionVisible(cfg, principalOf(c), info) {
+			fmt.Printf("[WARN] Session %s outside the namespaces of %s, not killed\n", id, principalOf(c))
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"errors": []string{"Session not found"},
+			})
+			return
+		}
+		if !sessions.Kill(id) {
+			if clusterWide(cfg, c) {
+				node = killOnPeers(cfg, c, id)
+			}
+			if node == "" {
+				c.JSON(http.StatusNotFound, gin.H{
+					"status": "error",
+					"errors": []string{"Session not found"},
+				})
+				return
+			}
+			fmt.Printf("[INFO] Session %s killed on %s by %s (%s)\n", id, node, principalOf(c), c.ClientIP())
+		} else {
+			fmt.Printf("[INFO] Session %s killed by %s (%s)\n", id, principalOf(c), c.ClientIP())
+		}
+
+		resp := gin.H{
+			"status":  "success",
+			"message": "Session terminated",
+		}
+		if node != "" {
+			resp["node"] = node
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// GET /api/tenants, ?by=<metadata key> groups by a registration metadata value
+func tenantsHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+		tenants := sessions.Tenants()
+		if by := c.Query("by"); by != "" {
+			tenants = sessions.TenantsBy(by)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":          "success",
+			"sample_interval": sessionSampleInterval.Seconds(),
+			"tenants":         tenants,
+		})
+	}
+}
+
+// GET /api/sessions/watch streams session events as server-sent events
+func watchSessionsHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+
+		events, cancel := sessions.Subscribe()
+		defer cancel()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+
+		fmt.Printf("[INFO] Session watch started by %s (%s)\n", c.ClientIP(), principalOf(c))
+		defer fmt.Printf("[INFO] Session watch ended for %s\n", c.ClientIP())
+
+		// Current sessions first, so the watcher does not need a separate listing
+		for _, info := range visibleSessions(cfg, principalOf(c), sessions.List()) {
+			c.SSEvent("start", SessionEvent{Type: "start", Time: info.Started, Session: info})
+		}
+		c.Writer.Flush()
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case ev := <-events:
+				if !sessionVisible(cfg, principalOf(c), ev.Session) {
+					continue
+				}
+				c.SSEvent(ev.Type, ev)
+				c.Writer.Flush()
+			case <-keepAlive.C:
+				fmt.Fprint(c.Writer, ": keep-alive\n\n")
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return
+			case <-stopping:
+				return
+			}
+		}
+	}
+}
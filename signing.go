@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers carrying the registration signature:
+// X-Signature = hex(HMAC-SHA256(secret, timestamp + "\n" + body))
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+// replayCache remembers signatures accepted within the window so a captured
+// request cannot be sent again before its timestamp goes stale
+type replayCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+var signatures = &replayCache{seen: make(map[string]time.Time)}
+
+// Remember records sig and reports whether it was new
+func (rc *replayCache) Remember(sig string, window time.Duration) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	rc.sweep(now, window)
+	if at, ok := rc.seen[sig]; ok && now.Sub(at) <= 2*window {
+		return false
+	}
+	rc.seen[sig] = now
+	return true
+}
+
+// sweep forgets signatures older than 2*window, at most once a minute
+func (rc *replayCache) sweep(now time.Time, window time.Duration) {
+	if now.Sub(rc.lastSweep) < time.Minute {
+		return
+	}
+	rc.lastSweep = now
+
+	for s, at := range rc.seen {
+		if now.Sub(at) > 2*window {
+			delete(rc.seen, s)
+		}
+	}
+}
+
+// Seen reports whether key was remembered within the last 2*window
+func (rc *replayCache) Seen(key string, window time.Duration) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	at, ok := rc.seen[key]
+	return ok && time.Since(at) <= 2*window
+}
+
+// verifySignature checks the HMAC of a registration and restores its body for binding
+func verifySignature(cfg *Config, c *gin.Context) error {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return fmt.Errorf("reading body: %v", err)
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	ts := c.GetHeader(signatureTimestampHeader)
+	sig := strings.ToLower(c.GetHeader(signatureHeader))
+	if ts == "" || sig == "" {
+		return fmt.Errorf("missing %s or %s header", signatureHeader, signatureTimestampHeader)
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", ts)
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > cfg.SignatureWindow || age < -cfg.SignatureWindow {
+		return fmt.Errorf("timestamp outside the %v window (age %v)", cfg.SignatureWindow, age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.SigningSecret))
+	mac.Write([]byte(ts + "\n"))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	if !signatures.Remember(sig, cfg.SignatureWindow) {
+		return fmt.Errorf("replayed signature")
+	}
+	return nil
+}
+
+// rejectUnsigned verifies the signature when -signing_secret is set, writing the error response itself
+func rejectUnsigned(cfg *Config, c *gin.Context) bool {
+	if cfg.SigningSecret == "" {
+		return false
+	}
+	if err := verifySignature(cfg, c); err != nil {
+		fmt.Printf("[ERROR] Rejected registration from %s: %v\n", c.ClientIP(), err)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"errors": []string{"Invalid request signature"},
+		})
+		return true
+	}
+	return false
+}
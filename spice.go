@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Port of Proxmox's spiceproxy when the proxy URL doesn't name one
+const spiceProxyDefaultPort = "3128"
+
+// How long opening a tunnel through spiceproxy may take
+const spiceDialTimeout = 10 * time.Second
+
+// SpiceParams are the connection settings POST /nodes/<node>/qemu/<vmid>/spiceproxy
+// returns. Host is the signed ticket spiceproxy expects as CONNECT target,
+// Password the one-time SPICE ticket QEMU checks
+type SpiceParams struct {
+	Host        string `json:"host"`
+	Proxy       string `json:"proxy"`
+	Password    string `json:"password"`
+	TLSPort     int    `json:"tls-port"`
+	HostSubject string `json:"host-subject,omitempty"`
+	CA          string `json:"ca,omitempty"`
+	Title       string `json:"title,omitempty"`
+}
+
+// expandSpiceTarget checks the spiceproxy parameters of a SPICE registration
+// and makes its spiceproxy the target URL; other consoles can't carry them
+func expandSpiceTarget(req *ProxyRequest) error {
+	if req.Console != consoleSpice {
+		if req.Spice != nil {
+			return fmt.Errorf("spice needs console spice")
+		}
+		return nil
+	}
+	sp := req.Spice
+	switch {
+	case sp == nil:
+		return fmt.Errorf("console spice needs the spice parameters returned by spiceproxy")
+	case req.URL != "" || len(req.URLs) > 0 || req.Node != "" || req.VMID != 0 || req.ProxmoxHost != "":
+		return fmt.Errorf("spice registrations take no proxmox_ws_url, node or vmid")
+	case sp.Host == "" || sp.Password == "":
+		return fmt.Errorf("spice host and password are required")
+	case sp.TLSPort <= 0 || sp.TLSPort > 65535:
+		return fmt.Errorf("spice tls-port must be between 1 and 65535")
+	case req.SingleUse || req.MaxUses != 0 || req.MaxViewers != 0 || req.DuplicatePolicy != "":
+		return fmt.Errorf("single_use, max_uses, max_viewers and duplicate_policy can't be applied to SPICE consoles, a viewer opens several channels")
+	case req.Shadow || req.ReadOnly || req.BlockClipboard || req.MaxClipboardBytes != 0 || req.BlockedKeys != "" ||
+		req.Record || req.IdleTimeoutSeconds != 0 || req.Viewer != nil:
+		return fmt.Errorf("shadow, read_only, clipboard, blocked_keys, record, idle_timeout_seconds and viewer are only available for VNC consoles")
+	}
+
+	proxy, err := spiceProxyURL(sp.Proxy)
+	if err != nil {
+		return err
+	}
+	sp.Proxy = proxy
+	req.URL = proxy
+	return nil
+}
+
+// spiceProxyURL normalizes the proxy of spiceproxy parameters to http://host:port
+func spiceProxyURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return "", fmt.Errorf("spice proxy must be an http://host[:port] URL")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), spiceProxyDefaultPort)
+	}
+	return "http://" + host, nil
+}
+
+// spiceItem looks up the SPICE registration of hash for a viewer at viewerIP;
+// on failure it returns the status and message to answer with
+func spiceItem(cfg *Config, hash, viewerIP string) (*ProxiedItem, int, error) {
+	item, err := lookupItem(cfg, hash)
+	if err == nil && !item.ExpiresAt.IsZero() && expiredWithSkew(cfg, item.ExpiresAt) {
+		err = &notFoundError{key: hash}
+	}
+	if err != nil {
+		if _, notFound := err.(*notFoundError); notFound {
+			recordHashFailure(cfg, viewerIP, hash, err)
+			return nil, http.StatusNotFound, fmt.Errorf("console not found or expired")
+		}
+		fmt.Printf("[ERROR] Failed to look up SPICE console %s: %v\n", hashTag(hash), err)
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("console unavailable")
+	}
+	if item.Console != consoleSpice {
+		return nil, http.StatusBadRequest, fmt.Errorf("not a SPICE console")
+	}
+	if !item.AllowsViewer(viewerIP) {
+		fmt.Printf("[WARN] Viewer %s refused for SPICE hash %s, bound to %v\n", viewerIP, hashTag(hash), item.ViewerNetworks)
+		return nil, http.StatusForbidden, fmt.Errorf("console link is bound to another viewer address")
+	}
+	if cfg.SlidingTTL && item.ExpiresAt.IsZero() {
+		if err := proxied.Touch(hash); err != nil {
+			fmt.Printf("[ERROR] Failed to refresh TTL of %s: %v\n", hashTag(hash), err)
+		}
+	}
+	return item, 0, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialSpice opens a tunnel through the registration's spiceproxy to the SPICE
+// port of its guest. The stream is QEMU's TLS, which the viewer negotiates itself
+func dialSpice(item *ProxiedItem) (net.Conn, error) {
+	sp := item.Spice
+	u, err := url.Parse(sp.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, spiceDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(spiceDialTimeout))
+
+	// The host is spiceproxy's ticket and contains colons, so it isn't bracketed
+	target := sp.Host + ":" + strconv.Itoa(sp.TLSPort)
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: target}, Host: target, Header: http.Header{}}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.0\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("spiceproxy answered %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// countingWriter adds the bytes written through it to n
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// runSpiceTunnel relays one SPICE channel between viewer and backend as a
+// session of hash; a viewer opens one per channel (main, display, inputs...)
+func runSpiceTunnel(hash string, item *ProxiedItem, viewerIP string, viewer io.ReadWriteCloser, backend net.Conn) {
+	activeSessions.Add(1)
+	defer activeSessions.Done()
+
+	live := sessions.Add(hash, item.Principal, viewerIP, strings.TrimPrefix(item.Spice.Proxy, "http://"), item.Metadata)
+	defer sessions.Remove(live)
+	fmt.Printf("[INFO] SPICE channel of hash %s opened by %s as session %s\n", hashTag(hash), viewerIP, live.info.ID)
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(countingWriter{w: backend, n: &live.bytesToBackend}, viewer)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(countingWriter{w: viewer, n: &live.bytesToClient}, backend)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			live.closeError = err.Error()
+		}
+	case <-live.kill:
+		fmt.Printf("[INFO] Session %s killed: %s\n", live.info.ID, live.killReason)
+		live.closeCode, live.closeReason = live.killCode, live.killReason
+	}
+	viewer.Close()
+	backend.Close()
+}
+
+// spiceConnectHandler serves -spice_listen: an HTTP CONNECT proxy like
+// Proxmox's spiceproxy, whose targets are <hash>:<tls-port> as written to the
+// .vv file. Each channel is tunneled to the registration's spiceproxy
+func spiceConnectHandler(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		viewerIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is served here", http.StatusMethodNotAllowed)
+			return
+		}
+		if !cfg.IsControlIP(viewerIP) && bans.IsBanned(viewerIP) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if currentMaintenance().Enabled {
+			fmt.Printf("[INFO] Rejected SPICE channel from %s: maintenance mode\n", viewerIP)
+			http.Error(w, "proxy is in maintenance mode", http.StatusServiceUnavailable)
+			return
+		}
+
+		i := strings.LastIndex(r.Host, ":")
+		if i <= 0 {
+			http.Error(w, "CONNECT target must be <hash>:<port>", http.StatusBadRequest)
+			return
+		}
+		hash, port := r.Host[:i], r.Host[i+1:]
+		item, status, err := spiceItem(cfg, hash, viewerIP)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if port != strconv.Itoa(item.Spice.TLSPort) {
+			fmt.Printf("[WARN] Viewer %s asked for port %s of SPICE hash %s\n", viewerIP, port, hashTag(hash))
+			http.Error(w, "port not allowed", http.StatusForbidden)
+			return
+		}
+
+		backend, err := dialSpice(item)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to open SPICE tunnel for hash %s: %v\n", hashTag(hash), err)
+			http.Error(w, "backend unavailable", http.StatusBadGateway)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			backend.Close()
+			http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			backend.Close()
+			fmt.Printf("[ERROR] SPICE CONNECT hijack failed: %v\n", err)
+			return
+		}
+		if _, err := conn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n")); err != nil {
+			conn.Close()
+			backend.Close()
+			return
+		}
+		var viewer net.Conn = conn
+		if brw.Reader.Buffered() > 0 {
+			viewer = &bufferedConn{Conn: conn, r: brw.Reader}
+		}
+		runSpiceTunnel(hash, item, viewerIP, viewer, backend)
+	})
+}
+
+// wsStream reads and writes a WebSocket as a byte stream of binary messages
+type wsStream struct {
+	conn *websocket.Conn
+	r    io.Reader
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for {
+		if s.r == nil {
+			_, r, err := s.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			s.r = r
+		}
+		n, err := s.r.Read(p)
+		if err == io.EOF {
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error {
+	return s.conn.Close()
+}
+
+// handleSpiceWebSocket tunnels one SPICE channel over a WebSocket, for web
+// clients that speak SPICE over TLS themselves
+func handleSpiceWebSocket(cfg *Config, ctx *gin.Context) {
+	if rejectIfMaintenance(ctx) {
+		return
+	}
+	hash, viewerIP := ctx.Param("data"), ctx.ClientIP()
+	item, status, err := spiceItem(cfg, hash, viewerIP)
+	if err != nil {
+		ctx.String(status, "%v", err)
+		return
+	}
+	backend, err := dialSpice(item)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to open SPICE tunnel for hash %s: %v\n", hashTag(hash), err)
+		ctx.String(http.StatusBadGateway, "backend unavailable")
+		return
+	}
+	conn, err := clientUpgrader(cfg).Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		fmt.Printf("[ERROR] Client WebSocket upgrade failed: %v\n", err)
+		backend.Close()
+		return
+	}
+	runSpiceTunnel(hash, item, viewerIP, &wsStream{conn: conn}, backend)
+}
+
+// vvValue keeps a .vv setting on its line
+var vvValue = strings.NewReplacer("\r", "", "\n", " ")
+
+// spiceViewerFile is the virt-viewer file connecting remote-viewer to hash
+// through -spice_proxy_url, like the one the Proxmox GUI downloads
+func spiceViewerFile(cfg *Config, hash string, sp *SpiceParams) string {
+	var b strings.Builder
+	b.WriteString("[virt-viewer]\n")
+	set := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, vvValue.Replace(value))
+		}
+	}
+	set("type", "spice")
+	set("host", hash)
+	set("tls-port", strconv.Itoa(sp.TLSPort))
+	set("password", sp.Password)
+	set("proxy", cfg.SpiceProxyURL)
+	set("host-subject", sp.HostSubject)
+	set("ca", strings.ReplaceAll(strings.TrimSpace(sp.CA), "\n", `\n`))
+	set("title", sp.Title)
+	set("delete-this-file", "1")
+	set("secure-attention", "Ctrl+Alt+Ins")
+	set("toggle-fullscreen", "Shift+F11")
+	set("release-cursor", "Ctrl+Alt+R")
+	return b.String()
+}
+
+// GET /spice/:data/console.vv downloads the virt-viewer file of a SPICE console
+func spiceViewerFileHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		if cfg.SpiceProxyURL == "" {
+			c.String(http.StatusNotFound, "SPICE viewer files need -spice_proxy_url\n")
+			return
+		}
+		hash := c.Param("data")
+		item, status, err := spiceItem(cfg, hash, c.ClientIP())
+		if err != nil {
+			c.String(status, "%v\n", err)
+			return
+		}
+		fmt.Printf("[INFO] SPICE viewer file of hash %s downloaded by %s\n", hashTag(hash), c.ClientIP())
+		c.Header("Content-Disposition", `attachment; filename="console.vv"`)
+		c.Data(http.StatusOK, "application/x-virt-viewer", []byte(spiceViewerFile(cfg, hash, item.Spice)))
+	}
+}
+
+// registerSpiceRoutes mounts the SPICE WebSocket tunnel and viewer file
+func registerSpiceRoutes(r *gin.Engine, cfg *Config) {
+	r.GET("/spice/:data", func(ctx *gin.Context) {
+		handleSpiceWebSocket(cfg, ctx)
+	})
+	r.GET("/spice/:data/console.vv", spiceViewerFileHandler(cfg))
+}
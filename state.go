@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedRegistrations is the -state_file written on shutdown
+type savedRegistrations struct {
+	Saved   time.Time         `json:"saved"`
+	Entries []savedRegistered `json:"entries"`
+}
+
+// savedRegistered is one registration with the time the in-memory list would have dropped it
+type savedRegistered struct {
+	Hash    string      `json:"hash"`
+	Item    ProxiedItem `json:"item"`
+	Expires time.Time   `json:"expires"`
+}
+
+// saveRegistrations writes the in-memory registrations to -state_file so a
+// restarted proxy still knows the console links already handed out
+func saveRegistrations(cfg *Config) {
+	list, ok := proxied.(*ProxiedList)
+	if cfg.StateFile == "" || !ok {
+		return
+	}
+
+	items, _ := list.List()
+	state := savedRegistrations{Saved: time.Now(), Entries: []savedRegistered{}}
+	for hash, item := range items {
+		state.Entries = append(state.Entries, savedRegistered{Hash: hash, Item: *sealItem(hash, &item), Expires: item.expires})
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to save registrations: %v\n", err)
+		return
+	}
+
+	// Written aside and renamed, so a successor reading it never sees half a file
+	tmp, err := os.CreateTemp(filepath.Dir(cfg.StateFile), ".vncwebproxy-state-*")
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to save registrations: %v\n", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cfg.StateFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Printf("[ERROR] Failed to save registrations: %v\n", err)
+		return
+	}
+	fmt.Printf("[INFO] Saved %d registrations to %s\n", len(state.Entries), cfg.StateFile)
+}
+
+// restoreRegistrations loads -state_file into list with the TTLs remaining at
+// shutdown, then removes it so a later crash can't bring back revoked hashes
+func restoreRegistrations(cfg *Config, list *ProxiedList) error {
+	data, err := os.ReadFile(cfg.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state savedRegistrations
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %v", cfg.StateFile, err)
+	}
+
+	restored := 0
+	for _, e := range state.Entries {
+		remaining := time.Until(e.Expires)
+		if remaining <= 0 {
+			continue
+		}
+		item := e.Item
+		if err := openItem(e.Hash, &item); err != nil {
+			fmt.Printf("[ERROR] Registration %s not restored: %v\n", hashTag(e.Hash), err)
+			continue
+		}
+		list.add(e.Hash, &item, remaining)
+		restored++
+	}
+	if err := os.Remove(cfg.StateFile); err != nil {
+		fmt.Printf("[WARN] Failed to remove %s after restoring it: %v\n", cfg.StateFile, err)
+	}
+	fmt.Printf("[INFO] Restored %d of %d registrations saved %s ago\n",
+		restored, len(state.Entries), time.Since(state.Saved).Round(time.Second))
+	return nil
+}
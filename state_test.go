@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withProxied swaps the global store for the duration of a test
+func withProxied(t *testing.T, store ProxiedStore) {
+	t.Helper()
+	old := proxied
+	proxied = store
+	t.Cleanup(func() { proxied = old })
+}
+
+func TestRegistrationsRestored(t *testing.T) {
+	cfg := &Config{StateFile: filepath.Join(t.TempDir(), "state.json")}
+	list := NewProxiedList(time.Hour)
+	withProxied(t, list)
+	list.Add("kept", &ProxiedItem{Token: "t", URL: "wss://pve.example.com/ws"})
+	list.Add("short", &ProxiedItem{URL: "wss://pve.example.com/ws", TTL: 50 * time.Millisecond})
+
+	saveRegistrations(cfg)
+	time.Sleep(100 * time.Millisecond)
+
+	restored := NewProxiedList(time.Hour)
+	if err := restoreRegistrations(cfg, restored); err != nil {
+		t.Fatal(err)
+	}
+	item, err := restored.Get("kept")
+	if err != nil {
+		t.Fatalf("kept: %v", err)
+	}
+	if item.Token != "t" || item.URL != "wss://pve.example.com/ws" {
+		t.Errorf("restored item = %+v", item)
+	}
+	if expires, _ := restored.Expiry("kept"); time.Until(expires) > time.Hour || time.Until(expires) < 59*time.Minute {
+		t.Errorf("restored TTL = %v, want the remaining hour", time.Until(expires))
+	}
+	if _, err := restored.Get("short"); err == nil {
+		t.Error("registration expired since the save was restored")
+	}
+	if _, err := os.Stat(cfg.StateFile); !os.IsNotExist(err) {
+		t.Errorf("state file kept after restoring it: %v", err)
+	}
+}
+
+func TestStateOwnedBySuccessor(t *testing.T) {
+	cfg := &Config{StateFile: filepath.Join(t.TempDir(), "state.json")}
+	list := NewProxiedList(time.Hour)
+	withProxied(t, list)
+	list.Add("revoked", &ProxiedItem{URL: "wss://pve.example.com/ws"})
+
+	// Saved before the successor starts, which restores and removes the file
+	saveRegistrations(cfg)
+	if err := restoreRegistrations(cfg, NewProxiedList(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{cfg: cfg, handedOff: 1}
+	s.saveState()
+	if _, err := os.Stat(cfg.StateFile); !os.IsNotExist(err) {
+		t.Fatalf("state file written again after the handoff: %v", err)
+	}
+
+	// Without a handoff the shutdown save is the only one
+	s = &Server{cfg: cfg}
+	s.saveState()
+	if _, err := os.Stat(cfg.StateFile); err != nil {
+		t.Errorf("state file not saved on shutdown: %v", err)
+	}
+}
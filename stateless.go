@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Prefix of stateless console tokens; registered hashes can't start with it
+const statelessPrefix = "s1."
+
+// Principal that stateless sessions are accounted to
+const statelessPrincipal = "stateless"
+
+// statelessClaims is the plaintext of a stateless token: a registration as
+// POSTed to /api/proxy plus its expiry in Unix seconds
+type statelessClaims struct {
+	ProxyRequest
+	Expires int64 `json:"exp"`
+}
+
+// loadStatelessKey reads the AES-256 key shared with PUQcloud, written as 64 hex characters
+func loadStatelessKey(path string) (cipher.AEAD, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain 64 hex characters (32 bytes)", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// isStatelessToken reports whether data is a stateless token this proxy can open
+func isStatelessToken(cfg *Config, data string) bool {
+	return cfg.StatelessKey != nil && strings.HasPrefix(data, statelessPrefix)
+}
+
+// Stateless tokens already used, by token ID, with -stateless_replay_window
+var statelessTokens = &replayCache{seen: make(map[string]time.Time)}
+
+// statelessTokenID identifies a token by its random nonce, the first 16
+// characters after the prefix (12 bytes in base64url)
+func statelessTokenID(data string) string {
+	id := data[len(statelessPrefix):]
+	if len(id) > 16 {
+		id = id[:16]
+	}
+	return id
+}
+
+// claimStatelessToken marks a token used once its viewer is accepted and
+// reports whether it was still unused. The ID is kept for 2*window, beyond the
+// expiry of any token accepted within the window
+func claimStatelessToken(cfg *Config, data string) bool {
+	if cfg.StatelessReplayWindow <= 0 {
+		return true
+	}
+	return statelessTokens.Remember(statelessTokenID(data), cfg.StatelessReplayWindow)
+}
+
+// lookupItem returns the item behind the :data segment of a viewer URL, from
+// the store or, for stateless tokens, from the token itself
+func lookupItem(cfg *Config, data string) (*ProxiedItem, error) {
+	if isStatelessToken(cfg, data) {
+		return openStatelessToken(cfg, data)
+	}
+	return proxied.Get(data)
+}
+
+// sealStatelessToken encrypts claims into a token, as PUQcloud does
+func sealStatelessToken(aead cipher.AEAD, claims *statelessClaims) (string, error) {
+	plain, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(statelessPrefix))
+	return statelessPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openStatelessToken decrypts and validates a stateless token into the item a
+// registration would have stored. Tokens that can't be opened or have expired
+// are reported like unknown hashes
+func openStatelessToken(cfg *Config, data string) (*ProxiedItem, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(data[len(statelessPrefix):])
+	n := cfg.StatelessKey.NonceSize()
+	if err != nil || len(sealed) < n {
+		fmt.Printf("[WARN] Malformed stateless token %s\n", hashTag(data))
+		return nil, &notFoundError{key: data}
+	}
+	plain, err := cfg.StatelessKey.Open(nil, sealed[:n], sealed[n:], []byte(statelessPrefix))
+	if err != nil {
+		fmt.Printf("[WARN] Stateless token %s can't be decrypted with -stateless_key_file\n", hashTag(data))
+		return nil, &notFoundError{key: data}
+	}
+
+	var claims statelessClaims
+	if err := json.Unmarshal(plain, &claims); err != nil {
+		return nil, fmt.Errorf("stateless token: %v", err)
+	}
+	if claims.Expires == 0 {
+		return nil, fmt.Errorf("stateless token: exp is required")
+	}
+	expiresAt := time.Unix(claims.Expires, 0)
+	if expiredWithSkew(cfg, expiresAt) {
+		return nil, &notFoundError{key: data}
+	}
+	if err := validateStatelessClaims(cfg, &claims, expiresAt); err != nil {
+		return nil, fmt.Errorf("stateless token: %v", err)
+	}
+	if cfg.StatelessReplayWindow > 0 && statelessTokens.Seen(statelessTokenID(data), cfg.StatelessReplayWindow) {
+		fmt.Printf("[WARN] Replayed stateless token %s\n", hashTag(data))
+		return nil, &notFoundError{key: data}
+	}
+
+	item := newProxiedItem(cfg, &claims.ProxyRequest, statelessPrincipal)
+	item.ExpiresAt = expiresAt
+	return item, nil
+}
+
+// validateStatelessClaims applies the registration checks to a token; settings
+// that need state kept by the proxy are refused
+func validateStatelessClaims(cfg *Config, claims *statelessClaims, expiresAt time.Time) error {
+	req := &claims.ProxyRequest
+	switch {
+	case req.Hash != "" || req.Namespace != "":
+		return fmt.Errorf("hash and namespace can't be set, the token is the hash")
+	case req.TTLSeconds != 0 || req.ExpiresAt != "":
+		return fmt.Errorf("use exp instead of ttl_seconds and expires_at")
+	case req.SingleUse || req.MaxUses != 0 || req.Shadow || req.NativeVNC:
+		return fmt.Errorf("single_use, max_uses, shadow and native_vnc need a registration")
+	case time.Until(expiresAt) > cfg.MaxTTL+cfg.ClockSkew:
+		return fmt.Errorf("exp is more than %v ahead", cfg.MaxTTL)
+	case cfg.StatelessReplayWindow > 0 && time.Until(expiresAt) > cfg.StatelessReplayWindow+cfg.ClockSkew:
+		return fmt.Errorf("exp is more than -stateless_replay_window (%v) ahead", cfg.StatelessReplayWindow)
+	}
+	return validateProxyRequest(cfg, req)
+}
+
+// statelessTokenCommand implements "vncwebproxy stateless-token", encrypting the
+// registration JSON on stdin into a token, e.g. to test -stateless_key_file
+func statelessTokenCommand(args []string) int {
+	fs := flag.NewFlagSet("stateless-token", flag.ExitOnError)
+	keyFile := fs.String("key_file", "", "File with the key given to -stateless_key_file")
+	ttl := fs.Duration("ttl", time.Minute, "How long the token remains connectable")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: vncwebproxy stateless-token -key_file <file> [-ttl 1m] < registration.json\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *keyFile == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	aead, err := loadStatelessKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	body, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	var claims statelessClaims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: registration JSON: %v\n", err)
+		return 1
+	}
+	claims.Expires = time.Now().Add(*ttl).Unix()
+
+	token, err := sealStatelessToken(aead, &claims)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Println(token)
+	return 0
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func newTestAEAD(t *testing.T) cipher.AEAD {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func newTestStatelessConfig(t *testing.T) *Config {
+	return &Config{
+		StatelessKey:          newTestAEAD(t),
+		StatelessReplayWindow: 5 * time.Minute,
+		MaxTTL:                time.Hour,
+	}
+}
+
+// sealRawToken encrypts plain as a token without marshalling claims
+func sealRawToken(aead cipher.AEAD, plain []byte) string {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, plain, []byte(statelessPrefix))
+	return statelessPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func testClaims(exp time.Duration) *statelessClaims {
+	return &statelessClaims{
+		ProxyRequest: ProxyRequest{
+			Token: "PVEAPIToken=root@pam!vnc=secret",
+			URL:   "wss://pve.example.com:8006/api2/json/nodes/pve/qemu/100/vncwebsocket?port=5900&vncticket=t",
+		},
+		Expires: time.Now().Add(exp).Unix(),
+	}
+}
+
+func TestOpenStatelessToken(t *testing.T) {
+	cfg := newTestStatelessConfig(t)
+	other := newTestAEAD(t)
+
+	seal := func(aead cipher.AEAD, claims *statelessClaims) string {
+		token, err := sealStatelessToken(aead, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := seal(cfg.StatelessKey, testClaims(time.Minute))
+	// Not the last character, whose low bits may be unused padding
+	tampered := []byte(valid)
+	i := len(tampered) - 8
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	withHash := testClaims(time.Minute)
+	withHash.Hash = "abc"
+	singleUse := testClaims(time.Minute)
+	singleUse.SingleUse = true
+	noExp := testClaims(time.Minute)
+	noExp.Expires = 0
+
+	tests := []struct {
+		name     string
+		token    string
+		notFound bool // reported as an unknown hash
+		wantErr  bool
+	}{
+		{name: "valid", token: valid},
+		{name: "other key", token: seal(other, testClaims(time.Minute)), notFound: true},
+		{name: "tampered", token: string(tampered), notFound: true},
+		{name: "not base64", token: statelessPrefix + "!!!", notFound: true},
+		{name: "empty", token: statelessPrefix, notFound: true},
+		{name: "shorter than nonce", token: statelessPrefix + base64.RawURLEncoding.EncodeToString(make([]byte, 11)), notFound: true},
+		{name: "nonce only", token: statelessPrefix + base64.RawURLEncoding.EncodeToString(make([]byte, 12)), notFound: true},
+		{name: "truncated", token: valid[:len(valid)-4], notFound: true},
+		{name: "expired", token: seal(cfg.StatelessKey, testClaims(-time.Minute)), notFound: true},
+		{name: "no exp", token: seal(cfg.StatelessKey, noExp), wantErr: true},
+		{name: "exp beyond replay window", token: seal(cfg.StatelessKey, testClaims(10*time.Minute)), wantErr: true},
+		{name: "hash set", token: seal(cfg.StatelessKey, withHash), wantErr: true},
+		{name: "single use", token: seal(cfg.StatelessKey, singleUse), wantErr: true},
+		{name: "not json", token: sealRawToken(cfg.StatelessKey, []byte("not json")), wantErr: true},
+		{name: "json array", token: sealRawToken(cfg.StatelessKey, []byte("[]")), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item, err := openStatelessToken(cfg, tt.token)
+			_, notFound := err.(*notFoundError)
+			switch {
+			case tt.notFound && !notFound:
+				t.Fatalf("got %v, want an unknown hash", err)
+			case tt.wantErr && (err == nil || notFound):
+				t.Fatalf("got %v, want a validation error", err)
+			case !tt.notFound && !tt.wantErr && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && item.Principal != statelessPrincipal {
+				t.Errorf("principal = %q, want %q", item.Principal, statelessPrincipal)
+			}
+		})
+	}
+}
+
+func TestClaimStatelessToken(t *testing.T) {
+	cfg := newTestStatelessConfig(t)
+	token, err := sealStatelessToken(cfg.StatelessKey, testClaims(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openStatelessToken(cfg, token); err != nil {
+		t.Fatalf("open before claim: %v", err)
+	}
+	if !claimStatelessToken(cfg, token) {
+		t.Fatal("first claim refused")
+	}
+	if claimStatelessToken(cfg, token) {
+		t.Error("second claim accepted")
+	}
+	if _, err := openStatelessToken(cfg, token); err == nil {
+		t.Error("claimed token opened again")
+	}
+
+	// Without a replay window tokens stay reusable until they expire
+	cfg.StatelessReplayWindow = 0
+	for i := 0; i < 2; i++ {
+		if !claimStatelessToken(cfg, token) {
+			t.Errorf("claim %d refused without a replay window", i+1)
+		}
+	}
+}
+
+func TestStatelessTokenID(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{token: statelessPrefix, want: ""},
+		{token: statelessPrefix + "short", want: "short"},
+		{token: statelessPrefix + "0123456789abcdef", want: "0123456789abcdef"},
+		{token: statelessPrefix + "0123456789abcdefXYZ", want: "0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		if got := statelessTokenID(tt.token); got != tt.want {
+			t.Errorf("statelessTokenID(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
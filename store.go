@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ProxiedStore holds the entries registered through /api/proxy until a viewer connects
+type ProxiedStore interface {
+	Add(key string, item *ProxiedItem) error
+	Get(key string) (*ProxiedItem, error)
+	Remove(key string)
+	// Touch restarts the TTL of an entry, for -sliding_ttl
+	Touch(key string) error
+	// Expiry returns when an entry will be dropped unless touched again
+	Expiry(key string) (time.Time, error)
+	// Use counts a viewer connection of an entry, returning the connections so far
+	Use(key string) (int, error)
+	// List returns a snapshot of all entries
+	List() (map[string]ProxiedItem, error)
+	// Watch returns a channel of entries added and removed, by any node sharing
+	// the store, and a function to stop receiving them; slow watchers miss events
+	Watch() (<-chan StoreEvent, func())
+}
+
+// Types of StoreEvent
+const (
+	storeAdded   = "add"
+	storeRemoved = "remove"
+)
+
+// StoreEvent reports an entry added to or removed from a store; expired
+// entries are reported as removed where the store can tell
+type StoreEvent struct {
+	Type string
+	Key  string
+}
+
+// storeWatchers fans events out to the channels returned by Watch
+type storeWatchers struct {
+	mu   sync.Mutex
+	subs map[chan StoreEvent]struct{}
+}
+
+func (sw *storeWatchers) watch() (<-chan StoreEvent, func()) {
+	ch := make(chan StoreEvent, 64)
+
+	sw.mu.Lock()
+	if sw.subs == nil {
+		sw.subs = make(map[chan StoreEvent]struct{})
+	}
+	sw.subs[ch] = struct{}{}
+	sw.mu.Unlock()
+
+	return ch, func() {
+		sw.mu.Lock()
+		delete(sw.subs, ch)
+		sw.mu.Unlock()
+	}
+}
+
+func (sw *storeWatchers) publish(ev StoreEvent) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	for ch := range sw.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// notFoundError is returned by stores for hashes that are not registered (or expired)
+type notFoundError struct {
+	key string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("key %s not found", e.key)
+}
+
+// keepHashAlive restarts the TTL of a hash every half TTL while its session runs,
+// and once more when it ends so the viewer can reconnect
+func keepHashAlive(cfg *Config, target *backendTarget) func() {
+	ttl := cfg.TTL
+	if target.item.TTL > 0 {
+		ttl = target.item.TTL
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ttl / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				proxied.Touch(target.hash)
+				return
+			}
+			if err := proxied.Touch(target.hash); err != nil {
+				fmt.Printf("[ERROR] Failed to refresh TTL of %s: %v\n", hashTag(target.hash), err)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// newProxiedStore creates the store selected with -store
+func newProxiedStore(cfg *Config) (ProxiedStore, error) {
+	switch cfg.Store {
+	case "", "memory":
+		return NewProxiedList(cfg.TTL), nil
+	case "etcd":
+		return newEtcdStore(cfg)
+	case "redis":
+		return newRedisStore(cfg)
+	}
+	return nil, fmt.Errorf("unknown store %q, expected memory, etcd or redis", cfg.Store)
+}
@@ -0,0 +1,362 @@
+//go:build !noetcd
+// +build !noetcd
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The etcd store is left out with -tags noetcd
+const featureEtcd = true
+
+// newEtcdStore creates the store for -store=etcd
+func newEtcdStore(cfg *Config) (ProxiedStore, error) {
+	if len(cfg.EtcdEndpoints) == 0 {
+		return nil, fmt.Errorf("-store=etcd requires -etcd_endpoints")
+	}
+	return NewEtcdStore(cfg.EtcdEndpoints, cfg.EtcdPrefix, cfg.TTL), nil
+}
+
+// EtcdStore keeps proxied entries in etcd under a lease per entry, talking to
+// the v3 JSON gateway so no etcd client library is needed
+type EtcdStore struct {
+	endpoints []string
+	prefix    string
+	ttl       time.Duration
+	client    *http.Client
+}
+
+// NewEtcdStore creates a store using the given etcd endpoints, e.g. http://10.0.0.5:2379
+func NewEtcdStore(endpoints []string, prefix string, ttl time.Duration) *EtcdStore {
+	return &EtcdStore{
+		endpoints: endpoints,
+		prefix:    prefix,
+		ttl:       ttl,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// call posts a gateway request to the first endpoint that answers
+func (s *EtcdStore) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, ep := range s.endpoints {
+		r, err := s.client.Post(ep+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = func() error {
+			defer r.Body.Close()
+			if r.StatusCode != http.StatusOK {
+				return fmt.Errorf("etcd %s returned %s", path, r.Status)
+			}
+			if resp == nil {
+				return nil
+			}
+			return json.NewDecoder(r.Body).Decode(resp)
+		}()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("etcd unavailable: %v", lastErr)
+}
+
+func (s *EtcdStore) encodedKey(key string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s.prefix + key))
+}
+
+// Add stores an item under a fresh lease so etcd removes it after the TTL
+func (s *EtcdStore) Add(key string, item *ProxiedItem) error {
+	var lease struct {
+		ID string `json:"ID"`
+	}
+	ttl := s.ttl
+	if item.TTL > 0 {
+		ttl = item.TTL
+	}
+	if err := s.call("/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl / time.Second)}, &lease); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(sealItem(key, item))
+	if err != nil {
+		return err
+	}
+	return s.call("/v3/kv/put", map[string]string{
+		"key":   s.encodedKey(key),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": lease.ID,
+	}, nil)
+}
+
+// prefixRange returns the base64 key and range_end covering every entry
+func (s *EtcdStore) prefixRange() (string, string) {
+	end := []byte(s.prefix)
+	if len(end) == 0 {
+		// No prefix: every key from the first on
+		return base64.StdEncoding.EncodeToString([]byte{0}), base64.StdEncoding.EncodeToString([]byte{0})
+	}
+	end[len(end)-1]++
+	return base64.StdEncoding.EncodeToString([]byte(s.prefix)), base64.StdEncoding.EncodeToString(end)
+}
+
+// List returns all items under the prefix
+func (s *EtcdStore) List() (map[string]ProxiedItem, error) {
+	var resp struct {
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	key, end := s.prefixRange()
+	if err := s.call("/v3/kv/range", map[string]string{"key": key, "range_end": end}, &resp); err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]ProxiedItem, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		k, err1 := base64.StdEncoding.DecodeString(kv.Key)
+		raw, err2 := base64.StdEncoding.DecodeString(kv.Value)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		key := strings.TrimPrefix(string(k), s.prefix)
+		var item ProxiedItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			continue
+		}
+		if err := openItem(key, &item); err != nil {
+			return nil, err
+		}
+		items[key] = item
+	}
+	return items, nil
+}
+
+// Watch streams puts and deletes under the prefix, including lease expiries;
+// puts of existing entries (Use) are not reported
+func (s *EtcdStore) Watch() (<-chan StoreEvent, func()) {
+	ch := make(chan StoreEvent, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for {
+			err := s.watch(ctx, ch)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			fmt.Printf("[ERROR] etcd store watch interrupted, restarting: %v\n", err)
+		}
+	}()
+	return ch, cancel
+}
+
+// watch delivers events from one endpoint until the stream ends
+func (s *EtcdStore) watch(ctx context.Context, ch chan<- StoreEvent) error {
+	key, end := s.prefixRange()
+	body, _ := json.Marshal(map[string]interface{}{
+		"create_request": map[string]string{"key": key, "range_end": end},
+	})
+
+	var lastErr error
+	for _, ep := range s.endpoints {
+		req, err := http.NewRequest(http.MethodPost, ep+"/v3/watch", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		// The stream stays open, so s.client's timeout does not apply
+		r, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("etcd /v3/watch returned %s", r.Status)
+			continue
+		}
+
+		dec := json.NewDecoder(r.Body)
+		for {
+			var msg struct {
+				Result struct {
+					Events []struct {
+						Type string `json:"type"`
+						Kv   struct {
+							Key            string `json:"key"`
+							CreateRevision string `json:"create_revision"`
+							ModRevision    string `json:"mod_revision"`
+						} `json:"kv"`
+					} `json:"events"`
+				} `json:"result"`
+			}
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			for _, e := range msg.Result.Events {
+				k, err := base64.StdEncoding.DecodeString(e.Kv.Key)
+				if err != nil {
+					continue
+				}
+				ev := StoreEvent{Type: storeAdded, Key: strings.TrimPrefix(string(k), s.prefix)}
+				if e.Type == "DELETE" {
+					ev.Type = storeRemoved
+				} else if e.Kv.CreateRevision != e.Kv.ModRevision {
+					continue
+				}
+				select {
+				case ch <- ev:
+				default:
+				}
+			}
+		}
+	}
+	return fmt.Errorf("etcd unavailable: %v", lastErr)
+}
+
+// Get retrieves an item, returns an error if not found
+func (s *EtcdStore) Get(key string) (*ProxiedItem, error) {
+	item, _, err := s.get(key)
+	return item, err
+}
+
+// get retrieves an item together with its mod revision
+func (s *EtcdStore) get(key string) (*ProxiedItem, string, error) {
+	var resp struct {
+		Kvs []struct {
+			Value       string `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", map[string]string{"key": s.encodedKey(key)}, &resp); err != nil {
+		return nil, "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, "", &notFoundError{key: key}
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, "", err
+	}
+	var item ProxiedItem
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return nil, "", err
+	}
+	if err := openItem(key, &item); err != nil {
+		return nil, "", err
+	}
+	return &item, resp.Kvs[0].ModRevision, nil
+}
+
+// lease returns the ID of the lease an item is stored under
+func (s *EtcdStore) lease(key string) (string, error) {
+	var resp struct {
+		Kvs []struct {
+			Lease string `json:"lease"`
+		} `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", map[string]interface{}{"key": s.encodedKey(key), "keys_only": true}, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", &notFoundError{key: key}
+	}
+	return resp.Kvs[0].Lease, nil
+}
+
+// Touch renews the lease of an item, restarting its TTL
+func (s *EtcdStore) Touch(key string) error {
+	lease, err := s.lease(key)
+	if err != nil {
+		return err
+	}
+	return s.call("/v3/lease/keepalive", map[string]string{"ID": lease}, nil)
+}
+
+// Expiry returns when the lease of an item runs out
+func (s *EtcdStore) Expiry(key string) (time.Time, error) {
+	lease, err := s.lease(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var resp struct {
+		TTL int64 `json:"TTL,string"`
+	}
+	if err := s.call("/v3/lease/timetolive", map[string]string{"ID": lease}, &resp); err != nil {
+		return time.Time{}, err
+	}
+	if resp.TTL < 0 {
+		return time.Time{}, &notFoundError{key: key}
+	}
+	return time.Now().Add(time.Duration(resp.TTL) * time.Second), nil
+}
+
+// Use counts a viewer connection of an item, keeping its lease. The update is
+// a transaction on the mod revision, so nodes connecting at once each count
+func (s *EtcdStore) Use(key string) (int, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		item, rev, err := s.get(key)
+		if err != nil {
+			return 0, err
+		}
+		item.Uses++
+		if item.FirstUsed.IsZero() {
+			item.FirstUsed = time.Now()
+		}
+
+		value, err := json.Marshal(sealItem(key, item))
+		if err != nil {
+			return 0, err
+		}
+		var resp struct {
+			Succeeded bool `json:"succeeded"`
+		}
+		err = s.call("/v3/kv/txn", map[string]interface{}{
+			"compare": []map[string]string{{
+				"key":          s.encodedKey(key),
+				"target":       "MOD",
+				"result":       "EQUAL",
+				"mod_revision": rev,
+			}},
+			"success": []map[string]interface{}{{
+				"request_put": map[string]interface{}{
+					"key":          s.encodedKey(key),
+					"value":        base64.StdEncoding.EncodeToString(value),
+					"ignore_lease": true,
+				},
+			}},
+		}, &resp)
+		if err != nil {
+			return 0, err
+		}
+		if resp.Succeeded {
+			return item.Uses, nil
+		}
+	}
+	return 0, fmt.Errorf("%s changed concurrently, use not counted", hashTag(key))
+}
+
+// Remove deletes an item manually
+func (s *EtcdStore) Remove(key string) {
+	if err := s.call("/v3/kv/deleterange", map[string]string{"key": s.encodedKey(key)}, nil); err != nil {
+		fmt.Printf("[ERROR] Failed to remove %s from etcd: %v\n", key, err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build noetcd
+// +build noetcd
+
+package main
+
+import "fmt"
+
+const featureEtcd = false
+
+func newEtcdStore(cfg *Config) (ProxiedStore, error) {
+	return nil, fmt.Errorf("-store=etcd is not available, this binary was built with -tags noetcd")
+}
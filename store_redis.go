@@ -0,0 +1,503 @@
+//go:build !noredis
+// +build !noredis
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Redis store is left out with -tags noredis
+const featureRedis = true
+
+// Idle connections kept open to Redis
+const redisPoolSize = 8
+
+// newRedisStore creates the store for -store=redis
+func newRedisStore(cfg *Config) (ProxiedStore, error) {
+	if cfg.RedisURL == "" {
+		return nil, fmt.Errorf("-store=redis requires -redis_url")
+	}
+	s, err := NewRedisStore(cfg.RedisURL, cfg.RedisPrefix, cfg.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -redis_url: %v", err)
+	}
+	return s, nil
+}
+
+// RedisStore keeps proxied entries in Redis as JSON under a key expiring with
+// the entry's TTL. It speaks RESP itself so no Redis client library is needed;
+// Use needs Redis 6.0 or later (SET KEEPTTL)
+type RedisStore struct {
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+	db       int
+	prefix   string
+	ttl      time.Duration
+	idle     chan *redisConn
+}
+
+// NewRedisStore creates a store for a redis:// or rediss:// (TLS) URL, e.g.
+// redis://:password@10.0.0.5:6379/0
+func NewRedisStore(rawURL, prefix string, ttl time.Duration) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisStore{addr: u.Host, prefix: prefix, ttl: ttl, idle: make(chan *redisConn, redisPoolSize)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("scheme must be redis or rediss")
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("database must be a number")
+		}
+	}
+	return s, nil
+}
+
+// redisConn is one connection to Redis
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// dial opens an authenticated connection to the configured database
+func (s *RedisStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("redis unavailable: %v", err)
+	}
+	if s.tls != nil {
+		conn = tls.Client(conn, s.tls)
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if s.password != "" {
+		if s.username != "" {
+			setup = append(setup, []string{"AUTH", s.username, s.password})
+		} else {
+			setup = append(setup, []string{"AUTH", s.password})
+		}
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	for _, args := range setup {
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// conn takes an idle connection or dials a new one
+func (s *RedisStore) conn() (*redisConn, error) {
+	select {
+	case rc := <-s.idle:
+		return rc, nil
+	default:
+		return s.dial()
+	}
+}
+
+// release returns a connection to the pool; broken ones are closed
+func (s *RedisStore) release(rc *redisConn, err error) {
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		rc.conn.Close()
+		return
+	}
+	select {
+	case s.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// do runs one command on a pooled connection
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	rc, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := rc.do(args...)
+	s.release(rc, err)
+	return reply, err
+}
+
+// do sends a command and reads its reply: string for simple and bulk strings,
+// int64, []interface{} or nil
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+func (rc *redisConn) read() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// Error elements (e.g. of EXEC) are kept as values
+			if items[i], err = rc.read(); err != nil {
+				if reply, ok := err.(redisError); ok {
+					items[i] = reply
+					continue
+				}
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (s *RedisStore) key(key string) string {
+	return s.prefix + key
+}
+
+func (s *RedisStore) itemTTL(item *ProxiedItem) time.Duration {
+	if item.TTL > 0 {
+		return item.TTL
+	}
+	return s.ttl
+}
+
+// Add stores an item expiring after its TTL
+func (s *RedisStore) Add(key string, item *ProxiedItem) error {
+	value, err := json.Marshal(sealItem(key, item))
+	if err != nil {
+		return err
+	}
+	ms := strconv.FormatInt(int64(s.itemTTL(item)/time.Millisecond), 10)
+	if _, err := s.do("SET", s.key(key), string(value), "PX", ms); err != nil {
+		return err
+	}
+	s.notify(storeAdded, key)
+	return nil
+}
+
+// Get retrieves an item, returns an error if not found
+func (s *RedisStore) Get(key string) (*ProxiedItem, error) {
+	reply, err := s.do("GET", s.key(key))
+	if err != nil {
+		return nil, err
+	}
+	return decodeRedisItem(key, reply)
+}
+
+func decodeRedisItem(key string, reply interface{}) (*ProxiedItem, error) {
+	value, ok := reply.(string)
+	if !ok {
+		return nil, &notFoundError{key: key}
+	}
+	var item ProxiedItem
+	if err := json.Unmarshal([]byte(value), &item); err != nil {
+		return nil, err
+	}
+	if err := openItem(key, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Touch restarts the TTL of an item
+func (s *RedisStore) Touch(key string) error {
+	item, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	ms := strconv.FormatInt(int64(s.itemTTL(item)/time.Millisecond), 10)
+	reply, err := s.do("PEXPIRE", s.key(key), ms)
+	if err != nil {
+		return err
+	}
+	if reply != int64(1) {
+		return &notFoundError{key: key}
+	}
+	return nil
+}
+
+// Expiry returns when Redis will drop an item
+func (s *RedisStore) Expiry(key string) (time.Time, error) {
+	reply, err := s.do("PTTL", s.key(key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	ms, _ := reply.(int64)
+	if ms < 0 {
+		return time.Time{}, &notFoundError{key: key}
+	}
+	return time.Now().Add(time.Duration(ms) * time.Millisecond), nil
+}
+
+// Use counts a viewer connection of an item, keeping its expiry. The update is
+// a WATCH/MULTI/EXEC transaction, so nodes connecting at once each count
+func (s *RedisStore) Use(key string) (int, error) {
+	rc, err := s.conn()
+	if err != nil {
+		return 0, err
+	}
+	uses, err := s.use(rc, key)
+	s.release(rc, err)
+	return uses, err
+}
+
+func (s *RedisStore) use(rc *redisConn, key string) (int, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		if _, err := rc.do("WATCH", s.key(key)); err != nil {
+			return 0, err
+		}
+		reply, err := rc.do("GET", s.key(key))
+		if err != nil {
+			return 0, err
+		}
+		item, err := decodeRedisItem(key, reply)
+		if err != nil {
+			rc.do("UNWATCH")
+			return 0, err
+		}
+		item.Uses++
+		if item.FirstUsed.IsZero() {
+			item.FirstUsed = time.Now()
+		}
+		value, err := json.Marshal(sealItem(key, item))
+		if err != nil {
+			rc.do("UNWATCH")
+			return 0, err
+		}
+
+		if _, err := rc.do("MULTI"); err != nil {
+			return 0, err
+		}
+		if _, err := rc.do("SET", s.key(key), string(value), "KEEPTTL"); err != nil {
+			rc.do("DISCARD")
+			return 0, err
+		}
+		reply, err = rc.do("EXEC")
+		if err != nil {
+			return 0, err
+		}
+		results, ok := reply.([]interface{})
+		if !ok {
+			// The entry changed since WATCH
+			continue
+		}
+		if len(results) == 1 {
+			if reply, failed := results[0].(redisError); failed {
+				return 0, reply
+			}
+		}
+		return item.Uses, nil
+	}
+	return 0, fmt.Errorf("%s changed concurrently, use not counted", hashTag(key))
+}
+
+// Remove deletes an item manually
+func (s *RedisStore) Remove(key string) {
+	if _, err := s.do("DEL", s.key(key)); err != nil {
+		fmt.Printf("[ERROR] Failed to remove %s from redis: %v\n", hashTag(key), err)
+		return
+	}
+	s.notify(storeRemoved, key)
+}
+
+// List returns all items under the prefix
+func (s *RedisStore) List() (map[string]ProxiedItem, error) {
+	items := make(map[string]ProxiedItem)
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", redisPattern(s.prefix)+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		keys, _ := page[1].([]interface{})
+		for _, k := range keys {
+			key := strings.TrimPrefix(fmt.Sprint(k), s.prefix)
+			item, err := s.Get(key)
+			if _, gone := err.(*notFoundError); gone {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[key] = *item
+		}
+		if cursor, _ = page[0].(string); cursor == "0" {
+			return items, nil
+		}
+	}
+}
+
+// redisPattern escapes the glob characters of a SCAN MATCH pattern
+func redisPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Channel the stores of all nodes publish added and removed entries on
+func (s *RedisStore) eventChannel() string {
+	return s.prefix + "events"
+}
+
+// notify tells the watchers of every node about an entry
+func (s *RedisStore) notify(eventType, key string) {
+	if _, err := s.do("PUBLISH", s.eventChannel(), eventType+" "+key); err != nil {
+		fmt.Printf("[ERROR] Failed to publish %s of %s to redis: %v\n", eventType, hashTag(key), err)
+	}
+}
+
+// Watch subscribes to the entries added and removed by any node; expiries are
+// reported when the server has keyspace notifications for them enabled
+// (notify-keyspace-events Ex)
+func (s *RedisStore) Watch() (<-chan StoreEvent, func()) {
+	ch := make(chan StoreEvent, 64)
+	done := make(chan struct{})
+	expired := fmt.Sprintf("__keyevent@%d__:expired", s.db)
+
+	go func() {
+		for {
+			err := s.subscribe(ch, done, expired)
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+			fmt.Printf("[ERROR] Redis store watch interrupted, resubscribing: %v\n", err)
+		}
+	}()
+	var once sync.Once
+	return ch, func() { once.Do(func() { close(done) }) }
+}
+
+// subscribe delivers events until the connection fails or done is closed
+func (s *RedisStore) subscribe(ch chan<- StoreEvent, done <-chan struct{}, expired string) error {
+	rc, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer rc.conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+			rc.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if _, err := rc.do("SUBSCRIBE", s.eventChannel(), expired); err != nil {
+		return err
+	}
+	// The second subscription's confirmation arrives as a message of its own
+	for {
+		rc.conn.SetDeadline(time.Time{})
+		reply, err := rc.read()
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		payload, _ := msg[2].(string)
+		var ev StoreEvent
+		if msg[1] == expired {
+			if !strings.HasPrefix(payload, s.prefix) {
+				continue
+			}
+			ev = StoreEvent{Type: storeRemoved, Key: strings.TrimPrefix(payload, s.prefix)}
+		} else {
+			parts := strings.SplitN(payload, " ", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			ev = StoreEvent{Type: parts[0], Key: parts[1]}
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
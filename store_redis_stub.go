@@ -0,0 +1,12 @@
+//go:build noredis
+// +build noredis
+
+package main
+
+import "fmt"
+
+const featureRedis = false
+
+func newRedisStore(cfg *Config) (ProxiedStore, error) {
+	return nil, fmt.Errorf("-store=redis is not available, this binary was built with -tags noredis")
+}
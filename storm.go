@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How often stale hashes are sent to -reconnect_webhook
+const reconnectFlushInterval = 5 * time.Second
+
+// Distinct unknown hashes within -reconnect_window that count as a storm
+const reconnectStormHashes = 5
+
+// Most stale hashes remembered, so random hashes can't grow the set without bound
+const reconnectMaxHashes = 10000
+
+// ReconnectAlert is POSTed to -reconnect_webhook with the hashes viewers tried
+// to reopen since the last batch, so PUQcloud can issue fresh consoles
+type ReconnectAlert struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Started time.Time `json:"proxy_started"`
+	Hashes  []string  `json:"hashes"`
+}
+
+// ReconnectGuard handles lookups of unknown hashes during -reconnect_window
+// after startup, when they are most likely viewers of entries the restart
+// dropped: it throttles them per IP, answers with a re-request hint and
+// reports the hashes in batches
+type ReconnectGuard struct {
+	cfg     *Config
+	started time.Time
+	limiter *RateLimiter
+
+	mu      sync.Mutex
+	seen    map[string]struct{}
+	pending []string
+	storm   bool
+}
+
+// Guard for the running process, replaced in NewServer
+var reconnectGuard = NewReconnectGuard(&Config{})
+
+func NewReconnectGuard(cfg *Config) *ReconnectGuard {
+	return &ReconnectGuard{
+		cfg:     cfg,
+		started: time.Now(),
+		limiter: NewRateLimiter(cfg.ReconnectRate, cfg.ReconnectBurst, 0, 0),
+		seen:    make(map[string]struct{}),
+	}
+}
+
+// active reports whether the process is still within -reconnect_window
+func (rg *ReconnectGuard) active() bool {
+	return rg.cfg.ReconnectWindow > 0 && time.Since(rg.started) < rg.cfg.ReconnectWindow
+}
+
+// Start sends batches to -reconnect_webhook until the window has passed
+func (rg *ReconnectGuard) Start() {
+	if !rg.active() || rg.cfg.ReconnectWebhook == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(reconnectFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			rg.flush()
+			if !rg.active() {
+				return
+			}
+		}
+	}()
+}
+
+// reject answers a lookup of an unknown hash during the window, writing the
+// response itself; outside the window it leaves the request alone
+func (rg *ReconnectGuard) reject(c *gin.Context, hash string, err error) bool {
+	if _, ok := err.(*notFoundError); !ok || !rg.active() {
+		return false
+	}
+
+	ip := c.ClientIP()
+	if ok, wait := rg.limiter.Allow(ip); !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"status": "error",
+			"code":   "reconnect_throttled",
+			"errors": []string{"Too many reconnects, re-request the console"},
+		})
+		return true
+	}
+
+	rg.record(hash)
+	c.JSON(http.StatusGone, gin.H{
+		"status": "error",
+		"code":   "console_expired",
+		"action": "re-request console",
+		"errors": []string{"Console link is no longer valid after a proxy restart, request a new console"},
+	})
+	return true
+}
+
+// record queues a stale hash for the webhook and warns once a storm is under way
+func (rg *ReconnectGuard) record(hash string) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+
+	if _, ok := rg.seen[hash]; ok || len(rg.seen) >= reconnectMaxHashes {
+		return
+	}
+	rg.seen[hash] = struct{}{}
+	if rg.cfg.ReconnectWebhook != "" {
+		rg.pending = append(rg.pending, hash)
+	}
+	if !rg.storm && len(rg.seen) >= reconnectStormHashes {
+		rg.storm = true
+		fmt.Printf("[WARN] Reconnect storm: %d unknown hashes requested %v after startup\n",
+			len(rg.seen), time.Since(rg.started).Round(time.Second))
+	}
+}
+
+// flush sends the hashes queued since the last batch
+func (rg *ReconnectGuard) flush() {
+	rg.mu.Lock()
+	hashes := rg.pending
+	rg.pending = nil
+	rg.mu.Unlock()
+
+	if len(hashes) == 0 {
+		return
+	}
+	body, err := json.Marshal(ReconnectAlert{
+		Event:   "stale_reconnects",
+		Time:    time.Now(),
+		Started: rg.started,
+		Hashes:  hashes,
+	})
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(rg.cfg.ReconnectWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to report %d stale hashes: %v\n", len(hashes), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("[ERROR] Reconnect webhook answered %s\n", resp.Status)
+	}
+}
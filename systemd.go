@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation
+const sdListenFDsStart = 3
+
+// sdNotify sends a state string to systemd; it is a no-op outside a Type=notify unit
+func sdNotify(state string) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return
+	}
+
+	// Abstract namespace sockets are announced with a leading '@'
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		fmt.Printf("[ERROR] sd_notify dial failed: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		fmt.Printf("[ERROR] sd_notify write failed: %v\n", err)
+	}
+}
+
+// systemdListeners returns sockets passed by systemd socket activation, keyed by
+// listener name: a socket with FileDescriptorName=api serves the control API, the
+// first other socket serves everything else
+func systemdListeners() (map[string]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		name := listenerMain
+		if i < len(names) && (names[i] == listenerAPI || names[i] == listenerSpice || names[i] == listenerVNC) {
+			name = names[i]
+		}
+		if _, taken := listeners[name]; taken {
+			fmt.Printf("[INFO] Ignoring extra systemd socket #%d\n", i)
+			continue
+		}
+
+		f := os.NewFile(uintptr(sdListenFDsStart+i), "systemd-"+name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("systemd socket #%d: %v", i, err)
+		}
+
+		fmt.Printf("[INFO] Using systemd-activated %s socket %s\n", name, ln.Addr())
+		listeners[name] = ln
+	}
+	return listeners, nil
+}
+
+// startWatchdog pings the systemd watchdog at half the configured interval
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	fmt.Printf("[INFO] systemd watchdog enabled, pinging every %v\n", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
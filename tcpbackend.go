@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Scheme of raw VNC backends, bridged like websockify
+const schemeTCP = "tcp"
+
+// How long connecting to a raw VNC backend may take
+const tcpBackendDialTimeout = 10 * time.Second
+
+// validateTCPBackend checks a tcp://host:port backend URL
+func validateTCPBackend(u *url.URL) error {
+	if u.Hostname() == "" || u.Port() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return fmt.Errorf("tcp backends must be tcp://host:port")
+	}
+	return nil
+}
+
+// checkTCPBackends refuses raw VNC backends in a registration unless
+// -tcp_backends is on; they only serve VNC consoles
+func checkTCPBackends(cfg *Config, req *ProxyRequest) error {
+	for _, rawURL := range req.targetURLs() {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme != schemeTCP {
+			continue
+		}
+		if err := validateTCPBackend(u); err != nil {
+			return err
+		}
+		switch {
+		case !cfg.TCPBackends:
+			return fmt.Errorf("tcp backends are disabled on this proxy, see -tcp_backends")
+		case req.Console != "" && req.Console != consoleVNC:
+			return fmt.Errorf("tcp backends only serve vnc consoles")
+		}
+	}
+	return nil
+}
+
+// dialURL is the URL the backend WebSocket is dialed at; raw VNC backends are
+// reached through dialTCPBridge, which ignores it
+func (t *backendTarget) dialURL() string {
+	if t.url.Scheme == schemeTCP {
+		return "ws://" + t.url.Host + "/"
+	}
+	return t.item.URL
+}
+
+// dialTCPBridge returns a websocket.Dialer NetDial connecting to the raw VNC
+// server at addr: the dialer gets one end of a pipe whose other end is
+// upgraded in process and bridged to the TCP connection, so sessions see the
+// same WebSocket backend as with Proxmox
+func dialTCPBridge(addr string) func(network, address string) (net.Conn, error) {
+	return func(string, string) (net.Conn, error) {
+		backend, err := net.DialTimeout("tcp", addr, tcpBackendDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		client, server := net.Pipe()
+		go bridgeTCP(server, backend)
+		return client, nil
+	}
+}
+
+// tcpBridgeUpgrader accepts the proxy's own dial on the in-process end of a bridge
+var tcpBridgeUpgrader = &websocket.Upgrader{
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	ReadBufferSize:  8192,
+	WriteBufferSize: 8192,
+}
+
+// bridgeResponse is the http.ResponseWriter of an in-process upgrade
+type bridgeResponse struct {
+	conn     net.Conn
+	brw      *bufio.ReadWriter
+	header   http.Header
+	hijacked bool
+}
+
+func (w *bridgeResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bridgeResponse) WriteHeader(status int) {
+	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+}
+
+func (w *bridgeResponse) Write(p []byte) (int, error) {
+	return w.conn.Write(p)
+}
+
+func (w *bridgeResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return w.conn, w.brw, nil
+}
+
+// bridgeTCP completes the WebSocket handshake on conn and copies binary
+// messages to the VNC server and its bytes back, as websockify does
+func bridgeTCP(conn, backend net.Conn) {
+	defer backend.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	w := &bridgeResponse{conn: conn, brw: bufio.NewReadWriter(br, bufio.NewWriter(conn)), header: http.Header{}}
+	ws, err := tcpBridgeUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer ws.Close()
+
+	stream := &wsStream{conn: ws}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, stream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(stream, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,129 @@
+//go:build !norecording
+// +build !norecording
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Longest transcript line kept in memory before it is written anyway
+const transcriptMaxLine = 4096
+
+// transcriptLine collects one direction of a transcript until a line ends
+type transcriptLine struct {
+	started time.Time
+	buf     []byte
+}
+
+// sessionTranscript writes what is typed into and printed by a terminal console
+// to -transcript_dir, one timestamped line per text line: "> " for input, "< "
+// for output. The first line is "# " and the session as JSON. A nil
+// *sessionTranscript is valid and records nothing.
+type sessionTranscript struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	input  transcriptLine
+	output transcriptLine
+}
+
+// newTranscript starts a transcript for xterm consoles when -transcript_dir is set
+func newTranscript(cfg *Config, target *backendTarget, info SessionInfo) *sessionTranscript {
+	if cfg.TranscriptDir == "" || target.item.Console != consoleXterm {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s_%s.log", info.Started.UTC().Format("20060102T150405Z"), info.ID)
+	path := filepath.Join(cfg.TranscriptDir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to create transcript %s: %v\n", path, err)
+		return nil
+	}
+
+	t := &sessionTranscript{f: f, w: bufio.NewWriter(f)}
+	header, _ := json.Marshal(info)
+	fmt.Fprintf(t.w, "# %s\n", header)
+	fmt.Printf("[INFO] Recording transcript of session %s to %s\n", info.ID, path)
+	return t
+}
+
+// recordInput accounts a termproxy client frame after the login frame
+func (t *sessionTranscript) recordInput(msg []byte) {
+	if t == nil {
+		return
+	}
+	data := termproxyData(msg)
+	if len(data) == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.append(&t.input, ">", data)
+	t.mu.Unlock()
+}
+
+// recordOutput accounts terminal output sent by the backend
+func (t *sessionTranscript) recordOutput(msg []byte) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.append(&t.output, "<", msg)
+	t.mu.Unlock()
+}
+
+// append adds data to a line buffer, writing every completed line. Input lines
+// end with Enter (CR), output lines with LF; a CR before LF is dropped
+func (t *sessionTranscript) append(line *transcriptLine, dir string, data []byte) {
+	for _, b := range data {
+		if len(line.buf) == 0 {
+			line.started = time.Now()
+		}
+		switch {
+		case b == '\n' || (b == '\r' && dir == ">"):
+			t.writeLine(line, dir)
+		case b == '\r':
+		default:
+			line.buf = append(line.buf, b)
+			if len(line.buf) >= transcriptMaxLine {
+				t.writeLine(line, dir)
+			}
+		}
+	}
+}
+
+func (t *sessionTranscript) writeLine(line *transcriptLine, dir string) {
+	fmt.Fprintf(t.w, "%s %s %s\n", line.started.UTC().Format(time.RFC3339Nano), dir, line.buf)
+	line.buf = line.buf[:0]
+}
+
+// close writes partial lines (e.g. the last prompt) and closes the file
+func (t *sessionTranscript) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.input.buf) > 0 {
+		t.writeLine(&t.input, ">")
+	}
+	if len(t.output.buf) > 0 {
+		t.writeLine(&t.output, "<")
+	}
+	if err := t.w.Flush(); err != nil {
+		fmt.Printf("[ERROR] Failed to write transcript %s: %v\n", t.f.Name(), err)
+	}
+	t.f.Close()
+
+	if err := transcriptIndex.Add(t.f.Name()); err != nil {
+		fmt.Printf("[ERROR] Failed to index transcript %s: %v\n", t.f.Name(), err)
+	}
+}
@@ -0,0 +1,245 @@
+//go:build !norecording
+// +build !norecording
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Limits of one history search
+const (
+	searchMaxTranscripts = 100
+	searchMaxMatches     = 20
+)
+
+// Terminal escape sequences: CSI (colours, cursor movement), OSC (window
+// titles, ended by BEL or ST) and the remaining two-byte escapes
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// stripANSI turns a transcript line into what a reader saw: escape sequences
+// removed, backspace and DEL applied, other control characters dropped
+func stripANSI(s string) string {
+	s = ansiPattern.ReplaceAllString(s, "")
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == '\b' || r == 0x7f:
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case r == '\t':
+			out = append(out, ' ')
+		case unicode.IsControl(r):
+		default:
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+// searchTokens splits text into the lower-case words the index is keyed by
+func searchTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// transcriptEntry is a parsed line of a transcript
+type transcriptEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Text      string    `json:"text"`
+}
+
+// readTranscript returns the session and the ANSI-stripped lines of a transcript
+func readTranscript(path string) (SessionInfo, []transcriptEntry, error) {
+	var info SessionInfo
+	f, err := os.Open(path)
+	if err != nil {
+		return info, nil, err
+	}
+	defer f.Close()
+
+	var entries []transcriptEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, transcriptMaxLine*2), transcriptMaxLine*8)
+	if !sc.Scan() {
+		return info, nil, fmt.Errorf("empty transcript")
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(sc.Text(), "# ")), &info); err != nil {
+		return info, nil, fmt.Errorf("bad transcript header: %v", err)
+	}
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), " ", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			continue
+		}
+		dir := "output"
+		if parts[1] == ">" {
+			dir = "input"
+		}
+		entries = append(entries, transcriptEntry{Time: t, Direction: dir, Text: stripANSI(parts[2])})
+	}
+	return info, entries, sc.Err()
+}
+
+// SearchResult is a transcript with the lines that matched a search
+type SearchResult struct {
+	Session SessionInfo       `json:"session"`
+	Matches []transcriptEntry `json:"matches"`
+}
+
+// TranscriptIndex maps the words of ANSI-stripped transcripts to the sessions
+// they appear in. It lives in memory and is rebuilt from -transcript_dir at
+// startup; lines are read back from the files when a search matches
+type TranscriptIndex struct {
+	dir string
+
+	mu       sync.RWMutex
+	postings map[string]map[string]struct{} // word -> session IDs
+	sessions map[string]SessionInfo
+	paths    map[string]string
+}
+
+// Index of -transcript_dir, nil unless -transcript_index is set
+var transcriptIndex *TranscriptIndex
+
+func NewTranscriptIndex(dir string) *TranscriptIndex {
+	return &TranscriptIndex{
+		dir:      dir,
+		postings: make(map[string]map[string]struct{}),
+		sessions: make(map[string]SessionInfo),
+		paths:    make(map[string]string),
+	}
+}
+
+// startTranscriptIndex builds the index of -transcript_dir in the background
+func startTranscriptIndex(cfg *Config) {
+	if !cfg.TranscriptIndex {
+		return
+	}
+	transcriptIndex = NewTranscriptIndex(cfg.TranscriptDir)
+	go transcriptIndex.Rebuild()
+}
+
+// Rebuild indexes every transcript already in the directory
+func (ti *TranscriptIndex) Rebuild() {
+	start := time.Now()
+	paths, _ := filepath.Glob(filepath.Join(ti.dir, "*.log"))
+	for _, path := range paths {
+		if err := ti.Add(path); err != nil {
+			fmt.Printf("[ERROR] Failed to index transcript %s: %v\n", path, err)
+		}
+	}
+	fmt.Printf("[INFO] Indexed %d transcripts in %v\n", len(paths), time.Since(start))
+}
+
+// Add indexes a finished transcript
+func (ti *TranscriptIndex) Add(path string) error {
+	if ti == nil {
+		return nil
+	}
+	info, entries, err := readTranscript(path)
+	if err != nil {
+		return err
+	}
+
+	words := make(map[string]struct{})
+	for _, e := range entries {
+		for _, w := range searchTokens(e.Text) {
+			words[w] = struct{}{}
+		}
+	}
+
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.sessions[info.ID] = info
+	ti.paths[info.ID] = path
+	for w := range words {
+		ids := ti.postings[w]
+		if ids == nil {
+			ids = make(map[string]struct{})
+			ti.postings[w] = ids
+		}
+		ids[info.ID] = struct{}{}
+	}
+	return nil
+}
+
+// candidates returns the sessions whose transcripts contain every word, newest first
+func (ti *TranscriptIndex) candidates(words []string) []SessionInfo {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	var out []SessionInfo
+	for id := range ti.postings[words[0]] {
+		all := true
+		for _, w := range words[1:] {
+			if _, ok := ti.postings[w][id]; !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			out = append(out, ti.sessions[id])
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.After(out[j].Started) })
+	return out
+}
+
+// Search finds the lines containing q, ignoring case and escape sequences;
+// direction "input" or "output" narrows it to typed or printed lines
+func (ti *TranscriptIndex) Search(q, direction string) []SearchResult {
+	words := searchTokens(q)
+	if len(words) == 0 {
+		return nil
+	}
+	phrase := strings.ToLower(strings.TrimSpace(q))
+
+	results := []SearchResult{}
+	for _, info := range ti.candidates(words) {
+		if len(results) >= searchMaxTranscripts {
+			break
+		}
+		ti.mu.RLock()
+		path := ti.paths[info.ID]
+		ti.mu.RUnlock()
+
+		_, entries, err := readTranscript(path)
+		if err != nil {
+			continue
+		}
+		res := SearchResult{Session: info}
+		for _, e := range entries {
+			if direction != "" && e.Direction != direction {
+				continue
+			}
+			if strings.Contains(strings.ToLower(e.Text), phrase) {
+				res.Matches = append(res.Matches, e)
+				if len(res.Matches) >= searchMaxMatches {
+					break
+				}
+			}
+		}
+		if len(res.Matches) > 0 {
+			results = append(results, res)
+		}
+	}
+	return results
+}
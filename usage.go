@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery of usage records: attempts before a record is left in the spool,
+// the first retry after usageBackoff and doubling; spooled records are resent
+// every usageSpoolInterval
+var (
+	usageAttempts      = 3
+	usageBackoff       = 2 * time.Second
+	usageSpoolInterval = time.Minute
+)
+
+// Records deliverUsage is still sending, skipped by flushUsageSpool
+var usageInFlight sync.Map
+
+// UsageRecord is POSTed to -usage_url when a session closes, for billing its
+// console traffic. RecordID is the session ID, so a record delivered twice
+// (e.g. from the spool after a lost answer) can be recognised
+type UsageRecord struct {
+	RecordID       string            `json:"record_id"`
+	Namespace      string            `json:"namespace,omitempty"`
+	Hash           string            `json:"hash"`
+	Principal      string            `json:"principal"`
+	ViewerIP       string            `json:"viewer_ip"`
+	BackendHost    string            `json:"backend_host"`
+	Started        time.Time         `json:"started"`
+	Ended          time.Time         `json:"ended"`
+	Duration       float64           `json:"duration_seconds"`
+	BytesToClient  int64             `json:"bytes_to_client"`
+	BytesToBackend int64             `json:"bytes_to_backend"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
+// startUsageReporting records usage for every session that ends and resends
+// spooled records
+func startUsageReporting(cfg *Config) {
+	if cfg.UsageURL == "" {
+		return
+	}
+
+	fmt.Printf("[INFO] Reporting session usage to %s, spooling to %s\n", cfg.UsageURL, cfg.UsageSpoolDir)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	sessions.OnLifecycle(func(ev SessionEvent) {
+		if ev.Type == "end" {
+			recordUsage(cfg, client, ev)
+		}
+	})
+
+	go func() {
+		for {
+			flushUsageSpool(cfg, client)
+			time.Sleep(usageSpoolInterval)
+		}
+	}()
+}
+
+// recordUsage spools the usage record of an ended session, then sends it in
+// the background; the spooled copy goes once delivered, so a stop or crash
+// mid-delivery leaves it for the next flush
+func recordUsage(cfg *Config, client *http.Client, ev SessionEvent) {
+	info := ev.Session
+	body, err := json.Marshal(UsageRecord{
+		RecordID:       info.ID,
+		Namespace:      info.Namespace,
+		Hash:           info.Hash,
+		Principal:      info.Principal,
+		ViewerIP:       info.ViewerIP,
+		BackendHost:    info.BackendHost,
+		Started:        info.Started,
+		Ended:          ev.Time,
+		Duration:       ev.Time.Sub(info.Started).Seconds(),
+		BytesToClient:  info.BytesToClient,
+		BytesToBackend: info.BytesToBackend,
+		Metadata:       info.Metadata,
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Usage record of session %s lost: %v\n", info.ID, err)
+		return
+	}
+
+	// Marked in flight first, so a flush running meanwhile doesn't send it too
+	usageInFlight.Store(info.ID, struct{}{})
+	path := filepath.Join(cfg.UsageSpoolDir, info.ID+".json")
+	if err := os.WriteFile(path, body, 0600); err != nil {
+		fmt.Printf("[ERROR] Failed to spool usage record of session %s, sending it unspooled: %v\n", info.ID, err)
+		path = ""
+	}
+
+	deliveries.Add(1)
+	go func() {
+		defer deliveries.Done()
+		defer usageInFlight.Delete(info.ID)
+		deliverUsage(cfg, client, info.ID, path, body)
+	}()
+}
+
+// deliverUsage sends a record and removes its spooled copy at path, which
+// stays for flushUsageSpool when every attempt failed
+func deliverUsage(cfg *Config, client *http.Client, id, path string, body []byte) {
+	backoff := usageBackoff
+	for attempt := 1; ; attempt++ {
+		err := postUsage(cfg, client, body)
+		if err == nil {
+			if path != "" {
+				os.Remove(path)
+			}
+			return
+		}
+		if attempt == usageAttempts {
+			if path == "" {
+				fmt.Printf("[ERROR] Usage record of session %s lost, it could not be spooled: %v\n", id, err)
+				return
+			}
+			fmt.Printf("[WARN] Failed to send usage record of session %s, left in the spool: %v\n", id, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// flushUsageSpool resends spooled records oldest first, stopping at the first failure
+func flushUsageSpool(cfg *Config, client *http.Client) {
+	entries, err := os.ReadDir(cfg.UsageSpoolDir)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to read usage spool %s: %v\n", cfg.UsageSpoolDir, err)
+		return
+	}
+
+	type spooled struct {
+		path     string
+		modified time.Time
+	}
+	var records []spooled
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if _, sending := usageInFlight.Load(strings.TrimSuffix(e.Name(), ".json")); sending {
+			continue
+		}
+		if fi, err := e.Info(); err == nil {
+			records = append(records, spooled{filepath.Join(cfg.UsageSpoolDir, e.Name()), fi.ModTime()})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].modified.Before(records[j].modified) })
+
+	sent := 0
+	for _, r := range records {
+		body, err := os.ReadFile(r.path)
+		if err != nil {
+			continue
+		}
+		if err := postUsage(cfg, client, body); err != nil {
+			fmt.Printf("[WARN] Failed to resend %d spooled usage records: %v\n", len(records)-sent, err)
+			return
+		}
+		os.Remove(r.path)
+		sent++
+	}
+	if sent > 0 {
+		fmt.Printf("[INFO] Resent %d spooled usage records\n", sent)
+	}
+}
+
+// postUsage sends one record signed like registrations: X-Signature is the hex
+// HMAC-SHA256 of timestamp + "\n" + body with the usage secret
+func postUsage(cfg *Config, client *http.Client, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, cfg.UsageURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(cfg.UsageSecret))
+	mac.Write([]byte(ts + "\n"))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureTimestampHeader, ts)
+	req.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("usage endpoint answered %s", resp.Status)
+	}
+	return nil
+}
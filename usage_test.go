@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// usageEndpoint records the usage records POSTed to it, answering with the
+// statuses in order and then the last one
+type usageEndpoint struct {
+	mu       sync.Mutex
+	statuses []int
+	calls    int
+	records  []UsageRecord
+	badSig   int
+}
+
+func (ue *usageEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	mac := hmac.New(sha256.New, []byte("usage-secret"))
+	mac.Write([]byte(r.Header.Get(signatureTimestampHeader) + "\n"))
+	mac.Write(body)
+
+	ue.mu.Lock()
+	defer ue.mu.Unlock()
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(r.Header.Get(signatureHeader))) {
+		ue.badSig++
+	}
+	status := ue.statuses[len(ue.statuses)-1]
+	if ue.calls < len(ue.statuses) {
+		status = ue.statuses[ue.calls]
+	}
+	ue.calls++
+	if status == http.StatusOK {
+		var rec UsageRecord
+		json.Unmarshal(body, &rec)
+		ue.records = append(ue.records, rec)
+	}
+	w.WriteHeader(status)
+}
+
+func (ue *usageEndpoint) setStatuses(statuses ...int) {
+	ue.mu.Lock()
+	ue.statuses, ue.calls = statuses, 0
+	ue.mu.Unlock()
+}
+
+func (ue *usageEndpoint) delivered() []UsageRecord {
+	ue.mu.Lock()
+	defer ue.mu.Unlock()
+	return append([]UsageRecord(nil), ue.records...)
+}
+
+func spooledFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func newUsageTest(t *testing.T, statuses ...int) (*Config, *usageEndpoint) {
+	t.Helper()
+	oldBackoff := usageBackoff
+	usageBackoff = time.Millisecond
+	t.Cleanup(func() { usageBackoff = oldBackoff })
+
+	ue := &usageEndpoint{statuses: statuses}
+	srv := httptest.NewServer(ue)
+	t.Cleanup(srv.Close)
+	return &Config{UsageURL: srv.URL, UsageSecret: "usage-secret", UsageSpoolDir: t.TempDir()}, ue
+}
+
+func endEvent(id string) SessionEvent {
+	started := time.Now().Add(-time.Minute)
+	return SessionEvent{
+		Type: "end",
+		Time: started.Add(time.Minute),
+		Session: SessionInfo{
+			ID:            id,
+			Hash:          "abcd1234",
+			Principal:     "prod",
+			Started:       started,
+			BytesToClient: 4096,
+		},
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		calls     int
+		delivered bool
+	}{
+		{name: "delivered", statuses: []int{200}, calls: 1, delivered: true},
+		{name: "delivered after retries", statuses: []int{500, 502, 200}, calls: 3, delivered: true},
+		{name: "endpoint down", statuses: []int{500}, calls: usageAttempts},
+		{name: "redirect is not delivery", statuses: []int{302}, calls: usageAttempts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, ue := newUsageTest(t, tt.statuses...)
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+			recordUsage(cfg, client, endEvent("s1"))
+			deliveries.Wait()
+
+			if ue.calls != tt.calls {
+				t.Errorf("%d attempts, want %d", ue.calls, tt.calls)
+			}
+			if ue.badSig != 0 {
+				t.Errorf("%d records with a bad signature", ue.badSig)
+			}
+			spool := spooledFiles(t, cfg.UsageSpoolDir)
+			if tt.delivered {
+				got := ue.delivered()
+				if len(got) != 1 || got[0].RecordID != "s1" || got[0].Duration != 60 || got[0].BytesToClient != 4096 {
+					t.Errorf("delivered %+v", got)
+				}
+				if len(spool) != 0 {
+					t.Errorf("delivered record left in the spool: %v", spool)
+				}
+				return
+			}
+			if len(spool) != 1 || spool[0] != "s1.json" {
+				t.Fatalf("spool = %v, want the undelivered record", spool)
+			}
+
+			// The next flush after the endpoint recovers sends and removes it
+			ue.setStatuses(200)
+			flushUsageSpool(cfg, client)
+			if got := ue.delivered(); len(got) != 1 || got[0].RecordID != "s1" {
+				t.Errorf("flush delivered %+v", got)
+			}
+			if spool := spooledFiles(t, cfg.UsageSpoolDir); len(spool) != 0 {
+				t.Errorf("flushed record left in the spool: %v", spool)
+			}
+		})
+	}
+}
+
+func TestRecordUsageUnspooled(t *testing.T) {
+	cfg, ue := newUsageTest(t, 200)
+	cfg.UsageSpoolDir = filepath.Join(cfg.UsageSpoolDir, "missing")
+
+	recordUsage(cfg, http.DefaultClient, endEvent("s1"))
+	deliveries.Wait()
+	if got := ue.delivered(); len(got) != 1 {
+		t.Errorf("record not sent when it couldn't be spooled: %+v", got)
+	}
+}
+
+func TestFlushSkipsRecordsInFlight(t *testing.T) {
+	cfg, ue := newUsageTest(t, 200)
+	os.WriteFile(filepath.Join(cfg.UsageSpoolDir, "s1.json"), []byte(`{"record_id":"s1"}`), 0600)
+
+	usageInFlight.Store("s1", struct{}{})
+	flushUsageSpool(cfg, http.DefaultClient)
+	if ue.calls != 0 {
+		t.Errorf("flush resent a record still being delivered")
+	}
+
+	usageInFlight.Delete("s1")
+	flushUsageSpool(cfg, http.DefaultClient)
+	if got := ue.delivered(); len(got) != 1 || got[0].RecordID != "s1" {
+		t.Errorf("flush delivered %+v", got)
+	}
+}
+
+func TestLifecycleEventsNotDropped(t *testing.T) {
+	sr := NewSessionRegistry()
+	var got []string
+	sr.OnLifecycle(func(ev SessionEvent) { got = append(got, ev.Type) })
+
+	// A subscriber that never reads fills up with updates
+	sr.Subscribe()
+	ls := sr.Add("abcd1234", "prod", "203.0.113.7", "pve:8006", nil)
+	for i := 0; i < 200; i++ {
+		sr.publish("update", ls.snapshot())
+	}
+	sr.Remove(ls)
+
+	if len(got) != 2 || got[0] != "start" || got[1] != "end" {
+		t.Errorf("lifecycle events = %v, want [start end]", got)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+)
+
+// ConnLimiter counts the open viewer WebSockets of each source IP
+type ConnLimiter struct {
+	mu    sync.Mutex
+	limit int
+	open  map[string]int
+}
+
+func NewConnLimiter(limit int) *ConnLimiter {
+	return &ConnLimiter{limit: limit, open: make(map[string]int)}
+}
+
+// Acquire takes a connection slot for ip, reporting false when it already
+// holds the limit; every successful Acquire must be paired with Release
+func (cl *ConnLimiter) Acquire(ip string) bool {
+	if cl.limit <= 0 {
+		return true
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.open[ip] >= cl.limit {
+		return false
+	}
+	cl.open[ip]++
+	return true
+}
+
+// Release frees a slot taken by Acquire
+func (cl *ConnLimiter) Release(ip string) {
+	if cl.limit <= 0 {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.open[ip]--; cl.open[ip] <= 0 {
+		delete(cl.open, ip)
+	}
+}
+
+// Open viewer connections per IP under -max_conns_per_ip, configured in NewServer
+var viewerConns = NewConnLimiter(0)
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -11,7 +13,22 @@ import (
 
 const Version = "1.0.1"
 
-func proxyWS(src, dst *websocket.Conn, errc chan<- error, label string, debug bool) {
+// messageHook inspects a message before it is forwarded; errSkipMessage drops it,
+// any other non-nil error ends the session
+type messageHook func(count, mt int, msg []byte) error
+
+// sessionCloseError ends a session with a specific close code and reason for the viewer
+type sessionCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *sessionCloseError) Error() string {
+	return e.reason
+}
+
+// proxyWS copies messages from src to dst, passing each one to onMessage (if set) before forwarding
+func proxyWS(src *websocket.Conn, dst messageWriter, errc chan<- error, label string, debug bool, onMessage messageHook) {
 	fmt.Printf("[INFO] Starting WebSocket proxy routine: %s\n", label)
 
 	defer func() {
@@ -53,6 +70,18 @@ func proxyWS(src, dst *websocket.Conn, errc chan<- error, label string, debug bo
 		messageCount++
 		totalBytes += int64(len(msg))
 
+		if onMessage != nil {
+			err := onMessage(messageCount, mt, msg)
+			if err == errSkipMessage {
+				continue
+			}
+			if err != nil {
+				fmt.Printf("[ERROR] %s stopped after %d messages: %v\n", label, messageCount, err)
+				errc <- err
+				return
+			}
+		}
+
 		if debug && len(msg) > 0 {
 			msgType := "unknown"
 			if len(msg) >= 12 && string(msg[:3]) == "RFB" {
@@ -135,43 +164,97 @@ func min(a, b int) int {
 	return b
 }
 
+// validateProxmoxURL checks targetURL is a vncwebsocket of a Proxmox product,
+// a guest console or a node shell on any host and port, or a raw VNC server
 func validateProxmoxURL(targetURL string) error {
 	u, err := url.Parse(targetURL)
 	if err != nil {
 		return fmt.Errorf("invalid URL: %v", err)
 	}
 
+	if u.Scheme == schemeTCP {
+		return validateTCPBackend(u)
+	}
+
 	if u.Scheme != "wss" && u.Scheme != "ws" {
-		return fmt.Errorf("invalid scheme: %s, expected ws or wss", u.Scheme)
+		return fmt.Errorf("invalid scheme: %s, expected ws, wss or tcp", u.Scheme)
 	}
 
 	if !strings.Contains(u.Path, "/vncwebsocket") {
-		return fmt.Errorf("invalid path: %s, expected VNC websocket path", u.Path)
+		return fmt.Errorf("invalid path: %s, expected a Proxmox vncwebsocket path", u.Path)
 	}
 
 	return nil
 }
 
+// Names of the listeners that can be inherited across upgrades and from systemd
+const (
+	listenerMain  = "main"
+	listenerAPI   = "api"
+	listenerGRPC  = "grpc"
+	listenerSpice = "spice"
+	listenerVNC   = "vnc"
+	listenerPprof = "pprof"
+)
+
+// newRouter creates a gin engine with the common middleware
+func newRouter(cfg *Config) (*gin.Engine, error) {
+	r := gin.Default()
+
+	// ClientIP() only honors X-Forwarded-For/X-Real-IP from these peers
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid -trusted_proxies: %v", err)
+	}
+
+	r.Use(securityHeaders(cfg))
+	r.Use(banGuard(cfg))
+	if len(cfg.HoneypotPaths) > 0 {
+		r.Use(honeypot(cfg))
+	}
+	return r, nil
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "apply-bundle" {
+		os.Exit(applyBundleCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-key" {
+		os.Exit(hashKeyCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stateless-token" {
+		os.Exit(statelessTokenCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-flags" {
+		os.Exit(migrateFlagsCommand(os.Args[2:]))
+	}
+
 	// Parse CLI flags
 	cfg := ParseFlags()
 
 	// Example usage of parsed config
 	fmt.Println("PUQcloud IP:", cfg.PuqcloudIP)
-	fmt.Println("API Key:", cfg.ApiKey)
+	fmt.Println("Allowed networks:", cfg.AllowedNetworks)
+	fmt.Println("API key labels:", cfg.APIKeys.Labels())
+	fmt.Println("Listen address:", cfg.ListenAddr)
 	fmt.Println("Port:", cfg.Port)
 	fmt.Println("Debug:", cfg.Debug)
 
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-
-	r.POST("/api/proxy", proxyHandler(cfg))
+	srv, err := NewServer(cfg)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		flushLogs()
+		os.Exit(1)
+	}
 
-	r.GET("/vncproxy/:data", func(ctx *gin.Context) {
-		handleVNCWebSocket(cfg, ctx)
-	})
+	go handleLifecycleSignals(srv)
 
-	fmt.Println("[INFO] Starting server on :8080")
-	r.Run(fmt.Sprintf(":%d", cfg.Port))
+	err = srv.Run(context.Background())
+	if err != nil {
+		fmt.Printf("[ERROR] Server stopped: %v\n", err)
+	}
+	flushLogs()
+	if err != nil {
+		os.Exit(1)
+	}
 }
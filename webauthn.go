@@ -0,0 +1,600 @@
+//go:build !noadminui
+// +build !noadminui
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long a WebAuthn challenge can be answered
+const webauthnChallengeTTL = 5 * time.Minute
+
+// Authenticator data flags
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+)
+
+// COSE algorithms accepted for admin authenticators
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+var errCBORTruncated = errors.New("cbor: truncated data")
+
+// Deepest nesting of arrays, maps and tags cborDecode follows; WebAuthn
+// structures stay within a few levels
+const cborMaxDepth = 16
+
+// cborDecode decodes one CBOR item (the definite-length subset WebAuthn uses),
+// returning it with the bytes that follow. Integers decode to int64, byte and text
+// strings to []byte and string, maps to map[interface{}]interface{} with int64 or
+// string keys
+func cborDecode(b []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(b, 0)
+}
+
+func cborDecodeDepth(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < size {
+			return nil, nil, errCBORTruncated
+		}
+		for _, c := range b[:size] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[size:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	if major >= 4 && major <= 6 {
+		if depth++; depth > cborMaxDepth {
+			return nil, nil, fmt.Errorf("cbor: nested deeper than %d levels", cborMaxDepth)
+		}
+	}
+
+	if major <= 1 && n > math.MaxInt64 {
+		return nil, nil, fmt.Errorf("cbor: integer overflows int64")
+	}
+
+	switch major {
+	case 0:
+		return int64(n), b, nil
+	case 1:
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if uint64(len(b)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 3 {
+			return string(b[:n]), b[n:], nil
+		}
+		return append([]byte{}, b[:n]...), b[n:], nil
+	case 4:
+		if uint64(len(b)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			var err error
+			if item, b, err = cborDecodeDepth(b, depth); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+	case 5:
+		if uint64(len(b))/2 < n {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			var err error
+			if k, b, err = cborDecodeDepth(b, depth); err != nil {
+				return nil, nil, err
+			}
+			if v, b, err = cborDecodeDepth(b, depth); err != nil {
+				return nil, nil, err
+			}
+			// Other keys are either unhashable or unused by WebAuthn
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: map keys must be integers or text strings, got %T", k)
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	case 6:
+		// Tags only annotate the following item
+		return cborDecodeDepth(b, depth)
+	default:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
+
+// coseKey is an authenticator public key in COSE_Key form
+type coseKey struct {
+	alg int64
+	pub crypto.PublicKey
+}
+
+// parseCOSEKey reads an ES256, EdDSA or RS256 COSE_Key
+func parseCOSEKey(raw []byte) (*coseKey, error) {
+	v, _, err := cborDecode(raw)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("COSE key is not a map")
+	}
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+	alg, _ := m[int64(3)].(int64)
+
+	switch alg {
+	case coseES256:
+		x, y := param(-2), param(-3)
+		if crv, _ := m[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("ES256 key must be on P-256")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("ES256 point is not on the curve")
+		}
+		return &coseKey{alg: alg, pub: pub}, nil
+	case coseEdDSA:
+		x := param(-2)
+		if crv, _ := m[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("EdDSA key must be Ed25519")
+		}
+		return &coseKey{alg: alg, pub: ed25519.PublicKey(x)}, nil
+	case coseRS256:
+		n, e := param(-1), param(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("RS256 key must be at least 2048 bits")
+		}
+		exp := 0
+		for _, c := range e {
+			exp = exp<<8 | int(c)
+		}
+		return &coseKey{alg: alg, pub: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}}, nil
+	}
+	return nil, fmt.Errorf("unsupported COSE algorithm %d", alg)
+}
+
+// verify checks an assertion signature over data
+func (k *coseKey) verify(data, sig []byte) bool {
+	digest := sha256.Sum256(data)
+	switch pub := k.pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
+
+// authenticatorData is the parsed authData of a registration or assertion
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // raw COSE_Key, registrations only
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.flags&authFlagAttested == 0 {
+		return ad, nil
+	}
+
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, fmt.Errorf("credential ID truncated")
+	}
+	ad.credentialID, rest = rest[:idLen], rest[idLen:]
+
+	_, after, err := cborDecode(rest)
+	if err != nil {
+		return nil, fmt.Errorf("credential public key: %v", err)
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// clientData is the part of clientDataJSON the relying party checks
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// webauthnCredential is an enrolled admin authenticator, stored in -webauthn_credentials_file
+type webauthnCredential struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	UserID    string    `json:"user_id"`
+	PublicKey string    `json:"public_key"`
+	SignCount uint32    `json:"sign_count"`
+	Created   time.Time `json:"created"`
+}
+
+type webauthnChallenge struct {
+	expires  time.Time
+	register bool
+	name     string
+	userID   string
+}
+
+// WebAuthn enrolls admin authenticators (discoverable credentials) and issues
+// short-lived admin sessions to operators who sign in with one
+type WebAuthn struct {
+	rpID       string
+	origin     string
+	path       string
+	sessionTTL time.Duration
+
+	mu         sync.Mutex
+	creds      []webauthnCredential
+	challenges map[string]webauthnChallenge
+	sessions   map[string]time.Time
+}
+
+// NewWebAuthn creates the relying party, loading enrolled credentials from path if it exists
+func NewWebAuthn(rpID, origin, path string, sessionTTL time.Duration) (*WebAuthn, error) {
+	w := &WebAuthn{
+		rpID:       rpID,
+		origin:     origin,
+		path:       path,
+		sessionTTL: sessionTTL,
+		challenges: make(map[string]webauthnChallenge),
+		sessions:   make(map[string]time.Time),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &w.creds); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return w, nil
+}
+
+// Enrolled reports whether any authenticator has been enrolled yet
+func (w *WebAuthn) Enrolled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.creds) > 0
+}
+
+// newChallengeLocked stores a fresh challenge and returns it base64url encoded
+func (w *WebAuthn) newChallengeLocked(ch webauthnChallenge) string {
+	now := time.Now()
+	for k, c := range w.challenges {
+		if now.After(c.expires) {
+			delete(w.challenges, k)
+		}
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	encoded := base64.RawURLEncoding.EncodeToString(b)
+	ch.expires = now.Add(webauthnChallengeTTL)
+	w.challenges[encoded] = ch
+	return encoded
+}
+
+// takeChallengeLocked consumes a challenge, so each can be answered only once
+func (w *WebAuthn) takeChallengeLocked(encoded string, register bool) (webauthnChallenge, bool) {
+	ch, ok := w.challenges[encoded]
+	delete(w.challenges, encoded)
+	if !ok || ch.register != register || time.Now().After(ch.expires) {
+		return ch, false
+	}
+	return ch, true
+}
+
+// BeginRegistration returns PublicKeyCredentialCreationOptions for a new authenticator
+func (w *WebAuthn) BeginRegistration(name string) gin.H {
+	userID := make([]byte, 16)
+	rand.Read(userID)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var exclude []gin.H
+	for _, c := range w.creds {
+		exclude = append(exclude, gin.H{"type": "public-key", "id": c.ID})
+	}
+	challenge := w.newChallengeLocked(webauthnChallenge{
+		register: true,
+		name:     name,
+		userID:   base64.RawURLEncoding.EncodeToString(userID),
+	})
+
+	return gin.H{
+		"challenge": challenge,
+		"rp":        gin.H{"id": w.rpID, "name": "vncwebproxy"},
+		"user": gin.H{
+			"id":          base64.RawURLEncoding.EncodeToString(userID),
+			"name":        name,
+			"displayName": name,
+		},
+		"pubKeyCredParams": []gin.H{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseEdDSA},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"authenticatorSelection": gin.H{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "required",
+		},
+		"excludeCredentials": exclude,
+		"attestation":        "none",
+		"timeout":            int64(webauthnChallengeTTL / time.Millisecond),
+	}
+}
+
+// checkClientData verifies the type, challenge and origin of clientDataJSON,
+// returning the consumed challenge
+func (w *WebAuthn) checkClientDataLocked(raw []byte, wantType string) (webauthnChallenge, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return webauthnChallenge{}, fmt.Errorf("invalid clientDataJSON")
+	}
+	if cd.Type != wantType {
+		return webauthnChallenge{}, fmt.Errorf("unexpected ceremony type %q", cd.Type)
+	}
+	ch, ok := w.takeChallengeLocked(cd.Challenge, wantType == "webauthn.create")
+	if !ok {
+		return ch, fmt.Errorf("unknown or expired challenge")
+	}
+	if cd.Origin != w.origin {
+		return ch, fmt.Errorf("origin %q does not match %q", cd.Origin, w.origin)
+	}
+	return ch, nil
+}
+
+// checkAuthData verifies the RP ID hash and that the user was present and verified
+func (w *WebAuthn) checkAuthData(ad *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(w.rpID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("authenticator data is for another RP ID")
+	}
+	if ad.flags&authFlagUserPresent == 0 || ad.flags&authFlagUserVerified == 0 {
+		return fmt.Errorf("user presence and verification are required")
+	}
+	return nil
+}
+
+// FinishRegistration verifies a navigator.credentials.create() response and enrolls the credential
+func (w *WebAuthn) FinishRegistration(clientDataJSON, attestationObject []byte) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch, err := w.checkClientDataLocked(clientDataJSON, "webauthn.create")
+	if err != nil {
+		return "", err
+	}
+
+	v, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return "", fmt.Errorf("invalid attestation object: %v", err)
+	}
+	att, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return "", fmt.Errorf("invalid attestation object")
+	}
+	// Attestation statements are not verified: enrollment already needs an
+	// API key (and an admin session once one authenticator exists)
+	rawAuthData, _ := att["authData"].([]byte)
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return "", err
+	}
+	if err := w.checkAuthData(ad); err != nil {
+		return "", err
+	}
+	if ad.publicKey == nil {
+		return "", fmt.Errorf("no attested credential data")
+	}
+	if _, err := parseCOSEKey(ad.publicKey); err != nil {
+		return "", err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(ad.credentialID)
+	for _, c := range w.creds {
+		if c.ID == id {
+			return "", fmt.Errorf("authenticator already enrolled")
+		}
+	}
+	w.creds = append(w.creds, webauthnCredential{
+		ID:        id,
+		Name:      ch.name,
+		UserID:    ch.userID,
+		PublicKey: base64.RawURLEncoding.EncodeToString(ad.publicKey),
+		SignCount: ad.signCount,
+		Created:   time.Now().UTC(),
+	})
+	if err := w.saveLocked(); err != nil {
+		w.creds = w.creds[:len(w.creds)-1]
+		return "", err
+	}
+	return ch.name, nil
+}
+
+// BeginLogin returns PublicKeyCredentialRequestOptions; credentials are discoverable,
+// so the authenticator offers them without an allow list
+func (w *WebAuthn) BeginLogin() gin.H {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return gin.H{
+		"challenge":        w.newChallengeLocked(webauthnChallenge{}),
+		"rpId":             w.rpID,
+		"userVerification": "required",
+		"timeout":          int64(webauthnChallengeTTL / time.Millisecond),
+	}
+}
+
+// FinishLogin verifies a navigator.credentials.get() response and opens an admin
+// session, returning its token, the authenticator name and the session expiry
+func (w *WebAuthn) FinishLogin(credentialID string, clientDataJSON, authData, signature, userHandle []byte) (string, string, time.Time, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.checkClientDataLocked(clientDataJSON, "webauthn.get"); err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	var cred *webauthnCredential
+	for i := range w.creds {
+		if w.creds[i].ID == credentialID {
+			cred = &w.creds[i]
+		}
+	}
+	if cred == nil {
+		return "", "", time.Time{}, fmt.Errorf("unknown authenticator")
+	}
+	if len(userHandle) > 0 && base64.RawURLEncoding.EncodeToString(userHandle) != cred.UserID {
+		return "", "", time.Time{}, fmt.Errorf("user handle does not match the authenticator")
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	if err := w.checkAuthData(ad); err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	rawKey, _ := base64.RawURLEncoding.DecodeString(cred.PublicKey)
+	key, err := parseCOSEKey(rawKey)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if !key.verify(append(append([]byte{}, authData...), clientDataHash[:]...), signature) {
+		return "", "", time.Time{}, fmt.Errorf("invalid signature")
+	}
+
+	// A counter that does not increase points to a cloned authenticator
+	if ad.signCount != 0 || cred.SignCount != 0 {
+		if ad.signCount <= cred.SignCount {
+			return "", "", time.Time{}, fmt.Errorf("signature counter did not increase, authenticator may be cloned")
+		}
+		cred.SignCount = ad.signCount
+		if err := w.saveLocked(); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+		}
+	}
+
+	token := make([]byte, 32)
+	rand.Read(token)
+	encoded := base64.RawURLEncoding.EncodeToString(token)
+	expires := time.Now().Add(w.sessionTTL)
+
+	now := time.Now()
+	for t, exp := range w.sessions {
+		if now.After(exp) {
+			delete(w.sessions, t)
+		}
+	}
+	w.sessions[encoded] = expires
+	return encoded, cred.Name, expires, nil
+}
+
+// ValidSession reports whether token belongs to an unexpired admin session
+func (w *WebAuthn) ValidSession(token string) bool {
+	if token == "" {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	exp, ok := w.sessions[token]
+	return ok && time.Now().Before(exp)
+}
+
+// saveLocked writes the enrolled credentials to -webauthn_credentials_file
+func (w *WebAuthn) saveLocked() error {
+	data, err := json.MarshalIndent(w.creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("saving WebAuthn credentials: %v", err)
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return fmt.Errorf("saving WebAuthn credentials: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+//go:build !noadminui
+// +build !noadminui
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WebAuthn admin sign-in is left out with -tags noadminui
+const featureAdminUI = true
+
+// Cookie and header carrying the admin session opened with WebAuthn
+const (
+	adminSessionCookie = "vncwebproxy_admin"
+	adminSessionHeader = "X-Admin-Session"
+)
+
+// Page for enrolling authenticators and signing in; it talks to /api/webauthn with the API key
+const webauthnPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>vncwebproxy admin sign-in</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:2em auto}input,button{margin:.3em 0;padding:.4em;width:100%}pre{white-space:pre-wrap}</style>
+</head>
+<body>
+<h1>vncwebproxy admin sign-in</h1>
+<input id="key" type="password" placeholder="API key" autocomplete="off">
+<button id="login">Sign in with security key</button>
+<input id="name" placeholder="Name of a new authenticator, e.g. alice-yubikey">
+<button id="enroll">Enroll authenticator</button>
+<pre id="out"></pre>
+<script>
+const b64u = (buf) => btoa(String.fromCharCode(...new Uint8Array(buf))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+const unb64u = (s) => Uint8Array.from(atob(s.replace(/-/g, '+').replace(/_/g, '/')), (c) => c.charCodeAt(0));
+const out = (msg) => { document.getElementById('out').textContent = msg; };
+
+async function api(path, body) {
+  const r = await fetch('/api/webauthn/' + path, {
+    method: 'POST',
+    credentials: 'same-origin',
+    headers: {'Content-Type': 'application/json', 'X-API-Key': document.getElementById('key').value},
+    body: JSON.stringify(body || {}),
+  });
+  const j = await r.json();
+  if (j.status !== 'success') throw new Error((j.errors || []).join(', '));
+  return j;
+}
+
+document.getElementById('enroll').onclick = async () => {
+  try {
+    const o = (await api('register/begin', {name: document.getElementById('name').value})).options;
+    o.challenge = unb64u(o.challenge);
+    o.user.id = unb64u(o.user.id);
+    o.excludeCredentials = (o.excludeCredentials || []).map((c) => ({...c, id: unb64u(c.id)}));
+    const c = await navigator.credentials.create({publicKey: o});
+    const j = await api('register/finish', {
+      client_data_json: b64u(c.response.clientDataJSON),
+      attestation_object: b64u(c.response.attestationObject),
+    });
+    out('Enrolled ' + j.name);
+  } catch (e) { out('Enrollment failed: ' + e.message); }
+};
+
+document.getElementById('login').onclick = async () => {
+  try {
+    const o = (await api('login/begin')).options;
+    o.challenge = unb64u(o.challenge);
+    const c = await navigator.credentials.get({publicKey: o});
+    const j = await api('login/finish', {
+      id: c.id,
+      client_data_json: b64u(c.response.clientDataJSON),
+      authenticator_data: b64u(c.response.authenticatorData),
+      signature: b64u(c.response.signature),
+      user_handle: c.response.userHandle ? b64u(c.response.userHandle) : '',
+    });
+    out('Signed in with ' + j.name + ' until ' + j.expires + '\nSession for scripts (X-Admin-Session): ' + j.session);
+  } catch (e) { out('Sign-in failed: ' + e.message); }
+};
+</script>
+</body>
+</html>
+`
+
+// Body of register/finish and login/finish, binary fields base64url encoded
+type webauthnResponse struct {
+	Name              string `json:"name"`
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AttestationObject string `json:"attestation_object"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"user_handle"`
+}
+
+// adminSessionToken returns the admin session presented with a request
+func adminSessionToken(r *http.Request) string {
+	if token := r.Header.Get(adminSessionHeader); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(adminSessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// requireAdminSession enforces a WebAuthn admin session for destructive operations
+// when -webauthn_rp_id is set, writing the error response itself
+func requireAdminSession(cfg *Config, c *gin.Context) bool {
+	if cfg.WebAuthn == nil || cfg.WebAuthn.ValidSession(adminSessionToken(c.Request)) {
+		return true
+	}
+	fmt.Printf("[ERROR] %s %s by %s without a WebAuthn admin session\n", c.Request.Method, c.Request.URL.Path, principalOf(c))
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"status": "error",
+		"errors": []string{"WebAuthn admin session required, sign in at /admin/webauthn"},
+	})
+	return false
+}
+
+// registerWebAuthnRoutes mounts the sign-in page and ceremonies when -webauthn_rp_id is set
+func registerWebAuthnRoutes(api *gin.Engine, cfg *Config) {
+	if cfg.WebAuthn == nil {
+		return
+	}
+
+	api.GET("/admin/webauthn", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(webauthnPage))
+	})
+	api.POST("/api/webauthn/register/begin", webauthnRegisterBeginHandler(cfg))
+	api.POST("/api/webauthn/register/finish", webauthnRegisterFinishHandler(cfg))
+	api.POST("/api/webauthn/login/begin", webauthnLoginBeginHandler(cfg))
+	api.POST("/api/webauthn/login/finish", webauthnLoginFinishHandler(cfg))
+
+	fmt.Printf("[INFO] WebAuthn admin sign-in enabled for %s\n", cfg.WebAuthnOrigin)
+}
+
+// authorizeEnrollment needs the API key, plus an admin session once any authenticator is enrolled
+func authorizeEnrollment(cfg *Config, c *gin.Context) bool {
+	if !authorizeControl(cfg, c) {
+		return false
+	}
+	return !cfg.WebAuthn.Enrolled() || requireAdminSession(cfg, c)
+}
+
+// POST /api/webauthn/register/begin
+func webauthnRegisterBeginHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeEnrollment(cfg, c) {
+			return
+		}
+
+		var req webauthnResponse
+		if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			keyError(c, http.StatusBadRequest, "Invalid JSON or missing name")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "options": cfg.WebAuthn.BeginRegistration(strings.TrimSpace(req.Name))})
+	}
+}
+
+// POST /api/webauthn/register/finish
+func webauthnRegisterFinishHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeEnrollment(cfg, c) {
+			return
+		}
+
+		var req webauthnResponse
+		if err := c.ShouldBindJSON(&req); err != nil {
+			keyError(c, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		clientData, err1 := base64.RawURLEncoding.DecodeString(req.ClientDataJSON)
+		attestation, err2 := base64.RawURLEncoding.DecodeString(req.AttestationObject)
+		if err1 != nil || err2 != nil {
+			keyError(c, http.StatusBadRequest, "client_data_json and attestation_object must be base64url")
+			return
+		}
+
+		name, err := cfg.WebAuthn.FinishRegistration(clientData, attestation)
+		if err != nil {
+			fmt.Printf("[ERROR] WebAuthn enrollment by %s failed: %v\n", principalOf(c), err)
+			keyError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		fmt.Printf("[INFO] WebAuthn authenticator %s enrolled by %s\n", name, principalOf(c))
+		c.JSON(http.StatusOK, gin.H{"status": "success", "name": name})
+	}
+}
+
+// POST /api/webauthn/login/begin
+func webauthnLoginBeginHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "options": cfg.WebAuthn.BeginLogin()})
+	}
+}
+
+// POST /api/webauthn/login/finish
+func webauthnLoginFinishHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeControl(cfg, c) {
+			return
+		}
+
+		var req webauthnResponse
+		if err := c.ShouldBindJSON(&req); err != nil {
+			keyError(c, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		clientData, err1 := base64.RawURLEncoding.DecodeString(req.ClientDataJSON)
+		authData, err2 := base64.RawURLEncoding.DecodeString(req.AuthenticatorData)
+		signature, err3 := base64.RawURLEncoding.DecodeString(req.Signature)
+		userHandle, err4 := base64.RawURLEncoding.DecodeString(req.UserHandle)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			keyError(c, http.StatusBadRequest, "binary fields must be base64url")
+			return
+		}
+
+		token, name, expires, err := cfg.WebAuthn.FinishLogin(req.ID, clientData, authData, signature, userHandle)
+		if err != nil {
+			fmt.Printf("[ERROR] WebAuthn sign-in from %s failed: %v\n", c.ClientIP(), err)
+			keyError(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(adminSessionCookie, token, int(time.Until(expires)/time.Second), "/", "",
+			strings.HasPrefix(cfg.WebAuthnOrigin, "https://"), true)
+
+		fmt.Printf("[INFO] WebAuthn admin session opened with %s from %s\n", name, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"name":    name,
+			"session": token,
+			"expires": expires.UTC().Format(time.RFC3339),
+		})
+	}
+}
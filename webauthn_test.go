@@ -0,0 +1,269 @@
+//go:build !noadminui
+// +build !noadminui
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cborHead encodes the initial byte and argument of a CBOR item
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	case n <= 0xffffffff:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	}
+	b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], n)
+	return b
+}
+
+// cborEncode encodes the int64, []byte, string and map[int64]interface{}
+// values cborDecode produces; maps are written in the given key order
+func cborEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case coseMap:
+		out := cborHead(5, uint64(len(v)))
+		for _, kv := range v {
+			out = append(out, cborEncode(kv.k)...)
+			out = append(out, cborEncode(kv.v)...)
+		}
+		return out
+	}
+	panic("cborEncode: unsupported type")
+}
+
+type coseMap []struct {
+	k int64
+	v interface{}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestCBORDecode(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, depth), 0x01)
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    interface{}
+		rest    []byte
+		wantErr string
+	}{
+		{name: "small uint", input: []byte{0x17}, want: int64(23)},
+		{name: "1-byte uint", input: []byte{0x18, 0xff}, want: int64(255)},
+		{name: "2-byte uint", input: []byte{0x19, 0x01, 0x00}, want: int64(256)},
+		{name: "4-byte uint", input: []byte{0x1a, 0, 1, 0, 0}, want: int64(65536)},
+		{name: "max int64", input: cborHead(0, 1<<63-1), want: int64(1<<63 - 1)},
+		{name: "uint overflows int64", input: cborHead(0, 1<<63), wantErr: "overflows"},
+		{name: "negative", input: []byte{0x26}, want: int64(-7)},
+		{name: "min int64", input: cborHead(1, 1<<63-1), want: int64(-1 << 63)},
+		{name: "negative overflows int64", input: cborHead(1, 1<<63), wantErr: "overflows"},
+		{name: "bytes", input: []byte{0x42, 0xde, 0xad}, want: []byte{0xde, 0xad}},
+		{name: "text", input: []byte{0x62, 'h', 'i'}, want: "hi"},
+		{name: "trailing data", input: []byte{0x01, 0x02}, want: int64(1), rest: []byte{0x02}},
+		{name: "array", input: []byte{0x82, 0x01, 0x61, 'a'}, want: []interface{}{int64(1), "a"}},
+		{name: "map", input: []byte{0xa2, 0x01, 0x02, 0x61, 'k', 0xf5}, want: map[interface{}]interface{}{int64(1): int64(2), "k": true}},
+		{name: "tag", input: []byte{0xc2, 0x41, 0x01}, want: []byte{0x01}},
+		{name: "simple values", input: []byte{0x83, 0xf4, 0xf5, 0xf6}, want: []interface{}{false, true, nil}},
+		{name: "nesting at limit", input: nested(cborMaxDepth), want: func() interface{} {
+			var v interface{} = int64(1)
+			for i := 0; i < cborMaxDepth; i++ {
+				v = []interface{}{v}
+			}
+			return v
+		}()},
+		{name: "nesting over limit", input: nested(cborMaxDepth + 1), wantErr: "nested"},
+		{name: "deeply nested", input: nested(100000), wantErr: "nested"},
+		{name: "nested tags", input: append(bytes.Repeat([]byte{0xc6}, cborMaxDepth+1), 0x01), wantErr: "nested"},
+		{name: "array map key", input: []byte{0xa1, 0x80, 0x01}, wantErr: "map keys"},
+		{name: "map map key", input: []byte{0xa1, 0xa0, 0x01}, wantErr: "map keys"},
+		{name: "byte string map key", input: []byte{0xa1, 0x41, 0x00, 0x01}, wantErr: "map keys"},
+		{name: "bool map key", input: []byte{0xa1, 0xf5, 0x01}, wantErr: "map keys"},
+		{name: "empty", input: nil, wantErr: "truncated"},
+		{name: "truncated argument", input: []byte{0x19, 0x01}, wantErr: "truncated"},
+		{name: "truncated bytes", input: []byte{0x43, 0x01, 0x02}, wantErr: "truncated"},
+		{name: "huge byte length", input: cborHead(2, 1<<62), wantErr: "truncated"},
+		{name: "huge array length", input: cborHead(4, 1<<62), wantErr: "truncated"},
+		{name: "huge map length", input: cborHead(5, 1<<63), wantErr: "truncated"},
+		{name: "truncated array", input: []byte{0x82, 0x01}, wantErr: "truncated"},
+		{name: "truncated map value", input: []byte{0xa1, 0x01}, wantErr: "truncated"},
+		{name: "indefinite length", input: []byte{0x9f, 0x01, 0xff}, wantErr: "additional info"},
+		{name: "reserved info", input: []byte{0x1c}, wantErr: "additional info"},
+		{name: "float", input: []byte{0xf9, 0x3c, 0x00}, wantErr: "simple value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rest, err := cborDecode(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, %v; want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+			if len(rest) != len(tt.rest) || !bytes.Equal(rest, tt.rest) {
+				t.Errorf("rest = %x, want %x", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecX, ecY := make([]byte, 32), make([]byte, 32)
+	ec.X.FillBytes(ecX)
+	ec.Y.FillBytes(ecY)
+	offCurve := append([]byte{}, ecY...)
+	offCurve[31] ^= 1
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaN := rsaKey.N.Bytes()
+	rsaE := big.NewInt(int64(rsaKey.E)).Bytes()
+
+	es256 := func(crv int64, x, y []byte) []byte {
+		return cborEncode(coseMap{{1, int64(2)}, {3, int64(coseES256)}, {-1, crv}, {-2, x}, {-3, y}})
+	}
+	eddsa := func(crv int64, x []byte) []byte {
+		return cborEncode(coseMap{{1, int64(1)}, {3, int64(coseEdDSA)}, {-1, crv}, {-2, x}})
+	}
+	rs256 := func(n, e []byte) []byte {
+		return cborEncode(coseMap{{1, int64(3)}, {3, int64(coseRS256)}, {-1, n}, {-2, e}})
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		wantAlg int64
+		wantErr bool
+	}{
+		{name: "es256", input: es256(1, ecX, ecY), wantAlg: coseES256},
+		{name: "es256 wrong curve", input: es256(2, ecX, ecY), wantErr: true},
+		{name: "es256 short x", input: es256(1, ecX[1:], ecY), wantErr: true},
+		{name: "es256 off curve", input: es256(1, ecX, offCurve), wantErr: true},
+		{name: "es256 missing y", input: cborEncode(coseMap{{3, int64(coseES256)}, {-1, int64(1)}, {-2, ecX}}), wantErr: true},
+		{name: "es256 x as text", input: cborEncode(coseMap{{3, int64(coseES256)}, {-1, int64(1)}, {-2, string(ecX)}, {-3, ecY}}), wantErr: true},
+		{name: "eddsa", input: eddsa(6, edPub), wantAlg: coseEdDSA},
+		{name: "eddsa wrong curve", input: eddsa(7, edPub), wantErr: true},
+		{name: "eddsa short key", input: eddsa(6, edPub[:31]), wantErr: true},
+		{name: "rs256", input: rs256(rsaN, rsaE), wantAlg: coseRS256},
+		{name: "rs256 short modulus", input: rs256(rsaN[:255], rsaE), wantErr: true},
+		{name: "rs256 empty exponent", input: rs256(rsaN, nil), wantErr: true},
+		{name: "rs256 long exponent", input: rs256(rsaN, []byte{1, 0, 0, 0, 1}), wantErr: true},
+		{name: "unsupported alg", input: cborEncode(coseMap{{3, int64(-35)}}), wantErr: true},
+		{name: "alg as text", input: cborEncode(coseMap{{3, "ES256"}}), wantErr: true},
+		{name: "not a map", input: cborEncode([]byte{1, 2}), wantErr: true},
+		{name: "truncated", input: es256(1, ecX, ecY)[:40], wantErr: true},
+		{name: "empty", input: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseCOSEKey(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got a %T key, want an error", key.pub)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if key.alg != tt.wantAlg {
+				t.Errorf("alg = %d, want %d", key.alg, tt.wantAlg)
+			}
+		})
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	rpIDHash := bytes.Repeat([]byte{0xaa}, 32)
+	counter := []byte{0, 0, 0, 7}
+	aaguid := make([]byte, 16)
+	credID := []byte{1, 2, 3, 4}
+	pubKey := cborEncode(coseMap{{1, int64(1)}, {3, int64(coseEdDSA)}})
+	attested := func(idLen uint16, id, key []byte) []byte {
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, idLen)
+		return concat(rpIDHash, []byte{authFlagUserPresent | authFlagAttested}, counter, aaguid, l, id, key)
+	}
+
+	tests := []struct {
+		name      string
+		input     []byte
+		wantCount uint32
+		wantID    []byte
+		wantKey   []byte
+		wantErr   bool
+	}{
+		{name: "assertion", input: concat(rpIDHash, []byte{authFlagUserPresent}, counter), wantCount: 7},
+		{name: "assertion with extensions", input: concat(rpIDHash, []byte{authFlagUserPresent}, counter, []byte{0xa0}), wantCount: 7},
+		{name: "attested", input: attested(4, credID, pubKey), wantCount: 7, wantID: credID, wantKey: pubKey},
+		{name: "attested with extensions", input: attested(4, credID, concat(pubKey, []byte{0xa0})), wantCount: 7, wantID: credID, wantKey: pubKey},
+		{name: "too short", input: rpIDHash, wantErr: true},
+		{name: "one byte short", input: concat(rpIDHash, []byte{authFlagUserPresent}, counter[:3]), wantErr: true},
+		{name: "attested data too short", input: concat(rpIDHash, []byte{authFlagAttested}, counter, aaguid), wantErr: true},
+		{name: "credential ID truncated", input: attested(5, credID, nil), wantErr: true},
+		{name: "credential ID length overflow", input: attested(0xffff, credID, pubKey), wantErr: true},
+		{name: "missing public key", input: attested(4, credID, nil), wantErr: true},
+		{name: "truncated public key", input: attested(4, credID, pubKey[:len(pubKey)-1]), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ad, err := parseAuthenticatorData(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ad.signCount != tt.wantCount {
+				t.Errorf("signCount = %d, want %d", ad.signCount, tt.wantCount)
+			}
+			if !bytes.Equal(ad.credentialID, tt.wantID) || !bytes.Equal(ad.publicKey, tt.wantKey) {
+				t.Errorf("credential %x key %x, want %x and %x", ad.credentialID, ad.publicKey, tt.wantID, tt.wantKey)
+			}
+		})
+	}
+}
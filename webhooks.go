@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Delivery attempts per webhook call, the first retry after sessionWebhookBackoff, doubling
+var (
+	sessionWebhookAttempts = 3
+	sessionWebhookBackoff  = 2 * time.Second
+)
+
+// SessionWebhook is POSTed to every -session_webhooks URL when a session
+// starts (session_start), ends (session_end) or fails (session_failure: it
+// ended with an error, or the backend could not be reached at all)
+type SessionWebhook struct {
+	Event       string      `json:"event"`
+	Time        time.Time   `json:"time"`
+	Session     SessionInfo `json:"session"`
+	Duration    float64     `json:"duration_seconds,omitempty"`
+	CloseCode   int         `json:"close_code,omitempty"`
+	CloseReason string      `json:"close_reason,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// startSessionWebhooks forwards every session start and end to -session_webhooks;
+// they come from the registry's lifecycle events, which are never dropped
+func startSessionWebhooks(cfg *Config) {
+	if len(cfg.SessionWebhooks) == 0 {
+		return
+	}
+
+	sessions.OnLifecycle(sessionWebhookListener(cfg))
+}
+
+// sessionWebhookListener turns lifecycle events into webhook deliveries
+func sessionWebhookListener(cfg *Config) func(SessionEvent) {
+	return func(ev SessionEvent) {
+		hook := SessionWebhook{Time: ev.Time, Session: ev.Session}
+		switch ev.Type {
+		case "start":
+			hook.Event = "session_start"
+		case "end":
+			hook.Event = "session_end"
+			if ev.Error != "" {
+				hook.Event = "session_failure"
+			}
+			hook.Duration = ev.Time.Sub(ev.Session.Started).Seconds()
+			hook.CloseCode, hook.CloseReason, hook.Error = ev.CloseCode, ev.CloseReason, ev.Error
+		default:
+			return
+		}
+		sendSessionWebhook(cfg, hook)
+	}
+}
+
+// notifyBackendFailure reports a viewer whose backend could not be reached;
+// no session was started, so info has no ID
+func notifyBackendFailure(cfg *Config, target *backendTarget, viewerIP string, started time.Time, err error) {
+	if len(cfg.SessionWebhooks) == 0 {
+		return
+	}
+	sendSessionWebhook(cfg, SessionWebhook{
+		Event: "session_failure",
+		Time:  time.Now(),
+		Session: SessionInfo{
+			Namespace:   splitNamespace(target.hash),
+			Hash:        hashTag(target.hash),
+			Principal:   target.item.Principal,
+			ViewerIP:    viewerIP,
+			BackendHost: target.url.Host,
+			Started:     started,
+			Metadata:    target.item.Metadata,
+		},
+		Error: fmt.Sprintf("backend dial: %v", err),
+	})
+}
+
+// sendSessionWebhook POSTs hook to every -session_webhooks URL in the
+// background, retrying failed deliveries; draining waits for them
+func sendSessionWebhook(cfg *Config, hook SessionWebhook) {
+	body, err := json.Marshal(hook)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, u := range cfg.SessionWebhooks {
+		deliveries.Add(1)
+		go func(u string) {
+			defer deliveries.Done()
+			backoff := sessionWebhookBackoff
+			for attempt := 1; ; attempt++ {
+				err := postWebhook(client, u, body)
+				if err == nil {
+					return
+				}
+				if attempt == sessionWebhookAttempts {
+					fmt.Printf("[ERROR] Failed to send %s of session %s to %s: %v\n", hook.Event, hook.Session.ID, u, err)
+					return
+				}
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}(u)
+	}
+}
+
+func postWebhook(client *http.Client, u string, body []byte) error {
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
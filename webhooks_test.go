@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookEndpoint collects the webhooks POSTed to it, failing the first
+// failures requests
+type webhookEndpoint struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	hooks    []SessionWebhook
+}
+
+func (we *webhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	we.calls++
+	if we.calls <= we.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var hook SessionWebhook
+	json.Unmarshal(body, &hook)
+	we.hooks = append(we.hooks, hook)
+}
+
+func newWebhookTest(t *testing.T, endpoints ...*webhookEndpoint) *Config {
+	t.Helper()
+	oldBackoff := sessionWebhookBackoff
+	sessionWebhookBackoff = time.Millisecond
+	t.Cleanup(func() { sessionWebhookBackoff = oldBackoff })
+
+	cfg := &Config{}
+	for _, we := range endpoints {
+		srv := httptest.NewServer(we)
+		t.Cleanup(srv.Close)
+		cfg.SessionWebhooks = append(cfg.SessionWebhooks, srv.URL)
+	}
+	return cfg
+}
+
+func TestSessionWebhooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		closeErr string
+		failures int
+		want     []string // events received, nil when delivery gives up
+	}{
+		{name: "session end", want: []string{"session_start", "session_end"}},
+		{name: "session failure", closeErr: "backend read: EOF", want: []string{"session_start", "session_failure"}},
+		{name: "retried", failures: 2, want: []string{"session_start", "session_end"}},
+		{name: "endpoint down", failures: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := &webhookEndpoint{failures: tt.failures}
+			cfg := newWebhookTest(t, we)
+			sr := NewSessionRegistry()
+			sr.OnLifecycle(sessionWebhookListener(cfg))
+
+			// A stalled subscriber full of updates must not cost any webhook
+			sr.Subscribe()
+			ls := sr.Add("abcd1234", "prod", "203.0.113.7", "pve:8006", nil)
+			deliveries.Wait()
+			for i := 0; i < 200; i++ {
+				sr.publish("update", ls.snapshot())
+			}
+			ls.closeCode, ls.closeError = 1000, tt.closeErr
+			sr.Remove(ls)
+			deliveries.Wait()
+
+			var got []string
+			for _, hook := range we.hooks {
+				got = append(got, hook.Event)
+				if hook.Session.ID != ls.info.ID {
+					t.Errorf("%s for session %q, want %q", hook.Event, hook.Session.ID, ls.info.ID)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("events = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("events = %v, want %v", got, tt.want)
+				}
+			}
+			if tt.want == nil && we.calls != 2*sessionWebhookAttempts {
+				t.Errorf("%d attempts, want %d per event", we.calls, sessionWebhookAttempts)
+			}
+			if len(got) == 2 && (we.hooks[1].CloseCode != 1000 || we.hooks[1].Error != tt.closeErr) {
+				t.Errorf("end webhook = %+v", we.hooks[1])
+			}
+		})
+	}
+}
+
+func TestSessionWebhooksEveryURL(t *testing.T) {
+	a, b := &webhookEndpoint{}, &webhookEndpoint{failures: 1}
+	cfg := newWebhookTest(t, a, b)
+
+	target := &backendTarget{
+		hash: "whmcs:abcd1234efgh",
+		item: &ProxiedItem{Principal: "prod"},
+		url:  &url.URL{Scheme: "wss", Host: "pve:8006"},
+	}
+	notifyBackendFailure(cfg, target, "203.0.113.7", time.Now(), errors.New("connection refused"))
+	deliveries.Wait()
+
+	for i, we := range []*webhookEndpoint{a, b} {
+		if len(we.hooks) != 1 {
+			t.Fatalf("endpoint %d got %d webhooks, want 1", i, len(we.hooks))
+		}
+		hook := we.hooks[0]
+		if hook.Event != "session_failure" || hook.Session.ID != "" || hook.Session.Namespace != "whmcs" || hook.Session.Hash != hashTag(target.hash) {
+			t.Errorf("endpoint %d got %+v", i, hook)
+		}
+	}
+}
@@ -0,0 +1,907 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// backendTarget is a registered Proxmox console endpoint that passed validation
+type backendTarget struct {
+	hash string
+	item *ProxiedItem
+	url  *url.URL
+	slot *viewerSlot // released once the viewer's session is added
+}
+
+// vncSession holds the state of one proxied console connection
+type vncSession struct {
+	cfg        *Config
+	target     *backendTarget
+	viewerIP   string
+	upgradedAt time.Time
+	capture    *frameCapture
+
+	// The backend accepted permessage-deflate
+	backendDeflate bool
+
+	// Reconnect token of the session, "" if it can't be resumed
+	resumeToken string
+
+	// Set for native viewers, told the ticket of the backend connected to
+	native *nativeViewer
+}
+
+func newVNCSession(cfg *Config, target *backendTarget, ctx *gin.Context) *vncSession {
+	s := &vncSession{
+		cfg:      cfg,
+		target:   target,
+		viewerIP: ctx.ClientIP(),
+		native:   nativeViewerOf(ctx.Request),
+	}
+	s.capture = newFrameCapture(cfg, target.hash, s.viewerIP)
+	s.capture.recordHeaders("Viewer request headers", ctx.Request.Header)
+	return s
+}
+
+// backendDial carries the result of a backend dial started before the client upgrade
+type backendDial struct {
+	conn *websocket.Conn
+	resp *http.Response
+	err  error
+}
+
+// resolveTarget looks up a registered hash and validates its target URL;
+// the returned error text is suitable for sending to the viewer
+func resolveTarget(cfg *Config, data string) (target *backendTarget, err error) {
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Received data parameter: %s\n", data)
+	}
+
+	item, err := lookupItem(cfg, data)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to decode token and URL from data parameter: %v\n", err)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Data parameter that failed to decode: %s\n", data)
+		}
+		if _, ok := err.(*notFoundError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("token and url error: %v", err)
+	}
+
+	if item.Console == consoleSpice {
+		return nil, fmt.Errorf("console %s is a SPICE console, see /spice/", hashTag(data))
+	}
+
+	targetURL := item.URL
+
+	fmt.Printf("[INFO] Successfully get target URL\n")
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Get target URL: %s\n", targetURL)
+		fmt.Printf("[DEBUG] Token length: %d characters\n", len(item.Token))
+	}
+
+	if !item.ExpiresAt.IsZero() && expiredWithSkew(cfg, item.ExpiresAt) {
+		return nil, &notFoundError{key: data}
+	}
+
+	if cfg.SlidingTTL && item.ExpiresAt.IsZero() {
+		if err := proxied.Touch(data); err != nil {
+			fmt.Printf("[ERROR] Failed to refresh TTL of %s: %v\n", hashTag(data), err)
+		}
+	}
+
+	if err := checkNamespaceCapacity(cfg, data); err != nil {
+		fmt.Printf("[WARN] %v\n", err)
+		return nil, err
+	}
+
+	if err := checkKeyCapacity(cfg, item.Principal); err != nil {
+		fmt.Printf("[WARN] %v\n", err)
+		return nil, err
+	}
+
+	slot, err := reserveViewer(cfg, data, item)
+	if err != nil {
+		fmt.Printf("[WARN] %v\n", err)
+		return nil, err
+	}
+	defer func() {
+		if target == nil {
+			slot.release()
+		}
+	}()
+
+	if item.TicketAPI != "" {
+		if item, err = requestVNCTicket(cfg, item); err != nil {
+			fmt.Printf("[ERROR] Failed to obtain a VNC ticket for %s: %v\n", hashTag(data), err)
+			return nil, fmt.Errorf("vnc ticket error: %v", err)
+		}
+		targetURL = item.URL
+	} else if !item.FirstUsed.IsZero() && renewalAPI(cfg, item) != "" {
+		// An earlier viewer spent the ticket
+		if renewed, err := renewTicket(cfg, item); err != nil {
+			fmt.Printf("[WARN] Failed to renew the VNC ticket of %s, trying the registered one: %v\n", hashTag(data), err)
+		} else {
+			fmt.Printf("[INFO] Renewed the VNC ticket of %s for a returning viewer\n", hashTag(data))
+			item = renewed
+			targetURL = item.URL
+		}
+	}
+
+	if err := validateProxmoxURL(targetURL); err != nil {
+		fmt.Printf("[ERROR] URL validation failed: %v\n", err)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Invalid URL that failed validation: %s\n", targetURL)
+		}
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+
+	fmt.Printf("[INFO] URL validation passed for Proxmox endpoint\n")
+
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to parse target URL: %v\n", err)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] URL that failed to parse: %s\n", targetURL)
+		}
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme == schemeTCP && !cfg.TCPBackends {
+		return nil, fmt.Errorf("tcp backends are disabled on this proxy")
+	}
+
+	return &backendTarget{hash: data, item: item, url: u, slot: slot}, nil
+}
+
+// dialBackend starts dialing the Proxmox backend and delivers the result on the returned channel
+func (s *vncSession) dialBackend() <-chan backendDial {
+	cfg, t := s.cfg, s.target
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		HandshakeTimeout:  30 * time.Second,
+		ReadBufferSize:    8192,
+		WriteBufferSize:   8192,
+		EnableCompression: cfg.BackendCompression == compressionDeflate,
+	}
+	if t.url.Scheme == schemeTCP {
+		dialer.NetDial = dialTCPBridge(t.url.Host)
+	}
+
+	headers := http.Header{}
+	proxmoxAuthHeaders(headers, t.item)
+
+	headers.Set("Host", t.url.Host)
+	headers.Set("Origin", "https://"+t.url.Host)
+	headers.Set("User-Agent", "Mozilla/5.0")
+	headers.Set("Accept-Encoding", "gzip, deflate, br")
+	headers.Set("Accept-Language", "en-US,en;q=0.9")
+	headers.Set("Cache-Control", "no-cache")
+	headers.Set("Pragma", "no-cache")
+
+	fmt.Printf("[INFO] Connecting to Proxmox backend: %s\n", t.url.Host)
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Full backend URL: %s\n", t.item.URL)
+		fmt.Printf("[DEBUG] Request headers:\n")
+		for k, v := range headers {
+			// Don't log the full token for security
+			if k == "Authorization" {
+				tokenScheme, _ := authNames(t.item)
+				fmt.Printf("  %s: %s=***[%d chars]\n", k, tokenScheme, len(t.item.Token))
+			} else {
+				fmt.Printf("  %s: %v\n", k, v)
+			}
+		}
+	}
+
+	s.capture.recordHeaders("Backend request headers", headers)
+
+	dialc := make(chan backendDial, 1)
+	go func() {
+		conn, resp, err := dialWithRetry(cfg, &dialer, t, headers)
+		dialc <- backendDial{conn: conn, resp: resp, err: err}
+	}()
+	return dialc
+}
+
+// discardBackend closes a backend connection that is no longer wanted once its dial completes
+func discardBackend(dialc <-chan backendDial) {
+	go func() {
+		if d := <-dialc; d.conn != nil {
+			d.conn.Close()
+		}
+	}()
+}
+
+// connectBackend awaits a dial started by dialBackend; when the backend can't
+// be reached the registration's fallback URLs are dialed in order, s.target
+// ends up as the one connected
+func (s *vncSession) connectBackend(dialc <-chan backendDial) (*websocket.Conn, error) {
+	fallbacks := s.target.item.FallbackURLs
+	conn, err := s.connectTarget(dialc)
+	for _, next := range fallbacks {
+		if err == nil {
+			break
+		}
+		target, terr := s.target.withURL(next)
+		if terr != nil {
+			fmt.Printf("[ERROR] Skipping fallback backend of %s: %v\n", hashTag(s.target.hash), terr)
+			continue
+		}
+		fmt.Printf("[WARN] Backend %s of %s unavailable, failing over to %s\n",
+			s.target.url.Host, hashTag(s.target.hash), target.url.Host)
+		s.target = target
+		conn, err = s.connectTarget(s.dialBackend())
+	}
+	return conn, err
+}
+
+// connectTarget awaits a dial of s.target; when it failed on a ticket the
+// proxy can renew, it dials once more with a fresh one
+func (s *vncSession) connectTarget(dialc <-chan backendDial) (*websocket.Conn, error) {
+	conn, err := s.awaitBackend(dialc)
+	if err == nil || renewalAPI(s.cfg, s.target.item) == "" {
+		return conn, err
+	}
+
+	renewed, rerr := renewTicket(s.cfg, s.target.item)
+	if rerr != nil {
+		fmt.Printf("[WARN] Failed to renew the VNC ticket of %s: %v\n", hashTag(s.target.hash), rerr)
+		return nil, err
+	}
+	u, rerr := url.Parse(renewed.URL)
+	if rerr != nil {
+		return nil, err
+	}
+	target := *s.target
+	target.item, target.url = renewed, u
+	s.target = &target
+
+	fmt.Printf("[INFO] Retrying the backend of %s with a renewed VNC ticket\n", hashTag(s.target.hash))
+	return s.awaitBackend(s.dialBackend())
+}
+
+// awaitBackend waits for a dial started by dialBackend and logs its outcome
+func (s *vncSession) awaitBackend(dialc <-chan backendDial) (*websocket.Conn, error) {
+	cfg := s.cfg
+
+	d := <-dialc
+	backendConn, resp, err := d.conn, d.resp, d.err
+	s.capture.recordResponse(resp)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to connect to Proxmox backend: %v\n", err)
+		s.capture.finish(fmt.Errorf("backend dial: %v", err))
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Backend connection error details: %v\n", err)
+			if resp != nil {
+				fmt.Printf("[DEBUG] HTTP response status: %s\n", resp.Status)
+				fmt.Printf("[DEBUG] Response headers:\n")
+				for k, v := range resp.Header {
+					fmt.Printf("  %s: %v\n", k, v)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				if len(body) > 0 {
+					fmt.Printf("[DEBUG] Response body: %s\n", string(body))
+				}
+				resp.Body.Close()
+			}
+		}
+		return nil, err
+	}
+
+	fmt.Printf("[INFO] Successfully connected to Proxmox backend\n")
+	if s.native != nil {
+		s.native.connected(s.target)
+	}
+	s.backendDeflate = resp != nil && offersDeflate(resp.Header)
+	if cfg.Debug && resp != nil {
+		fmt.Printf("[DEBUG] Backend connection response status: %s\n", resp.Status)
+		fmt.Printf("[DEBUG] Backend response headers:\n")
+		for k, v := range resp.Header {
+			fmt.Printf("  %s: %v\n", k, v)
+		}
+	}
+
+	return backendConn, nil
+}
+
+func handleVNCWebSocket(cfg *Config, ctx *gin.Context) {
+	data := ctx.Param("data")
+	fmt.Printf("[INFO] Starting VNC WebSocket connection for data parameter\n")
+
+	if rejectIfMaintenance(ctx) {
+		return
+	}
+
+	// A resuming viewer takes the place of one already counted
+	if resumeSession(cfg, ctx, data) {
+		return
+	}
+
+	if routeToOwner(cfg, ctx, data) {
+		return
+	}
+
+	viewerIP := ctx.ClientIP()
+	if !viewerConns.Acquire(viewerIP) {
+		fmt.Printf("[WARN] Viewer %s refused for hash %s, already holds %d connections\n",
+			viewerIP, hashTag(data), cfg.MaxConnsPerIP)
+		ctx.String(http.StatusTooManyRequests, "too many console connections from your address")
+		return
+	}
+	defer viewerConns.Release(viewerIP)
+
+	admission, status, err := admitViewer(cfg, ctx, data)
+	if err != nil {
+		if reconnectGuard.reject(ctx, data, err) {
+			return
+		}
+		ctx.String(status, "%v", err)
+		return
+	}
+	target := admission.target
+	defer target.slot.release()
+	if admission.hub != nil {
+		joinFanout(cfg, target, admission.hub, ctx, admission.viewOnly)
+		return
+	}
+
+	// Dial the backend while the client upgrade is in progress
+	session := newVNCSession(cfg, target, ctx)
+	session.resumeToken = resumeToken(cfg, ctx, target.item)
+	if cfg.BackendProbeTimeout > 0 {
+		if err := session.probeTargets(); err != nil {
+			notifyBackendFailure(cfg, session.target, session.viewerIP, time.Now(), err)
+			ctx.String(http.StatusBadGateway, "backend unavailable")
+			return
+		}
+	}
+	dialc := session.dialBackend()
+
+	upgrader := clientUpgrader(cfg)
+
+	fmt.Printf("[INFO] Upgrading client connection to WebSocket\n")
+	clientConn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, resumeHeader(session.resumeToken))
+	if err != nil {
+		fmt.Printf("[ERROR] Client WebSocket upgrade failed: %v\n", err)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Upgrade error details: %v\n", err)
+		}
+		discardBackend(dialc)
+		return
+	}
+	defer clientConn.Close()
+
+	activeSessions.Add(1)
+	defer activeSessions.Done()
+
+	session.upgradedAt = time.Now()
+	fmt.Printf("[INFO] Client WebSocket connection established successfully\n")
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Client connection remote address: %s\n", clientConn.RemoteAddr())
+	}
+
+	backendConn, err := session.connectBackend(dialc)
+	if err != nil {
+		notifyBackendFailure(cfg, target, session.viewerIP, session.upgradedAt, err)
+		clientConn.Close()
+		return
+	}
+	defer backendConn.Close()
+
+	session.setupCompression(ctx.Request, clientConn, backendConn)
+	session.run(clientConn, backendConn)
+}
+
+// viewerAdmission is a viewer admitted by admitViewer: it dials target, or
+// joins hub when set
+type viewerAdmission struct {
+	target   *backendTarget
+	hub      *fanoutHub
+	viewOnly bool
+}
+
+// admitViewer applies the checks every viewer of data passes before a backend
+// is dialed, on /vncproxy and /embed alike: the registration lookup, its
+// viewer_ip binding, and routing shadow viewers and fanout joiners to the
+// running session. Refusals come with the HTTP status for the viewer
+func admitViewer(cfg *Config, ctx *gin.Context, data string) (*viewerAdmission, int, error) {
+	target, err := resolveTarget(cfg, data)
+	if err != nil {
+		recordHashFailure(cfg, ctx.ClientIP(), data, err)
+		return nil, http.StatusBadRequest, err
+	}
+
+	if !target.item.AllowsViewer(ctx.ClientIP()) {
+		target.slot.release()
+		fmt.Printf("[WARN] Viewer %s refused for hash %s, bound to %v\n",
+			ctx.ClientIP(), hashTag(data), target.item.ViewerNetworks)
+		return nil, http.StatusForbidden, fmt.Errorf("console link is bound to another viewer address")
+	}
+
+	// Shadow hashes only watch the session of their registration
+	if target.item.ShadowOf != "" {
+		hub := fanoutHubs.joinable(target.item.ShadowOf)
+		if hub == nil {
+			target.slot.release()
+			fmt.Printf("[INFO] Nothing to observe for shadow hash %s\n", hashTag(data))
+			return nil, http.StatusConflict, fmt.Errorf("console is not open")
+		}
+		return &viewerAdmission{target: target, hub: hub, viewOnly: true}, 0, nil
+	}
+
+	// Join the shared session of the hash instead of dialing the backend again
+	if duplicatePolicy(cfg, target.item) == duplicateFanout && target.item.Console != consoleXterm {
+		if hub := fanoutHubs.joinable(data); hub != nil {
+			return &viewerAdmission{target: target, hub: hub, viewOnly: target.item.ReadOnly}, 0, nil
+		}
+	}
+	return &viewerAdmission{target: target}, 0, nil
+}
+
+// joinFanout upgrades a viewer and attaches it to a running fanout session
+func joinFanout(cfg *Config, target *backendTarget, hub *fanoutHub, ctx *gin.Context, viewOnly bool) {
+	clientConn, err := clientUpgrader(cfg).Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		fmt.Printf("[ERROR] Client WebSocket upgrade failed: %v\n", err)
+		return
+	}
+	defer clientConn.Close()
+
+	activeSessions.Add(1)
+	defer activeSessions.Done()
+
+	session := &vncSession{cfg: cfg, target: target, viewerIP: ctx.ClientIP()}
+	session.runFanoutViewer(clientConn, hub, viewOnly)
+}
+
+// clientUpgrader accepts viewer WebSocket connections
+func clientUpgrader(cfg *Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		HandshakeTimeout:  30 * time.Second,
+		ReadBufferSize:    8192,
+		WriteBufferSize:   8192,
+		EnableCompression: cfg.ClientCompression == compressionDeflate,
+	}
+}
+
+// consume counts a connection against the hash: single-use entries are consumed
+// once the viewer is accepted, limited-use ones with the last allowed viewer.
+// Stateless tokens are claimed instead when -stateless_replay_window is set.
+// It reports whether the hash is gone now and closes the viewer when it was used up
+func (s *vncSession) consume(clientConn *websocket.Conn) (consumed, ok bool) {
+	target := s.target
+
+	if isStatelessToken(s.cfg, target.hash) {
+		if claimStatelessToken(s.cfg, target.hash) {
+			return false, true
+		}
+		fmt.Printf("[WARN] Stateless token %s was already used, refusing viewer %s\n", hashTag(target.hash), s.viewerIP)
+		clientConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "console link used up"),
+			time.Now().Add(time.Second))
+		return false, false
+	}
+
+	// The store counts uses atomically, so of concurrent viewers of a
+	// single-use hash only the first gets use 1
+	limit := target.item.MaxUses
+	if target.item.SingleUse {
+		limit = 1
+	}
+	uses, err := proxied.Use(target.hash)
+	_, gone := err.(*notFoundError)
+	switch {
+	case limit > 0 && (gone || uses > limit):
+		// Another viewer took the last use while this one was connecting
+		fmt.Printf("[WARN] Hash %s is used up, refusing viewer %s\n", hashTag(target.hash), s.viewerIP)
+		clientConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "console link used up"),
+			time.Now().Add(time.Second))
+		return false, false
+	case err != nil:
+		fmt.Printf("[ERROR] Failed to count use of %s: %v\n", hashTag(target.hash), err)
+		// Still take single-use hashes out of service
+		consumed = target.item.SingleUse
+	case uses == limit:
+		consumed = true
+	}
+	if consumed {
+		proxied.Remove(target.hash)
+		fmt.Printf("[INFO] Hash %s consumed\n", hashTag(target.hash))
+	}
+	return consumed, true
+}
+
+// run forwards traffic between an upgraded client and a connected backend until either side ends
+func (s *vncSession) run(clientConn, backendConn *websocket.Conn) {
+	cfg, target := s.cfg, s.target
+
+	consumed, ok := s.consume(clientConn)
+	if !ok {
+		return
+	}
+
+	keyStats.RecordSession(target.item.Principal)
+
+	viewOnly := takeOverDuplicates(cfg, target)
+	if target.item.ReadOnly {
+		fmt.Printf("[INFO] Hash %s is read-only, viewer input is dropped\n", hashTag(target.hash))
+		viewOnly = true
+	}
+	live := sessions.Add(target.hash, target.item.Principal, s.viewerIP, target.url.Host, target.item.Metadata)
+	defer sessions.Remove(live)
+	target.slot.release()
+	fmt.Printf("[INFO] Session %s started: hash=%s viewer=%s backend=%s%s\n",
+		live.info.ID, live.info.Hash, s.viewerIP, target.url.Host, formatMetadata(target.item.Metadata))
+
+	if cfg.SlidingTTL && !consumed && target.item.ExpiresAt.IsZero() {
+		stopRefresh := keepHashAlive(cfg, target)
+		defer stopRefresh()
+	}
+
+	// Short deadlines until each side has sent -handshake_messages messages, so
+	// stalled handshakes don't hold the connection; cleared per direction below
+	var readDeadline, writeDeadline time.Time
+	if cfg.HandshakeMessages > 0 {
+		readDeadline = time.Now().Add(cfg.HandshakeReadTimeout)
+		writeDeadline = time.Now().Add(cfg.HandshakeWriteTimeout)
+	}
+	clientConn.SetReadDeadline(readDeadline)
+	clientConn.SetWriteDeadline(writeDeadline)
+	backendConn.SetReadDeadline(readDeadline)
+	backendConn.SetWriteDeadline(writeDeadline)
+
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Handshake deadlines set: read=%v write=%v messages=%d\n",
+			cfg.HandshakeReadTimeout, cfg.HandshakeWriteTimeout, cfg.HandshakeMessages)
+	}
+
+	// endHandshake runs in the goroutine reading src and writing dst, the only
+	// place their read and write deadlines may be changed
+	endHandshake := func(count int, src, dst *websocket.Conn, label string) {
+		if count == cfg.HandshakeMessages {
+			src.SetReadDeadline(time.Time{})
+			dst.SetWriteDeadline(time.Time{})
+			if cfg.Debug {
+				fmt.Printf("[DEBUG] %s handshake phase complete, deadlines cleared\n", label)
+			}
+		}
+	}
+
+	// Recent RTTs and message sizes, reported if the session ends abnormally
+	diag := &sessionDiag{}
+	diag.trackRTT(backendConn, false)
+
+	// Terminal consoles speak termproxy rather than RFB
+	xterm := target.item.Console == consoleXterm
+	var analyzer *trafficAnalyzer
+	if !xterm {
+		analyzer = newTrafficAnalyzer(cfg, live)
+	}
+	transcript := newTranscript(cfg, target, live.snapshot())
+	defer transcript.close()
+	recording := newRecording(cfg, target, live.snapshot())
+	defer recording.close()
+
+	// With the fanout policy later viewers of the hash share this backend
+	// connection, shadow observers watch it
+	var backendOut messageWriter = backendConn
+	var hub *fanoutHub
+	var cutText *cutTextPolicy
+	if !xterm {
+		cutText = clipboardPolicy(cfg, target.hash, target.item)
+	}
+	if !xterm && (duplicatePolicy(cfg, target.item) == duplicateFanout || target.item.ShadowHash != "") {
+		if hub = fanoutHubs.open(cfg, target.hash, backendConn, live, cutText); hub != nil {
+			defer hub.close()
+			backendOut = hub.backend
+		}
+	}
+
+	var keys *keyFilter
+	if !xterm {
+		keys = newKeyFilter(cfg, target.item, live.info.ID)
+	}
+
+	// Idle viewers are warned with an RFB Bell, which can only be placed
+	// between server messages, and resuming viewers join at one: the stream
+	// is followed as for the clipboard
+	idle := idleTimeout(cfg, target.item)
+	ringBell := !xterm && idle > 0 && cfg.IdleWarning > 0
+	if (ringBell || s.resumeToken != "") && cutText == nil {
+		cutText = &cutTextPolicy{hash: target.hash}
+	}
+
+	var clipboard *clipboardFilter
+	if cutText != nil {
+		if cutText.strip {
+			fmt.Printf("[INFO] Clipboard of hash %s is blocked\n", hashTag(target.hash))
+		}
+		clipboard = &clipboardFilter{policy: cutText}
+		defer clipboard.close()
+	}
+
+	// With a reconnect token, sent to the viewer in-band, a lost viewer can be
+	// replaced for -resume_grace
+	var clientOut messageWriter = clientConn
+	writeClientControl := clientConn.WriteControl
+	var resume *resumableClient
+	if s.resumeToken != "" {
+		if resume = resumables.open(s.resumeToken, target, live.info.ID, clientConn, clipboard.serverInit); resume != nil {
+			defer resume.close()
+			clientOut, writeClientControl = resume, resume.WriteControl
+			resume.announce()
+		}
+	}
+
+	var bell *bellWriter
+	if ringBell {
+		bell = &bellWriter{conn: clientOut}
+		clientOut = bell
+	}
+
+	if idle > 0 {
+		idleDone := make(chan struct{})
+		defer close(idleDone)
+		var warn func()
+		if bell != nil {
+			warn = bell.ring
+		}
+		go live.watchIdle(idle, cfg.IdleWarning, warn, idleDone)
+	}
+
+	// Close handlers; those of a resuming viewer's connection are set up the same way
+	watchClient := func(conn *websocket.Conn) {
+		diag.trackRTT(conn, true)
+		conn.SetCloseHandler(func(code int, text string) error {
+			fmt.Printf("[INFO] Client connection closing with code %d\n", code)
+			if cfg.Debug {
+				fmt.Printf("[DEBUG] Client close details: code=%d, text='%s'\n", code, text)
+			}
+			if resume != nil {
+				resume.leftCleanly(conn)
+			}
+			backendConn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, text),
+				time.Now().Add(time.Second))
+			return nil
+		})
+	}
+	watchClient(clientConn)
+
+	backendConn.SetCloseHandler(func(code int, text string) error {
+		fmt.Printf("[INFO] Backend connection closing with code %d\n", code)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Backend close details: code=%d, text='%s'\n", code, text)
+		}
+		writeClientControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, text),
+			time.Now().Add(time.Second))
+		return nil
+	})
+
+	// Ping/pong routine
+	fmt.Printf("[INFO] Starting WebSocket keep-alive routine\n")
+	pingDone := make(chan struct{})
+	var pingOnce sync.Once
+	go func() {
+		ticker := time.NewTicker(20 * time.Second)
+		defer ticker.Stop()
+
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Keep-alive routine started with 20-second intervals\n")
+		}
+
+		for {
+			select {
+			case <-ticker.C:
+				if cfg.Debug {
+					fmt.Printf("[DEBUG] Sending keep-alive pings\n")
+				}
+
+				if err := writeClientControl(websocket.PingMessage, pingPayload(), time.Now().Add(5*time.Second)); err != nil {
+					fmt.Printf("[ERROR] Failed to send client ping: %v\n", err)
+					if cfg.Debug {
+						fmt.Printf("[DEBUG] Client ping error details: %v\n", err)
+					}
+					return
+				}
+
+				if err := backendConn.WriteControl(websocket.PingMessage, pingPayload(), time.Now().Add(5*time.Second)); err != nil {
+					fmt.Printf("[ERROR] Failed to send backend ping: %v\n", err)
+					if cfg.Debug {
+						fmt.Printf("[DEBUG] Backend ping error details: %v\n", err)
+					}
+					return
+				}
+			case <-pingDone:
+				if cfg.Debug {
+					fmt.Printf("[DEBUG] Keep-alive routine stopping\n")
+				}
+				return
+			}
+		}
+	}()
+
+	fmt.Printf("[INFO] Starting WebSocket proxy data forwarding\n")
+	errc := make(chan error, 2)
+	fromBackend := func(count, mt int, msg []byte) error {
+		atomic.AddInt64(&live.bytesToClient, int64(len(msg)))
+		diag.recordSize(true, len(msg))
+		s.capture.recordFrame("backend->client", count, mt, msg)
+		endHandshake(count, backendConn, clientConn, "backend->client")
+		if xterm && count > 1 {
+			transcript.recordOutput(msg)
+		}
+		out := msg
+		if clipboard != nil {
+			var err error
+			var boundary bool
+			if out, boundary, err = clipboard.fromBackend(msg); err != nil {
+				return err
+			}
+			if bell != nil {
+				bell.next(boundary)
+			}
+			if resume != nil {
+				resume.next(boundary)
+			}
+		}
+		if hub != nil {
+			hub.fromBackend(out)
+		}
+		recording.recordOutput(out)
+		if count != 1 {
+			return forwardRewritten(clientOut, mt, msg, out)
+		}
+
+		// Proxmox answers with an RFB banner (termproxy with "OK"); anything else
+		// (e.g. an HTML error page) would otherwise leave the viewer at a black screen
+		if xterm && !bytes.HasPrefix(msg, []byte("OK")) {
+			fmt.Printf("[ERROR] Backend %s did not accept the terminal login, first bytes: %q\n",
+				target.url.Host, msg[:min(len(msg), 32)])
+			return &sessionCloseError{code: websocket.CloseInternalServerErr, reason: "backend refused the terminal login"}
+		}
+		if !xterm && !bytes.HasPrefix(msg, []byte("RFB ")) {
+			fmt.Printf("[ERROR] Backend %s did not speak VNC, first bytes: %q\n",
+				target.url.Host, msg[:min(len(msg), 32)])
+			return &sessionCloseError{code: websocket.CloseInternalServerErr, reason: "backend did not speak VNC"}
+		}
+
+		latency := time.Since(s.upgradedAt)
+		firstFrameLatency.Observe(latency)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] First backend frame after %v\n", latency)
+		}
+		if cfg.FirstFrameSLO > 0 && latency > cfg.FirstFrameSLO {
+			fmt.Printf("[WARN] First frame SLO violated: %v > %v (backend %s)\n",
+				latency, cfg.FirstFrameSLO, target.url.Host)
+		}
+		return nil
+	}
+	handshakeFrames := rfbClientHandshakeFrames
+	fromClient := func(count, mt int, msg []byte) error {
+		atomic.AddInt64(&live.bytesToBackend, int64(len(msg)))
+		diag.recordSize(false, len(msg))
+		s.capture.recordFrame("client->backend", count, mt, msg)
+		endHandshake(count, clientConn, backendConn, "client->backend")
+		if xterm {
+			// The first frame carries the login ticket and is never recorded
+			if count == 1 {
+				return nil
+			}
+			if termproxyData(msg) != nil {
+				live.touchInput()
+				if viewOnly {
+					return errSkipMessage
+				}
+			}
+			live.activity.observeTerminal(msg)
+			transcript.recordInput(msg)
+			return nil
+		}
+		// Security type None, as raw VNC servers often offer, has no auth response
+		if count == 2 && len(msg) == 1 && msg[0] == 1 {
+			handshakeFrames--
+		}
+		if count <= handshakeFrames {
+			if count == handshakeFrames {
+				if hub != nil {
+					hub.startStream()
+				}
+				if clipboard != nil {
+					clipboard.start()
+				}
+				recording.start()
+			}
+			return nil
+		}
+		if rfbClientInput(msg) {
+			live.touchInput()
+			if viewOnly {
+				return errSkipMessage
+			}
+		}
+		live.activity.observeRFB(msg)
+		analyzer.observe(msg)
+		recording.recordInput(msg)
+		out := keys.filter(msg)
+		if clipboard != nil {
+			out = clipboard.fromClient(out)
+		}
+		if hub != nil {
+			out = hub.filter(hub.owner, out)
+		}
+		return forwardRewritten(backendOut, mt, msg, out)
+	}
+	resumeDone := make(chan struct{})
+	defer close(resumeDone)
+	if resume != nil {
+		go resume.forward(cfg, backendOut, errc, fromClient, watchClient, resumeDone)
+	} else {
+		go proxyWS(clientConn, backendOut, errc, "client->backend", cfg.Debug, fromClient)
+	}
+	go proxyWS(backendConn, clientOut, errc, "backend->client", cfg.Debug, fromBackend)
+
+	// Wait for one of the proxy routines to finish or for the session to be killed
+	var err2 error
+	killed := false
+	select {
+	case err2 = <-errc:
+	case <-live.kill:
+		fmt.Printf("[INFO] Session %s killed: %s\n", live.info.ID, live.killReason)
+		err2 = &sessionCloseError{code: live.killCode, reason: live.killReason}
+		killed = true
+	}
+
+	if err2 != nil && !killed {
+		live.closeError = err2.Error()
+		live.closeSnapshot = diag.snapshot(err2, backendConn)
+		if data, err := json.Marshal(live.closeSnapshot); err == nil {
+			fmt.Printf("[WARN] Session %s ended abnormally, snapshot: %s\n", live.info.ID, data)
+		}
+	}
+	pingOnce.Do(func() { close(pingDone) })
+
+	fmt.Printf("[INFO] WebSocket proxy session ending, sending close messages\n")
+	if cfg.Debug {
+		fmt.Printf("[DEBUG] Sending graceful close messages to both connections\n")
+	}
+
+	closeCode, closeReason := websocket.CloseNormalClosure, ""
+	if ce, ok := err2.(*sessionCloseError); ok {
+		closeCode, closeReason = ce.code, ce.reason
+	}
+	live.closeCode, live.closeReason = closeCode, closeReason
+
+	writeClientControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeReason), time.Now().Add(time.Second))
+	backendConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+
+	s.capture.finish(err2)
+
+	if err2 != nil {
+		fmt.Printf("[ERROR] WebSocket proxy session ended with error: %v\n", err2)
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Proxy error details: %v\n", err2)
+		}
+	} else {
+		fmt.Printf("[INFO] WebSocket proxy session completed successfully\n")
+		if cfg.Debug {
+			fmt.Printf("[DEBUG] Both proxy routines finished without errors\n")
+		}
+	}
+}